@@ -0,0 +1,131 @@
+package push
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AdaptiveRate is a dispatch rate limit that adapts to the error
+// rate of the workers it feeds. Workers report the outcome of
+// each item with Success or Failure. Failures cut the rate in
+// half (multiplicative decrease) and successes raise it by one
+// item per interval (additive increase), so the rate backs off
+// quickly from a struggling downstream and recovers gradually as
+// errors subside. The rate is raised at most once per interval
+// after any adjustment, and cut at most once per interval after
+// the last cut, so that successes never hide failures. It always
+// stays between the configured minimum and maximum.
+//
+// An AdaptiveRate is given to a component with AdaptiveDispatchRate.
+// The same AdaptiveRate may be given to several components, which
+// then share it.
+type AdaptiveRate struct {
+	mutex      sync.Mutex
+	min        float64
+	max        float64
+	per        time.Duration
+	rate       float64
+	lastAdjust time.Time
+	lastCut    time.Time
+	bucket     *tokenBucket
+	onAdjust   func(from, to float64)
+}
+
+// compile-time check that interface is satisfied
+var _ RateLimiter = (*AdaptiveRate)(nil)
+
+// NewAdaptiveRate creates an AdaptiveRate that allows between min
+// and max items per interval. It starts at the maximum rate.
+// NewAdaptiveRate panics if min is not positive, if max is less
+// than min, or if per is not positive.
+func NewAdaptiveRate(min int, max int, per time.Duration) *AdaptiveRate {
+	if min < 1 {
+		panic("min rate must be greater than 0")
+	}
+	if max < min {
+		panic("max rate must not be less than min rate")
+	}
+	return &AdaptiveRate{
+		min:    float64(min),
+		max:    float64(max),
+		per:    per,
+		rate:   float64(max),
+		bucket: newTokenBucket(max, per, 1)}
+}
+
+// Rate returns the current rate in items per interval.
+func (a *AdaptiveRate) Rate() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.rate
+}
+
+// OnAdjust sets an event handler that will be called every time
+// the rate is adjusted, with the old and new rates in items per
+// interval.
+func (a *AdaptiveRate) OnAdjust(f func(from, to float64)) {
+	a.mutex.Lock()
+	a.onAdjust = f
+	a.mutex.Unlock()
+}
+
+// Success reports that a worker processed an item successfully.
+func (a *AdaptiveRate) Success() {
+	a.adjust(false, func(rate float64) float64 {
+		return rate + 1
+	})
+}
+
+// Failure reports that a worker failed to process an item.
+func (a *AdaptiveRate) Failure() {
+	a.adjust(true, func(rate float64) float64 {
+		return rate / 2
+	})
+}
+
+func (a *AdaptiveRate) adjust(cut bool, f func(float64) float64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	last := a.lastAdjust
+	if cut {
+		last = a.lastCut
+	}
+	if now.Sub(last) < a.per {
+		return
+	}
+
+	rate := f(a.rate)
+	if rate < a.min {
+		rate = a.min
+	}
+	if rate > a.max {
+		rate = a.max
+	}
+	if rate == a.rate {
+		return
+	}
+
+	from := a.rate
+	a.rate = rate
+	a.lastAdjust = now
+	if cut {
+		a.lastCut = now
+	}
+	a.bucket.setRate(rate, a.per)
+	if a.onAdjust != nil {
+		go a.onAdjust(from, rate)
+	}
+}
+
+// Allow reports whether an item may be dispatched now.
+func (a *AdaptiveRate) Allow() bool {
+	return a.bucket.take(time.Now())
+}
+
+// Wait blocks until an item may be dispatched or ctx is done.
+func (a *AdaptiveRate) Wait(ctx context.Context) error {
+	return waitLimiter(ctx, a.bucket)
+}
@@ -0,0 +1,56 @@
+package push_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestAdaptiveRate(t *testing.T) {
+	per := 10 * time.Millisecond
+	a := NewAdaptiveRate(1, 8, per)
+	adjusted := make(chan float64, 10)
+	a.OnAdjust(func(from, to float64) {
+		adjusted <- to
+	})
+
+	steps := []struct {
+		report func()
+		want   float64
+	}{
+		{a.Failure, 4},
+		{a.Failure, 2},
+		{a.Failure, 1},
+		{a.Failure, 1}, // floor
+		{a.Success, 2},
+		{a.Success, 3},
+	}
+	for i, step := range steps {
+		step.report()
+		// further reports within the interval are ignored
+		step.report()
+		if rate := a.Rate(); rate != step.want {
+			t.Fatalf("step %d: rate %v, want %v", i, rate, step.want)
+		}
+		time.Sleep(per)
+	}
+
+	if n := len(adjusted); n != 5 {
+		t.Errorf("got %d adjustment events, want 5", n)
+	}
+}
+
+func TestAdaptiveRateFailureAfterSuccess(t *testing.T) {
+	per := 50 * time.Millisecond
+	a := NewAdaptiveRate(1, 8, per)
+	a.Failure()
+	time.Sleep(per)
+
+	// a failure straight after an increase still cuts the rate
+	a.Success()
+	a.Failure()
+	if rate := a.Rate(); rate != 2.5 {
+		t.Errorf("rate %v, want 2.5", rate)
+	}
+}
@@ -0,0 +1,153 @@
+package push
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Administered is the set of methods used by AdminHandler. It is
+// satisfied by PushQueue, PushBatchQueue and PushStack. The capacity
+// served is that returned by a Depth or Height method, if the
+// component has one.
+type Administered interface {
+	Lifecycle
+	Stop()
+	Empty()
+	State() State
+	Count() int
+	InFlight() int
+	OverloadCount() int
+	ThrottledCount() int
+	ExpiredCount() int
+	DroppedWhileDrainingCount() int
+}
+
+// compile-time check that interface is satisfied
+var _ Administered = (*PushQueue)(nil)
+var _ Administered = (*PushBatchQueue)(nil)
+var _ Administered = (*PushStack)(nil)
+
+// AdminStats is the JSON form of a component served by
+// AdminHandler.
+type AdminStats struct {
+	Name                 string `json:"name"`
+	State                string `json:"state"`
+	Pending              int    `json:"pending"`
+	InFlight             int    `json:"inFlight"`
+	Capacity             int    `json:"capacity"`
+	Overloads            int    `json:"overloads"`
+	Throttled            int    `json:"throttled"`
+	Expired              int    `json:"expired"`
+	DroppedWhileDraining int    `json:"droppedWhileDraining"`
+}
+
+// AdminHandler returns an http.Handler for inspecting and
+// controlling the given components, keyed by name. Mount it with
+// http.StripPrefix so that it sees paths relative to its root:
+//
+//	GET  /              stats of every component, sorted by name
+//	GET  /name          stats of the named component
+//	POST /name/pause    Stop the component
+//	POST /name/resume   Start the component
+//	POST /name/drain    Drain the component
+//	POST /name/empty    Empty the component
+//
+// Stats are served as AdminStats in JSON. A successful action
+// responds with 204 No Content. An unknown component or action
+// responds with 404 Not Found, and any other method with 405 Method
+// Not Allowed. Resuming a component resets its counts, as Start
+// does.
+func AdminHandler(components map[string]Administered) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(r.URL.Path, "/")
+		if path == "" {
+			if r.Method != http.MethodGet {
+				adminError(w, http.StatusMethodNotAllowed)
+				return
+			}
+			names := make([]string, 0, len(components))
+			for name := range components {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			stats := make([]AdminStats, len(names))
+			for i, name := range names {
+				stats[i] = adminStats(name, components[name])
+			}
+			adminJSON(w, stats)
+			return
+		}
+
+		parts := strings.SplitN(path, "/", 2)
+		c, ok := components[parts[0]]
+		if !ok {
+			adminError(w, http.StatusNotFound)
+			return
+		}
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet {
+				adminError(w, http.StatusMethodNotAllowed)
+				return
+			}
+			adminJSON(w, adminStats(parts[0], c))
+			return
+		}
+
+		var action func()
+		switch parts[1] {
+		case "pause":
+			action = c.Stop
+		case "resume":
+			action = c.Start
+		case "drain":
+			action = c.Drain
+		case "empty":
+			action = c.Empty
+		default:
+			adminError(w, http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			adminError(w, http.StatusMethodNotAllowed)
+			return
+		}
+		action()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func adminStats(name string, c Administered) AdminStats {
+	return AdminStats{
+		Name:                 name,
+		State:                c.State().String(),
+		Pending:              c.Count(),
+		InFlight:             c.InFlight(),
+		Capacity:             capacity(c),
+		Overloads:            c.OverloadCount(),
+		Throttled:            c.ThrottledCount(),
+		Expired:              c.ExpiredCount(),
+		DroppedWhileDraining: c.DroppedWhileDrainingCount()}
+}
+
+// capacity returns the depth of a queue or height of a stack, or 0
+// for a component that has neither.
+func capacity(c Administered) int {
+	switch c := c.(type) {
+	case interface{ Depth() int }:
+		return c.Depth()
+	case interface{ Height() int }:
+		return c.Height()
+	}
+	return 0
+}
+
+func adminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int) {
+	http.Error(w, http.StatusText(code), code)
+}
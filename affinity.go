@@ -0,0 +1,43 @@
+package push
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// affinity pins items to worker slots by key, and allows a slot at
+// most one item at a time, so that items with the same key are
+// processed in order by the same slot.
+type affinity struct {
+	key  func(QueueItem) interface{}
+	busy []bool
+}
+
+func newAffinity(key func(QueueItem) interface{}, slots int) *affinity {
+	if key == nil {
+		panic("no key function set")
+	}
+	return &affinity{key: key, busy: make([]bool, slots)}
+}
+
+// clone returns an affinity with the same key function and no slot
+// busy.
+func (a *affinity) clone() *affinity {
+	if a == nil {
+		return nil
+	}
+	return newAffinity(a.key, len(a.busy))
+}
+
+// slot returns the slot of item, which depends only on the key's
+// printed form, so that it is the same for equal keys.
+func (a *affinity) slot(item QueueItem) int {
+	h := fnv.New32a()
+	fmt.Fprint(h, a.key(item))
+	return int(h.Sum32() % uint32(len(a.busy)))
+}
+
+// free reports whether the slot of item is free.
+func (a *affinity) free(item QueueItem) bool {
+	return !a.busy[a.slot(item)]
+}
@@ -0,0 +1,135 @@
+package push
+
+import (
+	"time"
+)
+
+// AgingCurve gives the boost in priority bands of a pending item
+// that has waited for a given time, for PriorityAgingCurve. A curve
+// must not fall as the wait grows.
+type AgingCurve interface {
+	Boost(waited time.Duration) int
+}
+
+// AgingCurveFunc adapts a function to an AgingCurve.
+type AgingCurveFunc func(waited time.Duration) int
+
+// Boost calls f(waited).
+func (f AgingCurveFunc) Boost(waited time.Duration) int {
+	return f(waited)
+}
+
+// LinearAging returns a curve that boosts an item by one band for
+// every interval of length every that it has waited, up to max
+// bands. LinearAging panics if every or max is not positive.
+func LinearAging(every time.Duration, max int) AgingCurve {
+	if every <= 0 {
+		panic("aging interval must be greater than 0")
+	}
+	if max < 1 {
+		panic("aging limit must be greater than 0")
+	}
+	return AgingCurveFunc(func(waited time.Duration) int {
+		boost := int(waited / every)
+		if boost > max {
+			boost = max
+		}
+		return boost
+	})
+}
+
+// AgingStep is a step of a curve made by StepAging: an item that
+// has waited for After or longer is boosted by Boost bands.
+type AgingStep struct {
+	After time.Duration
+	Boost int
+}
+
+// StepAging returns a curve that boosts an item by the Boost of the
+// last of the steps whose After it has waited, and not at all before
+// the first. A step with a large Boost bounds the time an item can
+// wait behind higher priority items. StepAging panics if there are
+// no steps, or if they are not in increasing order of After and
+// Boost.
+func StepAging(steps ...AgingStep) AgingCurve {
+	if len(steps) == 0 {
+		panic("no aging steps set")
+	}
+	for i := 1; i < len(steps); i++ {
+		if steps[i].After <= steps[i-1].After || steps[i].Boost < steps[i-1].Boost {
+			panic("aging steps must be in increasing order")
+		}
+	}
+	steps = append([]AgingStep(nil), steps...)
+	return AgingCurveFunc(func(waited time.Duration) int {
+		boost := 0
+		for _, s := range steps {
+			if waited < s.After {
+				break
+			}
+			boost = s.Boost
+		}
+		return boost
+	})
+}
+
+// aging raises the effective priority of pending items the longer
+// they wait, along a curve, so that a stream of higher priority
+// items cannot starve lower ones.
+type aging struct {
+	curve AgingCurve
+}
+
+func newAging(curve AgingCurve) *aging {
+	if curve == nil {
+		panic("no aging curve set")
+	}
+	return &aging{curve: curve}
+}
+
+// boost returns the boost of e at now, which is never negative.
+func (a *aging) boost(e *Envelope, now time.Time) int {
+	boost := a.curve.Boost(now.Sub(e.Enqueued))
+	if boost < 0 {
+		boost = 0
+	}
+	return boost
+}
+
+// effective returns the priority of e at now, raised by its boost.
+func (a *aging) effective(e *Envelope, now time.Time) int {
+	return e.Priority + a.boost(e, now)
+}
+
+// pick returns the index of the item with the highest effective
+// priority at now, preferring the earlier of equals, among items
+// ordered by insertByPriority. Within a band the first item has
+// waited longest, so only the first item of each band is compared.
+func (a *aging) pick(items []*Envelope, now time.Time) int {
+	best, bestPriority := 0, a.effective(items[0], now)
+	for i := 1; i < len(items); i++ {
+		if items[i].Priority == items[i-1].Priority {
+			continue
+		}
+		if p := a.effective(items[i], now); p > bestPriority {
+			best, bestPriority = i, p
+		}
+	}
+	return best
+}
+
+// overdue returns the index of the item with the largest boost at
+// now, preferring the earlier of equals, for dispatching ahead of
+// the fair share, and whether any item has been boosted at all.
+func (a *aging) overdue(items []*Envelope, now time.Time) (int, bool) {
+	if a == nil {
+		return 0, false
+	}
+	best, bestBoost := 0, 0
+	for i, e := range items {
+		if b := a.boost(e, now); b > bestBoost {
+			best, bestBoost = i, b
+		}
+	}
+	return best, bestBoost > 0
+}
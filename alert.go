@@ -0,0 +1,108 @@
+package push
+
+import (
+	"sync"
+	"time"
+)
+
+// AlertEvent describes an alert set with OnAlert being raised or
+// cleared.
+type AlertEvent struct {
+	// Level is the threshold of the alert, as a fraction of
+	// capacity.
+	Level float64
+
+	// Since is the time at which the count rose to Level.
+	Since time.Time
+
+	// Count is the number of items pending when the count last
+	// crossed the threshold.
+	Count int
+
+	// Capacity is the depth of a queue or height of a stack.
+	Capacity int
+}
+
+// alert raises an event when the count of items in a component has
+// stayed at or above a threshold for a sustained period, and clears
+// it once the count has fallen back below the threshold less its
+// hysteresis. A count that falls back before the period is over
+// raises nothing. Its crossed method is called by the threshold
+// with the component's mutex held.
+type alert struct {
+	sustain   time.Duration
+	mutex     *sync.Mutex
+	unlock    func()
+	events    *eventQueue
+	onAlert   func(AlertEvent)
+	onCleared func(AlertEvent)
+	gen       int
+	raised    bool
+	event     AlertEvent
+}
+
+func newAlert(level, hysteresis float64, sustain time.Duration, onAlert, onCleared func(AlertEvent)) (*alert, *threshold) {
+	if sustain < 0 {
+		panic("alert period must not be negative")
+	}
+	a := &alert{sustain: sustain, onAlert: onAlert, onCleared: onCleared}
+	t := newThreshold(level, hysteresis, nil)
+	t.crossed = a.crossed
+	return a, t
+}
+
+// attach ties the alert to the mutex and events of a component.
+// unlock releases the mutex and delivers held events.
+func (a *alert) attach(mutex *sync.Mutex, unlock func(), events *eventQueue) {
+	a.mutex = mutex
+	a.unlock = unlock
+	a.events = events
+}
+
+// crossed starts the sustain period when the count rises to the
+// threshold, and cancels the period or clears the alert when it
+// falls back.
+func (a *alert) crossed(e ThresholdEvent) {
+	a.gen++
+	a.event.Count = e.Count
+	a.event.Capacity = e.Capacity
+	if e.Above {
+		a.event.Level = e.Level
+		a.event.Since = time.Now()
+		gen := a.gen
+		time.AfterFunc(a.sustain, func() {
+			a.raise(gen)
+		})
+		return
+	}
+	if a.raised {
+		a.raised = false
+		if a.onCleared != nil {
+			handler, event := a.onCleared, a.event
+			a.events.emit(func() {
+				handler(event)
+			})
+		}
+	}
+}
+
+// raise raises the alert if the count has not crossed the threshold
+// again, nor the alert been removed, since the period of generation
+// gen began.
+func (a *alert) raise(gen int) {
+	a.mutex.Lock()
+	if gen == a.gen {
+		a.raised = true
+		handler, event := a.onAlert, a.event
+		a.events.emit(func() {
+			handler(event)
+		})
+	}
+	a.unlock()
+}
+
+// remove stops the alert from being raised by a period under way.
+// It must be called with the component's mutex held.
+func (a *alert) remove() {
+	a.gen++
+}
@@ -0,0 +1,103 @@
+package push
+
+import (
+	"time"
+)
+
+// DropReason is the reason an item was dropped without being
+// processed.
+type DropReason int
+
+const (
+	// DropOverload means the item was dropped because the
+	// component was at capacity.
+	DropOverload DropReason = iota
+
+	// DropDraining means the item was refused because the
+	// component was draining.
+	DropDraining
+
+	// DropTenant means the item's tenant was at its pending limit.
+	DropTenant
+
+	// DropThrottled means the item was rejected by the intake rate
+	// limit.
+	DropThrottled
+
+	// DropExpired means the item's deadline passed before it could
+	// be handed to a worker.
+	DropExpired
+
+	// DropShed means the item was shed under pressure.
+	DropShed
+
+	// DropDuplicate means the item was suppressed as a duplicate.
+	DropDuplicate
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropOverload:
+		return "overload"
+	case DropDraining:
+		return "draining"
+	case DropTenant:
+		return "tenant"
+	case DropThrottled:
+		return "throttled"
+	case DropExpired:
+		return "expired"
+	case DropShed:
+		return "shed"
+	case DropDuplicate:
+		return "duplicate"
+	}
+	return "unknown"
+}
+
+// dropReason returns the DropReason of an overload.
+func (r OverloadReason) dropReason() DropReason {
+	switch r {
+	case OverloadDraining:
+		return DropDraining
+	case OverloadTenant:
+		return DropTenant
+	}
+	return DropOverload
+}
+
+// AuditRecord describes an item dropped by a component, for the
+// sink set with AuditSink.
+type AuditRecord struct {
+	// Item is the item that was dropped.
+	Item interface{}
+
+	// Reason is why the item was dropped.
+	Reason DropReason
+
+	// At is the time the item was dropped.
+	At time.Time
+}
+
+// AuditTo returns an audit sink that Puts each record into c, such
+// as a queue whose worker writes an audit log, so that dropped items
+// can be kept for later replay without slowing the component that
+// dropped them.
+func AuditTo(c PushQueuePut) func(AuditRecord) {
+	return func(r AuditRecord) {
+		c.Put(r)
+	}
+}
+
+// audited sends a record of item, dropped for reason, to the audit
+// sink, if one is set. It must be called with the component's mutex
+// held.
+func (q *eventQueue) audited(item interface{}, reason DropReason) {
+	if q.audit == nil {
+		return
+	}
+	sink, r := q.audit, AuditRecord{Item: item, Reason: reason, At: time.Now()}
+	q.emit(func() {
+		sink(r)
+	})
+}
@@ -0,0 +1,64 @@
+package push
+
+import (
+	"context"
+	"time"
+)
+
+// BackfillPriority is the Priority given to the items put by
+// Backfill, below the default of live items, so that a PushQueue
+// hands live items to its workers first.
+const BackfillPriority = -1
+
+// BackfillProgress reports how far a Backfill has got.
+type BackfillProgress struct {
+	// Put is the number of items put so far.
+	Put int
+
+	// Total is the number of items to put.
+	Total int
+
+	// Elapsed is the time since the Backfill began.
+	Elapsed time.Duration
+}
+
+// Backfill feeds historical items into q, which may be busy with
+// live traffic, without holding the live traffic up. Each item is
+// put in an Envelope with BackfillPriority, unless it is an
+// *Envelope already, at most as fast as rate allows if rate is not
+// nil, and only while q is less than half full, so that room is
+// left for live items rather than them being dropped as overloads.
+// If progress is not nil, it is called at most once a second, and
+// once more when every item has been put. Backfill returns nil once
+// every item has been put, or ctx.Err() if ctx is done first.
+func Backfill(ctx context.Context, q PushQueuePut, items []interface{}, rate RateLimiter, progress func(BackfillProgress)) error {
+	start := time.Now()
+	reported := start
+	headroom := q.Depth() / 2
+	if headroom < 1 {
+		headroom = 1
+	}
+
+	for i, item := range items {
+		if rate != nil {
+			if err := rate.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		if err := waitBelow(ctx, q, headroom); err != nil {
+			return err
+		}
+		e, ok := item.(*Envelope)
+		if !ok {
+			e = &Envelope{Item: item, Priority: BackfillPriority}
+		}
+		q.Put(e)
+
+		now := time.Now()
+		if progress != nil && (i == len(items)-1 || now.Sub(reported) >= time.Second) {
+			reported = now
+			progress(BackfillProgress{Put: i + 1, Total: len(items), Elapsed: now.Sub(start)})
+		}
+	}
+	return nil
+}
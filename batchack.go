@@ -0,0 +1,131 @@
+package push
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotAcked is reported by the Future of an item that the worker
+// set with AckWorker neither acknowledged nor failed, once it has no
+// attempts left.
+var ErrNotAcked = errors.New("push: item not acknowledged")
+
+// BatchAck is handed to a worker set with AckWorker along with its
+// batch, for the worker to acknowledge the items it has finished
+// with, by their index in the batch. It may be used from other
+// goroutines, but only until the worker returns.
+type BatchAck struct {
+	mutex sync.Mutex
+	acked []bool
+	errs  []error
+}
+
+func newBatchAck(n int) *BatchAck {
+	return &BatchAck{acked: make([]bool, n), errs: make([]error, n)}
+}
+
+// Ack acknowledges that item i has been processed.
+func (a *BatchAck) Ack(i int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.acked[i] = true
+	a.errs[i] = nil
+}
+
+// AckAll acknowledges that every item of the batch has been
+// processed.
+func (a *BatchAck) AckAll() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for i := range a.acked {
+		a.acked[i] = true
+		a.errs[i] = nil
+	}
+}
+
+// Fail reports that item i could not be processed because of err,
+// so that it is tried again.
+func (a *BatchAck) Fail(i int, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.acked[i] = false
+	a.errs[i] = err
+}
+
+// err returns the error for item i, or nil if it was acknowledged.
+func (a *BatchAck) err(i int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	switch {
+	case a.acked[i]:
+		return nil
+	case a.errs[i] != nil:
+		return a.errs[i]
+	}
+	return ErrNotAcked
+}
+
+// acker runs batches with a worker that acknowledges their items,
+// and schedules the items it does not acknowledge to be tried again
+// after a backoff.
+type acker struct {
+	worker      func(items []interface{}, ack *BatchAck)
+	backoff     func(attempts int) time.Duration
+	maxAttempts int
+}
+
+func newAcker(worker func(items []interface{}, ack *BatchAck), backoff func(attempts int) time.Duration, maxAttempts int) *acker {
+	if worker == nil {
+		panic("no worker set")
+	}
+	if backoff == nil {
+		panic("no backoff set")
+	}
+	if maxAttempts < 1 {
+		panic("max attempts must be greater than 0")
+	}
+	return &acker{worker: worker, backoff: backoff, maxAttempts: maxAttempts}
+}
+
+// retryAfter is an item of a batch to be tried again after a delay.
+type retryAfter struct {
+	e     *Envelope
+	after time.Duration
+}
+
+// run calls the worker for batch and returns the items to be tried
+// again. The futures of the others are resolved, with nil for the
+// acknowledged items and otherwise with the reason for the failure.
+// If the worker panics, the items it had not acknowledged fail with
+// a *PanicError.
+func (r *acker) run(batch []*Envelope, items []interface{}) []retryAfter {
+	ack := newBatchAck(len(batch))
+	work := func() {
+		r.worker(items, ack)
+	}
+	var perr error
+	if watched(batch) {
+		perr = recovered(work)
+	} else {
+		work()
+	}
+
+	var retries []retryAfter
+	for i, e := range batch {
+		err := ack.err(i)
+		if err == ErrNotAcked && perr != nil {
+			err = perr
+		}
+		if err != nil && e.Attempts < r.maxAttempts {
+			retries = append(retries, retryAfter{e: e, after: r.backoff(e.Attempts)})
+			continue
+		}
+		e.resolve(err)
+	}
+	return retries
+}
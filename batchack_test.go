@@ -0,0 +1,58 @@
+package push_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestBatchAckWorker(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+	q := NewPushBatchQueue(1, 10, 3, nil)
+	q.AckWorker(func(items []interface{}, ack *BatchAck) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, item := range items {
+			attempts[item.(string)]++
+			switch {
+			case item == "flaky" && attempts["flaky"] == 1:
+				ack.Fail(i, errors.New("flaky"))
+			case item != "ignored":
+				ack.Ack(i)
+			}
+		}
+	}, func(int) time.Duration { return 10 * time.Millisecond }, 2)
+	q.Start()
+
+	good := q.PutFuture("good")
+	flaky := q.PutFuture("flaky")
+	ignored := q.PutFuture("ignored")
+
+	if err := good.Wait(); err != nil {
+		t.Errorf("got error %v for acknowledged item", err)
+	}
+	if err := flaky.Wait(); err != nil {
+		t.Errorf("got error %v for item acknowledged on retry", err)
+	}
+	if err := ignored.Wait(); err != ErrNotAcked {
+		t.Errorf("got error %v for unacknowledged item, want ErrNotAcked", err)
+	}
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(attempts, map[string]int{"good": 1, "flaky": 2, "ignored": 2}) {
+		t.Errorf("got attempts %v", attempts)
+	}
+	if n := q.ScheduledRetries(); n != 0 {
+		t.Errorf("%d retries still scheduled", n)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
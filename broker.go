@@ -0,0 +1,99 @@
+package push
+
+import (
+	"context"
+)
+
+// Message is a message received from a Source. Exactly one of Ack
+// or Nack is called for each message, once the fate of its item is
+// known.
+type Message interface {
+	// Value returns the item to put into the component.
+	Value() interface{}
+
+	// Ack acknowledges that the item was processed.
+	Ack()
+
+	// Nack reports that the item was not processed, because the
+	// worker panicked or the item was dropped, throttled, removed
+	// or expired. The source may redeliver it.
+	Nack()
+}
+
+// Source is an external supplier of messages, such as a message
+// broker consumer.
+type Source interface {
+	// Receive blocks until the next message is available or ctx
+	// is done.
+	Receive(ctx context.Context) (Message, error)
+}
+
+// Sink is an external destination for items, such as a message
+// broker producer.
+type Sink interface {
+	Send(ctx context.Context, item interface{}) error
+}
+
+// Consume receives messages from src and Puts their values into q
+// until ctx is done, which returns nil, or src returns an error,
+// which Consume returns. Each message is acknowledged only after
+// the worker has finished with its item, or q has forwarded it with
+// the Forwarder set with ForwardOverloads, and negatively
+// acknowledged if the item never reaches a worker or the worker
+// panics. Receiving pauses while q is full, or while twice as many
+// messages as q's depth await acknowledgement, so that messages wait
+// in the source rather than overloading q. A message not yet
+// acknowledged when ctx is done is negatively acknowledged, even if
+// its item is still to be processed, so the source may redeliver an
+// item that is then processed twice.
+func Consume(ctx context.Context, src Source, q PushQueuePutFuture) error {
+	waiters := make(chan struct{}, 2*q.Depth())
+	for {
+		msg, err := src.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case waiters <- struct{}{}:
+		case <-ctx.Done():
+			msg.Nack()
+			return nil
+		}
+		if err := waitForRoom(ctx, q); err != nil {
+			<-waiters
+			msg.Nack()
+			return nil
+		}
+		f := q.PutFuture(msg.Value())
+		go func() {
+			defer func() { <-waiters }()
+			select {
+			case <-f.Done():
+			case <-ctx.Done():
+				msg.Nack()
+				return
+			}
+			switch f.Err() {
+			case nil, ErrForwarded:
+				msg.Ack()
+			default:
+				msg.Nack()
+			}
+		}()
+	}
+}
+
+// SinkWorker returns a worker function that sends each item it is
+// handed to s. If the send fails, onError, when not nil, is called
+// with the item and the error.
+func SinkWorker(ctx context.Context, s Sink, onError func(item interface{}, err error)) func(interface{}) {
+	return func(item interface{}) {
+		if err := s.Send(ctx, item); err != nil && onError != nil {
+			onError(item, err)
+		}
+	}
+}
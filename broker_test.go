@@ -0,0 +1,151 @@
+package push_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+type testMessage struct {
+	value interface{}
+	acks  chan<- string
+}
+
+func (m *testMessage) Value() interface{} { return m.value }
+func (m *testMessage) Ack()               { m.acks <- "ack:" + m.value.(string) }
+func (m *testMessage) Nack()              { m.acks <- "nack:" + m.value.(string) }
+
+type testSource struct {
+	msgs chan Message
+}
+
+func (s *testSource) Receive(ctx context.Context) (Message, error) {
+	select {
+	case m := <-s.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestConsumeAcksAfterWorker(t *testing.T) {
+	acks := make(chan string, 2)
+	var mutex sync.Mutex
+	var seen []string
+	q := NewPushQueue(1, 2, func(item interface{}) {
+		mutex.Lock()
+		seen = append(seen, item.(string))
+		mutex.Unlock()
+		if item == "bad" {
+			panic("bad item")
+		}
+	})
+	q.Start()
+
+	src := &testSource{msgs: make(chan Message, 2)}
+	src.msgs <- &testMessage{value: "good", acks: acks}
+	src.msgs <- &testMessage{value: "bad", acks: acks}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Consume(ctx, src, q) }()
+
+	got := map[string]bool{<-acks: true, <-acks: true}
+	if !got["ack:good"] || !got["nack:bad"] {
+		t.Errorf("got %v, want ack:good and nack:bad", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Consume returned %v after cancel, want nil", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(seen) != 2 {
+		t.Errorf("worker saw %v, want both items", seen)
+	}
+}
+
+func TestConsumeCancelWhileFull(t *testing.T) {
+	acks := make(chan string, 1)
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.Put("filler")
+
+	src := &testSource{msgs: make(chan Message, 1)}
+	src.msgs <- &testMessage{value: "waiting", acks: acks}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Consume(ctx, src, q) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Consume returned %v after cancel, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consume did not return after cancel")
+	}
+	if got := <-acks; got != "nack:waiting" {
+		t.Errorf("got %s, want nack:waiting", got)
+	}
+}
+
+func TestConsumeAcksForwarded(t *testing.T) {
+	acks := make(chan string, 1)
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.DropOldestOnOverload()
+	q.ForwardOverloads(ForwarderFunc(func(item interface{}) error { return nil }))
+
+	src := &testSource{msgs: make(chan Message, 1)}
+	src.msgs <- &testMessage{value: "forwarded", acks: acks}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Consume(ctx, src, q)
+	for q.Count() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is stopped and full, so this forwards the oldest
+	q.Put("newer")
+	select {
+	case got := <-acks:
+		if got != "ack:forwarded" {
+			t.Errorf("got %s, want ack:forwarded", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarded message not acknowledged")
+	}
+}
+
+func TestConsumeCancelWhileWaiting(t *testing.T) {
+	acks := make(chan string, 1)
+	q := NewPushQueue(1, 2, func(item interface{}) {})
+
+	src := &testSource{msgs: make(chan Message, 1)}
+	src.msgs <- &testMessage{value: "pending", acks: acks}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Consume(ctx, src, q) }()
+	for q.Count() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is stopped, so the item is never processed, and its
+	// message is released when ctx is done
+	cancel()
+	<-done
+	select {
+	case got := <-acks:
+		if got != "nack:pending" {
+			t.Errorf("got %s, want nack:pending", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending message not released after cancel")
+	}
+}
@@ -0,0 +1,177 @@
+package push
+
+import (
+	"reflect"
+	"sync"
+)
+
+// FromChan bridges a channel-based producer into a push component.
+// It receives every value from ch, which may be a channel of any
+// element type, and Puts it into q. When ch is closed, FromChan
+// drains q if q has a Drain method, and then returns. FromChan
+// blocks until ch is closed, so it is normally run on its own
+// goroutine. FromChan panics if ch is not a channel that can be
+// received from.
+//
+//	go push.FromChan(orders, q)
+func FromChan(ch interface{}, q PushQueuePut) {
+	switch c := ch.(type) {
+	case chan interface{}:
+		for item := range c {
+			q.Put(item)
+		}
+	case <-chan interface{}:
+		for item := range c {
+			q.Put(item)
+		}
+	default:
+		v := reflect.ValueOf(ch)
+		if v.Kind() != reflect.Chan || v.Type().ChanDir()&reflect.RecvDir == 0 {
+			panic("FromChan requires a channel that can be received from")
+		}
+		for {
+			item, ok := v.Recv()
+			if !ok {
+				break
+			}
+			q.Put(item.Interface())
+		}
+	}
+
+	drainIfPossible(q)
+}
+
+// FanIn merges several channel-based producers into one push
+// component. inputs maps a label for each producer to its channel,
+// which may be of any element type. Every value received is Put
+// into q in an Envelope whose Source is the channel's label, so a
+// component that delivers envelopes can tell where each item came
+// from. A value that is already an *Envelope has its Source set and
+// is Put as it is.
+//
+// FanIn returns once every channel is closed, after draining q if q
+// has a Drain method. It panics if any input is not a channel that
+// can be received from.
+//
+//	go push.FanIn(q, map[string]interface{}{
+//	    "web":    webOrders,
+//	    "mobile": mobileOrders,
+//	})
+func FanIn(q PushQueuePut, inputs map[string]interface{}) {
+	cases := make([]reflect.SelectCase, 0, len(inputs))
+	labels := make([]string, 0, len(inputs))
+	for label, ch := range inputs {
+		v := reflect.ValueOf(ch)
+		if v.Kind() != reflect.Chan || v.Type().ChanDir()&reflect.RecvDir == 0 {
+			panic("FanIn requires channels that can be received from")
+		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: v})
+		labels = append(labels, label)
+	}
+
+	for len(cases) > 0 {
+		i, item, ok := reflect.Select(cases)
+		if !ok {
+			cases = append(cases[:i], cases[i+1:]...)
+			labels = append(labels[:i], labels[i+1:]...)
+			continue
+		}
+
+		e, isEnvelope := item.Interface().(*Envelope)
+		if !isEnvelope {
+			e = NewEnvelope(item.Interface())
+		}
+		e.Source = labels[i]
+		q.Put(e)
+	}
+
+	drainIfPossible(q)
+}
+
+// drainIfPossible drains q if it has a Drain method.
+func drainIfPossible(q PushQueuePut) {
+	if d, ok := q.(interface{ Drain() }); ok {
+		d.Drain()
+	}
+}
+
+// ChanOutput exposes the items of a push component as a channel,
+// for consumers that must stay channel-based. Its Worker method is
+// used as the component's worker and sends each item it is handed
+// to the channel returned by C, blocking until the item is received
+// or the ChanOutput is closed. A slow consumer therefore holds the
+// component's workers, and the component buffers and overloads
+// exactly as it would with any slow worker.
+//
+// The channel is closed by Close. Registering Close as the
+// component's OnDrained handler closes the channel once a Drain
+// has delivered every remaining item:
+//
+//	out := push.NewChanOutput(0)
+//	q := push.NewPushQueue(1, 100, out.Worker)
+//	q.OnDrained(out.Close)
+//	q.Start()
+//
+//	for item := range out.C() {
+//	    ...
+//	}
+//
+// Stop does not close the channel, since the component keeps its
+// pending items and may be started again; call Close directly to
+// end the consumer's range loop. Items handed to Worker after
+// Close are discarded. With a concurrency greater than 1, items
+// may arrive on the channel out of order.
+type ChanOutput struct {
+	ch      chan interface{}
+	done    chan struct{}
+	mutex   sync.Mutex
+	closed  bool
+	sending sync.WaitGroup
+}
+
+// NewChanOutput creates a ChanOutput whose channel has the given
+// buffer size.
+func NewChanOutput(buffer int) *ChanOutput {
+	return &ChanOutput{
+		ch:   make(chan interface{}, buffer),
+		done: make(chan struct{})}
+}
+
+// C returns the channel that receives the items.
+func (o *ChanOutput) C() <-chan interface{} {
+	return o.ch
+}
+
+// Worker sends item to the channel. It is meant to be given as
+// the worker of a push component.
+func (o *ChanOutput) Worker(item interface{}) {
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return
+	}
+	o.sending.Add(1)
+	o.mutex.Unlock()
+	defer o.sending.Done()
+
+	select {
+	case o.ch <- item:
+	case <-o.done:
+	}
+}
+
+// Close closes the channel once any sends in progress have
+// finished. It is safe to call Close more than once.
+func (o *ChanOutput) Close() {
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return
+	}
+	o.closed = true
+	o.mutex.Unlock()
+
+	close(o.done)
+	o.sending.Wait()
+	close(o.ch)
+}
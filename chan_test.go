@@ -0,0 +1,86 @@
+package push_test
+
+import (
+	"testing"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestFromChan(t *testing.T) {
+	tl := newTally()
+	q := NewPushQueue(2, 100, tl.process)
+	drained := make(chan bool, 1)
+	q.OnDrained(func() {
+		drained <- true
+	})
+	q.Start()
+
+	ch := make(chan int)
+	go func() {
+		for i := 0; i < 50; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+	FromChan(ch, q)
+
+	<-drained
+	tl.check(t, 50)
+}
+
+func TestChanOutput(t *testing.T) {
+	out := NewChanOutput(0)
+	q := NewPushQueue(1, 100, out.Worker)
+	q.OnDrained(out.Close)
+	for i := 0; i < 20; i++ {
+		q.Put(i)
+	}
+	q.Start()
+	q.Drain()
+
+	next := 0
+	for item := range out.C() {
+		if item != next {
+			t.Fatalf("got %v, want %d", item, next)
+		}
+		next++
+	}
+	if next != 20 {
+		t.Errorf("received %d items, want 20", next)
+	}
+}
+
+func TestFanIn(t *testing.T) {
+	counts := make(map[string]int)
+	q := NewPushQueue(1, 100, func(item interface{}) {
+		e := item.(*Envelope)
+		counts[e.Source] += e.Item.(int)
+	})
+	q.DeliverEnvelopes()
+	drained := make(chan bool, 1)
+	q.OnDrained(func() {
+		drained <- true
+	})
+	q.Start()
+
+	a := make(chan int)
+	b := make(chan interface{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			a <- 1
+		}
+		close(a)
+	}()
+	go func() {
+		for i := 0; i < 5; i++ {
+			b <- 2
+		}
+		close(b)
+	}()
+	FanIn(q, map[string]interface{}{"a": a, "b": b})
+
+	<-drained
+	if counts["a"] != 10 || counts["b"] != 10 || len(counts) != 2 {
+		t.Errorf("got %v, want a:10 b:10", counts)
+	}
+}
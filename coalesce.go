@@ -0,0 +1,44 @@
+package push
+
+// coalescer merges an item put into a component into a pending item
+// with the same key, as returned by key, so that a run of updates to
+// the same thing is processed as one.
+type coalescer struct {
+	key     func(QueueItem) interface{}
+	combine func(pending, item interface{}) interface{}
+}
+
+func newCoalescer(key func(QueueItem) interface{}, combine func(pending, item interface{}) interface{}) *coalescer {
+	if key == nil {
+		panic("no key function set")
+	}
+	if combine == nil {
+		panic("no combine function set")
+	}
+	return &coalescer{key: key, combine: combine}
+}
+
+// merge combines e into the first of the pending items with the same
+// key, and reports whether there was one. The pending item keeps its
+// envelope and place, and its Future also resolves e's.
+func (c *coalescer) merge(items []*Envelope, e *Envelope, whole bool) bool {
+	if c == nil {
+		return false
+	}
+	k := c.key(e.payload(whole))
+	for _, p := range items {
+		if c.key(p.payload(whole)) != k {
+			continue
+		}
+		p.Item = c.combine(p.Item, e.Item)
+		switch {
+		case e.future == nil:
+		case p.future == nil:
+			p.future = e.future
+		default:
+			p.future.join(e.future)
+		}
+		return true
+	}
+	return false
+}
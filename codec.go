@@ -0,0 +1,56 @@
+package push
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Codec compresses the encoded form of each item that is written
+// out to be read back later, such as by a Recorder, and decompresses
+// it again when it is read back. It must be safe for use by more
+// than one goroutine.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// GzipCodec is a Codec that compresses with gzip at the given Level,
+// such as gzip.BestSpeed. The zero Level means
+// gzip.DefaultCompression.
+type GzipCodec struct {
+	Level int
+}
+
+// compile-time check that interface is satisfied
+var _ Codec = GzipCodec{}
+
+// Compress returns data compressed with gzip.
+func (c GzipCodec) Compress(data []byte) ([]byte, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress returns data decompressed with gzip.
+func (c GzipCodec) Decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
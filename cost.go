@@ -0,0 +1,52 @@
+package push
+
+// costLimit enforces a ceiling on the total cost of the items
+// being processed at once. The zero value imposes no limit.
+type costLimit struct {
+	max      int
+	cost     func(QueueItem) int
+	inFlight int
+}
+
+// clone returns a cost limit with the same ceiling and cost function
+// and nothing in flight.
+func (c *costLimit) clone() costLimit {
+	return costLimit{max: c.max, cost: c.cost}
+}
+
+// checkMaxCost panics if maxCost is less than 1. Setters call it
+// before locking, so that in safe mode the panic is recovered with
+// the mutex released.
+func checkMaxCost(maxCost int) {
+	if maxCost < 1 {
+		panic("max cost must be greater than 0")
+	}
+}
+
+// set sets the ceiling, which has been checked with checkMaxCost,
+// and the cost function.
+func (c *costLimit) set(maxCost int, cost func(QueueItem) int) {
+	c.max = maxCost
+	c.cost = cost
+}
+
+// of returns the cost of item, or 0 if no cost function is set.
+func (c *costLimit) of(item QueueItem) int {
+	if c.cost == nil {
+		return 0
+	}
+	return c.cost(item)
+}
+
+// fits reports whether an item of the given cost may start in
+// addition to the in-flight cost and the pending cost already
+// committed. An item that is too costly on its own may still
+// start when nothing else is in flight, so that it cannot be
+// blocked forever.
+func (c *costLimit) fits(pending, cost int) bool {
+	if c.cost == nil {
+		return true
+	}
+	total := c.inFlight + pending
+	return total == 0 || total+cost <= c.max
+}
@@ -0,0 +1,80 @@
+package push_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestCostLimitSafeMode(t *testing.T) {
+	type costLimited interface {
+		SafeMode()
+		OnInternalError(func(error))
+		CostLimit(maxCost int, cost func(QueueItem) int)
+		Count() int
+	}
+	components := map[string]costLimited{
+		"queue":       NewPushQueue(1, 10, func(interface{}) {}),
+		"batch queue": NewPushBatchQueue(1, 10, 2, func([]interface{}) {}),
+		"stack":       NewPushStack(1, 10, func(interface{}) {}),
+	}
+	for name, c := range components {
+		errs := make(chan error, 1)
+		c.SafeMode()
+		c.OnInternalError(func(err error) { errs <- err })
+		c.CostLimit(0, func(QueueItem) int { return 1 })
+		select {
+		case err := <-errs:
+			if _, ok := err.(*InternalError); !ok {
+				t.Errorf("%s: got %v, want an *InternalError", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: invalid cost limit not reported", name)
+		}
+
+		// the component must not be left locked
+		counted := make(chan int)
+		go func() { counted <- c.Count() }()
+		select {
+		case <-counted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: locked after an invalid cost limit", name)
+		}
+	}
+}
+
+func TestCostLimit(t *testing.T) {
+	var mutex sync.Mutex
+	inFlight, violations := 0, 0
+	q := NewPushQueue(10, 100, func(item interface{}) {
+		cost := item.(int)
+		mutex.Lock()
+		inFlight += cost
+		if inFlight > 10 && inFlight != cost {
+			violations++
+		}
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		inFlight -= cost
+		mutex.Unlock()
+	})
+	q.CostLimit(10, func(item QueueItem) int {
+		return item.(int)
+	})
+	for i := 0; i < 50; i++ {
+		q.Put(1 + i%6)
+	}
+	q.Put(25) // too costly on its own, so runs alone
+	q.Put(3)
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if violations > 0 {
+		t.Errorf("cost limit exceeded %d times", violations)
+	}
+}
@@ -0,0 +1,76 @@
+package push
+
+import (
+	"sync"
+)
+
+// Cursor tracks a position in an ordered stream of items, such as a
+// recording or the offsets of a source, before which every item has
+// been processed, even though items may finish out of order. Saving
+// the position as it advances, with OnAdvance, lets a consumer resume
+// after a restart without skipping an item, and SeekTo lets it replay
+// from an earlier point on purpose.
+type Cursor struct {
+	mutex     sync.Mutex
+	position  int64
+	done      map[int64]bool
+	onAdvance func(int64)
+}
+
+// NewCursor creates a Cursor at position, such as one saved earlier.
+func NewCursor(position int64) *Cursor {
+	return &Cursor{position: position, done: make(map[int64]bool)}
+}
+
+// Position returns the position of the first item not yet known to
+// have been processed.
+func (c *Cursor) Position() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.position
+}
+
+// Done marks the item at pos as processed. The position advances
+// past it once every item before it is done too. Items before the
+// position are ignored.
+func (c *Cursor) Done(pos int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if pos < c.position {
+		return
+	}
+	c.done[pos] = true
+	advanced := false
+	for c.done[c.position] {
+		delete(c.done, c.position)
+		c.position++
+		advanced = true
+	}
+	if advanced && c.onAdvance != nil {
+		c.onAdvance(c.position)
+	}
+}
+
+// SeekTo moves the cursor to pos, forgetting the items done beyond
+// the old position, so that the stream is consumed again from pos.
+// It should be called while no items are in flight.
+func (c *Cursor) SeekTo(pos int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.position = pos
+	c.done = make(map[int64]bool)
+}
+
+// OnAdvance sets a function to be called with the new position
+// whenever it advances, such as to save it durably. It is called
+// with the Cursor's lock held, so that positions arrive in order,
+// and must not call back into the Cursor.
+func (c *Cursor) OnAdvance(f func(int64)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.onAdvance = f
+}
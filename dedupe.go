@@ -0,0 +1,59 @@
+package push
+
+import (
+	"time"
+)
+
+// dedupe remembers the keys of the items put into a component for a
+// window, so that duplicates put within it can be suppressed, even
+// once the first item has been processed. Items are told apart by
+// the key that key returns for them.
+type dedupe struct {
+	key    func(QueueItem) interface{}
+	window time.Duration
+	seen   map[interface{}]time.Time
+	sweep  time.Time
+}
+
+func newDedupe(key func(QueueItem) interface{}, window time.Duration) *dedupe {
+	if key == nil {
+		panic("no key function set")
+	}
+	if window <= 0 {
+		panic("window must be greater than 0")
+	}
+	return &dedupe{key: key, window: window, seen: make(map[interface{}]time.Time)}
+}
+
+// clone returns a dedupe with the same key function and window that
+// has seen no items.
+func (d *dedupe) clone() *dedupe {
+	if d == nil {
+		return nil
+	}
+	return newDedupe(d.key, d.window)
+}
+
+// duplicate reports whether an item with the same key as e was put
+// within the window before now. If not, e's key is remembered as
+// put at now. Keys whose window has passed are forgotten at most
+// once per window, so that the keys remembered stay bounded.
+func (d *dedupe) duplicate(e *Envelope, whole bool, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	k := d.key(e.payload(whole))
+	if at, ok := d.seen[k]; ok && now.Sub(at) < d.window {
+		return true
+	}
+	if !now.Before(d.sweep) {
+		for key, at := range d.seen {
+			if now.Sub(at) >= d.window {
+				delete(d.seen, key)
+			}
+		}
+		d.sweep = now.Add(d.window)
+	}
+	d.seen[k] = now
+	return false
+}
@@ -0,0 +1,151 @@
+package push_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+// tally records how many times each item was handed to a worker
+// or reported as dropped.
+type tally struct {
+	mutex     sync.Mutex
+	processed map[int]int
+	dropped   map[int]int
+}
+
+func newTally() *tally {
+	return &tally{processed: make(map[int]int), dropped: make(map[int]int)}
+}
+
+func (t *tally) process(item interface{}) {
+	t.mutex.Lock()
+	t.processed[item.(int)]++
+	t.mutex.Unlock()
+}
+
+func (t *tally) processBatch(batch []interface{}) {
+	for _, item := range batch {
+		t.process(item)
+	}
+}
+
+func (t *tally) drop(item interface{}) {
+	t.mutex.Lock()
+	t.dropped[item.(int)]++
+	t.mutex.Unlock()
+}
+
+// check asserts that every item in [0, n) was either processed or
+// dropped, and that no item was seen more than once in total.
+func (t *tally) check(tb testing.TB, n int) {
+	tb.Helper()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i := 0; i < n; i++ {
+		p, d := t.processed[i], t.dropped[i]
+		if p+d != 1 {
+			tb.Errorf("item %d: processed %d times, dropped %d times", i, p, d)
+		}
+	}
+}
+
+type drainer interface {
+	OnDrained(func())
+	Drain()
+}
+
+func drainAndWait(tb testing.TB, c drainer) {
+	tb.Helper()
+	done := make(chan bool, 1)
+	c.OnDrained(func() {
+		done <- true
+	})
+	c.Drain()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		tb.Fatal("timed out waiting for drain")
+	}
+}
+
+const exactlyOnceItems = 2000
+
+func TestPushQueueExactlyOnce(t *testing.T) {
+	tl := newTally()
+	q := NewPushQueue(4, exactlyOnceItems, tl.process)
+	q.OnOverload(tl.drop)
+	q.Start()
+	for i := 0; i < exactlyOnceItems; i++ {
+		q.Put(i)
+	}
+	drainAndWait(t, q)
+	tl.check(t, exactlyOnceItems)
+}
+
+func TestPushQueuePutItemsExactlyOnce(t *testing.T) {
+	for _, dropOldest := range []bool{false, true} {
+		tl := newTally()
+		q := NewPushQueue(4, 10, tl.process)
+		if dropOldest {
+			q.DropOldestOnOverload()
+		}
+		q.OnOverload(tl.drop)
+
+		// fill past depth before starting so that overload occurs
+		items := make([]interface{}, 25)
+		for i := range items {
+			items[i] = i
+		}
+		q.PutItems(items...)
+		if q.Count() != q.Depth() {
+			t.Errorf("dropOldest=%v: count %d, want %d", dropOldest, q.Count(), q.Depth())
+		}
+		q.Start()
+		drainAndWait(t, q)
+		// overload handlers run on their own goroutines
+		time.Sleep(50 * time.Millisecond)
+		tl.check(t, len(items))
+	}
+}
+
+func TestPushBatchQueueExactlyOnce(t *testing.T) {
+	tl := newTally()
+	q := NewPushBatchQueue(4, exactlyOnceItems, 7, tl.processBatch)
+	q.OnOverload(tl.drop)
+	q.Start()
+	for i := 0; i < exactlyOnceItems; i++ {
+		q.Put(i)
+	}
+	drainAndWait(t, q)
+	tl.check(t, exactlyOnceItems)
+}
+
+func TestPushStackExactlyOnce(t *testing.T) {
+	tl := newTally()
+	s := NewPushStack(4, exactlyOnceItems, tl.process)
+	s.OnOverload(tl.drop)
+	s.Start()
+	for i := 0; i < exactlyOnceItems; i++ {
+		s.Push(i)
+	}
+	drainAndWait(t, s)
+	tl.check(t, exactlyOnceItems)
+}
+
+func TestPushStackOverloadExactlyOnce(t *testing.T) {
+	tl := newTally()
+	s := NewPushStack(1, 10, tl.process)
+	s.OnOverload(tl.drop)
+	for i := 0; i < 25; i++ {
+		s.Push(i)
+	}
+	s.Start()
+	drainAndWait(t, s)
+	// overload handlers run on their own goroutines
+	time.Sleep(50 * time.Millisecond)
+	tl.check(t, 25)
+}
@@ -0,0 +1,133 @@
+package push
+
+import (
+	"sync"
+)
+
+// Dispatcher is a pool of worker slots shared by several push
+// components. Each component is given a worker wrapped by the
+// Dispatcher, which holds each item until a slot is free. When
+// workers of several components are waiting, slots are granted by
+// smooth weighted round-robin, so that a component of weight 3 is
+// served three times as often as one of weight 1 while both have
+// work.
+//
+// The slots are thus a ceiling on the items in flight across all
+// the components, on top of each component's own concurrency, such
+// as to protect a database connection pool they share. A batch
+// counts as a single item.
+//
+// A component's own concurrency bounds how many of its items wait
+// for a slot at once; it should be at least the component's share of
+// the pool for the weights to take full effect.
+type Dispatcher struct {
+	mutex   sync.Mutex
+	slots   int
+	free    int
+	members int
+	waiting map[interface{}][]chan struct{}
+	share   fairShare
+}
+
+// NewDispatcher creates a Dispatcher with the given number of worker
+// slots. NewDispatcher panics if slots is not positive.
+func NewDispatcher(slots int) *Dispatcher {
+	if slots < 1 {
+		panic("slots must be greater than 0")
+	}
+	return &Dispatcher{
+		slots:   slots,
+		free:    slots,
+		waiting: make(map[interface{}][]chan struct{}),
+		share:   fairShare{weights: make(map[interface{}]int)}}
+}
+
+// Worker returns a worker for a component served with the given
+// weight, which calls f for each item once a slot is granted.
+// Worker panics if weight is not positive.
+func (d *Dispatcher) Worker(weight int, f func(interface{})) func(interface{}) {
+	member := d.join(weight)
+	return func(item interface{}) {
+		d.acquire(member)
+		defer d.release()
+		f(item)
+	}
+}
+
+// BatchWorker returns a worker for a PushBatchQueue served with the
+// given weight, which calls f for each batch once a slot is granted.
+// A batch takes a single slot. BatchWorker panics if weight is not
+// positive.
+func (d *Dispatcher) BatchWorker(weight int, f func([]interface{})) func([]interface{}) {
+	member := d.join(weight)
+	return func(items []interface{}) {
+		d.acquire(member)
+		defer d.release()
+		f(items)
+	}
+}
+
+// InFlight returns the number of slots granted to workers that are
+// still running.
+func (d *Dispatcher) InFlight() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.slots - d.free
+}
+
+// join adds a member with the given weight and returns it.
+func (d *Dispatcher) join(weight int) interface{} {
+	if weight < 1 {
+		panic("weight must be greater than 0")
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.members++
+	member := d.members
+	d.share.weights[member] = weight
+	return member
+}
+
+// acquire blocks until member is granted a slot.
+func (d *Dispatcher) acquire(member interface{}) {
+	d.mutex.Lock()
+	if d.free > 0 && len(d.waiting) == 0 {
+		d.free--
+		d.mutex.Unlock()
+		return
+	}
+	granted := make(chan struct{})
+	d.waiting[member] = append(d.waiting[member], granted)
+	d.mutex.Unlock()
+
+	<-granted
+}
+
+// release hands a slot to the waiting member that is due next, or
+// frees it if none is waiting.
+func (d *Dispatcher) release() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if len(d.waiting) == 0 {
+		d.free++
+		return
+	}
+	classes := make([]interface{}, 0, len(d.waiting))
+	for member := range d.waiting {
+		classes = append(classes, member)
+	}
+	member := d.share.next(classes)
+	d.share.commit(classes, member)
+
+	queue := d.waiting[member]
+	close(queue[0])
+	if len(queue) == 1 {
+		delete(d.waiting, member)
+	} else {
+		d.waiting[member] = queue[1:]
+	}
+}
@@ -0,0 +1,79 @@
+package push_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestDispatcherWeights(t *testing.T) {
+	d := NewDispatcher(1)
+	var mutex sync.Mutex
+	var served []string
+	work := func(item interface{}) {
+		mutex.Lock()
+		served = append(served, item.(string))
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	interactive := NewPushQueue(2, 100, d.Worker(3, work))
+	batch := NewPushQueue(2, 100, d.Worker(1, work))
+	for i := 0; i < 100; i++ {
+		interactive.Put("interactive")
+		batch.Put("batch")
+	}
+	interactive.Start()
+	batch.Start()
+	drainAndWait(t, interactive)
+	drainAndWait(t, batch)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	n := 0
+	for _, s := range served[:80] {
+		if s == "interactive" {
+			n++
+		}
+	}
+	// 3 of every 4 while both have work
+	if n < 55 || n > 65 {
+		t.Errorf("interactive served %d of the first 80, want about 60", n)
+	}
+}
+
+func TestDispatcherCeiling(t *testing.T) {
+	d := NewDispatcher(3)
+	var mutex sync.Mutex
+	running, peak := 0, 0
+	work := func(item interface{}) {
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	}
+	a := NewPushQueue(3, 100, d.Worker(1, work))
+	b := NewPushQueue(3, 100, d.Worker(1, work))
+	a.Start()
+	b.Start()
+	for i := 0; i < 30; i++ {
+		a.Put(i)
+		b.Put(i)
+	}
+	drainAndWait(t, a)
+	drainAndWait(t, b)
+
+	if peak > 3 {
+		t.Errorf("%d items in flight at once, want at most 3", peak)
+	}
+	if n := d.InFlight(); n != 0 {
+		t.Errorf("%d slots in flight after drain, want 0", n)
+	}
+}
@@ -18,6 +18,44 @@
 // In the above example, the worker will be called as a goroutine
 // at most two times concurrently.
 //
+// Delivery
+//
+// Every item accepted by a push component is handed to the worker
+// exactly once while the component is running normally. An item
+// that is dropped on the floor because of an overload is never
+// handed to the worker, and an item handed to the worker is never
+// reported as dropped. Items removed by Empty are neither
+// processed nor reported.
+//
+// Brokers
+//
+// Any message broker client can feed the components, or be fed by
+// them, through two small interfaces. A Source receives Messages,
+// and Consume Puts their values into a component, acknowledging each
+// message only once the worker has finished with its item, or
+// negatively if the item never reaches a worker. A Sink sends items
+// on, and SinkWorker makes a worker of it. The kafka, nats, sqs,
+// websocket and grpc modules adapt particular clients.
+//
+// Concurrency
+//
+// Every exported method of the components may be called from any
+// number of goroutines at once, including while workers are running
+// and from within workers and event handlers. The components guard
+// their state with a single mutex per component, and never hold it
+// while calling a worker or an event handler. Functions that the
+// components consult while choosing items, such as cost, key and
+// priority functions, scheduling policies, RemoveWhere and
+// SplitWhere predicates, ForEach functions and Sort comparators, are
+// called with the mutex held and must not call back into the
+// component. Event handlers are each called on their own goroutine,
+// unless SyncEvents has been called, or they were subscribed with
+// Handlers.Sync, in which case they are called in order on the
+// goroutine that raised the event, once the mutex is released. A panic in an event handler is recovered and reported
+// to the OnHandlerPanic handler, and the component keeps running.
+// Items Put while a component is draining are refused and reported
+// by the DroppedWhileDraining event.
+//
 // Events
 //
 // The following events are provided for client programs to respond
@@ -30,10 +68,56 @@
 // * FirstOverload(Item) -- same as Overload except that it happens
 // only on the first occurance.
 // 
+// * OverloadSummary(OverloadSummary) -- fired at most once per
+// given period with the number of overloads in it and a sample item,
+// for handling overloads in bulk when one call per dropped item
+// would be too costly.
+//
+// * DroppedWhileDraining(Item) -- fired for each item Put while the
+// push component is draining. The item is dropped, but counted apart
+// from overloads, so that data lost at shutdown can be told apart
+// from a lack of capacity.
+//
+// * Shed(Item) -- fired for each item shed while the push component
+// is under pressure, set by ApplyPressure or by WatchMemory when
+// the heap grows too large.
+//
+// * Suppressed(Item) -- fired for each item suppressed as a
+// duplicate of one put shortly before it, set by SuppressDuplicates.
+//
+// * Result(Result) -- fired for each item processed by a worker
+// set with ResultWorker, with the value and error it returned.
+//
+// * StoreError(error) -- fired for each error returned by the
+// ProcessedStore set with ExactlyOnce.
+//
+// * Threshold(ThresholdEvent) -- fired when the count of items rises
+// to a given fraction of capacity, and again when it falls back below
+// it by a given margin. Several thresholds may be set for graduated
+// alerts.
+//
+// * Alert(AlertEvent) -- fired when the count of items has stayed at
+// or above a given fraction of capacity for a given period, and
+// again, as cleared, when it falls back below it by a given margin.
+// Unlike Threshold, a count flapping around the level within the
+// period raises nothing, so alerts suit paging.
+//
+// * StateChange(StateChangeEvent) -- fired when the push component
+// moves between the stopped, started and draining states, with what
+// caused the change: a method call, the end of a drain, or the end
+// of the context given to StartContext.
+//
 // * Drained -- fired when the push component finishes processing all
 // items after the client calls the Drain method. This signals to
 // the client that (for example) the program may be safely without
-// interrupting processing.
+// interrupting processing. The DrainSummary event fires at the same
+// time with the number of items processed and dropped during the
+// drain and how long it took, for shutdown logs.
+//
+// Each On method sets the one handler for its event. Further
+// handlers for any of the events, such as those of a short-lived
+// observer, can be added with Subscribe and removed again by
+// unsubscribing the returned Subscription.
 //
 // An example of the client's program blocking until all items 
 // are finished processing:
@@ -0,0 +1,108 @@
+package push
+
+import (
+	"fmt"
+	"time"
+)
+
+// DrainTimeoutError is returned by WaitForDrain when a drain does
+// not complete in time.
+type DrainTimeoutError struct {
+	// Items holds the items still pending in the component.
+	Items []QueueItem
+
+	// Workers is the number of workers still busy.
+	Workers int
+}
+
+func (e *DrainTimeoutError) Error() string {
+	return fmt.Sprintf("push: drain timed out with %d items pending and %d workers busy: %v",
+		len(e.Items), e.Workers, e.Items)
+}
+
+// DrainSummary describes a completed drain, for reporting what
+// happened at shutdown.
+type DrainSummary struct {
+	// Processed is the number of items processed from the start of
+	// the drain until it completed.
+	Processed int
+
+	// Duration is the time from the start of the drain until it
+	// completed.
+	Duration time.Duration
+
+	// Dropped is the number of items refused because they were put
+	// during the drain.
+	Dropped int
+}
+
+// drainStats records the state of a component at the start of a
+// drain, so that a DrainSummary can be made when the drain is
+// complete.
+type drainStats struct {
+	start     time.Time
+	processed int
+	dropped   int
+}
+
+// begin records the start of a drain, with the component's counts
+// of items processed and dropped while draining so far.
+func (d *drainStats) begin(processed, dropped int) {
+	d.start = time.Now()
+	d.processed = processed
+	d.dropped = dropped
+}
+
+// summary returns the summary of a drain that is complete with the
+// given counts.
+func (d *drainStats) summary(processed, dropped int) DrainSummary {
+	return DrainSummary{
+		Processed: processed - d.processed,
+		Duration:  time.Since(d.start),
+		Dropped:   dropped - d.dropped}
+}
+
+// drainReporter is implemented by the components so that
+// WaitForDrain can observe a drain without taking over the
+// component's OnDrained handler.
+type drainReporter interface {
+	drained() bool
+	busyWorkers() int
+	Items() []QueueItem
+}
+
+// WaitForDrain drains c and blocks until the drain is complete or
+// timeout has elapsed, in which case it returns a *DrainTimeoutError
+// describing what is left. For a PushQueue, PushBatchQueue or
+// PushStack the component's OnDrained handler is left in place; for
+// any other Lifecycle, WaitForDrain replaces it.
+func WaitForDrain(c Lifecycle, timeout time.Duration) error {
+	r, ok := c.(drainReporter)
+	if !ok {
+		done := make(chan struct{})
+		c.OnDrained(func() {
+			close(done)
+		})
+		c.Drain()
+		select {
+		case <-done:
+			return nil
+		case <-time.After(timeout):
+			return &DrainTimeoutError{}
+		}
+	}
+
+	c.Drain()
+	deadline := time.Now().Add(timeout)
+	delay := time.Millisecond
+	for !r.drained() {
+		if time.Now().After(deadline) {
+			return &DrainTimeoutError{Items: r.Items(), Workers: r.busyWorkers()}
+		}
+		time.Sleep(delay)
+		if delay < 50*time.Millisecond {
+			delay *= 2
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package push_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestWaitForDrain(t *testing.T) {
+	release := make(chan bool)
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		<-release
+	})
+	drained := make(chan bool, 1)
+	q.OnDrained(func() {
+		drained <- true
+	})
+	q.Put(1)
+	q.Put(2)
+	q.Start()
+
+	err := WaitForDrain(q, 20*time.Millisecond)
+	te, ok := err.(*DrainTimeoutError)
+	if !ok || len(te.Items) != 1 || te.Items[0] != 2 || te.Workers != 1 {
+		t.Fatalf("got %v, want timeout with item 2 pending and 1 worker busy", err)
+	}
+
+	close(release)
+	if err := WaitForDrain(q, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Error("OnDrained handler was not called")
+	}
+}
@@ -0,0 +1,70 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// dumpSample is the number of pending items listed by Dump.
+const dumpSample = 10
+
+// description describes a push component for String and Dump.
+type description struct {
+	kind        string
+	state       State
+	count       int
+	capacity    int
+	inFlight    int
+	available   int
+	concurrency int
+
+	// settings and counts are name and value pairs, in order
+	settings []interface{}
+	counts   []interface{}
+
+	sample []QueueItem
+	more   int
+}
+
+func (d *description) String() string {
+	return fmt.Sprintf("%s(%v, %d/%d pending, %d in flight, %d/%d workers free)",
+		d.kind, d.state, d.count, d.capacity, d.inFlight, d.available, d.concurrency)
+}
+
+// dump returns a multi-line description.
+func (d *description) dump() string {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, d.String())
+	pairs := func(label string, kv []interface{}) {
+		fmt.Fprintf(&b, "  %s:", label)
+		for i := 0; i < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+		}
+		fmt.Fprintln(&b)
+	}
+	pairs("settings", d.settings)
+	pairs("counts", d.counts)
+	fmt.Fprintf(&b, "  pending:")
+	for _, item := range d.sample {
+		fmt.Fprintf(&b, " %v", item)
+	}
+	if d.more > 0 {
+		fmt.Fprintf(&b, " ... and %d more", d.more)
+	}
+	fmt.Fprintln(&b)
+	return b.String()
+}
+
+// sampleItems returns the first dumpSample of items, oldest first,
+// and the number left out.
+func sampleItems(items []*Envelope, whole bool) ([]QueueItem, int) {
+	n := len(items)
+	if n > dumpSample {
+		n = dumpSample
+	}
+	sample := make([]QueueItem, n)
+	for i, e := range items[:n] {
+		sample[i] = e.payload(whole)
+	}
+	return sample, len(items) - n
+}
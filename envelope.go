@@ -0,0 +1,91 @@
+package push
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Envelope carries an item through a push component together with
+// metadata about the item. Push components wrap every item they
+// accept in an Envelope. Workers receive the bare Item unless
+// DeliverEnvelopes has been called on the component, in which case
+// they receive the *Envelope itself.
+//
+// Clients may also put an *Envelope directly, for example to set the
+// Priority or Metadata of an item. The component uses the given
+// envelope rather than wrapping it a second time.
+type Envelope struct {
+	// Item is the value that was put into the component.
+	Item interface{}
+
+	// ID uniquely identifies the envelope within the process. It is
+	// assigned when the envelope is first accepted by a component,
+	// unless the client has already set it.
+	ID uint64
+
+	// Enqueued is the time at which the component accepted the item.
+	Enqueued time.Time
+
+	// Attempts is the number of times the item has been handed to
+	// a worker.
+	Attempts int
+
+	// Deadline, if set, is the time after which the item is no
+	// longer worth processing. An item whose deadline has passed
+	// by the time it is due to be handed to a worker is skipped
+	// instead.
+	Deadline time.Time
+
+	// Priority is a client-defined priority for the item. Larger
+	// values mean higher priority.
+	Priority int
+
+	// Metadata holds arbitrary client data associated with the item.
+	Metadata map[string]interface{}
+
+	// Source labels the input the item arrived from, when it was
+	// put by FanIn.
+	Source string
+
+	// Slot is the worker slot the item was last handed to, when the
+	// component pins items to slots by key with Affinity.
+	Slot int
+
+	future *Future
+}
+
+// NewEnvelope wraps item in a new Envelope.
+func NewEnvelope(item interface{}) *Envelope {
+	return &Envelope{Item: item}
+}
+
+var lastEnvelopeID uint64
+
+// envelop returns item as an *Envelope stamped for enqueueing,
+// wrapping it first if it is not already an *Envelope.
+func envelop(item interface{}) *Envelope {
+	e, ok := item.(*Envelope)
+	if !ok {
+		e = &Envelope{Item: item}
+	}
+	if e.ID == 0 {
+		e.ID = atomic.AddUint64(&lastEnvelopeID, 1)
+	}
+	e.Enqueued = time.Now()
+	return e
+}
+
+// expired reports whether the envelope's deadline has passed.
+func (e *Envelope) expired(now time.Time) bool {
+	return !e.Deadline.IsZero() && now.After(e.Deadline)
+}
+
+// payload returns what a worker or event handler should be given
+// for the envelope: the envelope itself when whole is true,
+// otherwise the bare item.
+func (e *Envelope) payload(whole bool) interface{} {
+	if whole {
+		return e
+	}
+	return e.Item
+}
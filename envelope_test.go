@@ -0,0 +1,52 @@
+package push_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestEnvelopeBareItems(t *testing.T) {
+	got := make(chan interface{}, 1)
+	q := NewPushQueue(1, 10, func(item interface{}) { got <- item })
+	q.Start()
+
+	// an item put in an envelope reaches the worker bare
+	q.Put(NewEnvelope("a"))
+	select {
+	case item := <-got:
+		if item != "a" {
+			t.Errorf("worker got %v, want a", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("item not processed")
+	}
+}
+
+func TestDeliverEnvelopes(t *testing.T) {
+	got := make(chan *Envelope, 2)
+	q := NewPushQueue(1, 10, func(item interface{}) { got <- item.(*Envelope) })
+	q.DeliverEnvelopes()
+	before := time.Now()
+	q.Put("bare")
+	e := &Envelope{Item: "wrapped", ID: 42, Metadata: map[string]interface{}{"k": "v"}}
+	q.Put(e)
+	q.Start()
+
+	bare, wrapped := <-got, <-got
+	if bare.Item != "bare" || bare.ID == 0 || bare.Attempts != 1 || bare.Enqueued.Before(before) {
+		t.Errorf("got envelope %+v for a bare item, want it stamped", bare)
+	}
+	// a client's envelope is used rather than wrapped again, keeping
+	// its ID and metadata
+	if wrapped != e {
+		t.Errorf("got envelope %+v, want the one put", wrapped)
+	}
+	if e.ID != 42 || e.Metadata["k"] != "v" || e.Attempts != 1 || e.Enqueued.IsZero() {
+		t.Errorf("got envelope %+v, want ID 42 with its metadata, stamped", e)
+	}
+	if bare.ID == e.ID {
+		t.Errorf("envelopes share ID %d", e.ID)
+	}
+}
@@ -0,0 +1,230 @@
+package push
+
+import (
+	"log"
+	"time"
+)
+
+// itemHooks holds the event handlers that bracket each worker call.
+// The components copy their hooks under the mutex when dispatching,
+// so that the handlers can be called without it.
+type itemHooks struct {
+	onStart func(item interface{}, waited time.Duration)
+	onDone  func(item interface{}, elapsed time.Duration)
+	onPanic func(interface{})
+
+	// subs are the component's subscribers, which the components
+	// set afresh whenever they change
+	subs []*subscriber
+}
+
+// clone returns the hooks without the subscribers.
+func (h itemHooks) clone() itemHooks {
+	return itemHooks{onStart: h.onStart, onDone: h.onDone, onPanic: h.onPanic}
+}
+
+// start calls the OnItemStart handlers, if any, for an item about
+// to be handed to a worker, and returns the time the worker starts.
+func (h itemHooks) start(e *Envelope, item interface{}) time.Time {
+	now := time.Now()
+	waited := now.Sub(e.Enqueued)
+	if h.onStart != nil {
+		protect(panicked(h.onPanic, h.subs), func() {
+			h.onStart(item, waited)
+		})
+	}
+	for _, s := range h.subs {
+		if f := s.h.ItemStart; f != nil {
+			protect(panicked(h.onPanic, h.subs), func() {
+				f(item, waited)
+			})
+		}
+	}
+	return now
+}
+
+// done calls the OnItemDone handlers, if any, for an item whose
+// worker started at started.
+func (h itemHooks) done(item interface{}, started time.Time) {
+	elapsed := time.Since(started)
+	if h.onDone != nil {
+		protect(panicked(h.onPanic, h.subs), func() {
+			h.onDone(item, elapsed)
+		})
+	}
+	for _, s := range h.subs {
+		if f := s.h.ItemDone; f != nil {
+			protect(panicked(h.onPanic, h.subs), func() {
+				f(item, elapsed)
+			})
+		}
+	}
+}
+
+// OverloadReason is the reason an item was dropped as an overload.
+type OverloadReason int
+
+const (
+	// OverloadFull means the component was at capacity.
+	OverloadFull OverloadReason = iota
+
+	// OverloadDraining means the component was draining and
+	// refused new items. Such items are not counted as overloads;
+	// see OnDroppedWhileDraining.
+	OverloadDraining
+
+	// OverloadTenant means the item's tenant already had as many
+	// items pending as its limit set with TenantLimits allows.
+	OverloadTenant
+)
+
+func (r OverloadReason) String() string {
+	switch r {
+	case OverloadFull:
+		return "full"
+	case OverloadDraining:
+		return "draining"
+	case OverloadTenant:
+		return "tenant"
+	}
+	return "unknown"
+}
+
+// OverloadEvent describes an item dropped as an overload. It is
+// passed to the handler set with OnOverloadEvent.
+type OverloadEvent struct {
+	// Item is the item that was dropped, which is not necessarily
+	// the item being put when the component drops its oldest items.
+	Item interface{}
+
+	// Reason is why the item was dropped.
+	Reason OverloadReason
+
+	// Overloads is the count of drops for Reason including this
+	// one: the overload count for OverloadFull and OverloadTenant,
+	// or the count of items dropped while draining for
+	// OverloadDraining.
+	Overloads int
+
+	// Count is the number of items pending after the drop.
+	Count int
+
+	// Capacity is the depth of a queue or height of a stack.
+	Capacity int
+
+	// Tenant is the tenant key of the item, for OverloadTenant.
+	Tenant interface{}
+}
+
+// skipCount counts the items that a component rejected or skipped
+// for one reason, such as the intake rate limit, and raises the
+// event for that reason. The count is reset when the component is
+// started.
+type skipCount struct {
+	count   int
+	err     error
+	reason  DropReason
+	handler func(interface{})
+
+	// pick returns the subscribers' handler for the event, if
+	// they can subscribe to it
+	pick func(Handlers) func(interface{})
+}
+
+// add resolves the Futures of the given items with the count's
+// error, counts them and raises the event for each of them. It
+// returns the number of items added. It must be called with the
+// component's mutex held.
+func (c *skipCount) add(skipped []*Envelope, whole bool, events *eventQueue) int {
+	c.count += len(skipped)
+	for _, e := range skipped {
+		e.resolve(c.err)
+		item := e.payload(whole)
+		events.audited(item, c.reason)
+		if c.handler != nil {
+			events.item(c.handler, item)
+		}
+		if c.pick != nil {
+			events.subscribed(c.pick, item)
+		}
+	}
+	return len(skipped)
+}
+
+// clone returns a count of zero with the same event handler.
+func (c *skipCount) clone() skipCount {
+	return skipCount{err: c.err, reason: c.reason, handler: c.handler, pick: c.pick}
+}
+
+// eventQueue delivers a component's events. By default each event
+// handler is called on its own goroutine. When sync is set, or for
+// the handlers of a subscription made with Handlers.Sync, events are
+// held until the component's mutex is released and then delivered
+// in order on the goroutine that raised them.
+type eventQueue struct {
+	sync    bool
+	pending []func()
+	onPanic func(interface{})
+	audit   func(AuditRecord)
+	subs    []*subscriber
+}
+
+// emit raises an event delivered by calling f. It must be called
+// with the component's mutex held.
+func (q *eventQueue) emit(f func()) {
+	q.send(false, f)
+}
+
+// send raises an event delivered by calling f, held for delivery in
+// order if sync or the queue's sync is set. It must be called with
+// the component's mutex held.
+func (q *eventQueue) send(sync bool, f func()) {
+	onPanic := panicked(q.onPanic, q.subs)
+	call := func() {
+		protect(onPanic, f)
+	}
+	if sync || q.sync {
+		q.pending = append(q.pending, call)
+	} else {
+		go call()
+	}
+}
+
+// item raises an event delivered by calling f with item.
+func (q *eventQueue) item(f func(interface{}), item interface{}) {
+	q.emit(func() {
+		f(item)
+	})
+}
+
+// take returns the events held for delivery and forgets them. It
+// must be called with the component's mutex held, which is then
+// released before the events are delivered.
+func (q *eventQueue) take() []func() {
+	pending := q.pending
+	q.pending = nil
+	return pending
+}
+
+// deliver calls the given event handlers in order.
+func deliver(pending []func()) {
+	for _, f := range pending {
+		f()
+	}
+}
+
+// protect calls the event handler call f, recovering a panic so
+// that the component keeps running. The panic is reported to
+// onPanic, or to the standard logger if onPanic is nil.
+func protect(onPanic func(interface{}), f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			if onPanic != nil {
+				onPanic(r)
+			} else {
+				log.Printf("push: event handler panic: %v", r)
+			}
+		}
+	}()
+	f()
+}
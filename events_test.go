@@ -0,0 +1,32 @@
+package push_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestSyncEvents(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.SyncEvents()
+	var events []string
+	q.OnFirstOverload(func(item interface{}) {
+		events = append(events, "first")
+	})
+	q.OnOverload(func(item interface{}) {
+		// handlers may call back into the queue
+		events = append(events, "overload "+strings.Repeat("+", q.Count()))
+	})
+
+	q.Put(1)
+	q.Put(2)
+	q.Put(3)
+
+	// delivered in order before Put returned
+	want := []string{"overload +", "first", "overload +"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %q, want %q", events, want)
+	}
+}
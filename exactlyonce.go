@@ -0,0 +1,114 @@
+package push
+
+import (
+	"errors"
+	"sync"
+)
+
+// ProcessedStore records which items have been processed, so that
+// with ExactlyOnce an item is processed once however many times it
+// is put, such as when a source redelivers it after a crash.
+type ProcessedStore interface {
+	// Process calls work unless key is already recorded as
+	// processed, and records key if work returns nil. Checking,
+	// working and recording must take effect together or not at
+	// all, such as in one database transaction, and nothing may be
+	// recorded if work returns an error or panics. An item with the
+	// same key may be in flight at the same time, in which case
+	// Process waits for it, or refuses one of them. Process reports
+	// whether it called work, and returns the error work returned,
+	// or its own.
+	Process(key interface{}, work func() error) (ran bool, err error)
+}
+
+// ErrNotProcessed is returned by work, passed to a ProcessedStore,
+// when the worker did not process the item, so that its key must
+// not be recorded.
+var ErrNotProcessed = errors.New("push: item not processed")
+
+// exactlyOnce runs items through a ProcessedStore, by the key that
+// key returns for them.
+type exactlyOnce struct {
+	key   func(QueueItem) interface{}
+	store ProcessedStore
+}
+
+func newExactlyOnce(key func(QueueItem) interface{}, store ProcessedStore) *exactlyOnce {
+	if key == nil {
+		panic("no key function set")
+	}
+	if store == nil {
+		panic("no store set")
+	}
+	return &exactlyOnce{key: key, store: store}
+}
+
+// run calls work for item through the store, and reports whether
+// the item was skipped as already processed and any error from the
+// store itself. work returns whether the item was processed.
+func (x *exactlyOnce) run(item interface{}, work func() bool) (skipped bool, err error) {
+	ran, err := x.store.Process(x.key(item), func() error {
+		if !work() {
+			return ErrNotProcessed
+		}
+		return nil
+	})
+	if err == ErrNotProcessed {
+		err = nil
+	}
+	return !ran && err == nil, err
+}
+
+// MemoryStore is a ProcessedStore that keeps the keys of processed
+// items in memory. It does not survive a restart, so it suits tests
+// and sources that redeliver within the life of the process.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	processed map[interface{}]bool
+	busy      map[interface{}]bool
+	idle      *sync.Cond
+}
+
+// compile-time check that interface is satisfied
+var _ ProcessedStore = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{processed: make(map[interface{}]bool), busy: make(map[interface{}]bool)}
+	s.idle = sync.NewCond(&s.mutex)
+	return s
+}
+
+// Process calls work unless key is recorded, waiting for any item
+// with the same key in flight to finish first.
+func (s *MemoryStore) Process(key interface{}, work func() error) (ran bool, err error) {
+	s.mutex.Lock()
+	for s.busy[key] {
+		s.idle.Wait()
+	}
+	if s.processed[key] {
+		s.mutex.Unlock()
+		return false, nil
+	}
+	s.busy[key] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.busy, key)
+		if err == nil && ran {
+			s.processed[key] = true
+		}
+		s.idle.Broadcast()
+		s.mutex.Unlock()
+	}()
+	return true, work()
+}
+
+// Processed reports whether key is recorded as processed.
+func (s *MemoryStore) Processed(key interface{}) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.processed[key]
+}
@@ -0,0 +1,52 @@
+package push_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestExactlyOnce(t *testing.T) {
+	var mutex sync.Mutex
+	var processed []string
+	failed := false
+	q := NewPushQueue(2, 10, nil)
+	q.ResultWorker(func(item interface{}) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		processed = append(processed, item.(string))
+		if item == "b" && !failed {
+			failed = true
+			return nil, errors.New("failed")
+		}
+		return item, nil
+	})
+	store := NewMemoryStore()
+	q.ExactlyOnce(func(item QueueItem) interface{} { return item }, store)
+	q.Start()
+
+	if err := q.PutFuture("a").Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.PutFuture("b").Wait(); err == nil {
+		t.Error("got no error for the failing item")
+	}
+	// redelivered, as after a crash
+	q.PutItems("a", "b", "a")
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(processed, []string{"a", "b", "b"}) {
+		t.Errorf("processed %v, want [a b b]", processed)
+	}
+	if n := q.SkippedProcessedCount(); n != 2 {
+		t.Errorf("skipped count %d, want 2", n)
+	}
+	if !store.Processed("a") || !store.Processed("b") {
+		t.Error("store does not record both items")
+	}
+}
@@ -0,0 +1,70 @@
+package push
+
+// fairShare interleaves dispatch across classes of items in
+// proportion to per-class weights, using smooth weighted
+// round-robin over the classes that have pending items.
+type fairShare struct {
+	classify func(QueueItem) interface{}
+	weights  map[interface{}]int
+	current  map[interface{}]int
+}
+
+func (f *fairShare) weight(class interface{}) int {
+	if w, ok := f.weights[class]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// clone returns a fair share with the same classes and weights and
+// no dispatches recorded. The weights set by FairDispatch are never
+// modified, so they are shared.
+func (f *fairShare) clone() *fairShare {
+	if f == nil {
+		return nil
+	}
+	return &fairShare{classify: f.classify, weights: f.weights}
+}
+
+// pick returns the index of the first pending item of the class
+// that is due next, together with the classes that have pending
+// items, for passing to commit once the item is dispatched.
+func (f *fairShare) pick(items []*Envelope, whole bool) (int, []interface{}) {
+	first := make(map[interface{}]int)
+	var classes []interface{}
+	for i, e := range items {
+		class := f.classify(e.payload(whole))
+		if _, ok := first[class]; !ok {
+			first[class] = i
+			classes = append(classes, class)
+		}
+	}
+
+	return first[f.next(classes)], classes
+}
+
+// next returns the class that is due next among the given classes,
+// of which there must be at least one.
+func (f *fairShare) next(classes []interface{}) interface{} {
+	best := classes[0]
+	for _, class := range classes[1:] {
+		if f.current[class]+f.weight(class) > f.current[best]+f.weight(best) {
+			best = class
+		}
+	}
+	return best
+}
+
+// commit records that an item of class chosen was dispatched
+// while the given classes had pending items.
+func (f *fairShare) commit(classes []interface{}, chosen interface{}) {
+	current := make(map[interface{}]int, len(classes))
+	total := 0
+	for _, class := range classes {
+		w := f.weight(class)
+		current[class] = f.current[class] + w
+		total += w
+	}
+	current[chosen] -= total
+	f.current = current
+}
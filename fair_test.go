@@ -0,0 +1,39 @@
+package push_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestFairDispatch(t *testing.T) {
+	var mutex sync.Mutex
+	var got []string
+	q := NewPushQueue(1, 100, func(item interface{}) {
+		mutex.Lock()
+		got = append(got, item.(string))
+		mutex.Unlock()
+	})
+	q.FairDispatch(func(item QueueItem) interface{} {
+		return item.(string)[:1]
+	}, map[interface{}]int{"a": 3})
+
+	// a flood of class b ahead of class a
+	for i := 0; i < 8; i++ {
+		q.Put("b")
+	}
+	for i := 0; i < 6; i++ {
+		q.Put("a")
+	}
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := "abaaabaabb"
+	if prefix := strings.Join(got, "")[:len(want)]; prefix != want {
+		t.Errorf("dispatch order %s, want prefix %s", prefix, want)
+	}
+}
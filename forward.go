@@ -0,0 +1,28 @@
+package push
+
+// Forwarder passes on an item that a component cannot take, such as
+// to a peer instance over a transport of the client's choosing, so
+// that load can spill over between instances. Forward returns an
+// error if the item could not be passed on.
+type Forwarder interface {
+	Forward(item interface{}) error
+}
+
+// ForwarderFunc adapts a function to a Forwarder.
+type ForwarderFunc func(item interface{}) error
+
+// Forward calls f(item).
+func (f ForwarderFunc) Forward(item interface{}) error {
+	return f(item)
+}
+
+// forward calls f for item, reporting a panic in f as a *PanicError.
+func forward(f Forwarder, item interface{}) error {
+	var err error
+	if perr := recovered(func() {
+		err = f.Forward(item)
+	}); perr != nil {
+		return perr
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDropped is the error reported by a Future whose item was
+// dropped on the floor because of an overload.
+var ErrDropped = errors.New("push: item dropped")
+
+// ErrRemoved is the error reported by a Future whose item was
+// removed from the component (for example by Empty) before it
+// was processed.
+var ErrRemoved = errors.New("push: item removed")
+
+// ErrThrottled is the error reported by a Future whose item was
+// rejected by the component's intake rate limit.
+var ErrThrottled = errors.New("push: item throttled")
+
+// ErrExpired is the error reported by a Future whose item's
+// deadline passed before it could be handed to a worker.
+var ErrExpired = errors.New("push: item expired")
+
+// ErrShed is the error reported by a Future whose item was shed
+// because the component was under pressure.
+var ErrShed = errors.New("push: item shed")
+
+// ErrDuplicate is the error reported by a Future whose item was
+// suppressed as a duplicate of an item put shortly before it.
+var ErrDuplicate = errors.New("push: item duplicate")
+
+// ErrForwarded is the error reported by a Future whose item the
+// component could not take and passed to its Forwarder instead.
+var ErrForwarded = errors.New("push: item forwarded")
+
+// ErrNoResult is the error reported by a Future whose item was
+// left without a result by a batch ResultWorker that returned fewer
+// results than it was handed items.
+var ErrNoResult = errors.New("push: no result for item")
+
+// PanicError is the error reported by a Future when the worker
+// panicked while processing its item.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("push: worker panic: %v", e.Value)
+}
+
+// Future reports the completion of the processing of a single
+// item. It is returned by PutFuture and PushFuture.
+type Future struct {
+	done   chan struct{}
+	once   sync.Once
+	value  interface{}
+	err    error
+	joined []*Future
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed when the item's worker
+// has finished, or when the item has been dropped or removed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the outcome of the item once Done is closed. It is
+// nil if the worker returned normally, a *PanicError if the worker
+// panicked, or ErrDropped, ErrThrottled, ErrRemoved or ErrExpired
+// if the item never reached a worker. Err returns nil while the
+// item is still pending.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Value returns the value the worker returned for the item once
+// Done is closed, if the worker was set with ResultWorker. It is
+// nil for other workers, and while the item is still pending.
+func (f *Future) Value() interface{} {
+	select {
+	case <-f.done:
+		return f.value
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the item is done and returns its outcome.
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// WaitContext blocks until the item is done or ctx is done. It
+// returns the item's outcome, or ctx.Err() if ctx is done first.
+func (f *Future) WaitContext(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *Future) resolve(err error) {
+	f.resolveValue(nil, err)
+}
+
+func (f *Future) resolveValue(value interface{}, err error) {
+	f.once.Do(func() {
+		f.value = value
+		f.err = err
+		close(f.done)
+		for _, j := range f.joined {
+			j.resolveValue(value, err)
+		}
+	})
+}
+
+// join makes other resolve along with f, for an item merged into
+// f's. It must be called before f can be resolved.
+func (f *Future) join(other *Future) {
+	f.joined = append(f.joined, other)
+}
+
+// resolve resolves the envelope's future, if it has one.
+func (e *Envelope) resolve(err error) {
+	if e.future != nil {
+		e.future.resolve(err)
+	}
+}
+
+// call runs work, which processes the given envelopes, and
+// resolves their futures with the outcome. If any of the
+// envelopes has a future, a panic in work is recovered and
+// reported through the futures rather than crashing the program.
+func call(work func(), envelopes ...*Envelope) {
+	if !watched(envelopes) {
+		work()
+		return
+	}
+
+	err := recovered(work)
+	for _, e := range envelopes {
+		e.resolve(err)
+	}
+}
+
+// watched reports whether any of the envelopes has a future.
+func watched(envelopes []*Envelope) bool {
+	for _, e := range envelopes {
+		if e.future != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// recovered runs work and returns a *PanicError if it panicked.
+func recovered(work func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r}
+		}
+	}()
+	work()
+	return nil
+}
@@ -0,0 +1,93 @@
+package push_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func waitFuture(t *testing.T, f *Future) error {
+	t.Helper()
+	select {
+	case <-f.Done():
+		return f.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for future")
+		return nil
+	}
+}
+
+func TestPutFuture(t *testing.T) {
+	processed := make(chan interface{}, 1)
+	q := NewPushQueue(1, 1, func(item interface{}) {
+		processed <- item
+	})
+
+	f := q.PutFuture("a")
+	dropped := q.PutFuture("b")
+	if err := waitFuture(t, dropped); err != ErrDropped {
+		t.Errorf("overloaded item: got %v, want ErrDropped", err)
+	}
+
+	q.Start()
+	if err := waitFuture(t, f); err != nil {
+		t.Errorf("processed item: got %v, want nil", err)
+	}
+	if item := <-processed; item != "a" {
+		t.Errorf("worker got %v, want a", item)
+	}
+}
+
+func TestPutFuturePanic(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {
+		panic("boom")
+	})
+	q.Start()
+	err := waitFuture(t, q.PutFuture(1))
+	if pe, ok := err.(*PanicError); !ok || pe.Value != "boom" {
+		t.Errorf("got %v, want PanicError(boom)", err)
+	}
+}
+
+func TestPushFutureRemoved(t *testing.T) {
+	s := NewPushStack(1, 2, func(item interface{}) {})
+	f := s.PushFuture(1)
+	s.Empty()
+	if err := waitFuture(t, f); err != ErrRemoved {
+		t.Errorf("got %v, want ErrRemoved", err)
+	}
+}
+
+func TestPutAndWait(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	q := NewPushQueue(1, 1, func(item interface{}) {
+		if item == "slow" {
+			close(started)
+			<-release
+		}
+	})
+	q.Start()
+	if err := q.PutAndWait(context.Background(), "fast"); err != nil {
+		t.Errorf("processed item: got %v, want nil", err)
+	}
+
+	// the slow item takes the worker, so the next one waits in the
+	// queue until ctx is done, and stays there
+	go q.PutAndWait(context.Background(), "slow")
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.PutAndWait(ctx, "waiting"); err != context.DeadlineExceeded {
+		t.Errorf("waiting item: got %v, want DeadlineExceeded", err)
+	}
+	if n := q.Count(); n != 1 {
+		t.Errorf("got %d items in the queue, want 1", n)
+	}
+	if err := q.PutAndWait(context.Background(), "dropped"); err != ErrDropped {
+		t.Errorf("overloaded item: got %v, want ErrDropped", err)
+	}
+	close(release)
+}
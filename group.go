@@ -0,0 +1,123 @@
+package push
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Lifecycle is the set of methods used to run a push component
+// from helpers such as RunInGroup. It is satisfied by PushQueue,
+// PushBatchQueue and PushStack.
+type Lifecycle interface {
+	Start()
+	Drain()
+	OnDrained(func())
+}
+
+// compile-time check that interface is satisfied
+var _ Lifecycle = (*PushQueue)(nil)
+var _ Lifecycle = (*PushBatchQueue)(nil)
+var _ Lifecycle = (*PushStack)(nil)
+
+// GoGroup is the method of errgroup.Group used by RunInGroup, so
+// that a *errgroup.Group from golang.org/x/sync/errgroup can be
+// passed without this package depending on it.
+type GoGroup interface {
+	Go(f func() error)
+}
+
+// RunInGroup runs c as a member of the group g, which is normally
+// an errgroup.Group created with errgroup.WithContext, with ctx
+// being the group's context. c is started immediately and drained
+// when ctx is done, which for such a group means on the first group
+// error or when the parent context is cancelled. The group function
+// returns once the drain is complete.
+//
+// Workers report errors with the returned fail function. The first
+// reported error also drains c, and is returned from the group
+// function as the group's error, so that the rest of the group is
+// cancelled in turn. Later errors are ignored.
+//
+// RunInGroup sets c's OnDrained handler.
+func RunInGroup(ctx context.Context, g GoGroup, c Lifecycle) (fail func(error)) {
+	var once sync.Once
+	var workerErr error
+	failed := make(chan struct{})
+	fail = func(err error) {
+		once.Do(func() {
+			workerErr = err
+			close(failed)
+		})
+	}
+
+	// c may be drained more than once, for example directly by a
+	// client as well as by the group
+	var drainOnce sync.Once
+	drained := make(chan struct{})
+	c.OnDrained(func() {
+		drainOnce.Do(func() {
+			close(drained)
+		})
+	})
+	c.Start()
+
+	g.Go(func() error {
+		select {
+		case <-ctx.Done():
+		case <-failed:
+		}
+		c.Drain()
+		<-drained
+
+		select {
+		case <-failed:
+			return workerErr
+		default:
+			return nil
+		}
+	})
+	return fail
+}
+
+// StageDrainError is returned by RollingDrain when a stage does not
+// finish draining in time.
+type StageDrainError struct {
+	// Stage is the name of the stage that did not drain.
+	Stage string
+
+	// Err is the *DrainTimeoutError describing what the stage had
+	// left.
+	Err error
+}
+
+func (e *StageDrainError) Error() string {
+	return fmt.Sprintf("push: stage %q: %v", e.Stage, e.Err)
+}
+
+// RollingDrain drains the named stages one at a time in the given
+// order with WaitForDrain, waiting up to perStageTimeout for each to
+// finish before draining the next, for an orderly shutdown of
+// stages that feed one another. Upstream stages should come first,
+// so that their workers can still hand items to the stages
+// downstream while they drain.
+//
+// If a stage does not finish draining in time, RollingDrain returns
+// a *StageDrainError for it and leaves the later stages running, as
+// they may still receive items from it. RollingDrain panics if
+// order names a stage that is not in stages.
+func RollingDrain(stages map[string]Lifecycle, order []string, perStageTimeout time.Duration) error {
+	for _, name := range order {
+		if _, ok := stages[name]; !ok {
+			panic(fmt.Sprintf("no stage named %q", name))
+		}
+	}
+
+	for _, name := range order {
+		if err := WaitForDrain(stages[name], perStageTimeout); err != nil {
+			return &StageDrainError{Stage: name, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+// group is a minimal stand-in for errgroup.Group.
+type group struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+	cancel func()
+}
+
+func (g *group) Go(f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+func (g *group) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
+
+func TestRunInGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &group{cancel: cancel}
+
+	boom := errors.New("boom")
+	var fail func(error)
+	var mutex sync.Mutex
+	processed := 0
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		processed++
+		mutex.Unlock()
+		if item == 3 {
+			fail(boom)
+		}
+	})
+	fail = RunInGroup(ctx, g, q)
+	for i := 0; i < 5; i++ {
+		q.Put(i)
+	}
+
+	if err := g.Wait(); err != boom {
+		t.Errorf("group error %v, want boom", err)
+	}
+	if ctx.Err() == nil {
+		t.Error("group context not cancelled")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if processed != 5 {
+		t.Errorf("processed %d items, want all 5 drained", processed)
+	}
+}
+
+func TestRunInGroupDrainedTwice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &group{cancel: cancel}
+
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	RunInGroup(ctx, g, q)
+	if err := WaitForDrain(q, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	if err := g.Wait(); err != nil {
+		t.Errorf("group error %v, want nil", err)
+	}
+	// the second drained event is raised on its own goroutine
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestRollingDrain(t *testing.T) {
+	var mutex sync.Mutex
+	processed := 0
+	down := NewPushQueue(2, 100, func(item interface{}) {
+		mutex.Lock()
+		processed++
+		mutex.Unlock()
+	})
+	up := NewPushQueue(2, 100, func(item interface{}) {
+		time.Sleep(time.Millisecond)
+		down.Put(item)
+	})
+	down.Start()
+	up.Start()
+	for i := 0; i < 50; i++ {
+		up.Put(i)
+	}
+
+	stages := map[string]Lifecycle{"up": up, "down": down}
+	if err := RollingDrain(stages, []string{"up", "down"}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if processed != 50 {
+		t.Errorf("got %d items through both stages, want 50", processed)
+	}
+}
+
+func TestRollingDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	stuck := NewPushQueue(1, 10, func(item interface{}) { <-release })
+	next := NewPushQueue(1, 10, func(item interface{}) {})
+	stuck.Start()
+	next.Start()
+	stuck.Put(1)
+
+	stages := map[string]Lifecycle{"stuck": stuck, "next": next}
+	err := RollingDrain(stages, []string{"stuck", "next"}, 20*time.Millisecond)
+	if e, ok := err.(*StageDrainError); !ok || e.Stage != "stuck" {
+		t.Errorf("got error %v, want a timeout for stage stuck", err)
+	}
+	if !next.IsStarted() {
+		t.Error("stage after the timed out stage was drained")
+	}
+}
+
+func TestFollowLeadership(t *testing.T) {
+	processed := make(chan interface{}, 10)
+	q := NewPushQueue(1, 1, func(item interface{}) { processed <- item })
+	q.Start()
+	leading := make(chan bool)
+	promoted := make(chan struct{}, 1)
+	demoted := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		FollowLeadership(context.Background(), leading, LeadershipHooks{
+			Promoted: func() { promoted <- struct{}{} },
+			Demoted:  func() { demoted <- struct{}{} },
+		}, q)
+		close(done)
+	}()
+	// a report of no change is ignored, once following has begun
+	leading <- false
+
+	// a follower keeps what is put
+	q.Put(1)
+	q.Put("overload")
+	select {
+	case <-processed:
+		t.Fatal("follower processed an item")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	leading <- true
+	<-promoted
+	select {
+	case item := <-processed:
+		if item != 1 {
+			t.Errorf("processed %v, want 1", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader did not process the item put while following")
+	}
+	if n := q.OverloadCount(); n != 1 {
+		t.Errorf("overload count %d after promotion, want 1", n)
+	}
+
+	leading <- false
+	<-demoted
+	if !q.IsStarted() {
+		t.Error("queue stopped by demotion")
+	}
+	q.Put(2)
+	select {
+	case <-processed:
+		t.Fatal("demoted follower processed an item")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := q.Count(); n != 1 {
+		t.Errorf("follower kept %d items, want 1", n)
+	}
+	close(leading)
+	<-done
+}
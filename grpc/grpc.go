@@ -0,0 +1,117 @@
+// Package grpc is a reference adapter between gRPC streams, by way
+// of google.golang.org/grpc, and the push components.
+//
+// A Source receives the messages of a stream, such as the client
+// side of a server-streaming or bidirectional call, so that it can
+// feed a PushQueue with push.Consume. While the queue is full,
+// Consume stops receiving, so messages wait in gRPC's flow control
+// window and the sender is held back once the window is full,
+// rather than messages piling up in memory.
+//
+// gRPC has no acknowledgements of its own. A message whose item is
+// dropped or whose worker panics is counted by Nacked, and passed to
+// the OnNack handler, which may for example send a reply on a
+// bidirectional stream asking for it again.
+package grpc
+
+import (
+	"context"
+	"sync"
+
+	push "github.com/blocktop/go-push-components"
+	"google.golang.org/grpc"
+)
+
+// Stream is the receiving side of a gRPC stream.
+type Stream interface {
+	RecvMsg(m interface{}) error
+}
+
+// compile-time check that the streams of both sides are Streams
+var _ Stream = grpc.ClientStream(nil)
+var _ Stream = grpc.ServerStream(nil)
+
+// Source is a push.Source that receives messages from a gRPC
+// stream. The values it delivers are the messages made by newMsg.
+type Source struct {
+	stream Stream
+	newMsg func() interface{}
+	mutex  sync.Mutex
+	nacked int
+	onNack func(interface{})
+}
+
+// compile-time check that interface is satisfied
+var _ push.Source = (*Source)(nil)
+
+// NewSource creates a Source receiving from stream into the
+// messages that newMsg returns, such as new(pb.Event).
+func NewSource(stream Stream, newMsg func() interface{}) *Source {
+	if stream == nil {
+		panic("stream is required")
+	}
+	if newMsg == nil {
+		panic("newMsg is required")
+	}
+	return &Source{stream: stream, newMsg: newMsg}
+}
+
+// OnNack sets a function to be called with each message negatively
+// acknowledged, which was received but never processed.
+func (s *Source) OnNack(f func(interface{})) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.onNack = f
+}
+
+// Nacked returns the number of messages negatively acknowledged.
+func (s *Source) Nacked() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.nacked
+}
+
+// Receive receives the next message from the stream. It returns
+// io.EOF once the stream has ended normally. A receive in progress
+// is ended by the stream's own context rather than by ctx, so the
+// stream's context should be done no later than ctx.
+func (s *Source) Receive(ctx context.Context) (push.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m := s.newMsg()
+	if err := s.stream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return &message{source: s, msg: m}, nil
+}
+
+func (s *Source) nack(msg interface{}) {
+	s.mutex.Lock()
+	s.nacked++
+	f := s.onNack
+	s.mutex.Unlock()
+
+	if f != nil {
+		f(msg)
+	}
+}
+
+type message struct {
+	source *Source
+	msg    interface{}
+}
+
+func (m *message) Value() interface{} {
+	return m.msg
+}
+
+// Ack does nothing, as gRPC has no acknowledgements.
+func (m *message) Ack() {}
+
+// Nack counts the message and passes it to the OnNack handler.
+func (m *message) Nack() {
+	m.source.nack(m.msg)
+}
@@ -0,0 +1,72 @@
+package grpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+)
+
+// fakeStream receives strings into *string messages.
+type fakeStream struct {
+	msgs chan string
+	ctx  context.Context
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	select {
+	case msg := <-s.msgs:
+		*m.(*string) = msg
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func TestSourceNacksUnprocessed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &fakeStream{msgs: make(chan string, 2), ctx: ctx}
+	stream.msgs <- "good"
+	stream.msgs <- "bad"
+	src := NewSource(stream, func() interface{} { return new(string) })
+	nacks := make(chan string, 2)
+	src.OnNack(func(m interface{}) { nacks <- *m.(*string) })
+
+	var mutex sync.Mutex
+	var processed []string
+	done := make(chan struct{}, 2)
+	q := push.NewPushQueue(1, 2, func(item interface{}) {
+		defer func() { done <- struct{}{} }()
+		msg := *item.(*string)
+		if msg == "bad" {
+			panic("bad message")
+		}
+		mutex.Lock()
+		processed = append(processed, msg)
+		mutex.Unlock()
+	})
+	q.Start()
+	go push.Consume(ctx, src, q)
+
+	select {
+	case got := <-nacks:
+		if got != "bad" {
+			t.Errorf("got nack for %q, want bad", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unprocessed message not nacked")
+	}
+	<-done
+	<-done
+	if n := src.Nacked(); n != 1 {
+		t.Errorf("got %d nacked, want 1", n)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(processed) != 1 || processed[0] != "good" {
+		t.Errorf("processed %v, want [good]", processed)
+	}
+}
@@ -0,0 +1,55 @@
+package push
+
+import (
+	"net/http"
+)
+
+// EnqueueHandler returns an http.Handler that decodes each request
+// with decode and Puts the result into q. It responds with:
+//
+//	202 Accepted             q did not refuse the item at once
+//	400 Bad Request          decode returned an error
+//	429 Too Many Requests    q is full, or the item was throttled
+//	503 Service Unavailable  q is not started, is draining, or shed
+//	                         the item under pressure
+//
+// The response is decided only by whether q refuses the item
+// synchronously, as reported by its Future right after the Put, so
+// an item dropped by a racing Put that filled q, or by a racing
+// Drain, is refused too. 202 means only that the item was accepted:
+// it is not waited for, and whatever befalls it afterwards is not
+// reflected. In particular an overload passed to the Forwarder set
+// with ForwardOverloads is accepted, even if forwarding it fails and
+// it is dropped after the response has been sent.
+func EnqueueHandler(q PushQueuePutFuture, decode func(*http.Request) (interface{}, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		item, err := decode(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !q.IsStarted() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if q.Count() >= q.Depth() {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		// Err does not wait, so only a synchronous refusal is seen
+		switch q.PutFuture(item).Err() {
+		case ErrDropped:
+			if !q.IsStarted() {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		case ErrThrottled:
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		case ErrShed:
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package push_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestEnqueueHandler(t *testing.T) {
+	block := make(chan bool)
+	q := NewPushQueue(1, 1, func(item interface{}) {
+		<-block
+	})
+	defer close(block)
+
+	h := EnqueueHandler(q, func(r *http.Request) (interface{}, error) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) == 0 {
+			return nil, errors.New("empty body")
+		}
+		return string(body), nil
+	})
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post("a"); code != http.StatusServiceUnavailable {
+		t.Errorf("before Start: got %d, want 503", code)
+	}
+	q.Start()
+	if code := post(""); code != http.StatusBadRequest {
+		t.Errorf("bad body: got %d, want 400", code)
+	}
+	if code := post("a"); code != http.StatusAccepted {
+		t.Errorf("first item: got %d, want 202", code)
+	}
+	// wait for the worker to take the first item
+	for q.Count() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if code := post("b"); code != http.StatusAccepted {
+		t.Errorf("second item: got %d, want 202", code)
+	}
+	if code := post("c"); code != http.StatusTooManyRequests {
+		t.Errorf("full queue: got %d, want 429", code)
+	}
+}
+
+func TestEnqueueHandlerThrottled(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.IntakeRate(1, time.Hour)
+	q.Start()
+	h := EnqueueHandler(q, func(r *http.Request) (interface{}, error) {
+		return "item", nil
+	})
+	post := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		return w.Code
+	}
+
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("first item: got %d, want 202", code)
+	}
+	// the queue has room, but the Put is refused
+	if code := post(); code != http.StatusTooManyRequests {
+		t.Errorf("throttled item: got %d, want 429", code)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	s := NewPushStack(1, 5, func(item interface{}) {})
+	for _, item := range []string{"a", "b", "c", "d", "e", "overload"} {
+		s.Push(item)
+	}
+	h := AdminHandler(map[string]Administered{"queue": q, "stack": s})
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := do("GET", "/")
+	var all []AdminStats
+	if err := json.NewDecoder(w.Body).Decode(&all); err != nil {
+		t.Fatal(err)
+	}
+	want := []AdminStats{
+		{Name: "queue", State: "stopped", Capacity: 10},
+		{Name: "stack", State: "stopped", Pending: 5, Capacity: 5, Overloads: 1}}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("got stats %+v, want %+v", all, want)
+	}
+
+	if code := do("POST", "/stack/empty").Code; code != http.StatusNoContent {
+		t.Errorf("empty: got %d, want 204", code)
+	}
+	if code := do("POST", "/queue/resume").Code; code != http.StatusNoContent {
+		t.Errorf("resume: got %d, want 204", code)
+	}
+	var one AdminStats
+	if err := json.NewDecoder(do("GET", "/stack").Body).Decode(&one); err != nil {
+		t.Fatal(err)
+	}
+	if one.Pending != 0 {
+		t.Errorf("got %d pending after empty, want 0", one.Pending)
+	}
+	if !q.IsStarted() {
+		t.Error("queue not started after resume")
+	}
+	if code := do("POST", "/queue/pause").Code; code != http.StatusNoContent || q.IsStarted() {
+		t.Errorf("pause: got %d, started %v", code, q.IsStarted())
+	}
+	if code := do("GET", "/queue/drain").Code; code != http.StatusMethodNotAllowed {
+		t.Errorf("GET action: got %d, want 405", code)
+	}
+	if code := do("POST", "/queue/restart").Code; code != http.StatusNotFound {
+		t.Errorf("unknown action: got %d, want 404", code)
+	}
+	if code := do("GET", "/missing").Code; code != http.StatusNotFound {
+		t.Errorf("unknown component: got %d, want 404", code)
+	}
+}
@@ -0,0 +1,53 @@
+package push
+
+import (
+	"fmt"
+)
+
+// InvariantChecker is implemented by the components to verify that
+// their internal accounting is consistent. It is meant for tests,
+// such as the property harness in the pushtest package.
+type InvariantChecker interface {
+	CheckInvariants() error
+}
+
+// compile-time check that interface is satisfied
+var _ InvariantChecker = (*PushQueue)(nil)
+var _ InvariantChecker = (*PushBatchQueue)(nil)
+var _ InvariantChecker = (*PushStack)(nil)
+
+// totals counts, over the lifetime of a component, what has become
+// of the items put into it. Unlike the overload, throttled and
+// expired counts, the totals are never reset.
+type totals struct {
+	put       int
+	processed int
+	inFlight  int
+	dropped   int
+	removed   int
+	throttled int
+	expired   int
+	coalesced int
+	forwarded int
+}
+
+// check returns an error describing the first invariant that does
+// not hold for a component with these totals and the given state.
+func (t totals) check(pending, capacity, available, concurrency, inFlightCost int) error {
+	accounted := t.processed + t.inFlight + pending + t.dropped + t.removed + t.throttled + t.expired + t.coalesced + t.forwarded
+	busy := concurrency - available
+	switch {
+	case t.put != accounted:
+		return fmt.Errorf("push: invariant violated: %d items put, but %d processed + %d in flight + %d pending + %d dropped + %d removed + %d throttled + %d expired + %d coalesced + %d forwarded = %d",
+			t.put, t.processed, t.inFlight, pending, t.dropped, t.removed, t.throttled, t.expired, t.coalesced, t.forwarded, accounted)
+	case available < 0 || available > concurrency:
+		return fmt.Errorf("push: invariant violated: %d available workers with concurrency %d", available, concurrency)
+	case pending > capacity:
+		return fmt.Errorf("push: invariant violated: %d items pending with capacity %d", pending, capacity)
+	case busy > t.inFlight || (busy == 0) != (t.inFlight == 0):
+		return fmt.Errorf("push: invariant violated: %d workers busy with %d items in flight", busy, t.inFlight)
+	case inFlightCost < 0:
+		return fmt.Errorf("push: invariant violated: in-flight cost %d is negative", inFlightCost)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package push
+
+import (
+	"sort"
+)
+
+// QueueItem is an item held by a push component. It is an alias
+// for interface{}, so any value may be put into a component.
+type QueueItem = interface{}
+
+// removeWhere removes the envelopes whose payload matches pred
+// from items, preserving the order of the rest. The remaining
+// envelopes are compacted in place.
+func removeWhere(items []*Envelope, whole bool, pred func(QueueItem) bool) (kept, removed []*Envelope) {
+	kept = items[:0]
+	for _, e := range items {
+		if pred(e.payload(whole)) {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	// release references held beyond the new length
+	for i := len(kept); i < len(items); i++ {
+		items[i] = nil
+	}
+	return kept, removed
+}
+
+// findKey returns the first envelope whose payload has the given
+// key, or nil if there is none.
+func findKey(items []*Envelope, whole bool, keyFunc func(QueueItem) interface{}, key interface{}) *Envelope {
+	if keyFunc == nil {
+		panic("no key function set")
+	}
+	for _, e := range items {
+		if keyFunc(e.payload(whole)) == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// insertByPriority inserts e after every item of equal or higher
+// priority. Items inserted this way are ordered by descending
+// priority, and oldest first within a priority.
+func insertByPriority(items []*Envelope, e *Envelope) []*Envelope {
+	i := len(items)
+	for i > 0 && items[i-1].Priority < e.Priority {
+		i--
+	}
+	items = append(items, nil)
+	copy(items[i+1:], items[i:])
+	items[i] = e
+	return items
+}
+
+// sortItems reorders items so that those of equal priority are in
+// the order given by less, keeping the priority bands of
+// insertByPriority.
+func sortItems(items []*Envelope, less func(a, b QueueItem) bool, envelopes bool) {
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return less(a.payload(envelopes), b.payload(envelopes))
+	})
+}
+
+// earliestDeadline returns the index of the item with the earliest
+// deadline in the priority band of items[i], preferring the earlier
+// of equals, among items ordered by insertByPriority. Items without
+// a deadline come after those with one.
+func earliestDeadline(items []*Envelope, i int) int {
+	best := i
+	for j := i + 1; j < len(items) && items[j].Priority == items[i].Priority; j++ {
+		d := items[j].Deadline
+		if !d.IsZero() && (items[best].Deadline.IsZero() || d.Before(items[best].Deadline)) {
+			best = j
+		}
+	}
+	return best
+}
+
+// oldestLowest returns the index of the oldest item in the lowest
+// priority band of items ordered by insertByPriority.
+func oldestLowest(items []*Envelope) int {
+	last := len(items) - 1
+	i := last
+	for i > 0 && items[i-1].Priority == items[last].Priority {
+		i--
+	}
+	return i
+}
+
+// removeIndex removes the item at index i, preserving the order
+// of the rest.
+func removeIndex(items []*Envelope, i int) []*Envelope {
+	if i == 0 {
+		return items[1:]
+	}
+	return append(items[:i], items[i+1:]...)
+}
@@ -0,0 +1,286 @@
+// Package kafka is a reference adapter between Kafka, by way of
+// github.com/segmentio/kafka-go, and the push components.
+//
+// A Source wraps a consumer group Reader so that it can feed a
+// PushQueue with push.Consume. Offsets are committed only once the
+// worker has finished with a message, and only up to the first
+// message of each partition that is still outstanding, so a crash
+// never loses a message that was fetched but not processed. After
+// a message is negatively acknowledged, nothing more is tracked for
+// its partition until the partition is rewound to it, as no later
+// offset can be committed before then.
+//
+// A Sink wraps a Writer so that workers can produce to Kafka with
+// push.SinkWorker.
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/segmentio/kafka-go"
+)
+
+// Source is a push.Source that fetches messages from a Kafka
+// consumer group. The values it delivers are kafka.Message.
+type Source struct {
+	reader        *kafka.Reader
+	ctx           context.Context
+	cancel        func()
+	mutex         sync.Mutex
+	partitions    map[partition]*pending
+	onCommitError func(error)
+	commitTimeout time.Duration
+
+	// commitMutex orders commits, which are made without mutex
+	// held so that a slow commit does not hold up Receive
+	commitMutex sync.Mutex
+	committed   map[partition]int64
+}
+
+type partition struct {
+	topic string
+	id    int
+}
+
+// pending tracks the fetched but uncommitted messages of a
+// partition, in offset order. Once a message is nacked, the
+// messages after it are no longer tracked.
+type pending struct {
+	msgs     []kafka.Message
+	acked    map[int64]bool
+	nacked   bool
+	nackedAt int64
+}
+
+// DefaultCommitTimeout is how long a Source waits for an offset
+// commit unless set otherwise with CommitTimeout.
+const DefaultCommitTimeout = 10 * time.Second
+
+// compile-time check that interfaces are satisfied
+var _ push.Source = (*Source)(nil)
+var _ push.Sink = (*Sink)(nil)
+
+// NewSource creates a Source reading from r, which must have been
+// configured with a GroupID so that offsets can be committed.
+func NewSource(r *kafka.Reader) *Source {
+	if r == nil {
+		panic("reader is required")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Source{
+		reader:        r,
+		ctx:           ctx,
+		cancel:        cancel,
+		partitions:    make(map[partition]*pending),
+		commitTimeout: DefaultCommitTimeout,
+		committed:     make(map[partition]int64)}
+}
+
+// OnCommitError sets a function to be called when committing
+// offsets fails. The offsets are committed again with the next
+// acknowledged message of the partition.
+func (s *Source) OnCommitError(f func(error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.onCommitError = f
+}
+
+// CommitTimeout sets how long to wait for an offset commit before
+// it fails. A commit that fails is reported to the OnCommitError
+// handler.
+func (s *Source) CommitTimeout(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.commitTimeout = d
+}
+
+// Receive fetches the next message from the reader.
+func (s *Source) Receive(ctx context.Context) (push.Message, error) {
+	m, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := partition{m.Topic, m.Partition}
+	p := s.partitions[key]
+	if p == nil || p.rewound(m.Offset) {
+		// acks of messages fetched before a rewind are ignored, as
+		// those messages are fetched again
+		p = &pending{acked: make(map[int64]bool)}
+		s.partitions[key] = p
+	}
+	if !p.nacked {
+		p.msgs = append(p.msgs, m)
+	}
+
+	return &message{source: s, pending: p, msg: m}, nil
+}
+
+// rewound reports whether offset is at or before a message already
+// fetched, or the nacked message, which happens when the partition
+// is reassigned.
+func (p *pending) rewound(offset int64) bool {
+	if len(p.msgs) > 0 && offset <= p.msgs[len(p.msgs)-1].Offset {
+		return true
+	}
+	return p.nacked && offset <= p.nackedAt
+}
+
+// nack stops tracking the messages from m onwards.
+func (s *Source) nack(p *pending, m kafka.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.partitions[partition{m.Topic, m.Partition}] != p || p.nacked {
+		return
+	}
+	p.nacked = true
+	p.nackedAt = m.Offset
+	n := 0
+	for n < len(p.msgs) && p.msgs[n].Offset < m.Offset {
+		n++
+	}
+	for _, c := range p.msgs[n:] {
+		delete(p.acked, c.Offset)
+	}
+	p.msgs = p.msgs[:n]
+}
+
+// ack marks m as processed and commits the partition's offset up to
+// the last message before the first one still outstanding.
+func (s *Source) ack(p *pending, m kafka.Message) {
+	key := partition{m.Topic, m.Partition}
+	s.mutex.Lock()
+	if s.partitions[key] != p || (p.nacked && m.Offset >= p.nackedAt) {
+		// fetched before a rewind, or after a nacked message
+		s.mutex.Unlock()
+		return
+	}
+	p.acked[m.Offset] = true
+
+	n := 0
+	for n < len(p.msgs) && p.acked[p.msgs[n].Offset] {
+		n++
+	}
+	if n == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	last := p.msgs[n-1]
+	for _, c := range p.msgs[:n] {
+		delete(p.acked, c.Offset)
+	}
+	p.msgs = p.msgs[n:]
+	timeout := s.commitTimeout
+	onCommitError := s.onCommitError
+	s.mutex.Unlock()
+
+	// a failed commit is covered by the next one for the partition,
+	// as committing an offset commits all those before it
+	s.commitMutex.Lock()
+	defer s.commitMutex.Unlock()
+	if committed, ok := s.committed[key]; ok && committed >= last.Offset {
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	if err := s.reader.CommitMessages(ctx, last); err != nil {
+		if onCommitError != nil {
+			go onCommitError(err)
+		}
+		return
+	}
+	s.committed[key] = last.Offset
+}
+
+// Close cancels any commit in progress and closes the underlying
+// reader.
+func (s *Source) Close() error {
+	s.cancel()
+	return s.reader.Close()
+}
+
+type message struct {
+	source  *Source
+	pending *pending
+	msg     kafka.Message
+}
+
+func (m *message) Value() interface{} {
+	return m.msg
+}
+
+func (m *message) Ack() {
+	m.source.ack(m.pending, m.msg)
+}
+
+// Nack leaves the message uncommitted. Kafka cannot skip a single
+// offset, so the partition's offset is not committed past it and
+// the message, along with any later ones, is redelivered when the
+// partition is next assigned.
+func (m *message) Nack() {
+	m.source.nack(m.pending, m.msg)
+}
+
+// Worker adapts a handler of Kafka messages to the worker function
+// of a push component fed by a Source.
+func Worker(handler func(kafka.Message)) func(interface{}) {
+	return func(item interface{}) {
+		handler(item.(kafka.Message))
+	}
+}
+
+// ErrUnencodable is returned by Sink.Send for an item that is
+// neither a kafka.Message nor a []byte and no encoder is set.
+var ErrUnencodable = errors.New("kafka: item cannot be encoded as a message")
+
+// Sink is a push.Sink that writes items to Kafka.
+type Sink struct {
+	writer *kafka.Writer
+	encode func(interface{}) (kafka.Message, error)
+}
+
+// NewSink creates a Sink writing with w.
+func NewSink(w *kafka.Writer) *Sink {
+	if w == nil {
+		panic("writer is required")
+	}
+	return &Sink{writer: w}
+}
+
+// Encoder sets the function used to turn items into messages. Items
+// that are already a kafka.Message are written as they are, and
+// without an encoder a []byte item is written as the message value.
+func (s *Sink) Encoder(f func(interface{}) (kafka.Message, error)) {
+	s.encode = f
+}
+
+// Send writes item to Kafka.
+func (s *Sink) Send(ctx context.Context, item interface{}) error {
+	var m kafka.Message
+	switch v := item.(type) {
+	case kafka.Message:
+		m = v
+	default:
+		if s.encode != nil {
+			var err error
+			if m, err = s.encode(item); err != nil {
+				return err
+			}
+		} else if b, ok := item.([]byte); ok {
+			m = kafka.Message{Value: b}
+		} else {
+			return ErrUnencodable
+		}
+	}
+	return s.writer.WriteMessages(ctx, m)
+}
@@ -0,0 +1,79 @@
+package push
+
+import (
+	"context"
+)
+
+// Runner is the set of methods used by FollowLeadership to run a
+// push component. It is satisfied by PushQueue, PushBatchQueue and
+// PushStack.
+type Runner interface {
+	Start()
+	Stop()
+	SuspendIntake()
+	ResumeIntake()
+}
+
+// compile-time check that interface is satisfied
+var _ Runner = (*PushQueue)(nil)
+var _ Runner = (*PushBatchQueue)(nil)
+var _ Runner = (*PushStack)(nil)
+
+// LeadershipHooks are called by FollowLeadership when leadership
+// changes. Either may be nil.
+type LeadershipHooks struct {
+	// Promoted is called once the components have resumed on
+	// becoming the leader.
+	Promoted func()
+
+	// Demoted is called once the components have been suspended on
+	// losing leadership.
+	Demoted func()
+}
+
+// FollowLeadership runs the components only while this instance is
+// the leader, as reported by leading, which receives true on
+// promotion and false on demotion, such as from a leader election
+// client. The components should be started; FollowLeadership
+// suspends their intake at once, as this instance begins as a
+// follower, resumes it on promotion and suspends it again on
+// demotion. A follower's components keep their pending items and
+// go on accepting Puts, to be processed once promoted, and their
+// counts are kept across changes of leadership.
+//
+// A report that does not change leadership is ignored.
+// FollowLeadership returns when ctx is done or leading is closed,
+// leaving the components as they are.
+func FollowLeadership(ctx context.Context, leading <-chan bool, hooks LeadershipHooks, components ...Runner) {
+	for _, c := range components {
+		c.SuspendIntake()
+	}
+	leader := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case l, ok := <-leading:
+			if !ok {
+				return
+			}
+			if l == leader {
+				continue
+			}
+			leader = l
+			for _, c := range components {
+				if leader {
+					c.ResumeIntake()
+				} else {
+					c.SuspendIntake()
+				}
+			}
+			switch {
+			case leader && hooks.Promoted != nil:
+				hooks.Promoted()
+			case !leader && hooks.Demoted != nil:
+				hooks.Demoted()
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package push
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MapError is returned by MapReduce when the map function failed
+// for some of the inputs.
+type MapError struct {
+	// Errors holds the error returned for each failed input, by the
+	// input's index.
+	Errors map[int]error
+}
+
+func (e *MapError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return fmt.Sprintf("push: map failed for %d inputs, first at %d: %v",
+		len(indexes), indexes[0], e.Errors[indexes[0]])
+}
+
+// MapReduce runs mapFn for each of the inputs on a PushQueue with
+// the given concurrency, and once every input has been mapped,
+// returns what reduceFn makes of the values, in the order of the
+// inputs. Inputs for which mapFn fails or panics are left out of
+// the values, and reported by a *MapError. MapReduce panics if
+// mapFn or reduceFn is nil or concurrency is not positive.
+func MapReduce(inputs []interface{}, mapFn func(input interface{}) (interface{}, error), reduceFn func(values []interface{}) interface{}, concurrency int) (interface{}, error) {
+	if reduceFn == nil {
+		panic("no reduce function set")
+	}
+	depth := len(inputs)
+	if depth == 0 {
+		depth = 1
+	}
+	q := NewPushQueue(concurrency, depth, nil)
+	q.ResultWorker(mapFn)
+	q.Start()
+	defer q.Drain()
+
+	futures := make([]*Future, len(inputs))
+	for i, input := range inputs {
+		futures[i] = q.PutFuture(input)
+	}
+
+	values := make([]interface{}, 0, len(inputs))
+	errs := make(map[int]error)
+	for i, f := range futures {
+		if err := f.Wait(); err != nil {
+			errs[i] = err
+			continue
+		}
+		values = append(values, f.Value())
+	}
+
+	result := reduceFn(values)
+	if len(errs) > 0 {
+		return result, &MapError{Errors: errs}
+	}
+	return result, nil
+}
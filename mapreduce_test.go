@@ -0,0 +1,70 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestMapReduce(t *testing.T) {
+	inputs := []interface{}{1, 2, 3, -4, 5}
+	square := func(input interface{}) (interface{}, error) {
+		n := input.(int)
+		if n < 0 {
+			return nil, errors.New("negative")
+		}
+		return n * n, nil
+	}
+	sum := func(values []interface{}) interface{} {
+		total := 0
+		for _, v := range values {
+			total += v.(int)
+		}
+		return total
+	}
+
+	result, err := MapReduce(inputs, square, sum, 3)
+	if result != 1+4+9+25 {
+		t.Errorf("got %v, want %d", result, 1+4+9+25)
+	}
+	merr, ok := err.(*MapError)
+	if !ok || len(merr.Errors) != 1 || merr.Errors[3] == nil {
+		t.Errorf("got error %v, want a *MapError for input 3", err)
+	}
+
+	result, err = MapReduce(nil, square, sum, 3)
+	if result != 0 || err != nil {
+		t.Errorf("got %v and %v for no inputs", result, err)
+	}
+}
+
+func TestScatterGather(t *testing.T) {
+	release := make(chan struct{})
+	q := NewPushQueue(2, 10, nil)
+	q.ResultWorker(func(item interface{}) (interface{}, error) {
+		if item == "slow" {
+			<-release
+		}
+		return item.(string) + "!", nil
+	})
+	q.Start()
+	defer close(release)
+
+	results, err := ScatterGather(context.Background(), q, []interface{}{"a", "b"})
+	if err != nil || len(results) != 2 || results[0].Value != "a!" || results[1].Value != "b!" {
+		t.Errorf("got %+v and %v", results, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results, err = ScatterGather(ctx, q, []interface{}{"c", "slow"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want the context's", err)
+	}
+	if len(results) != 2 || results[0].Value != "c!" || results[1].Err != context.DeadlineExceeded {
+		t.Errorf("got %+v", results)
+	}
+}
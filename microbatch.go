@@ -0,0 +1,45 @@
+package push
+
+// microBatch hands items to a batch worker several at a time while
+// the count of items in a PushQueue is at or above a threshold, and
+// one at a time otherwise. Its crossed method is called by the
+// threshold with the component's mutex held.
+type microBatch struct {
+	worker func(items []interface{})
+	size   int
+	level  *threshold
+	on     bool
+}
+
+func newMicroBatch(worker func(items []interface{}), size int, level, hysteresis float64) *microBatch {
+	if worker == nil {
+		panic("no worker set")
+	}
+	if size < 2 {
+		panic("batch size must be greater than 1")
+	}
+	m := &microBatch{worker: worker, size: size}
+	m.level = newThreshold(level, hysteresis, nil)
+	m.level.crossed = m.crossed
+	return m
+}
+
+// clone returns a microBatch with the same worker, size and
+// threshold that is not batching.
+func (m *microBatch) clone() *microBatch {
+	if m == nil {
+		return nil
+	}
+	return newMicroBatch(m.worker, m.size, m.level.level, m.level.hysteresis)
+}
+
+// crossed starts batching when the count rises to the threshold and
+// stops it when the count falls back.
+func (m *microBatch) crossed(e ThresholdEvent) {
+	m.on = e.Above
+}
+
+// batching reports whether items are to be handed over in batches.
+func (m *microBatch) batching() bool {
+	return m != nil && m.on
+}
@@ -0,0 +1,60 @@
+package push_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestMicroBatch(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var got []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		if item == "blocking" {
+			<-release
+		}
+		mutex.Lock()
+		got = append(got, item)
+		mutex.Unlock()
+	})
+	q.MicroBatch(func(items []interface{}) {
+		mutex.Lock()
+		got = append(got, items)
+		mutex.Unlock()
+	}, 4, 0.5, 0.2)
+	q.Start()
+
+	q.Put("blocking")
+	for q.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if q.MicroBatching() {
+		t.Error("batching with an empty queue")
+	}
+	q.PutItems(1, 2, 3, 4, 5, 6)
+	deadline := time.Now().Add(time.Second)
+	for !q.MicroBatching() {
+		if time.Now().After(deadline) {
+			t.Fatal("not batching with the queue over the threshold")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// batching stops once the first batch leaves the queue below
+	// the threshold less the hysteresis
+	want := []interface{}{"blocking", []interface{}{1, 2, 3, 4}, 5, 6}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package nats is a reference adapter between NATS, by way of
+// github.com/nats-io/nats.go, and the push components.
+//
+// A Source wraps a synchronous Subscription so that it can feed a
+// PushQueue with push.Consume. While the queue is full, Consume
+// stops calling NextMsg, so messages collect in the subscription's
+// pending buffer; set its limits with Subscription.SetPendingLimits
+// to decide when NATS starts reporting the subscriber as a slow
+// consumer and dropping messages.
+//
+// Subscribe instead uses an asynchronous subscription and rejects
+// messages that arrive while the queue is full with a negative
+// acknowledgement, so that JetStream redelivers them later.
+package nats
+
+import (
+	"context"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/nats-io/nats.go"
+)
+
+// Source is a push.Source that receives messages from a NATS
+// subscription. The values it delivers are *nats.Msg.
+type Source struct {
+	sub subscription
+	ack func(*nats.Msg) acker
+}
+
+// subscription is the part of *nats.Subscription used by Source.
+type subscription interface {
+	NextMsgWithContext(ctx context.Context) (*nats.Msg, error)
+}
+
+// acker acknowledges a message. It is satisfied by *nats.Msg.
+type acker interface {
+	Ack(opts ...nats.AckOpt) error
+	Nak(opts ...nats.AckOpt) error
+}
+
+// selfAck has each message acknowledge itself.
+func selfAck(m *nats.Msg) acker {
+	return m
+}
+
+// compile-time check that interface is satisfied
+var _ push.Source = (*Source)(nil)
+
+// NewSource creates a Source receiving from sub, which must be a
+// synchronous subscription, as created by SubscribeSync or
+// QueueSubscribeSync.
+func NewSource(sub *nats.Subscription) *Source {
+	if sub == nil {
+		panic("subscription is required")
+	}
+	return &Source{sub: sub, ack: selfAck}
+}
+
+// Receive waits for the next message on the subscription.
+func (s *Source) Receive(ctx context.Context) (push.Message, error) {
+	m, err := s.sub.NextMsgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return message{m, s.ack(m)}, nil
+}
+
+// message acknowledges through JetStream. Acknowledging a core NATS
+// message fails harmlessly, as there is nothing to acknowledge.
+type message struct {
+	msg *nats.Msg
+	ack acker
+}
+
+func (m message) Value() interface{} {
+	return m.msg
+}
+
+func (m message) Ack() {
+	m.ack.Ack()
+}
+
+func (m message) Nack() {
+	m.ack.Nak()
+}
+
+func (m message) settle(err error) {
+	if err == nil {
+		m.Ack()
+	} else {
+		m.Nack()
+	}
+}
+
+// Subscribe subscribes to subject, as a member of queue group queue
+// unless it is empty, and Puts each message into q, acknowledging
+// it once its worker has finished. A message that arrives while q
+// is full, or that is not processed, is negatively acknowledged
+// instead.
+func Subscribe(nc *nats.Conn, subject, queue string, q push.PushQueuePutFuture) (*nats.Subscription, error) {
+	handler := func(m *nats.Msg) {
+		if q.Count() >= q.Depth() {
+			m.Nak()
+			return
+		}
+		f := q.PutFuture(m)
+		go func() {
+			message{m, m}.settle(f.Wait())
+		}()
+	}
+	if queue == "" {
+		return nc.Subscribe(subject, handler)
+	}
+	return nc.QueueSubscribe(subject, queue, handler)
+}
+
+// Worker adapts a handler of NATS messages to the worker function of
+// a push component fed by a Source or Subscribe.
+func Worker(handler func(*nats.Msg)) func(interface{}) {
+	return func(item interface{}) {
+		handler(item.(*nats.Msg))
+	}
+}
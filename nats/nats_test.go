@@ -0,0 +1,71 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/nats-io/nats.go"
+)
+
+type fakeSubscription struct {
+	msgs chan *nats.Msg
+}
+
+func (s *fakeSubscription) NextMsgWithContext(ctx context.Context) (*nats.Msg, error) {
+	select {
+	case m := <-s.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type fakeAcker struct {
+	msg  *nats.Msg
+	acks chan<- string
+}
+
+func (a fakeAcker) Ack(opts ...nats.AckOpt) error {
+	a.acks <- "ack:" + a.msg.Subject
+	return nil
+}
+
+func (a fakeAcker) Nak(opts ...nats.AckOpt) error {
+	a.acks <- "nak:" + a.msg.Subject
+	return nil
+}
+
+func TestSourceAcksAfterWorker(t *testing.T) {
+	acks := make(chan string, 2)
+	sub := &fakeSubscription{msgs: make(chan *nats.Msg, 2)}
+	sub.msgs <- &nats.Msg{Subject: "good"}
+	sub.msgs <- &nats.Msg{Subject: "bad"}
+	src := &Source{sub: sub, ack: func(m *nats.Msg) acker {
+		return fakeAcker{msg: m, acks: acks}
+	}}
+
+	q := push.NewPushQueue(1, 2, Worker(func(m *nats.Msg) {
+		if m.Subject == "bad" {
+			panic("bad message")
+		}
+	}))
+	q.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go push.Consume(ctx, src, q)
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case a := <-acks:
+			got[a] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v, want ack:good and nak:bad", got)
+		}
+	}
+	if !got["ack:good"] || !got["nak:bad"] {
+		t.Errorf("got %v, want ack:good and nak:bad", got)
+	}
+}
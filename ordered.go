@@ -0,0 +1,140 @@
+package push
+
+import (
+	"context"
+	"sync"
+)
+
+// Sequenced is an item numbered by an Ordered, so that its result
+// can be released in the order the items were numbered.
+type Sequenced struct {
+	// Item is the item that was numbered.
+	Item interface{}
+
+	seq uint64
+}
+
+// Ordered is a reorder buffer. It releases the results of items
+// processed concurrently by a push component in the order the items
+// were put, while the component keeps its parallelism.
+//
+// Each item is numbered with Next before it is put, and its worker
+// hands the result to Done. An item that will never be processed,
+// such as one dropped as an overload, must be passed to Skip, or
+// later results are held back forever; Skip may be set directly as
+// the component's OnOverload, OnExpired, OnThrottled and
+// OnDroppedWhileDraining handler.
+type Ordered struct {
+	mutex     sync.Mutex
+	out       func(result interface{})
+	maxSkew   uint64
+	assigned  uint64
+	next      uint64
+	pending   map[uint64]orderedResult
+	releasing bool
+	room      chan struct{}
+}
+
+type orderedResult struct {
+	result  interface{}
+	skipped bool
+}
+
+// NewOrdered creates an Ordered that calls out with each result in
+// order. At most maxSkew items may be numbered ahead of the oldest
+// result not yet released, which bounds the results held back. out
+// is called on the goroutine of a Done or Skip call, one result at a
+// time. NewOrdered panics if maxSkew is not positive.
+func NewOrdered(maxSkew int, out func(result interface{})) *Ordered {
+	if maxSkew < 1 {
+		panic("max skew must be greater than 0")
+	}
+	return &Ordered{
+		out:     out,
+		maxSkew: uint64(maxSkew),
+		pending: make(map[uint64]orderedResult),
+		room:    make(chan struct{})}
+}
+
+// Next numbers item and returns it for putting into a component.
+// If maxSkew items are already numbered ahead of the oldest result
+// not yet released, Next blocks until that result is released or
+// ctx is done, in which case it returns ctx.Err().
+func (o *Ordered) Next(ctx context.Context, item interface{}) (*Sequenced, error) {
+	o.mutex.Lock()
+	for o.assigned-o.next >= o.maxSkew {
+		room := o.room
+		o.mutex.Unlock()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		o.mutex.Lock()
+	}
+	s := &Sequenced{Item: item, seq: o.assigned}
+	o.assigned++
+	o.mutex.Unlock()
+
+	return s, nil
+}
+
+// Done records the result of item, which is the *Sequenced returned
+// by Next or an *Envelope holding it, and releases the results that
+// are now in order.
+func (o *Ordered) Done(item interface{}, result interface{}) {
+	o.finish(item, orderedResult{result: result})
+}
+
+// Skip records that item, which is the *Sequenced returned by Next
+// or an *Envelope holding it, will not be processed, so that later
+// results are not held back for it.
+func (o *Ordered) Skip(item interface{}) {
+	o.finish(item, orderedResult{skipped: true})
+}
+
+func (o *Ordered) finish(item interface{}, r orderedResult) {
+	if e, ok := item.(*Envelope); ok {
+		item = e.Item
+	}
+	s, ok := item.(*Sequenced)
+	if !ok {
+		panic("push: item was not numbered by Ordered.Next")
+	}
+
+	o.mutex.Lock()
+	o.pending[s.seq] = r
+	if o.releasing {
+		// the releasing goroutine will pick it up
+		o.mutex.Unlock()
+		return
+	}
+	o.releasing = true
+	for {
+		var ready []orderedResult
+		for {
+			r, ok := o.pending[o.next]
+			if !ok {
+				break
+			}
+			delete(o.pending, o.next)
+			o.next++
+			ready = append(ready, r)
+		}
+		if len(ready) == 0 {
+			o.releasing = false
+			o.mutex.Unlock()
+			return
+		}
+		close(o.room)
+		o.room = make(chan struct{})
+		o.mutex.Unlock()
+
+		for _, r := range ready {
+			if !r.skipped {
+				o.out(r.result)
+			}
+		}
+		o.mutex.Lock()
+	}
+}
@@ -0,0 +1,71 @@
+package push_test
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestOrdered(t *testing.T) {
+	var results []interface{}
+	var mutex sync.Mutex
+	o := NewOrdered(5, func(result interface{}) {
+		mutex.Lock()
+		results = append(results, result)
+		mutex.Unlock()
+	})
+	q := NewPushQueue(4, 10, func(item interface{}) {
+		n := item.(*Sequenced).Item.(int)
+		time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+		if n == 7 {
+			o.Skip(item)
+			return
+		}
+		o.Done(item, n*10)
+	})
+	q.OnOverload(o.Skip)
+	q.Start()
+
+	for i := 0; i < 20; i++ {
+		s, err := o.Next(context.Background(), i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Put(s)
+	}
+	drainAndWait(t, q)
+
+	var want []interface{}
+	for i := 0; i < 20; i++ {
+		if i != 7 {
+			want = append(want, i*10)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got results %v, want %v", results, want)
+	}
+}
+
+func TestOrderedMaxSkew(t *testing.T) {
+	o := NewOrdered(2, func(result interface{}) {})
+	first, _ := o.Next(context.Background(), 0)
+	o.Next(context.Background(), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := o.Next(ctx, 2); err != context.DeadlineExceeded {
+		t.Errorf("got error %v while skew limit reached, want %v", err, context.DeadlineExceeded)
+	}
+
+	o.Done(first, nil)
+	if _, err := o.Next(context.Background(), 2); err != nil {
+		t.Errorf("got error %v after release", err)
+	}
+}
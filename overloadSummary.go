@@ -0,0 +1,85 @@
+package push
+
+import (
+	"time"
+)
+
+// OverloadSummary is passed to the OnOverloadSummary handler with
+// the overloads of one period.
+type OverloadSummary struct {
+	// Overloads is the number of items dropped as overloads in the
+	// period.
+	Overloads int
+
+	// Sample is the first item dropped in the period.
+	Sample interface{}
+
+	// Start is the time of the first overload in the period, and
+	// Period its length.
+	Start  time.Time
+	Period time.Duration
+}
+
+// overloadSummary coalesces overloads into a summary raised once per
+// period, so that a burst of overloads does not raise an event for
+// every item.
+type overloadSummary struct {
+	period  time.Duration
+	handler func(OverloadSummary)
+	flush   func()
+	summary OverloadSummary
+}
+
+// checkSummaryPeriod panics if period is not valid for handler f.
+func checkSummaryPeriod(period time.Duration, f func(OverloadSummary)) {
+	if f != nil && period <= 0 {
+		panic("period must be greater than 0")
+	}
+}
+
+// set sets the period and handler, which have been checked with
+// checkSummaryPeriod. flush is called at the end of each period in
+// which there were overloads; it must lock the component and call
+// report.
+func (o *overloadSummary) set(period time.Duration, f func(OverloadSummary), flush func()) {
+	o.period = period
+	o.handler = f
+	o.flush = flush
+}
+
+// add counts an overload of item, starting a period if none is
+// running. It must be called with the component's mutex held.
+func (o *overloadSummary) add(item interface{}) {
+	if o.period <= 0 {
+		return
+	}
+	if o.summary.Overloads == 0 {
+		o.summary = OverloadSummary{Sample: item, Start: time.Now(), Period: o.period}
+		time.AfterFunc(o.period, o.flush)
+	}
+	o.summary.Overloads++
+}
+
+// report raises the summary of the period that has ended, if there
+// were overloads, and starts afresh. It must be called with the
+// component's mutex held.
+func (o *overloadSummary) report(events *eventQueue) {
+	if o.summary.Overloads == 0 {
+		return
+	}
+	f, summary := o.handler, o.summary
+	o.summary = OverloadSummary{}
+	if f != nil {
+		events.emit(func() {
+			f(summary)
+		})
+	}
+	events.toSubscribers(func(h Handlers) func() {
+		if g := h.OverloadSummary; g != nil {
+			return func() {
+				g(summary)
+			}
+		}
+		return nil
+	})
+}
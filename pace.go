@@ -0,0 +1,129 @@
+package push
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pacer paces the handing of items to workers by a dispatch rate
+// limiter and by jitter, on behalf of a component. When it holds
+// back a dispatch, it calls the component's dispatch function again
+// once the wait is over. Its methods must be called with the
+// component's mutex held.
+type pacer struct {
+	mutex       *sync.Mutex
+	dispatch    func()
+	rate        RateLimiter
+	newRate     func() RateLimiter
+	rateGen     int
+	rateHeld    bool
+	rateWaiting bool
+	jitter      limiter
+	scheduled   bool
+}
+
+func newPacer(mutex *sync.Mutex, dispatch func()) pacer {
+	return pacer{mutex: mutex, dispatch: dispatch}
+}
+
+// setRate replaces the dispatch rate limiter. A permission held
+// from the previous limiter is given up. Limiters are told apart by
+// generation rather than compared, as a RateLimiter's dynamic type
+// need not be comparable.
+func (p *pacer) setRate(l RateLimiter) {
+	p.rate = l
+	p.newRate = nil
+	p.rateGen++
+	p.rateHeld = false
+}
+
+// setOwnRate replaces the dispatch rate limiter with l, one of the
+// component's own made by newRate, so that a clone of the component
+// gets its own limiter, made afresh, rather than sharing it.
+func (p *pacer) setOwnRate(l RateLimiter, newRate func() RateLimiter) {
+	p.setRate(l)
+	p.newRate = newRate
+}
+
+// clone returns a pacer for another component with the same
+// dispatch rate and jitter. A limiter the component was given is
+// shared with the clone; one of its own is made afresh.
+func (p *pacer) clone(mutex *sync.Mutex, dispatch func()) pacer {
+	c := newPacer(mutex, dispatch)
+	if p.newRate != nil {
+		c.setOwnRate(p.newRate(), p.newRate)
+	} else if p.rate != nil {
+		c.setRate(p.rate)
+	}
+	if j, ok := p.jitter.(*jitterLimiter); ok {
+		c.jitter = newJitterLimiter(j.max)
+	}
+	return c
+}
+
+// delayed reports whether jitter holds back a dispatch at now, in
+// which case another attempt is scheduled for when the wait is over.
+func (p *pacer) delayed(now time.Time) bool {
+	if p.jitter == nil {
+		return false
+	}
+	wait := p.jitter.reserve(now)
+	if wait <= 0 {
+		return false
+	}
+	p.retryAfter(wait)
+	return true
+}
+
+// allow reports whether the dispatch rate limit allows an item to
+// be handed to a worker now. If it does not, another attempt to
+// dispatch is made as soon as the limiter allows.
+func (p *pacer) allow() bool {
+	if p.rate == nil {
+		return true
+	}
+	if p.rateHeld {
+		p.rateHeld = false
+		return true
+	}
+	if p.rate.Allow() {
+		return true
+	}
+	if !p.rateWaiting {
+		p.rateWaiting = true
+		go p.await(p.rate, p.rateGen)
+	}
+	return false
+}
+
+// await waits for a permission from the limiter of generation gen
+// and holds it for the next dispatch, unless the limiter has been
+// replaced meanwhile. It is called without the mutex held.
+func (p *pacer) await(l RateLimiter, gen int) {
+	err := l.Wait(context.Background())
+
+	p.mutex.Lock()
+	p.rateWaiting = false
+	if err == nil && gen == p.rateGen {
+		p.rateHeld = true
+	}
+	p.mutex.Unlock()
+
+	p.dispatch()
+}
+
+// retryAfter schedules another attempt to dispatch once wait has
+// elapsed, unless one is already scheduled.
+func (p *pacer) retryAfter(wait time.Duration) {
+	if p.scheduled {
+		return
+	}
+	p.scheduled = true
+	time.AfterFunc(wait, func() {
+		p.mutex.Lock()
+		p.scheduled = false
+		p.mutex.Unlock()
+		p.dispatch()
+	})
+}
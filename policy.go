@@ -0,0 +1,80 @@
+package push
+
+import (
+	"time"
+)
+
+// SchedulingPolicy chooses which pending item a push queue hands to
+// a worker next, so that clients can dispatch in an order of their
+// own. Pick is given the pending items, ordered by descending
+// priority and oldest first within a priority, and the current
+// time. It returns the index of the item to dispatch, or -1 to hold
+// back every item until the next Put or worker completion. Pick is
+// called with the queue's mutex held: it must not modify items or
+// call back into the queue.
+type SchedulingPolicy interface {
+	Pick(items []*Envelope, now time.Time) int
+}
+
+// SchedulingPolicyFunc adapts a function to a SchedulingPolicy.
+type SchedulingPolicyFunc func(items []*Envelope, now time.Time) int
+
+// Pick calls f(items, now).
+func (f SchedulingPolicyFunc) Pick(items []*Envelope, now time.Time) int {
+	return f(items, now)
+}
+
+// Built-in scheduling policies.
+var (
+	// FIFO dispatches the item accepted first, regardless of
+	// priority.
+	FIFO SchedulingPolicy = SchedulingPolicyFunc(pickFirstIn)
+
+	// LIFO dispatches the item accepted last, regardless of
+	// priority.
+	LIFO SchedulingPolicy = SchedulingPolicyFunc(pickLastIn)
+
+	// PriorityOrder dispatches the oldest item of the highest
+	// priority. This is the order the queue uses by default.
+	PriorityOrder SchedulingPolicy = SchedulingPolicyFunc(pickHead)
+
+	// EarliestDeadlineFirst dispatches the item with the earliest
+	// Envelope deadline, regardless of priority. Items without a
+	// deadline follow those with one, in priority order.
+	EarliestDeadlineFirst SchedulingPolicy = SchedulingPolicyFunc(pickEarliestDeadline)
+)
+
+func pickFirstIn(items []*Envelope, now time.Time) int {
+	best := 0
+	for i := 1; i < len(items); i++ {
+		if items[i].Enqueued.Before(items[best].Enqueued) {
+			best = i
+		}
+	}
+	return best
+}
+
+func pickLastIn(items []*Envelope, now time.Time) int {
+	best := 0
+	for i := 1; i < len(items); i++ {
+		if !items[i].Enqueued.Before(items[best].Enqueued) {
+			best = i
+		}
+	}
+	return best
+}
+
+func pickHead(items []*Envelope, now time.Time) int {
+	return 0
+}
+
+func pickEarliestDeadline(items []*Envelope, now time.Time) int {
+	best := 0
+	for i := 1; i < len(items); i++ {
+		d := items[i].Deadline
+		if !d.IsZero() && (items[best].Deadline.IsZero() || d.Before(items[best].Deadline)) {
+			best = i
+		}
+	}
+	return best
+}
@@ -0,0 +1,56 @@
+package push
+
+import (
+	"context"
+)
+
+// Poller is an external queue that is consumed by polling, such as
+// Amazon SQS. Messages received from a Poller are typically hidden
+// from other consumers until they are acknowledged, which removes
+// them from the remote queue, or negatively acknowledged, which
+// makes them visible again.
+type Poller interface {
+	// Poll waits, usually by long polling, for up to max messages.
+	// It may return fewer, or none if its wait times out.
+	Poll(ctx context.Context, max int) ([]Message, error)
+}
+
+// PollSource returns a Source that receives messages from p, polling
+// for up to max messages at a time. Passing it to Consume feeds a
+// component from the remote queue, removing each message from the
+// remote queue only after its worker has finished. PollSource panics
+// if max is less than 1. The returned Source is not safe for use by
+// more than one goroutine.
+func PollSource(p Poller, max int) Source {
+	if p == nil {
+		panic("poller is required")
+	}
+	if max < 1 {
+		panic("max must be at least 1")
+	}
+	return &pollSource{poller: p, max: max}
+}
+
+type pollSource struct {
+	poller Poller
+	max    int
+	buffer []Message
+}
+
+func (s *pollSource) Receive(ctx context.Context) (Message, error) {
+	for len(s.buffer) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		msgs, err := s.poller.Poll(ctx, s.max)
+		if err != nil {
+			return nil, err
+		}
+		s.buffer = msgs
+	}
+
+	m := s.buffer[0]
+	s.buffer[0] = nil
+	s.buffer = s.buffer[1:]
+	return m, nil
+}
@@ -0,0 +1,56 @@
+package push_test
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+type testPoller struct {
+	batches [][]Message
+	maxes   []int
+}
+
+func (p *testPoller) Poll(ctx context.Context, max int) ([]Message, error) {
+	p.maxes = append(p.maxes, max)
+	if len(p.batches) == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	b := p.batches[0]
+	p.batches = p.batches[1:]
+	return b, nil
+}
+
+func TestPollSource(t *testing.T) {
+	acks := make(chan string, 3)
+	p := &testPoller{batches: [][]Message{
+		{&testMessage{value: "a", acks: acks}, &testMessage{value: "b", acks: acks}},
+		nil,
+		{&testMessage{value: "c", acks: acks}},
+	}}
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- Consume(ctx, PollSource(p, 5), q) }()
+
+	got := map[string]bool{<-acks: true, <-acks: true, <-acks: true}
+	for _, want := range []string{"ack:a", "ack:b", "ack:c"} {
+		if !got[want] {
+			t.Errorf("missing %s in %v", want, got)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Consume returned %v after cancel, want nil", err)
+	}
+	for _, max := range p.maxes {
+		if max != 5 {
+			t.Errorf("polled for %d messages, want 5", max)
+		}
+	}
+}
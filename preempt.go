@@ -0,0 +1,100 @@
+package push
+
+import (
+	"context"
+	"time"
+)
+
+// preemptor runs items with a worker that takes a context, and
+// cancels the context of a low priority item in flight to make way
+// for a higher priority one.
+type preemptor struct {
+	worker  func(ctx context.Context, item interface{}) error
+	running map[*Envelope]*preemption
+}
+
+// preemption is the context of an item in flight.
+type preemption struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	started   time.Time
+	preempted bool
+}
+
+func newPreemptor(worker func(ctx context.Context, item interface{}) error) *preemptor {
+	if worker == nil {
+		panic("no worker set")
+	}
+	return &preemptor{worker: worker, running: make(map[*Envelope]*preemption)}
+}
+
+// clone returns a preemptor with the same worker and nothing in
+// flight.
+func (p *preemptor) clone() *preemptor {
+	if p == nil {
+		return nil
+	}
+	return newPreemptor(p.worker)
+}
+
+// begin records that e is handed to a worker and returns its
+// context.
+func (p *preemptor) begin(e *Envelope) *preemption {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &preemption{ctx: ctx, cancel: cancel, started: time.Now()}
+	p.running[e] = r
+	return r
+}
+
+// end records that the worker of e has returned.
+func (p *preemptor) end(e *Envelope) {
+	if r, ok := p.running[e]; ok {
+		r.cancel()
+		delete(p.running, e)
+	}
+}
+
+// preempt cancels the context of the item in flight with the lowest
+// priority below priority, preferring the most recently started of
+// equals, and reports whether there was one.
+func (p *preemptor) preempt(priority int) bool {
+	var victim *Envelope
+	for e, r := range p.running {
+		if r.preempted || e.Priority >= priority {
+			continue
+		}
+		if victim == nil || e.Priority < victim.Priority ||
+			e.Priority == victim.Priority && r.started.After(p.running[victim].started) {
+			victim = e
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	r := p.running[victim]
+	r.preempted = true
+	r.cancel()
+	return true
+}
+
+// run calls the worker for e and reports whether e was preempted and
+// should be put back: that is, whether its context was cancelled for
+// preemption and the worker returned the context's error. Otherwise
+// e's future is resolved, with a *PanicError if the worker panicked.
+func (p *preemptor) run(r *preemption, e *Envelope, item interface{}) (requeue bool) {
+	var err error
+	work := func() {
+		err = p.worker(r.ctx, item)
+	}
+	if e.future == nil {
+		work()
+	} else if perr := recovered(work); perr != nil {
+		e.resolve(perr)
+		return false
+	}
+	if r.preempted && err != nil && err == r.ctx.Err() {
+		return true
+	}
+	e.resolve(nil)
+	return false
+}
@@ -0,0 +1,135 @@
+package push
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Pressure describes how a push component sheds load while under
+// pressure, such as a shortage of memory. Items shed are dropped and
+// reported to the OnShed handler.
+type Pressure struct {
+	// Depth, if positive and below the component's capacity, is the
+	// capacity of the component while under pressure. Pending items
+	// beyond it are shed, oldest first, and items put beyond it are
+	// handled according to the overload policy.
+	Depth int
+
+	// Evict is the number of the oldest pending items to shed when
+	// the pressure is applied.
+	Evict int
+
+	// PauseIntake sheds every item put while under pressure.
+	PauseIntake bool
+}
+
+// pressure is the pressure applied to a component, if any.
+type pressure struct {
+	on bool
+	p  Pressure
+}
+
+// capacity returns the capacity of a component of the given
+// capacity under the pressure.
+func (s *pressure) capacity(capacity int) int {
+	if s.on && s.p.Depth > 0 && s.p.Depth < capacity {
+		return s.p.Depth
+	}
+	return capacity
+}
+
+// paused reports whether items put are to be shed.
+func (s *pressure) paused() bool {
+	return s.on && s.p.PauseIntake
+}
+
+// excess returns how many of pending items must be shed on applying
+// the pressure to a component of the given capacity.
+func (s *pressure) excess(pending, capacity int) int {
+	n := pending - s.capacity(capacity)
+	if s.p.Evict > n {
+		n = s.p.Evict
+	}
+	if n > pending {
+		n = pending
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// shedFirst removes the first n of items, compacting the rest in
+// place so that the shed items are no longer referenced.
+func shedFirst(items []*Envelope, n int) (kept, shed []*Envelope) {
+	shed = append(shed, items[:n]...)
+	kept = items[:copy(items, items[n:])]
+	for i := len(kept); i < len(items); i++ {
+		items[i] = nil
+	}
+	return kept, shed
+}
+
+// Pressurable is the set of methods used by WatchMemory. It is
+// satisfied by PushQueue, PushBatchQueue and PushStack.
+type Pressurable interface {
+	ApplyPressure(p Pressure)
+	ReleasePressure()
+}
+
+// compile-time check that interface is satisfied
+var _ Pressurable = (*PushQueue)(nil)
+var _ Pressurable = (*PushBatchQueue)(nil)
+var _ Pressurable = (*PushStack)(nil)
+
+// WatchMemory reads the runtime's memory statistics every interval,
+// and applies p to the given components when the bytes of allocated
+// heap objects rise to limit, releasing it again once they fall
+// below limit. Reading the statistics briefly stops the world, so
+// interval should be no shorter than about a second. The returned
+// function stops watching; it does not release a pressure applied.
+func WatchMemory(limit uint64, interval time.Duration, p Pressure, components ...Pressurable) (stop func()) {
+	return watchMemory(heapAlloc, limit, interval, p, components)
+}
+
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func watchMemory(read func() uint64, limit uint64, interval time.Duration, p Pressure, components []Pressurable) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		under := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			switch used := read(); {
+			case !under && used >= limit:
+				under = true
+				for _, c := range components {
+					c.ApplyPressure(p)
+				}
+			case under && used < limit:
+				under = false
+				for _, c := range components {
+					c.ReleasePressure()
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
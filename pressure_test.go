@@ -0,0 +1,64 @@
+package push_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestApplyPressure(t *testing.T) {
+	shed := make(chan interface{}, 10)
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.OnShed(func(item interface{}) { shed <- item })
+	q.PutItems(1, 2, 3, 4, 5)
+
+	q.ApplyPressure(Pressure{Depth: 3, Evict: 1, PauseIntake: true})
+	f := q.PutFuture(6)
+	if err := f.Err(); err != ErrShed {
+		t.Errorf("item put under pressure: got %v, want ErrShed", err)
+	}
+	if items := q.Items(); !reflect.DeepEqual(items, []QueueItem{3, 4, 5}) {
+		t.Errorf("got pending %v, want [3 4 5]", items)
+	}
+	if n := q.ShedCount(); n != 3 {
+		t.Errorf("got shed count %d, want 3", n)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-shed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing shed event")
+		}
+	}
+
+	q.ReleasePressure()
+	q.PutItems(7, 8)
+	if n := q.Count(); n != 5 {
+		t.Errorf("got %d pending after release, want 5", n)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWatchMemory(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.PutItems(1, 2, 3)
+	// any heap is above a limit of one byte
+	stop := WatchMemory(1, time.Millisecond, Pressure{Evict: 2}, q)
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for q.ShedCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("pressure not applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	if n := q.Count(); n != 1 {
+		t.Errorf("got %d pending, want 1", n)
+	}
+}
@@ -1,7 +1,9 @@
 package push
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
 // PushBatchQueue holds the processing and state information
@@ -12,19 +14,53 @@ type PushBatchQueue struct {
 	batchSize            int
 	availableWorkers     int
 	depth                int
-	items                []interface{}
+	items                []*Envelope
+	deliverEnvelopes     bool
+	keyFunc              func(QueueItem) interface{}
 	started              bool
+	suspended            bool
+	run                  int
+	stopOnCancel         bool
 	draining             bool
 	overload             int
+	intakeRate           *tokenBucket
+	throttled            skipCount
+	shed                 skipCount
+	suppressed           skipCount
+	dedupe               *dedupe
+	coalesce             *coalescer
+	pressure             pressure
+	expired              skipCount
+	drainDropped         skipCount
+	pace                 pacer
+	warmup               warmup
+	costs                costLimit
+	window               *batchWindow
+	levels               thresholds
+	total                totals
+	hooks                itemHooks
+	resulter             *batchResulter
+	results              results
+	acker                *acker
+	retries              int
+	events               eventQueue
+	safe                 safety
 	dropOldestOnOverload bool
 	onOverload           func(interface{})
 	onFirstOverload      func(interface{})
+	onOverloadEvent      func(OverloadEvent)
+	overloads            overloadSummary
 	onDrained            func()
+	onDrainSummary       func(DrainSummary)
+	onStateChange        func(StateChangeEvent)
+	drain                drainStats
 	mutex                sync.Mutex
 }
 
-// compile-time check that interface is satisfied
+// compile-time check that interfaces are satisfied
 var _ PushQueuePut = (*PushBatchQueue)(nil)
+var _ PushQueuePutEvents = (*PushBatchQueue)(nil)
+var _ PushQueuePutFuture = (*PushBatchQueue)(nil)
 
 // NewPushBatchQueue creates a new PushBatchQueue with the given concurrency,
 // depth and worker. The worker is the function that will be called
@@ -47,44 +83,263 @@ func NewPushBatchQueue(concurrency int, depth int, batchSize int, worker func([]
 		availableWorkers: concurrency,
 		depth:            depth,
 		batchSize:        batchSize,
-		items:            make([]interface{}, 0, depth),
-		worker:           worker}
+		items:            make([]*Envelope, 0, depth),
+		worker:           worker,
+		throttled:        skipCount{err: ErrThrottled, reason: DropThrottled, pick: pickThrottled},
+		shed:             skipCount{err: ErrShed, reason: DropShed, pick: pickShed},
+		suppressed:       skipCount{err: ErrDuplicate, reason: DropDuplicate, pick: pickSuppressed},
+		expired:          skipCount{err: ErrExpired, reason: DropExpired, pick: pickExpired},
+		drainDropped:     skipCount{err: ErrDropped, reason: DropDraining, pick: pickDroppedWhileDraining}}
+	q.pace = newPacer(&q.mutex, q.get)
 
 	return q
 }
 
+// CloneConfig returns a new, unstarted queue with the same
+// concurrency, depth, worker, policies and event handlers as the
+// queue, and an empty buffer. Dispatch and intake rates set on the
+// queue are given afresh to the clone, while a limiter given to the
+// queue, such as with SharedDispatchRate, is shared with it.
+// Handlers added with Subscribe, OnThreshold or OnAlert are not
+// copied, as their Subscriptions belong to the queue.
+func (q *PushBatchQueue) CloneConfig() *PushBatchQueue {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	c := &PushBatchQueue{
+		concurrency:          q.concurrency,
+		availableWorkers:     q.concurrency,
+		depth:                q.depth,
+		batchSize:            q.batchSize,
+		items:                make([]*Envelope, 0, q.depth),
+		worker:               q.worker,
+		deliverEnvelopes:     q.deliverEnvelopes,
+		keyFunc:              q.keyFunc,
+		stopOnCancel:         q.stopOnCancel,
+		throttled:            q.throttled.clone(),
+		shed:                 q.shed.clone(),
+		suppressed:           q.suppressed.clone(),
+		dedupe:               q.dedupe.clone(),
+		coalesce:             q.coalesce,
+		expired:              q.expired.clone(),
+		drainDropped:         q.drainDropped.clone(),
+		costs:                q.costs.clone(),
+		window:               q.window,
+		hooks:                q.hooks.clone(),
+		resulter:             q.resulter,
+		results:              results{handler: q.results.handler, collect: q.results.collect},
+		acker:                q.acker,
+		events:               eventQueue{sync: q.events.sync, onPanic: q.events.onPanic, audit: q.events.audit},
+		safe:                 q.safe,
+		dropOldestOnOverload: q.dropOldestOnOverload,
+		onOverload:           q.onOverload,
+		onFirstOverload:      q.onFirstOverload,
+		onOverloadEvent:      q.onOverloadEvent,
+		onDrained:            q.onDrained,
+		onDrainSummary:       q.onDrainSummary,
+		onStateChange:        q.onStateChange}
+	if q.intakeRate != nil {
+		c.intakeRate = q.intakeRate.clone()
+	}
+	c.pace = q.pace.clone(&c.mutex, c.get)
+	c.warmup = newWarmup(q.warmup.run, q.warmup.ramp)
+	c.overloads.set(q.overloads.period, q.overloads.handler, c.reportOverloads)
+
+	return c
+}
+
 // Start begins queue processing. Start panics if no worker
 // has been set.
 func (q *PushBatchQueue) Start() {
-	if q.worker == nil {
+	q.start()
+}
+
+// start begins processing and returns the number of the new run.
+func (q *PushBatchQueue) start() int {
+	defer q.guard()
+
+	if q.worker == nil && q.resulter == nil && q.acker == nil {
 		panic("no worker set")
 	}
+
+	q.mutex.Lock()
+	prepare := q.warmup.run
+	q.unlock()
+	if prepare != nil {
+		prepare()
+	}
+
+	q.mutex.Lock()
+	from := q.state()
 	q.started = true
 	q.draining = false
-	q.overload = 0
+	q.changeState(from, CauseCall)
+	q.resetStats()
+	q.run++
+	run := q.run
+	q.warmup.begin(time.Now(), q.concurrency, q.get)
+	q.unlock()
+
 	go q.get()
+	return run
+}
+
+// ResetStats resets the counts of overloads, expired, throttled,
+// shed, suppressed and dropped-while-draining items, as Start does,
+// without affecting processing. After a reset the next overload
+// raises the OnFirstOverload event again.
+func (q *PushBatchQueue) ResetStats() {
+	q.mutex.Lock()
+	q.resetStats()
+	q.unlock()
+}
+
+// resetStats resets the counts. It must be called with the mutex
+// held.
+func (q *PushBatchQueue) resetStats() {
+	q.overload = 0
+	q.expired.count = 0
+	q.throttled.count = 0
+	q.shed.count = 0
+	q.suppressed.count = 0
+	q.drainDropped.count = 0
+}
+
+// StartContext begins queue processing like Start, and ties the
+// queue's lifetime to ctx: when ctx is done, the queue is drained,
+// or stopped if StopOnCancel has been set. Calling Start, Stop or
+// StartContext again releases the queue from ctx.
+func (q *PushBatchQueue) StartContext(ctx context.Context) {
+	run := q.start()
+	go func() {
+		<-ctx.Done()
+		q.mutex.Lock()
+		current := q.run == run && q.started
+		stop := q.stopOnCancel
+		q.unlock()
+		if !current {
+			return
+		}
+		if stop {
+			q.stop(CauseContext)
+		} else {
+			q.startDrain(CauseContext)
+		}
+	}()
+}
+
+// StopOnCancel tells a queue started with StartContext to Stop,
+// rather than Drain, when its context is done.
+func (q *PushBatchQueue) StopOnCancel() {
+	q.mutex.Lock()
+	q.stopOnCancel = true
+	q.unlock()
 }
 
 // IsStarted indicates whether the queue is started. This method
 // returns true when the queue is available to clients to Put
 // items. IsStarted returns false when the queue is draining.
 func (q *PushBatchQueue) IsStarted() bool {
+	q.mutex.Lock()
+	defer q.unlock()
+
 	return q.started
 }
 
+// SuspendIntake stops the queue from handing items to its workers,
+// while it goes on accepting Puts and keeping them, until
+// ResumeIntake is called. Unlike Stop, it leaves the queue started,
+// and unlike Start, ResumeIntake leaves the counts as they are. A
+// drain proceeds even while intake is suspended.
+func (q *PushBatchQueue) SuspendIntake() {
+	q.mutex.Lock()
+	q.suspended = true
+	q.unlock()
+}
+
+// ResumeIntake resumes handing items to workers after
+// SuspendIntake.
+func (q *PushBatchQueue) ResumeIntake() {
+	q.mutex.Lock()
+	q.suspended = false
+	n := q.availableWorkers
+	q.unlock()
+
+	for i := 0; i < n; i++ {
+		go q.get()
+	}
+}
+
 // Stop ends processing of queue items. This also ends
 // draining of items if Drain has been called.
 func (q *PushBatchQueue) Stop() {
+	q.stop(CauseCall)
+}
+
+func (q *PushBatchQueue) stop(cause StateCause) {
+	q.mutex.Lock()
+	q.halt(cause)
+	q.unlock()
+}
+
+// halt ends processing. It must be called with the mutex held.
+func (q *PushBatchQueue) halt(cause StateCause) {
+	from := q.state()
+	q.run++
 	q.started = false
 	q.draining = false
+	q.changeState(from, cause)
+}
+
+// Absorb moves the items pending in other into the queue, as though
+// they had been Put in the order they were pending in other, and
+// stops other. Items that do not fit are handled according to the
+// queue's overload policy. Items already being processed by other's
+// workers are left to finish there. Absorb panics if other is the
+// queue itself.
+func (q *PushBatchQueue) Absorb(other *PushBatchQueue) {
+	defer q.guard()
+
+	if other == q {
+		panic("cannot absorb a queue into itself")
+	}
+
+	other.mutex.Lock()
+	items := other.items
+	other.items = make([]*Envelope, 0, other.depth)
+	other.total.removed += len(items)
+	other.halt(CauseCall)
+	other.levels.check(0, other.depth, &other.events)
+	other.unlock()
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.total.put += len(items)
+	for _, e := range items {
+		q.add(e)
+	}
+	go q.get()
 }
 
 // Drain processes remaining items in the queue and prevents
 // new items from being put onto the queue.
 func (q *PushBatchQueue) Drain() {
+	q.startDrain(CauseCall)
+}
+
+func (q *PushBatchQueue) startDrain(cause StateCause) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	from := q.state()
+	if !q.draining {
+		q.drain.begin(q.total.processed, q.drainDropped.count)
+	}
 	q.draining = true
 	q.started = false
-	if q.Count() == 0 && q.availableWorkers == q.concurrency {
+	q.changeState(from, cause)
+	if q.idle() {
 		q.setDrained()
 	}
 	go q.get()
@@ -93,7 +348,18 @@ func (q *PushBatchQueue) Drain() {
 // OnDrained sets an event handler that will be called when
 // the draining is complete.
 func (q *PushBatchQueue) OnDrained(f func()) {
+	q.mutex.Lock()
 	q.onDrained = f
+	q.unlock()
+}
+
+// OnDrainSummary sets an event handler that will be called when the
+// draining is complete, like the OnDrained handler, with a summary
+// of the drain.
+func (q *PushBatchQueue) OnDrainSummary(f func(DrainSummary)) {
+	q.mutex.Lock()
+	q.onDrainSummary = f
+	q.unlock()
 }
 
 // Empty removes all items currently in the queue. This method
@@ -101,154 +367,1302 @@ func (q *PushBatchQueue) OnDrained(f func()) {
 // queue.
 func (q *PushBatchQueue) Empty() {
 	q.mutex.Lock()
-	q.items = make([]interface{}, 0, q.Depth())
-	q.mutex.Unlock()
+	for _, e := range q.items {
+		e.resolve(ErrRemoved)
+	}
+	q.total.removed += len(q.items)
+	q.items = make([]*Envelope, 0, q.depth)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+	q.unlock()
+}
+
+// Items returns a snapshot of the items currently in the queue,
+// oldest first. The returned slice is a copy taken under lock; it
+// is safe to read and modify, and does not change as the queue
+// is processed.
+func (q *PushBatchQueue) Items() []QueueItem {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.pending()
+}
+
+// Snapshot returns a copy of the items currently in the queue,
+// oldest first, together with the queue's state, all taken at the
+// same moment under lock.
+func (q *PushBatchQueue) Snapshot() Snapshot {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return Snapshot{
+		Items:    q.pending(),
+		InFlight: q.total.inFlight,
+		Capacity: q.depth,
+		State:    q.state(),
+		Taken:    time.Now()}
+}
+
+// ForEach calls f for each item currently in the queue, oldest
+// first, until f returns false. Unlike Items, it does not copy the
+// queue; instead f is called with the mutex held, so it must be
+// quick and must not call back into the queue.
+func (q *PushBatchQueue) ForEach(f func(QueueItem) bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	for _, e := range q.items {
+		if !f(e.payload(q.deliverEnvelopes)) {
+			return
+		}
+	}
+}
+
+// Sort reorders the items currently in the queue as though they
+// had been put in the order given by less, which reports whether
+// item a goes before item b. The sort is stable, and less is
+// called with the mutex held, so it must not call back into the
+// queue.
+func (q *PushBatchQueue) Sort(less func(a, b QueueItem) bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	sortItems(q.items, less, q.deliverEnvelopes)
+}
+
+// String returns a one-line description of the queue's state, for
+// logs.
+func (q *PushBatchQueue) String() string {
+	return q.describe().String()
+}
+
+// Dump returns a multi-line description of the queue's settings,
+// state and counts, with a sample of the pending items, for logs and
+// crash reports.
+func (q *PushBatchQueue) Dump() string {
+	return q.describe().dump()
+}
+
+func (q *PushBatchQueue) describe() *description {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	sample, more := sampleItems(q.items, q.deliverEnvelopes)
+	return &description{
+		kind:        "PushBatchQueue",
+		state:       q.state(),
+		count:       len(q.items),
+		capacity:    q.depth,
+		inFlight:    q.total.inFlight,
+		available:   q.availableWorkers,
+		concurrency: q.concurrency,
+		settings: []interface{}{
+			"batchSize", q.batchSize,
+			"deliverEnvelopes", q.deliverEnvelopes,
+			"dropOldestOnOverload", q.dropOldestOnOverload,
+			"syncEvents", q.events.sync},
+		counts: []interface{}{
+			"overloads", q.overload,
+			"throttled", q.throttled.count,
+			"shed", q.shed.count,
+			"suppressed", q.suppressed.count,
+			"expired", q.expired.count,
+			"droppedWhileDraining", q.drainDropped.count,
+			"coalesced", q.total.coalesced,
+			"processed", q.total.processed,
+			"scheduledRetries", q.retries,
+			"removed", q.total.removed},
+		sample: sample,
+		more:   more}
+}
+
+// pending returns a copy of the pending items. It must be called
+// with the mutex held.
+func (q *PushBatchQueue) pending() []QueueItem {
+	items := make([]QueueItem, len(q.items))
+	for i, e := range q.items {
+		items[i] = e.payload(q.deliverEnvelopes)
+	}
+	return items
+}
+
+// RemoveWhere atomically removes the pending items for which pred
+// returns true and returns the number of items removed. Removed
+// items are not processed; their Futures report ErrRemoved.
+func (q *PushBatchQueue) RemoveWhere(pred func(QueueItem) bool) int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	var removed []*Envelope
+	q.items, removed = removeWhere(q.items, q.deliverEnvelopes, pred)
+	for _, e := range removed {
+		e.resolve(ErrRemoved)
+	}
+	q.total.removed += len(removed)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+	return len(removed)
+}
+
+// SplitWhere atomically removes the pending items for which pred
+// returns true, like RemoveWhere, and returns them, oldest first,
+// so that they can be redirected to another component. Each item is
+// returned in its *Envelope, so that Putting it into another
+// component carries its priority, deadline and Future along; the
+// item's Future is not resolved by the removal.
+func (q *PushBatchQueue) SplitWhere(pred func(QueueItem) bool) []QueueItem {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	var removed []*Envelope
+	q.items, removed = removeWhere(q.items, q.deliverEnvelopes, pred)
+	q.total.removed += len(removed)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+
+	items := make([]QueueItem, len(removed))
+	for i, e := range removed {
+		items[i] = e
+	}
+	return items
+}
+
+// KeyFunc sets the function used by Contains and Get to derive
+// a key from an item. Keys must be comparable.
+func (q *PushBatchQueue) KeyFunc(f func(QueueItem) interface{}) {
+	q.mutex.Lock()
+	q.keyFunc = f
+	q.unlock()
+}
+
+// Contains reports whether an item with the given key is pending
+// in the queue. Items already handed to a worker are not pending.
+// Contains panics if no key function has been set.
+func (q *PushBatchQueue) Contains(key interface{}) bool {
+	_, ok := q.Get(key)
+	return ok
+}
+
+// Get returns the first pending item with the given key, and
+// whether one was found. Get panics if no key function has been
+// set.
+func (q *PushBatchQueue) Get(key interface{}) (QueueItem, bool) {
+	defer q.guard()
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	e := findKey(q.items, q.deliverEnvelopes, q.keyFunc, key)
+	if e == nil {
+		return nil, false
+	}
+	return e.payload(q.deliverEnvelopes), true
 }
 
 // IsFull indicates whether the queue can accept new items.
 func (q *PushBatchQueue) IsFull() bool {
-	return q.Count() >= q.Depth()
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return len(q.items) >= q.depth
 }
 
 // Count returns the current number of items in the queue.
 func (q *PushBatchQueue) Count() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
 	return len(q.items)
 }
 
+// InFlight returns the number of items currently being processed by
+// workers, counting every item of the batches being processed.
+// Together with Count it tells whether any work is still happening.
+func (q *PushBatchQueue) InFlight() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.total.inFlight
+}
+
+// AvailableWorkers returns the number of workers currently free to
+// take an item, out of the queue's concurrency.
+func (q *PushBatchQueue) AvailableWorkers() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.availableWorkers
+}
+
 // Depth returns the maximum capacity of the queue.
 func (q *PushBatchQueue) Depth() int {
 	return q.depth
 }
 
+// DeliverEnvelopes tells the queue to hand each item to the worker,
+// and to the event handlers, wrapped in its *Envelope rather than
+// as the bare item.
+func (q *PushBatchQueue) DeliverEnvelopes() {
+	q.mutex.Lock()
+	q.deliverEnvelopes = true
+	q.unlock()
+}
+
+// SyncEvents tells the queue to call its event handlers in the order
+// the events occur, on the goroutine that caused them, rather than
+// each on its own goroutine. The handlers are still called without
+// the queue's mutex held, so they may call back into the queue, but a
+// slow handler holds up the call that raised its event, such as a
+// Put or the completion of a worker. To have only some handlers
+// called in order, Subscribe them with Handlers.Sync instead.
+func (q *PushBatchQueue) SyncEvents() {
+	q.mutex.Lock()
+	q.events.sync = true
+	q.unlock()
+}
+
+// AuditSink sets a sink that will be called with a record of every
+// item the queue drops without processing it, whatever the reason,
+// for audit logging and later replay. Like the event handlers, the
+// sink is never called with the mutex held. AuditTo makes a sink
+// that Puts the records into another component.
+func (q *PushBatchQueue) AuditSink(f func(AuditRecord)) {
+	q.mutex.Lock()
+	q.events.audit = f
+	q.unlock()
+}
+
+// OnHandlerPanic sets a function to be called with the value of any
+// panic raised by one of the queue's event handlers. The panic is
+// recovered and the queue keeps running. Until a function is set,
+// such panics are written to the standard logger.
+func (q *PushBatchQueue) OnHandlerPanic(f func(interface{})) {
+	q.mutex.Lock()
+	q.events.onPanic = f
+	q.hooks.onPanic = f
+	q.unlock()
+}
+
+// SafeMode tells the queue to recover panics rather than let them
+// crash the program, for long-running daemons that cannot tolerate
+// them. In safe mode a method that would panic, such as Start with
+// no worker set or a setter given an invalid argument, instead
+// reports an *InternalError to the OnInternalError handler and
+// returns without effect, returning zero values if it has results.
+// A panic in a worker is reported as a *PanicError, and the queue
+// keeps running. Constructors still panic on invalid arguments.
+func (q *PushBatchQueue) SafeMode() {
+	q.mutex.Lock()
+	q.safe.on = true
+	q.unlock()
+}
+
+// OnInternalError sets an event handler that will be called with
+// each error recovered in safe mode. Until a handler is set, such
+// errors are written to the standard logger.
+func (q *PushBatchQueue) OnInternalError(f func(error)) {
+	q.mutex.Lock()
+	q.safe.handler = f
+	q.unlock()
+}
+
+// guard recovers a panic in a method of the queue in safe mode and
+// reports it, and otherwise lets it continue. It must be deferred
+// by methods that may panic, which must not hold the mutex at the
+// point of the panic.
+func (q *PushBatchQueue) guard() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	q.mutex.Lock()
+	safe := q.safe.on
+	if safe {
+		q.safe.report(&InternalError{Value: v}, &q.events)
+	}
+	q.unlock()
+	if !safe {
+		panic(v)
+	}
+}
+
+// safely runs work, which calls a worker, recovering and reporting a
+// panic in it in safe mode.
+func (q *PushBatchQueue) safely(work func()) {
+	q.mutex.Lock()
+	safe := q.safe.on
+	q.unlock()
+	if !safe {
+		work()
+		return
+	}
+	if err := recovered(work); err != nil {
+		q.mutex.Lock()
+		q.safe.report(err, &q.events)
+		q.unlock()
+	}
+}
+
 // DropOldestOnOverload tells the queue to drop the oldest item
 // in the queue on the floor when an overload occurs. The default
 // behavior is to drop the item being added.
 func (q *PushBatchQueue) DropOldestOnOverload() {
+	q.mutex.Lock()
 	q.dropOldestOnOverload = true
+	q.unlock()
 }
 
 // OverloadCount returns the number of times that clients attempted
-// to Put items exceeding queue depth or while the queue was
-// draining. The exceeding items were dropped on the floor. This
-// count is reset when Start is called.
+// to Put items exceeding queue depth. The exceeding items were
+// dropped on the floor. Items refused while the queue is draining
+// are counted by DroppedWhileDrainingCount instead. This count is
+// reset by Start and ResetStats.
 func (q *PushBatchQueue) OverloadCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
 	return q.overload
 }
 
+// CostLimit enforces concurrency by item cost in addition to the
+// worker count. The cost function returns the cost of an item, and
+// new work is started only while the total cost of the items being
+// processed stays within maxCost. The cost of a batch is
+// the sum of the costs of its items; a batch is cut short
+// rather than exceed the limit. An item whose cost alone
+// exceeds maxCost is started only when nothing else is in flight.
+// CostLimit panics if maxCost is less than 1.
+func (q *PushBatchQueue) CostLimit(maxCost int, cost func(QueueItem) int) {
+	defer q.guard()
+
+	checkMaxCost(maxCost)
+
+	q.mutex.Lock()
+	q.costs.set(maxCost, cost)
+	q.unlock()
+}
+
+// MaxDispatchRate limits the queue to handing at most n items to
+// workers in any interval of length per, even when workers are
+// available. A batch is cut short rather than exceed
+// the rate. MaxDispatchRate panics if n or per is not
+// positive.
+func (q *PushBatchQueue) MaxDispatchRate(n int, per time.Duration) {
+	defer q.guard()
+
+	newRate := func() RateLimiter {
+		return NewRateLimit(n, per)
+	}
+	l := newRate()
+
+	q.mutex.Lock()
+	q.pace.setOwnRate(l, newRate)
+	q.unlock()
+}
+
+// DispatchRateWithBurst limits the queue to handing items to
+// workers at a sustained rate of n per interval, using a token
+// bucket that holds up to burst tokens. Unlike MaxDispatchRate,
+// which caps the count in every interval, this absorbs spikes of
+// up to burst items at full speed and throttles only sustained
+// load. A batch is cut short rather than exceed
+// the rate. DispatchRateWithBurst panics if n, per or burst is not
+// positive.
+func (q *PushBatchQueue) DispatchRateWithBurst(n int, per time.Duration, burst int) {
+	defer q.guard()
+
+	newRate := func() RateLimiter {
+		return NewRateLimitWithBurst(n, per, burst)
+	}
+	l := newRate()
+
+	q.mutex.Lock()
+	q.pace.setOwnRate(l, newRate)
+	q.unlock()
+}
+
+// IntakeRate limits the rate at which the queue accepts items
+// with a token bucket that is refilled at n tokens per interval
+// and holds at most n tokens. Each Put takes a token; a Put that
+// finds the bucket empty is rejected before it can reach the
+// buffer. Rejected items are counted by ThrottledCount rather
+// than as overloads. IntakeRate panics if n or per is not
+// positive.
+func (q *PushBatchQueue) IntakeRate(n int, per time.Duration) {
+	q.IntakeRateWithBurst(n, per, n)
+}
+
+// IntakeRateWithBurst is like IntakeRate, but the bucket holds
+// up to burst tokens, so that a spike of up to burst items is
+// accepted at full speed and only sustained load above n per
+// interval is throttled. IntakeRateWithBurst panics if n, per or
+// burst is not positive.
+func (q *PushBatchQueue) IntakeRateWithBurst(n int, per time.Duration, burst int) {
+	defer q.guard()
+
+	b := newTokenBucket(n, per, burst)
+
+	q.mutex.Lock()
+	q.intakeRate = b
+	q.unlock()
+}
+
+// ThrottledCount returns the number of items rejected by the
+// intake rate limit. This count is reset by Start and
+// ResetStats.
+func (q *PushBatchQueue) ThrottledCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.throttled.count
+}
+
+// OnThrottled sets an event handler that will be called for every
+// item rejected by the intake rate limit.
+func (q *PushBatchQueue) OnThrottled(f func(interface{})) {
+	q.mutex.Lock()
+	q.throttled.handler = f
+	q.unlock()
+}
+
+// ApplyPressure puts the queue under pressure p, so that it sheds
+// load until ReleasePressure is called. Pending items beyond p.Depth
+// and the p.Evict oldest pending items are shed at once, oldest
+// first, and items put are then handled according to p. Shed items
+// are dropped and reported to the OnShed handler, and their Futures
+// report ErrShed. A pressure already applied is replaced.
+func (q *PushBatchQueue) ApplyPressure(p Pressure) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.pressure = pressure{on: true, p: p}
+	n := q.pressure.excess(len(q.items), q.depth)
+	var shed []*Envelope
+	q.items, shed = shedFirst(q.items, n)
+	q.total.dropped += q.shed.add(shed, q.deliverEnvelopes, &q.events)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+}
+
+// ReleasePressure ends the pressure set with ApplyPressure. Items
+// already shed are not restored.
+func (q *PushBatchQueue) ReleasePressure() {
+	q.mutex.Lock()
+	q.pressure = pressure{}
+	q.unlock()
+}
+
+// ShedCount returns the number of items shed under pressure. This
+// count is reset by Start and ResetStats.
+func (q *PushBatchQueue) ShedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.shed.count
+}
+
+// OnShed sets an event handler that will be called for every item
+// shed under pressure.
+func (q *PushBatchQueue) OnShed(f func(interface{})) {
+	q.mutex.Lock()
+	q.shed.handler = f
+	q.unlock()
+}
+
+// SuppressDuplicates suppresses every item put whose key, as returned
+// by key, is that of an item put within window before it, even if
+// that item has since been processed or dropped. Suppressed items
+// are dropped and reported to the OnSuppressed handler, and their
+// Futures report ErrDuplicate. Keys must be comparable.
+// SuppressDuplicates panics if key is nil or window is not
+// positive.
+func (q *PushBatchQueue) SuppressDuplicates(key func(QueueItem) interface{}, window time.Duration) {
+	defer q.guard()
+
+	d := newDedupe(key, window)
+
+	q.mutex.Lock()
+	q.dedupe = d
+	q.unlock()
+}
+
+// SuppressedCount returns the number of items suppressed as
+// duplicates. This count is reset by Start and ResetStats.
+func (q *PushBatchQueue) SuppressedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.suppressed.count
+}
+
+// OnSuppressed sets an event handler that will be called for every
+// item suppressed as a duplicate.
+func (q *PushBatchQueue) OnSuppressed(f func(interface{})) {
+	q.mutex.Lock()
+	q.suppressed.handler = f
+	q.unlock()
+}
+
+// CoalesceByKey merges each item put into the first pending item
+// with the same key, as returned by key, if there is one, so that
+// updates to the same thing are processed as one and batches shrink.
+// The pending item is replaced by what combine returns for it and
+// the item put, such as the sum of two deltas, and keeps its place
+// and Envelope; the Future of the item put reports the outcome of
+// the merged item. Keys must be comparable. CoalesceByKey panics if
+// key or combine is nil.
+func (q *PushBatchQueue) CoalesceByKey(key func(QueueItem) interface{}, combine func(pending, item interface{}) interface{}) {
+	defer q.guard()
+
+	c := newCoalescer(key, combine)
+
+	q.mutex.Lock()
+	q.coalesce = c
+	q.unlock()
+}
+
+// CoalescedCount returns the number of items merged into pending
+// items by CoalesceByKey since the queue was created.
+func (q *PushBatchQueue) CoalescedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.total.coalesced
+}
+
+// SmoothDispatchRate spaces the handing of items to workers
+// evenly over time at n per interval, like a leaky bucket, rather
+// than releasing bursts up to the concurrency limit. As the rate
+// applies to items, each batch then holds a single item. It is
+// equivalent to DispatchRateWithBurst(n, per, 1).
+func (q *PushBatchQueue) SmoothDispatchRate(n int, per time.Duration) {
+	q.DispatchRateWithBurst(n, per, 1)
+}
+
+// DispatchRateLimiter limits the rate at which the queue hands
+// items to workers with any RateLimiter, such as a *rate.Limiter
+// from golang.org/x/time/rate. Each item handed to a worker takes
+// one permission from the limiter. The same limiter may be given
+// to several components.
+func (q *PushBatchQueue) DispatchRateLimiter(l RateLimiter) {
+	q.mutex.Lock()
+	q.pace.setRate(l)
+	q.unlock()
+}
+
+// SharedDispatchRate limits the rate at which the queue hands
+// items to workers with a RateLimit that may also be given to
+// other components, so that their combined dispatches respect a
+// single quota.
+func (q *PushBatchQueue) SharedDispatchRate(l *RateLimit) {
+	q.DispatchRateLimiter(l)
+}
+
+// AdaptiveDispatchRate limits the rate at which the queue hands
+// items to workers with the given AdaptiveRate, which the workers
+// inform of their outcomes so that the rate follows the health of
+// the downstream.
+func (q *PushBatchQueue) AdaptiveDispatchRate(a *AdaptiveRate) {
+	q.DispatchRateLimiter(a)
+}
+
+// DispatchJitter waits a random delay of up to max before each
+// batch is handed to a worker, including the first. This spreads
+// out the load when many components start or drain against the
+// same backend at once. DispatchJitter panics if max is not
+// positive.
+func (q *PushBatchQueue) DispatchJitter(max time.Duration) {
+	defer q.guard()
+
+	j := newJitterLimiter(max)
+
+	q.mutex.Lock()
+	q.pace.jitter = j
+	q.unlock()
+}
+
+// Warmup sets a function that Start calls before any batch is
+// handed to a worker, to acquire the workers' resources or to Put
+// items preloaded from storage; Start returns once f has. If ramp
+// is positive, the number of busy workers is then allowed to grow
+// evenly from one to the concurrency over ramp, so that a cold
+// start does not stampede the services the workers call. f may be
+// nil to ramp only. Warmup panics if ramp is negative.
+func (q *PushBatchQueue) Warmup(f func(), ramp time.Duration) {
+	defer q.guard()
+
+	w := newWarmup(f, ramp)
+
+	q.mutex.Lock()
+	q.warmup = w
+	q.unlock()
+}
+
+// AlignedBatchWindow holds items back until the end of the
+// wall-clock window of length every in which they were accepted,
+// and then hands them to workers in batches. Windows are aligned to
+// multiples of every, so that with every set to 30 seconds batches
+// are dispatched at :00 and :30 past each minute, in line with the
+// windows of other processes. Items are dispatched in queue order,
+// so an item of higher priority accepted in a later window holds
+// back the items behind it until its own window closes. A draining
+// queue dispatches its items without waiting for their windows to
+// close. AlignedBatchWindow panics if every is not positive.
+func (q *PushBatchQueue) AlignedBatchWindow(every time.Duration) {
+	defer q.guard()
+
+	w := newBatchWindow(every)
+
+	q.mutex.Lock()
+	q.window = w
+	q.unlock()
+}
+
+// ExpiredCount returns the number of items that were skipped
+// because their Envelope deadline had passed by the time they
+// were due to be handed to a worker. Expired items are not
+// counted as overloads. This count is reset by Start and
+// ResetStats.
+func (q *PushBatchQueue) ExpiredCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.expired.count
+}
+
+// OnItemStart sets an event handler that will be called each time
+// an item is handed to a worker, with the time the item waited in
+// the queue. The handler is called on the worker's goroutine
+// immediately before the worker, so together with OnItemDone it
+// brackets the processing of the item.
+// The handler is called for each item of a batch before the
+// batch is handed to the worker.
+func (q *PushBatchQueue) OnItemStart(f func(item interface{}, waited time.Duration)) {
+	q.mutex.Lock()
+	q.hooks.onStart = f
+	q.unlock()
+}
+
+// OnItemDone sets an event handler that will be called each time a
+// worker has finished with an item, with the time the worker took.
+// The handler is called on the worker's goroutine immediately after
+// the worker returns, including when the worker panicked and the
+// panic was reported through the item's Future.
+// The handler is called for each item of a batch after the worker
+// has returned, with the time the whole batch took.
+func (q *PushBatchQueue) OnItemDone(f func(item interface{}, elapsed time.Duration)) {
+	q.mutex.Lock()
+	q.hooks.onDone = f
+	q.unlock()
+}
+
+// ResultWorker sets a worker that returns a result for each item of
+// the batch it is handed, in the same order, in place of the worker
+// the queue was created with. Each result is passed to the OnResult
+// handler, kept for DrainResults if CollectResults has been called,
+// and reported by its item's Future, so that the outcome of each
+// item can be told apart within a batch. Items the worker returns
+// no result for are given ErrNoResult. ResultWorker should be
+// called before the queue is started, and panics if worker is nil.
+func (q *PushBatchQueue) ResultWorker(worker func(items []interface{}) []Result) {
+	defer q.guard()
+
+	r := newBatchResulter(worker)
+
+	q.mutex.Lock()
+	q.resulter = r
+	q.unlock()
+}
+
+// AckWorker sets a worker that acknowledges the items of the batch
+// it is handed through ack, in place of the worker the queue was
+// created with, so that, fed by Consume, a broker's messages are
+// acknowledged, and its offsets committed, only once the worker has
+// acknowledged them. An item the worker fails or leaves
+// unacknowledged when it returns is tried again in a later batch,
+// up to maxAttempts attempts in all, each time after the delay that
+// backoff returns for the number of attempts made so far. While it
+// waits, the item takes up neither buffer space nor a worker; it is
+// counted by ScheduledRetries, and a drain is not complete until it
+// has been retried. Each attempt counts as processed. The item's
+// Future reports nil once it is acknowledged, or else the error it
+// failed with last, ErrNotAcked or a *PanicError. AckWorker should
+// be called before the queue is started, and panics if worker or
+// backoff is nil or maxAttempts is not positive.
+func (q *PushBatchQueue) AckWorker(worker func(items []interface{}, ack *BatchAck), backoff func(attempts int) time.Duration, maxAttempts int) {
+	defer q.guard()
+
+	a := newAcker(worker, backoff, maxAttempts)
+
+	q.mutex.Lock()
+	q.acker = a
+	q.unlock()
+}
+
+// ScheduledRetries returns the number of items failed by the worker
+// set with AckWorker that are waiting to be tried again.
+func (q *PushBatchQueue) ScheduledRetries() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.retries
+}
+
+// OnResult sets an event handler that will be called with the
+// result of each item processed by a ResultWorker. To receive the
+// results on a channel, send them from f.
+func (q *PushBatchQueue) OnResult(f func(Result)) {
+	q.mutex.Lock()
+	q.results.handler = f
+	q.unlock()
+}
+
+// CollectResults tells the queue to keep the result of each item
+// processed by a ResultWorker until DrainResults returns them.
+func (q *PushBatchQueue) CollectResults() {
+	q.mutex.Lock()
+	q.results.collect = true
+	q.unlock()
+}
+
+// DrainResults drains the queue as WaitForDrain does, and returns
+// the results kept since CollectResults was called or the results
+// were last returned, together with any *DrainTimeoutError.
+func (q *PushBatchQueue) DrainResults(timeout time.Duration) ([]Result, error) {
+	err := WaitForDrain(q, timeout)
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.results.take(), err
+}
+
+// OnExpired sets an event handler that will be called for every
+// item skipped because its deadline had passed.
+func (q *PushBatchQueue) OnExpired(f func(interface{})) {
+	q.mutex.Lock()
+	q.expired.handler = f
+	q.unlock()
+}
+
+// DroppedWhileDrainingCount returns the number of items refused
+// because they were put while the queue was draining. Such items
+// are lost at shutdown rather than for lack of capacity, so they
+// are not counted as overloads. This count is reset by Start
+// and ResetStats.
+func (q *PushBatchQueue) DroppedWhileDrainingCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.drainDropped.count
+}
+
+// OnDroppedWhileDraining sets an event handler that will be called
+// for every item refused because it was put while the queue was
+// draining. Such items do not raise the OnOverload and
+// OnFirstOverload events.
+func (q *PushBatchQueue) OnDroppedWhileDraining(f func(interface{})) {
+	q.mutex.Lock()
+	q.drainDropped.handler = f
+	q.unlock()
+}
+
+// OnThreshold sets an event handler that will be called when the
+// count of items in the queue rises to level, a fraction of the
+// queue depth, and again when it falls back below level less
+// hysteresis, so that a count hovering around the level does not
+// raise a stream of events. Unlike the other events, any number of
+// thresholds may be set, each with its own handler, for graduated
+// alerts; each is removed by unsubscribing the returned
+// Subscription. OnThreshold panics unless 0 < level <= 1 and
+// 0 <= hysteresis < level.
+func (q *PushBatchQueue) OnThreshold(level, hysteresis float64, f func(ThresholdEvent)) *Subscription {
+	defer q.guard()
+
+	t := newThreshold(level, hysteresis, f)
+
+	q.mutex.Lock()
+	q.levels = append(q.levels, t)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	q.unlock()
+
+	return newSubscription(&q.mutex, func() {
+		q.levels = q.levels.remove(t)
+	})
+}
+
+// OnAlert sets an alert that calls alert when the count of items in
+// the queue has stayed at or above level, a fraction of the queue
+// depth, for the sustain period, and then calls cleared, if not nil,
+// once the count falls back below level less hysteresis. A count
+// that falls back before the period is over raises nothing, so a
+// count flapping around the level does not raise a stream of
+// alerts. Any number of alerts may be set; each is removed by
+// unsubscribing the returned Subscription. OnAlert panics unless
+// 0 < level <= 1, 0 <= hysteresis < level and sustain is not
+// negative.
+func (q *PushBatchQueue) OnAlert(level, hysteresis float64, sustain time.Duration, alert, cleared func(AlertEvent)) *Subscription {
+	defer q.guard()
+
+	a, t := newAlert(level, hysteresis, sustain, alert, cleared)
+	a.attach(&q.mutex, q.unlock, &q.events)
+
+	q.mutex.Lock()
+	q.levels = append(q.levels, t)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	q.unlock()
+
+	return newSubscription(&q.mutex, func() {
+		q.levels = q.levels.remove(t)
+		a.remove()
+	})
+}
+
+// Subscribe adds the given event handlers to those of the queue,
+// without replacing the handlers set with the On methods or by
+// other subscriptions. The handlers are removed by unsubscribing
+// the returned Subscription.
+func (q *PushBatchQueue) Subscribe(h Handlers) *Subscription {
+	q.mutex.Lock()
+	sub := q.events.subscribe(h)
+	q.hooks.subs = q.events.subs
+	q.unlock()
+
+	return newSubscription(&q.mutex, func() {
+		q.events.unsubscribe(sub)
+		q.hooks.subs = q.events.subs
+	})
+}
+
 // OnOverload sets an event handler that will be called *every
 // time* a client attempts to overload the queue. The handler
 // is passed the value of the Overload register.
 func (q *PushBatchQueue) OnOverload(f func(interface{})) {
+	q.mutex.Lock()
 	q.onOverload = f
+	q.unlock()
+}
+
+// OnOverloadEvent sets an event handler that will be called every
+// time an item is dropped as an overload, like OnOverload, but with
+// an OverloadEvent telling why the item was dropped and the state of
+// the queue at the time.
+func (q *PushBatchQueue) OnOverloadEvent(f func(OverloadEvent)) {
+	q.mutex.Lock()
+	q.onOverloadEvent = f
+	q.unlock()
 }
 
 // OnFirstOverload sets an event handler that will be called the first
 // time a client attempts to overload the queue.
 func (q *PushBatchQueue) OnFirstOverload(f func(interface{})) {
+	q.mutex.Lock()
 	q.onFirstOverload = f
+	q.unlock()
 }
 
 // Put adds an item to the queue for processing. If the count
 // of items in the queue is at the queue depth, then
 // the Overload flag is set and the item is dropped on the floor.
+// If DropOldestOnOverload is set, the oldest item is dropped
+// instead, except while the queue is draining, when the item is
+// dropped and reported to the OnDroppedWhileDraining handler
+// instead.
 func (q *PushBatchQueue) Put(item interface{}) {
+	e := envelop(item)
+
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	defer q.unlock()
 
-	if q.Count() >= q.Depth() || q.draining {
-		var dropItem interface{}
-		if q.dropOldestOnOverload {
-			dropItem = q.items[:1][0]
-			q.items = append(q.items[1:], item)
-			go q.get()
+	q.total.put++
+	now := time.Now()
+	if q.intakeRate != nil && !q.intakeRate.take(now) {
+		q.total.throttled += q.throttled.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+		return
+	}
+	if q.dedupe.duplicate(e, q.deliverEnvelopes, now) {
+		q.total.dropped += q.suppressed.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+		return
+	}
+	if !q.draining && q.coalesce.merge(q.items, e, q.deliverEnvelopes) {
+		q.total.coalesced++
+		return
+	}
+
+	q.add(e)
+	go q.get()
+}
+
+// add adds e to the pending items, or handles it according to the
+// overload policy if the queue is full or draining. It must be
+// called with the mutex held.
+func (q *PushBatchQueue) add(e *Envelope) {
+	if q.pressure.paused() && !q.draining {
+		q.total.dropped += q.shed.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+		return
+	}
+	if len(q.items) >= q.pressure.capacity(q.depth) || q.draining {
+		var dropItem *Envelope
+		if q.dropOldestOnOverload && !q.draining {
+			dropItem = q.items[0]
+			q.items = append(q.items[1:], e)
 		} else {
-			dropItem = item
-		}
-		q.overload++
-		if q.onOverload != nil {
-			q.onOverload(dropItem)
-		}
-		if q.overload == 1 && q.onFirstOverload != nil {
-			q.onFirstOverload(dropItem)
+			dropItem = e
 		}
+		q.overloaded([]*Envelope{dropItem}, q.overloadReason())
 		return
 	}
 
-	q.items = append(q.items, item)
-	go q.get()
+	q.items = append(q.items, e)
+}
+
+// PutFuture adds an item to the queue like Put and returns a
+// Future that is resolved when the worker processing the item's
+// batch has finished, or when the item is dropped or removed
+// from the queue.
+func (q *PushBatchQueue) PutFuture(item interface{}) *Future {
+	e := envelop(item)
+	e.future = newFuture()
+	q.Put(e)
+	return e.future
+}
+
+// PutAndWait adds an item to the queue and blocks until the
+// worker processing the item's batch has finished or ctx is done.
+// It returns the same outcome as the item's Future, or ctx.Err()
+// if ctx is done first, in which case the item remains in the
+// queue.
+func (q *PushBatchQueue) PutAndWait(ctx context.Context, item interface{}) error {
+	return q.PutFuture(item).WaitContext(ctx)
 }
 
 func (q *PushBatchQueue) readyToWork() bool {
-	return (q.started || q.draining) &&
+	return (q.started && !q.suspended || q.draining) &&
 		q.availableWorkers > 0 &&
-		len(q.items) > 0
+		len(q.items) > 0 &&
+		q.warmup.allows(time.Now(), q.concurrency-q.availableWorkers, q.concurrency)
 }
 
 func (q *PushBatchQueue) get() {
+	q.mutex.Lock()
+	q.levels.check(len(q.items), q.depth, &q.events)
+
 	if !q.readyToWork() {
+		q.unlock()
 		return
 	}
 
-	q.mutex.Lock()
+	now := time.Now()
+	if q.pace.delayed(now) {
+		q.unlock()
+		return
+	}
 
-	if !q.readyToWork() {
-		q.mutex.Unlock()
+	var batch, expired []*Envelope
+	cost := 0
+	taken := 0
+	for taken < len(q.items) && len(batch) < q.batchSize {
+		e := q.items[taken]
+		if e.expired(now) {
+			expired = append(expired, e)
+			taken++
+			continue
+		}
+		if q.window != nil && !q.draining {
+			if closes := q.window.closes(e); closes.After(now) {
+				// try again when its window closes
+				q.pace.retryAfter(closes.Sub(now))
+				break
+			}
+		}
+		itemCost := q.costs.of(e.payload(q.deliverEnvelopes))
+		if !q.costs.fits(cost, itemCost) {
+			break
+		}
+		if !q.pace.allow() {
+			break
+		}
+		cost += itemCost
+		batch = append(batch, e)
+		taken++
+	}
+	q.items = q.items[taken:]
+	q.levels.check(len(q.items), q.depth, &q.events)
+	q.total.expired += q.expired.add(expired, q.deliverEnvelopes, &q.events)
+	if len(batch) == 0 {
+		if q.draining && q.idle() {
+			q.setDrained()
+		}
+		// otherwise a completing worker will try again
+		q.unlock()
 		return
 	}
 
 	q.availableWorkers--
-
-	lastIndex := q.batchSize
-	if len(q.items) < lastIndex {
-		lastIndex = len(q.items)
+	q.total.inFlight += len(batch)
+	q.costs.inFlight += cost
+	items := make([]interface{}, len(batch))
+	for i, e := range batch {
+		e.Attempts++
+		items[i] = e.payload(q.deliverEnvelopes)
 	}
 
-	batch := q.items[:lastIndex]
-	q.items = q.items[lastIndex:]
-
-	q.mutex.Unlock()
+	hooks, res, ack := q.hooks, q.resulter, q.acker
 
-	q.doWork(batch)
+	q.unlock()
 
-	if !q.draining {
-		go q.get()
-	}
+	q.doWork(batch, items, cost, hooks, res, ack)
 }
 
-func (q *PushBatchQueue) doWork(batch []interface{}) {
-
+func (q *PushBatchQueue) doWork(batch []*Envelope, items []interface{}, cost int, hooks itemHooks, res *batchResulter, ack *acker) {
 	done := make(chan bool)
+	var results []Result
+	var retries []retryAfter
 	go func() {
-		q.worker(batch)
+		var started time.Time
+		for i, e := range batch {
+			started = hooks.start(e, items[i])
+		}
+		q.safely(func() {
+			if ack != nil {
+				retries = ack.run(batch, items)
+				return
+			}
+			if res != nil {
+				results = res.run(batch, items)
+				return
+			}
+			call(func() {
+				q.worker(items)
+			}, batch...)
+		})
+		for _, item := range items {
+			hooks.done(item, started)
+		}
 		done <- true
 	}()
 	<-done
 
-	q.workerCompleted()
+	q.workerCompleted(len(batch), cost, results, retries)
 }
 
-func (q *PushBatchQueue) workerCompleted() {
+// workerCompleted records that the worker of a batch of n items has
+// returned, with the results of a ResultWorker or the items an
+// AckWorker left to be tried again.
+func (q *PushBatchQueue) workerCompleted(n int, cost int, results []Result, retries []retryAfter) {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	defer q.unlock()
+
+	q.costs.inFlight -= cost
+	q.total.inFlight -= n
+	q.total.processed += n
+	for _, r := range results {
+		q.results.deliver(r, &q.events)
+	}
+	for _, r := range retries {
+		e := r.e
+		q.retries++
+		time.AfterFunc(r.after, func() {
+			q.retryDue(e)
+		})
+	}
 
 	if q.availableWorkers < q.concurrency {
 		q.availableWorkers++
 	}
 
-	if q.availableWorkers == q.concurrency && len(q.items) == 0 {
-		if q.draining {
-			// final worker has completed
-			q.setDrained()
-			return
-		}
+	if q.draining && q.idle() {
+		// final worker has completed
+		q.setDrained()
+		return
 	}
 
 	go q.get()
 }
 
-func (q *PushBatchQueue) setDrained() {
-	if q.onDrained != nil {
-		go q.onDrained()
+// retryDue puts back e, whose retry was scheduled, for another
+// attempt, even while draining if there is room.
+func (q *PushBatchQueue) retryDue(e *Envelope) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.retries--
+	q.total.put++
+	if len(q.items) < q.depth {
+		q.items = append(q.items, e)
+	} else {
+		q.add(e)
+	}
+	if q.draining && q.idle() {
+		q.setDrained()
+		return
+	}
+	go q.get()
+}
+
+// overloaded drops the given items and raises the overload events
+// for them. Items refused because the queue is draining are counted
+// apart from overloads. It must be called with the mutex held,
+// after the items have been removed from the queue.
+func (q *PushBatchQueue) overloaded(dropped []*Envelope, reason OverloadReason) {
+	if reason == OverloadDraining {
+		n := q.drainDropped.count
+		q.total.dropped += q.drainDropped.add(dropped, q.deliverEnvelopes, &q.events)
+		for i, e := range dropped {
+			q.overloadEvent(e, reason, n+i+1)
+		}
+		return
+	}
+
+	first := q.overload == 0
+	for _, e := range dropped {
+		e.resolve(ErrDropped)
+		q.events.audited(e.payload(q.deliverEnvelopes), reason.dropReason())
+		q.total.dropped++
+		q.overload++
+		if q.onOverload != nil {
+			q.events.item(q.onOverload, e.payload(q.deliverEnvelopes))
+		}
+		q.overloads.add(e.payload(q.deliverEnvelopes))
+		q.overloadEvent(e, reason, q.overload)
+	}
+	if first && len(dropped) > 0 {
+		item := dropped[0].payload(q.deliverEnvelopes)
+		if q.onFirstOverload != nil {
+			q.events.item(q.onFirstOverload, item)
+		}
+		q.events.subscribed(pickFirstOverload, item)
+	}
+}
+
+// OnOverloadSummary sets an event handler that will be called at
+// most once per period, with the number of overloads in the period
+// and a sample of the dropped items. Unlike OnOverload, which is
+// called for every dropped item, it stays cheap however fast items
+// are dropped. Items refused while draining are not included. The
+// period also applies to the OverloadSummary handlers of
+// subscriptions, which may set it with a nil f. OnOverloadSummary
+// panics if f is not nil and period is not positive.
+func (q *PushBatchQueue) OnOverloadSummary(period time.Duration, f func(OverloadSummary)) {
+	defer q.guard()
+
+	checkSummaryPeriod(period, f)
+
+	q.mutex.Lock()
+	q.overloads.set(period, f, q.reportOverloads)
+	q.unlock()
+}
+
+// reportOverloads raises the summary of the overloads in the period
+// that has ended.
+func (q *PushBatchQueue) reportOverloads() {
+	q.mutex.Lock()
+	q.overloads.report(&q.events)
+	q.unlock()
+}
+
+// overloadEvent raises the OnOverloadEvent event for a dropped
+// item. It must be called with the mutex held.
+func (q *PushBatchQueue) overloadEvent(e *Envelope, reason OverloadReason, overloads int) {
+	q.events.overload(q.onOverloadEvent, OverloadEvent{
+		Item:      e.payload(q.deliverEnvelopes),
+		Reason:    reason,
+		Overloads: overloads,
+		Count:     len(q.items),
+		Capacity:  q.depth})
+}
+
+// overloadReason returns the reason for an overload occurring now.
+// It must be called with the mutex held.
+func (q *PushBatchQueue) overloadReason() OverloadReason {
+	if q.draining {
+		return OverloadDraining
 	}
+	return OverloadFull
+}
+
+// CheckInvariants verifies that the queue's accounting of its items
+// and workers is consistent, and returns an error describing the
+// first inconsistency found.
+func (q *PushBatchQueue) CheckInvariants() error {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.total.check(len(q.items), q.depth, q.availableWorkers, q.concurrency, q.costs.inFlight)
+}
+
+// drained reports whether the component has finished draining, or
+// was never draining, with nothing left to process.
+func (q *PushBatchQueue) drained() bool {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return !q.draining && q.idle()
+}
+
+// idle reports whether the queue has nothing left to process: no
+// pending items, no batches in flight and no scheduled retries. It
+// must be called with the mutex held.
+func (q *PushBatchQueue) idle() bool {
+	return len(q.items) == 0 && q.availableWorkers == q.concurrency && q.retries == 0
+}
+
+// busyWorkers returns the number of workers currently processing.
+func (q *PushBatchQueue) busyWorkers() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.concurrency - q.availableWorkers
+}
+
+// setDrained ends draining and raises the drained event. It must be
+// called with the mutex held.
+func (q *PushBatchQueue) setDrained() {
+	q.events.drained(q.onDrained, q.onDrainSummary,
+		q.drain.summary(q.total.processed, q.drainDropped.count))
 	q.draining = false
+	q.changeState(StateDraining, CauseDrained)
+}
+
+// State returns the lifecycle state of the queue.
+func (q *PushBatchQueue) State() State {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.state()
+}
+
+func (q *PushBatchQueue) state() State {
+	return stateOf(q.started, q.draining)
+}
+
+// OnStateChange sets an event handler that will be called when the
+// queue changes state, with the cause of the change.
+func (q *PushBatchQueue) OnStateChange(f func(StateChangeEvent)) {
+	q.mutex.Lock()
+	q.onStateChange = f
+	q.unlock()
+}
+
+// changeState raises the state change event for a change from the
+// given state to the current one. It must be called with the mutex
+// held.
+func (q *PushBatchQueue) changeState(from State, cause StateCause) {
+	q.events.stateChange(q.onStateChange, from, q.state(), cause)
+}
+
+// unlock releases the mutex and then delivers the events held for
+// synchronous delivery, if any.
+func (q *PushBatchQueue) unlock() {
+	pending := q.events.take()
+	q.mutex.Unlock()
+	deliver(pending)
 }
@@ -0,0 +1,71 @@
+package push_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestBatchQueueSnapshot(t *testing.T) {
+	q := NewPushBatchQueue(1, 10, 3, func(items []interface{}) {})
+	for i := 1; i <= 4; i++ {
+		q.Put(i)
+	}
+
+	snap := q.Snapshot()
+	if !reflect.DeepEqual(snap.Items, []QueueItem{1, 2, 3, 4}) {
+		t.Errorf("got items %v, want [1 2 3 4]", snap.Items)
+	}
+	if snap.InFlight != 0 || snap.Capacity != 10 || snap.State != StateStopped || snap.Taken.IsZero() {
+		t.Errorf("got snapshot %+v, want 0 in flight of 10, stopped", snap)
+	}
+	snap.Items[0] = 99
+	if got := q.Items(); !reflect.DeepEqual(got, []QueueItem{1, 2, 3, 4}) {
+		t.Errorf("queue items changed to %v through the snapshot", got)
+	}
+}
+
+func TestBatchResultWorker(t *testing.T) {
+	q := NewPushBatchQueue(1, 10, 3, nil)
+	q.ResultWorker(func(items []interface{}) []Result {
+		results := make([]Result, 0, len(items))
+		for _, item := range items {
+			if item == "short" {
+				break
+			}
+			if item == "bad" {
+				results = append(results, Result{Err: errors.New("bad item")})
+				continue
+			}
+			results = append(results, Result{Value: len(item.(string))})
+		}
+		return results
+	})
+	q.CollectResults()
+
+	good := q.PutFuture("good")
+	bad := q.PutFuture("bad")
+	short := q.PutFuture("short")
+	q.Start()
+
+	if err := good.Wait(); err != nil || good.Value() != 4 {
+		t.Errorf("got value %v and error %v for good item", good.Value(), err)
+	}
+	if err := bad.Wait(); err == nil {
+		t.Error("got no error for bad item")
+	}
+	if err := short.Wait(); err != ErrNoResult {
+		t.Errorf("got error %v for item without result, want ErrNoResult", err)
+	}
+
+	results, err := q.DrainResults(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Item != "good" || results[2].Item != "short" {
+		t.Errorf("got results %+v", results)
+	}
+}
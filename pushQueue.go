@@ -1,7 +1,9 @@
 package push
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
 // PushQueue holds the processing and state information
@@ -11,14 +13,58 @@ type PushQueue struct {
 	concurrency          int
 	availableWorkers     int
 	depth                int
-	items                []interface{}
+	items                []*Envelope
+	deliverEnvelopes     bool
+	keyFunc              func(QueueItem) interface{}
 	started              bool
+	suspended            bool
+	run                  int
+	stopOnCancel         bool
 	draining             bool
 	overload             int
+	intakeRate           *tokenBucket
+	throttled            skipCount
+	shed                 skipCount
+	suppressed           skipCount
+	dedupe               *dedupe
+	forwarder            Forwarder
+	forwarded            int
+	pressure             pressure
+	expired              skipCount
+	drainDropped         skipCount
+	pace                 pacer
+	warmup               warmup
+	costs                costLimit
+	levels               thresholds
+	micro                *microBatch
+	fair                 *fairShare
+	aging                *aging
+	deadlineFirst        bool
+	policy               SchedulingPolicy
+	shortest             *shortestFirst
+	affinity             *affinity
+	tenants              *tenants
+	preempt              *preemptor
+	retry                *retrier
+	retries              int
+	resulter             *resulter
+	results              results
+	once                 *exactlyOnce
+	skippedProcessed     int
+	onStoreError         func(error)
+	total                totals
+	hooks                itemHooks
+	events               eventQueue
+	safe                 safety
 	dropOldestOnOverload bool
 	onOverload           func(interface{})
 	onFirstOverload      func(interface{})
+	onOverloadEvent      func(OverloadEvent)
+	overloads            overloadSummary
 	onDrained            func()
+	onDrainSummary       func(DrainSummary)
+	onStateChange        func(StateChangeEvent)
+	drain                drainStats
 	mutex                sync.Mutex
 }
 
@@ -32,8 +78,27 @@ type PushQueuePut interface {
 	IsStarted() bool
 }
 
-// compile-time check that interface is satisfied
+// PushQueuePutEvents extends PushQueuePut with the event
+// registration methods, so that clients holding only the
+// interface can still attach handlers to the queue's events.
+type PushQueuePutEvents interface {
+	PushQueuePut
+	OnOverload(func(interface{}))
+	OnFirstOverload(func(interface{}))
+	OnDrained(func())
+}
+
+// PushQueuePutFuture extends PushQueuePut with PutFuture, for
+// clients that need to know when each of their items is done.
+type PushQueuePutFuture interface {
+	PushQueuePut
+	PutFuture(interface{}) *Future
+}
+
+// compile-time check that interfaces are satisfied
 var _ PushQueuePut = (*PushQueue)(nil)
+var _ PushQueuePutEvents = (*PushQueue)(nil)
+var _ PushQueuePutFuture = (*PushQueue)(nil)
 
 // NewPushQueue creates a new PushQueue with the given concurrency,
 // depth and worker. The worker is the function that will be called
@@ -52,44 +117,275 @@ func NewPushQueue(concurrency int, depth int, worker func(interface{})) *PushQue
 		concurrency:      concurrency,
 		availableWorkers: concurrency,
 		depth:            depth,
-		items:            make([]interface{}, 0, depth),
-		worker:           worker}
+		items:            make([]*Envelope, 0, depth),
+		worker:           worker,
+		throttled:        skipCount{err: ErrThrottled, reason: DropThrottled, pick: pickThrottled},
+		shed:             skipCount{err: ErrShed, reason: DropShed, pick: pickShed},
+		suppressed:       skipCount{err: ErrDuplicate, reason: DropDuplicate, pick: pickSuppressed},
+		expired:          skipCount{err: ErrExpired, reason: DropExpired, pick: pickExpired},
+		drainDropped:     skipCount{err: ErrDropped, reason: DropDraining, pick: pickDroppedWhileDraining}}
+	q.pace = newPacer(&q.mutex, q.get)
 
 	return q
 }
 
+// CloneConfig returns a new, unstarted queue with the same
+// concurrency, depth, worker, policies and event handlers as the
+// queue, and an empty buffer. Dispatch and intake rates set on the
+// queue are given afresh to the clone, while a limiter given to the
+// queue, such as with SharedDispatchRate, is shared with it.
+// Handlers added with Subscribe, OnThreshold or OnAlert are not
+// copied, as their Subscriptions belong to the queue.
+func (q *PushQueue) CloneConfig() *PushQueue {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	c := &PushQueue{
+		concurrency:          q.concurrency,
+		availableWorkers:     q.concurrency,
+		depth:                q.depth,
+		items:                make([]*Envelope, 0, q.depth),
+		worker:               q.worker,
+		deliverEnvelopes:     q.deliverEnvelopes,
+		keyFunc:              q.keyFunc,
+		stopOnCancel:         q.stopOnCancel,
+		throttled:            q.throttled.clone(),
+		shed:                 q.shed.clone(),
+		suppressed:           q.suppressed.clone(),
+		dedupe:               q.dedupe.clone(),
+		forwarder:            q.forwarder,
+		expired:              q.expired.clone(),
+		drainDropped:         q.drainDropped.clone(),
+		costs:                q.costs.clone(),
+		hooks:                q.hooks.clone(),
+		events:               eventQueue{sync: q.events.sync, onPanic: q.events.onPanic, audit: q.events.audit},
+		safe:                 q.safe,
+		fair:                 q.fair.clone(),
+		aging:                q.aging,
+		deadlineFirst:        q.deadlineFirst,
+		policy:               q.policy,
+		shortest:             q.shortest,
+		affinity:             q.affinity.clone(),
+		tenants:              q.tenants.clone(),
+		preempt:              q.preempt.clone(),
+		retry:                q.retry,
+		resulter:             q.resulter,
+		results:              results{handler: q.results.handler, collect: q.results.collect},
+		once:                 q.once,
+		onStoreError:         q.onStoreError,
+		dropOldestOnOverload: q.dropOldestOnOverload,
+		onOverload:           q.onOverload,
+		onFirstOverload:      q.onFirstOverload,
+		onOverloadEvent:      q.onOverloadEvent,
+		onDrained:            q.onDrained,
+		onDrainSummary:       q.onDrainSummary,
+		onStateChange:        q.onStateChange}
+	if q.intakeRate != nil {
+		c.intakeRate = q.intakeRate.clone()
+	}
+	c.pace = q.pace.clone(&c.mutex, c.get)
+	c.warmup = newWarmup(q.warmup.run, q.warmup.ramp)
+	c.overloads.set(q.overloads.period, q.overloads.handler, c.reportOverloads)
+	if q.micro != nil {
+		c.micro = q.micro.clone()
+		c.levels = thresholds{c.micro.level}
+	}
+
+	return c
+}
+
 // Start begins queue processing. Start panics if no worker
 // has been set.
 func (q *PushQueue) Start() {
-	if q.worker == nil {
+	q.start()
+}
+
+// start begins processing and returns the number of the new run.
+func (q *PushQueue) start() int {
+	defer q.guard()
+
+	if q.worker == nil && q.preempt == nil && q.retry == nil && q.resulter == nil {
 		panic("no worker set")
 	}
+
+	q.mutex.Lock()
+	prepare := q.warmup.run
+	q.unlock()
+	if prepare != nil {
+		prepare()
+	}
+
+	q.mutex.Lock()
+	from := q.state()
 	q.started = true
 	q.draining = false
-	q.overload = 0
+	q.changeState(from, CauseCall)
+	q.resetStats()
+	q.run++
+	run := q.run
+	q.warmup.begin(time.Now(), q.concurrency, q.get)
+	q.unlock()
+
 	go q.get()
+	return run
+}
+
+// ResetStats resets the counts of overloads, expired, throttled,
+// shed, suppressed and dropped-while-draining items, as Start does,
+// without affecting processing. After a reset the next overload
+// raises the OnFirstOverload event again.
+func (q *PushQueue) ResetStats() {
+	q.mutex.Lock()
+	q.resetStats()
+	q.unlock()
+}
+
+// resetStats resets the counts. It must be called with the mutex
+// held.
+func (q *PushQueue) resetStats() {
+	q.overload = 0
+	q.expired.count = 0
+	q.throttled.count = 0
+	q.shed.count = 0
+	q.suppressed.count = 0
+	q.drainDropped.count = 0
+}
+
+// StartContext begins queue processing like Start, and ties the
+// queue's lifetime to ctx: when ctx is done, the queue is drained,
+// or stopped if StopOnCancel has been set. Calling Start, Stop or
+// StartContext again releases the queue from ctx.
+func (q *PushQueue) StartContext(ctx context.Context) {
+	run := q.start()
+	go func() {
+		<-ctx.Done()
+		q.mutex.Lock()
+		current := q.run == run && q.started
+		stop := q.stopOnCancel
+		q.unlock()
+		if !current {
+			return
+		}
+		if stop {
+			q.stop(CauseContext)
+		} else {
+			q.startDrain(CauseContext)
+		}
+	}()
+}
+
+// StopOnCancel tells a queue started with StartContext to Stop,
+// rather than Drain, when its context is done.
+func (q *PushQueue) StopOnCancel() {
+	q.mutex.Lock()
+	q.stopOnCancel = true
+	q.unlock()
 }
 
 // IsStarted indicates whether the queue is started. This method
 // returns true when the queue is available to clients to Put
 // items. IsStarted returns false when the queue is draining.
 func (q *PushQueue) IsStarted() bool {
+	q.mutex.Lock()
+	defer q.unlock()
+
 	return q.started
 }
 
+// SuspendIntake stops the queue from handing items to its workers,
+// while it goes on accepting Puts and keeping them, until
+// ResumeIntake is called. Unlike Stop, it leaves the queue started,
+// and unlike Start, ResumeIntake leaves the counts as they are. A
+// drain proceeds even while intake is suspended.
+func (q *PushQueue) SuspendIntake() {
+	q.mutex.Lock()
+	q.suspended = true
+	q.unlock()
+}
+
+// ResumeIntake resumes handing items to workers after
+// SuspendIntake.
+func (q *PushQueue) ResumeIntake() {
+	q.mutex.Lock()
+	q.suspended = false
+	n := q.availableWorkers
+	q.unlock()
+
+	for i := 0; i < n; i++ {
+		go q.get()
+	}
+}
+
 // Stop ends processing of queue items. This also ends
 // draining of items if Drain has been called.
 func (q *PushQueue) Stop() {
+	q.stop(CauseCall)
+}
+
+func (q *PushQueue) stop(cause StateCause) {
+	q.mutex.Lock()
+	q.halt(cause)
+	q.unlock()
+}
+
+// halt ends processing. It must be called with the mutex held.
+func (q *PushQueue) halt(cause StateCause) {
+	from := q.state()
+	q.run++
 	q.started = false
 	q.draining = false
+	q.changeState(from, cause)
+}
+
+// Absorb moves the items pending in other into the queue, as though
+// they had been Put in the order they were pending in other, and
+// stops other. Items that do not fit are handled according to the
+// queue's overload policy. Items already being processed by other's
+// workers are left to finish there. Absorb panics if other is the
+// queue itself.
+func (q *PushQueue) Absorb(other *PushQueue) {
+	defer q.guard()
+
+	if other == q {
+		panic("cannot absorb a queue into itself")
+	}
+
+	other.mutex.Lock()
+	items := other.items
+	other.items = make([]*Envelope, 0, other.depth)
+	other.total.removed += len(items)
+	other.halt(CauseCall)
+	other.levels.check(0, other.depth, &other.events)
+	other.unlock()
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.total.put += len(items)
+	for _, e := range items {
+		q.add(e)
+	}
+	go q.get()
 }
 
 // Drain processes remaining items in the queue and prevents
 // new items from being put onto the queue.
 func (q *PushQueue) Drain() {
+	q.startDrain(CauseCall)
+}
+
+func (q *PushQueue) startDrain(cause StateCause) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	from := q.state()
+	if !q.draining {
+		q.drain.begin(q.total.processed, q.drainDropped.count)
+	}
 	q.draining = true
 	q.started = false
-	if q.Count() == 0 && q.availableWorkers == q.concurrency {
+	q.changeState(from, cause)
+	if q.idle() {
 		q.setDrained()
 	}
 	go q.get()
@@ -98,7 +394,18 @@ func (q *PushQueue) Drain() {
 // OnDrained sets an event handler that will be called when
 // the draining is complete.
 func (q *PushQueue) OnDrained(f func()) {
+	q.mutex.Lock()
 	q.onDrained = f
+	q.unlock()
+}
+
+// OnDrainSummary sets an event handler that will be called when the
+// draining is complete, like the OnDrained handler, with a summary
+// of the drain.
+func (q *PushQueue) OnDrainSummary(f func(DrainSummary)) {
+	q.mutex.Lock()
+	q.onDrainSummary = f
+	q.unlock()
 }
 
 // Empty removes all items currently in the queue. This method
@@ -106,182 +413,1833 @@ func (q *PushQueue) OnDrained(f func()) {
 // queue.
 func (q *PushQueue) Empty() {
 	q.mutex.Lock()
-	q.items = make([]interface{}, 0, q.Depth())
-	q.mutex.Unlock()
+	for _, e := range q.items {
+		e.resolve(ErrRemoved)
+	}
+	q.total.removed += len(q.items)
+	q.items = make([]*Envelope, 0, q.depth)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+	q.unlock()
+}
+
+// Items returns a snapshot of the items currently in the queue,
+// oldest first. The returned slice is a copy taken under lock; it
+// is safe to read and modify, and does not change as the queue
+// is processed.
+func (q *PushQueue) Items() []QueueItem {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.pending()
+}
+
+// Snapshot returns a copy of the items currently in the queue,
+// oldest first, together with the queue's state, all taken at the
+// same moment under lock.
+func (q *PushQueue) Snapshot() Snapshot {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return Snapshot{
+		Items:    q.pending(),
+		InFlight: q.total.inFlight,
+		Capacity: q.depth,
+		State:    q.state(),
+		Taken:    time.Now()}
+}
+
+// ForEach calls f for each item currently in the queue, oldest
+// first, until f returns false. Unlike Items, it does not copy the
+// queue; instead f is called with the mutex held, so it must be
+// quick and must not call back into the queue.
+func (q *PushQueue) ForEach(f func(QueueItem) bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	for _, e := range q.items {
+		if !f(e.payload(q.deliverEnvelopes)) {
+			return
+		}
+	}
+}
+
+// Sort reorders the items currently in the queue within their
+// priority bands, as though the items of each priority had been put
+// in the order given by less, which reports whether item a goes
+// before item b. Items of different priorities are never reordered;
+// when no priorities are used the whole queue is one band. The sort
+// is stable, and less is called with the mutex held, so it must not
+// call back into the queue.
+func (q *PushQueue) Sort(less func(a, b QueueItem) bool) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	sortItems(q.items, less, q.deliverEnvelopes)
+}
+
+// String returns a one-line description of the queue's state, for
+// logs.
+func (q *PushQueue) String() string {
+	return q.describe().String()
+}
+
+// Dump returns a multi-line description of the queue's settings,
+// state and counts, with a sample of the pending items, for logs and
+// crash reports.
+func (q *PushQueue) Dump() string {
+	return q.describe().dump()
+}
+
+func (q *PushQueue) describe() *description {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	sample, more := sampleItems(q.items, q.deliverEnvelopes)
+	return &description{
+		kind:        "PushQueue",
+		state:       q.state(),
+		count:       len(q.items),
+		capacity:    q.depth,
+		inFlight:    q.total.inFlight,
+		available:   q.availableWorkers,
+		concurrency: q.concurrency,
+		settings: []interface{}{
+			"deliverEnvelopes", q.deliverEnvelopes,
+			"dropOldestOnOverload", q.dropOldestOnOverload,
+			"fairDispatch", q.fair != nil,
+			"syncEvents", q.events.sync},
+		counts: []interface{}{
+			"overloads", q.overload,
+			"throttled", q.throttled.count,
+			"shed", q.shed.count,
+			"suppressed", q.suppressed.count,
+			"expired", q.expired.count,
+			"droppedWhileDraining", q.drainDropped.count,
+			"processed", q.total.processed,
+			"scheduledRetries", q.retries,
+			"removed", q.total.removed},
+		sample: sample,
+		more:   more}
+}
+
+// pending returns a copy of the pending items. It must be called
+// with the mutex held.
+func (q *PushQueue) pending() []QueueItem {
+	items := make([]QueueItem, len(q.items))
+	for i, e := range q.items {
+		items[i] = e.payload(q.deliverEnvelopes)
+	}
+	return items
+}
+
+// RemoveWhere atomically removes the pending items for which pred
+// returns true and returns the number of items removed. Removed
+// items are not processed; their Futures report ErrRemoved.
+func (q *PushQueue) RemoveWhere(pred func(QueueItem) bool) int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	var removed []*Envelope
+	q.items, removed = removeWhere(q.items, q.deliverEnvelopes, pred)
+	for _, e := range removed {
+		e.resolve(ErrRemoved)
+	}
+	q.total.removed += len(removed)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+	return len(removed)
+}
+
+// SplitWhere atomically removes the pending items for which pred
+// returns true, like RemoveWhere, and returns them, oldest first,
+// so that they can be redirected to another component. Each item is
+// returned in its *Envelope, so that Putting it into another
+// component carries its priority, deadline and Future along; the
+// item's Future is not resolved by the removal.
+func (q *PushQueue) SplitWhere(pred func(QueueItem) bool) []QueueItem {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	var removed []*Envelope
+	q.items, removed = removeWhere(q.items, q.deliverEnvelopes, pred)
+	q.total.removed += len(removed)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+
+	items := make([]QueueItem, len(removed))
+	for i, e := range removed {
+		items[i] = e
+	}
+	return items
+}
+
+// KeyFunc sets the function used by Contains and Get to derive
+// a key from an item. Keys must be comparable.
+func (q *PushQueue) KeyFunc(f func(QueueItem) interface{}) {
+	q.mutex.Lock()
+	q.keyFunc = f
+	q.unlock()
+}
+
+// Contains reports whether an item with the given key is pending
+// in the queue. Items already handed to a worker are not pending.
+// Contains panics if no key function has been set.
+func (q *PushQueue) Contains(key interface{}) bool {
+	_, ok := q.Get(key)
+	return ok
+}
+
+// Get returns the first pending item with the given key, and
+// whether one was found. Get panics if no key function has been
+// set.
+func (q *PushQueue) Get(key interface{}) (QueueItem, bool) {
+	defer q.guard()
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	e := findKey(q.items, q.deliverEnvelopes, q.keyFunc, key)
+	if e == nil {
+		return nil, false
+	}
+	return e.payload(q.deliverEnvelopes), true
 }
 
 // IsFull indicates whether the queue can accept new items.
 func (q *PushQueue) IsFull() bool {
-	return q.Count() >= q.Depth()
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return len(q.items) >= q.depth
 }
 
 // Count returns the current number of items in the queue.
 func (q *PushQueue) Count() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
 	return len(q.items)
 }
 
+// InFlight returns the number of items currently being processed by
+// workers. Together with Count it tells whether any work
+// is still happening.
+func (q *PushQueue) InFlight() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.total.inFlight
+}
+
+// AvailableWorkers returns the number of workers currently free to
+// take an item, out of the queue's concurrency.
+func (q *PushQueue) AvailableWorkers() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.availableWorkers
+}
+
 // Depth returns the maximum capacity of the queue.
 func (q *PushQueue) Depth() int {
 	return q.depth
 }
 
-// DropOldestOnOverload tells the queue to drop the oldest item
-// in the queue on the floor when an overload occurs. The default
-// behavior is to drop the item being added.
-func (q *PushQueue) DropOldestOnOverload() {
-	q.dropOldestOnOverload = true
+// DeliverEnvelopes tells the queue to hand each item to the worker,
+// and to the event handlers, wrapped in its *Envelope rather than
+// as the bare item.
+func (q *PushQueue) DeliverEnvelopes() {
+	q.mutex.Lock()
+	q.deliverEnvelopes = true
+	q.unlock()
 }
 
-// OverloadCount returns the number of times that clients attempted
-// to Put items exceeding queue depth or while the queue was
-// draining. The exceeding items were dropped on the floor. This
-// count is reset when Start is called.
-func (q *PushQueue) OverloadCount() int {
-	return q.overload
+// SyncEvents tells the queue to call its event handlers in the order
+// the events occur, on the goroutine that caused them, rather than
+// each on its own goroutine. The handlers are still called without
+// the queue's mutex held, so they may call back into the queue, but a
+// slow handler holds up the call that raised its event, such as a
+// Put or the completion of a worker. To have only some handlers
+// called in order, Subscribe them with Handlers.Sync instead.
+func (q *PushQueue) SyncEvents() {
+	q.mutex.Lock()
+	q.events.sync = true
+	q.unlock()
 }
 
-// OnOverload sets an event handler that will be called *every
-// time* a client attempts to overload the queue. The handler
-// is passed the value of the Overload register.
-func (q *PushQueue) OnOverload(f func(interface{})) {
-	q.onOverload = f
+// AuditSink sets a sink that will be called with a record of every
+// item the queue drops without processing it, whatever the reason,
+// for audit logging and later replay. Like the event handlers, the
+// sink is never called with the mutex held. AuditTo makes a sink
+// that Puts the records into another component.
+func (q *PushQueue) AuditSink(f func(AuditRecord)) {
+	q.mutex.Lock()
+	q.events.audit = f
+	q.unlock()
 }
 
-// OnFirstOverload sets an event handler that will be called the first
-// time a client attempts to overload the queue.
-func (q *PushQueue) OnFirstOverload(f func(interface{})) {
-	q.onFirstOverload = f
+// OnHandlerPanic sets a function to be called with the value of any
+// panic raised by one of the queue's event handlers. The panic is
+// recovered and the queue keeps running. Until a function is set,
+// such panics are written to the standard logger.
+func (q *PushQueue) OnHandlerPanic(f func(interface{})) {
+	q.mutex.Lock()
+	q.events.onPanic = f
+	q.hooks.onPanic = f
+	q.unlock()
 }
 
-func (q *PushQueue) PutItems(items ...interface{}) {
+// SafeMode tells the queue to recover panics rather than let them
+// crash the program, for long-running daemons that cannot tolerate
+// them. In safe mode a method that would panic, such as Start with
+// no worker set or a setter given an invalid argument, instead
+// reports an *InternalError to the OnInternalError handler and
+// returns without effect, returning zero values if it has results.
+// A panic in a worker is reported as a *PanicError, and the queue
+// keeps running. Constructors still panic on invalid arguments.
+func (q *PushQueue) SafeMode() {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.safe.on = true
+	q.unlock()
+}
 
-	remainingCapacity := q.Depth() - q.Count()
-	if remainingCapacity < len(items) {
-		numOver := len(items) - remainingCapacity
-		var dropItems []interface{}
-		if q.dropOldestOnOverload {
-			numLeft := len(items) - numOver
-			dropItems = q.items[:numLeft]
-			q.items = append(q.items[numLeft:], items...)
-		} else {
-			dropItems = items[numOver:]
-			q.items = append(q.items, items[:numOver]...)
-		}
-		firstOverload := q.overload == 0
-		q.overload += len(dropItems)
-		if q.onOverload != nil {
-			for _, item := range dropItems {
-				go q.onOverload(item)
-			}
-		}
-		if firstOverload && q.onFirstOverload != nil {
-			go q.onFirstOverload(dropItems[0])
-		}
-		go q.get()
+// OnInternalError sets an event handler that will be called with
+// each error recovered in safe mode. Until a handler is set, such
+// errors are written to the standard logger.
+func (q *PushQueue) OnInternalError(f func(error)) {
+	q.mutex.Lock()
+	q.safe.handler = f
+	q.unlock()
+}
+
+// guard recovers a panic in a method of the queue in safe mode and
+// reports it, and otherwise lets it continue. It must be deferred
+// by methods that may panic, which must not hold the mutex at the
+// point of the panic.
+func (q *PushQueue) guard() {
+	v := recover()
+	if v == nil {
 		return
 	}
-
-	q.items = append(q.items, items...)
-	go q.get()
+	q.mutex.Lock()
+	safe := q.safe.on
+	if safe {
+		q.safe.report(&InternalError{Value: v}, &q.events)
+	}
+	q.unlock()
+	if !safe {
+		panic(v)
+	}
 }
 
-// Put adds an item to the queue for processing. If the count
-// of items in the queue is at the queue depth, then
-// the Overload flag is set and the item is dropped on the floor.
-func (q *PushQueue) Put(item interface{}) {
+// safely runs work, which calls a worker, recovering and reporting a
+// panic in it in safe mode.
+func (q *PushQueue) safely(work func()) {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
-
-	if q.Count() >= q.Depth() || q.draining {
-		var dropItem interface{}
-		if q.dropOldestOnOverload {
-			dropItem = q.items[:1][0]
-			q.items = append(q.items[1:], item)
-			go q.get()
-		} else {
-			dropItem = item
-		}
-		q.overload++
-		if q.onOverload != nil {
-			go q.onOverload(dropItem)
-		}
-		if q.overload == 1 && q.onFirstOverload != nil {
-			go q.onFirstOverload(dropItem)
-		}
+	safe := q.safe.on
+	q.unlock()
+	if !safe {
+		work()
 		return
 	}
+	if err := recovered(work); err != nil {
+		q.mutex.Lock()
+		q.safe.report(err, &q.events)
+		q.unlock()
+	}
+}
 
-	q.items = append(q.items, item)
-	go q.get()
+// DropOldestOnOverload tells the queue to drop the oldest item
+// in the queue on the floor when an overload occurs. The default
+// behavior is to drop the item being added.
+func (q *PushQueue) DropOldestOnOverload() {
+	q.mutex.Lock()
+	q.dropOldestOnOverload = true
+	q.unlock()
 }
 
-func (q *PushQueue) readyToWork() bool {
-	return (q.started || q.draining) &&
-		q.availableWorkers > 0 &&
-		len(q.items) > 0
+// OverloadCount returns the number of times that clients attempted
+// to Put items exceeding queue depth. The exceeding items were
+// dropped on the floor. Items refused while the queue is draining
+// are counted by DroppedWhileDrainingCount instead. This count is
+// reset by Start and ResetStats.
+func (q *PushQueue) OverloadCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.overload
 }
 
-func (q *PushQueue) get() {
-	if !q.readyToWork() {
-		return
-	}
+// CostLimit enforces concurrency by item cost in addition to the
+// worker count. The cost function returns the cost of an item, and
+// new work is started only while the total cost of the items being
+// processed stays within maxCost. An item whose cost alone
+// exceeds maxCost is started only when nothing else is in flight.
+// CostLimit panics if maxCost is less than 1.
+func (q *PushQueue) CostLimit(maxCost int, cost func(QueueItem) int) {
+	defer q.guard()
+
+	checkMaxCost(maxCost)
 
 	q.mutex.Lock()
+	q.costs.set(maxCost, cost)
+	q.unlock()
+}
 
-	if !q.readyToWork() {
-		q.mutex.Unlock()
-		return
+// FairDispatch interleaves dispatch across classes of items instead
+// of taking items strictly in order. The classify function returns
+// the class of an item; classes must be comparable. Each class with
+// pending items receives a share of the dispatches in proportion to
+// its weight, so that a flood of one class cannot starve another.
+// Classes missing from weights have weight 1. Within a class, items
+// are dispatched in their normal order.
+func (q *PushQueue) FairDispatch(classify func(QueueItem) interface{}, weights map[interface{}]int) {
+	f := &fairShare{classify: classify, weights: make(map[interface{}]int)}
+	for class, w := range weights {
+		f.weights[class] = w
 	}
 
-	q.availableWorkers--
-	item := q.items[:1][0]
-	q.items = q.items[1:]
+	q.mutex.Lock()
+	q.fair = f
+	q.unlock()
+}
 
-	q.mutex.Unlock()
+// PriorityAging raises the effective priority of pending items by
+// one band for every interval of length every that they have
+// waited, up to max bands, so that a sustained stream of higher
+// priority items cannot starve lower priority ones forever. It is
+// equivalent to PriorityAgingCurve(LinearAging(every, max)).
+// PriorityAging panics if every or max is not positive.
+func (q *PushQueue) PriorityAging(every time.Duration, max int) {
+	defer q.guard()
+
+	q.PriorityAgingCurve(LinearAging(every, max))
+}
 
-	q.doWork(item)
+// PriorityAgingCurve raises the effective priority of pending items
+// by the boost that curve gives for the time they have waited. An
+// item that has only aged to the priority of an item in a higher
+// band still waits behind it. While FairDispatch is set, the item
+// with the largest boost, if any, is dispatched ahead of the fair
+// share, so that a step in the curve bounds how long an item can
+// wait. PriorityAgingCurve panics if curve is nil.
+func (q *PushQueue) PriorityAgingCurve(curve AgingCurve) {
+	defer q.guard()
 
-	if !q.draining {
-		go q.get()
-	}
+	a := newAging(curve)
+
+	q.mutex.Lock()
+	q.aging = a
+	q.unlock()
+}
+
+// DeadlineFirst tells the queue to hand items to workers in order of
+// their Envelope deadline, earliest first, rather than in the order
+// they were put, so that as many items as possible are processed
+// before their deadlines. Items without a deadline follow those with
+// one, in the order they were put. Priority bands still take
+// precedence: the deadline orders items within a band. DeadlineFirst
+// has no effect while FairDispatch is set.
+func (q *PushQueue) DeadlineFirst() {
+	q.mutex.Lock()
+	q.deadlineFirst = true
+	q.unlock()
 }
 
-func (q *PushQueue) doWork(item interface{}) {
+// TenantLimits limits, for each tenant sharing the queue, the items
+// it may have pending to maxPending and the workers it may have busy
+// to maxWorkers, so that one tenant cannot crowd out the others.
+// Tenants are told apart by the key that key returns for their
+// items, which must be comparable; a limit of 0 leaves it unlimited.
+// An item put while its tenant has maxPending items pending is
+// dropped as an overload with reason OverloadTenant, and its tenant
+// is given in the OverloadEvent. Items whose tenant has maxWorkers
+// busy wait while items of other tenants go ahead, which takes
+// precedence over the other dispatch orders. Checking the pending
+// limit costs time proportional to the number of pending items.
+// TenantLimits should be called before the queue is started, and
+// panics if key is nil or a limit is negative.
+func (q *PushQueue) TenantLimits(key func(QueueItem) interface{}, maxPending, maxWorkers int) {
+	defer q.guard()
 
-	done := make(chan bool)
-	go func() {
-		q.worker(item)
-		done <- true
-	}()
-	<-done
+	t := newTenants(key, maxPending, maxWorkers)
 
-	q.workerCompleted()
+	q.mutex.Lock()
+	q.tenants = t
+	q.unlock()
 }
 
-func (q *PushQueue) workerCompleted() {
+// Schedule tells the queue to choose the item to hand to a worker
+// next with p, such as one of the built-in policies FIFO, LIFO,
+// PriorityOrder and EarliestDeadlineFirst, in place of its own
+// order. While a policy is set, PriorityAging, ShortestJobFirst and
+// DeadlineFirst have no effect. Schedule has no effect while
+// FairDispatch or Affinity is set. A nil p restores the queue's own
+// order.
+func (q *PushQueue) Schedule(p SchedulingPolicy) {
 	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	q.policy = p
+	q.unlock()
+}
 
-	if q.availableWorkers < q.concurrency {
-		q.availableWorkers++
-	}
+// ShortestJobFirst tells the queue to hand the item with the lowest
+// estimated cost to a worker first whenever at least depth items are
+// pending, to lower the average wait of a mix of small and large
+// items. The estimate function returns an item's cost; it is called
+// with the mutex held. So that costly items are not starved, an item
+// that has waited at least maxWait is handed out first regardless of
+// cost. Priority bands still take precedence: the estimate orders
+// items within a band. While it applies, ShortestJobFirst takes
+// precedence over DeadlineFirst, and it has no effect while
+// FairDispatch is set. ShortestJobFirst panics if estimate is nil or
+// depth or maxWait is not positive.
+func (q *PushQueue) ShortestJobFirst(estimate func(QueueItem) int, depth int, maxWait time.Duration) {
+	defer q.guard()
 
-	if q.availableWorkers == q.concurrency && len(q.items) == 0 {
-		if q.draining {
-			// final worker has completed
-			q.setDrained()
-			return
-		}
-	}
+	f := newShortestFirst(estimate, depth, maxWait)
 
-	go q.get()
+	q.mutex.Lock()
+	q.shortest = f
+	q.unlock()
 }
 
-func (q *PushQueue) setDrained() {
-	if q.onDrained != nil {
-		go q.onDrained()
-	}
-	q.draining = false
+// Affinity pins items to the queue's worker slots by the key that
+// the key function returns, so that items with the same key are
+// always handed to the same one of the concurrency slots, which
+// processes at most one item at a time. Items with the same key are
+// thus processed in the order they were put, even at a concurrency
+// above 1, and a worker can keep per-key state warm in a cache per
+// slot; with DeliverEnvelopes, the worker finds its slot in the
+// Envelope. Keys are assigned to slots by their printed form, and
+// an item whose slot is busy waits while later items with free
+// slots go ahead. Affinity takes precedence over the other dispatch
+// orders, and should be set before the queue is started. It panics
+// if key is nil.
+func (q *PushQueue) Affinity(key func(QueueItem) interface{}) {
+	defer q.guard()
+
+	a := newAffinity(key, q.concurrency)
+
+	q.mutex.Lock()
+	q.affinity = a
+	q.unlock()
+}
+
+// PreemptiveWorker sets a worker that is given a context, in place of
+// the worker the queue was created with. When an item is queued
+// while every worker is busy, the context of the in-flight item of
+// the lowest priority below the new item's is cancelled, the most
+// recently started of equals first. An item dropped or refused by
+// Put preempts nothing. If the worker then returns the context's
+// error, the item is put back into the queue to be processed again
+// later, subject to the overload policy if the queue has filled up
+// meanwhile; its Future is not resolved until then. Any other error
+// returned by the worker is ignored. PreemptiveWorker should be
+// called before the queue is started, and panics if worker is nil.
+func (q *PushQueue) PreemptiveWorker(worker func(ctx context.Context, item interface{}) error) {
+	defer q.guard()
+
+	p := newPreemptor(worker)
+
+	q.mutex.Lock()
+	q.preempt = p
+	q.unlock()
+}
+
+// RetryWorker sets a worker that reports failure by returning an
+// error, in place of the worker the queue was created with. An item
+// whose worker fails is tried again up to maxAttempts attempts in
+// all, each time after the delay that backoff returns for the
+// number of attempts made so far. While it waits, the item takes up
+// neither buffer space nor a worker; it is counted by
+// ScheduledRetries, and a drain is not complete until it has been
+// retried. Each attempt counts as processed. The item's Future
+// reports the outcome of the last attempt. RetryWorker should be
+// called before the queue is started, and panics if worker or
+// backoff is nil or maxAttempts is not positive.
+func (q *PushQueue) RetryWorker(worker func(item interface{}) error, backoff func(attempts int) time.Duration, maxAttempts int) {
+	defer q.guard()
+
+	r := newRetrier(worker, backoff, maxAttempts)
+
+	q.mutex.Lock()
+	q.retry = r
+	q.unlock()
+}
+
+// ResultWorker sets a worker that returns a result for each item,
+// in place of the worker the queue was created with. Each result is
+// passed to the OnResult handler, kept for DrainResults if
+// CollectResults has been called, and reported by the item's Future.
+// ResultWorker should be called before the queue is started, and
+// panics if worker is nil.
+func (q *PushQueue) ResultWorker(worker func(item interface{}) (interface{}, error)) {
+	defer q.guard()
+
+	r := newResulter(worker)
+
+	q.mutex.Lock()
+	q.resulter = r
+	q.unlock()
+}
+
+// OnResult sets an event handler that will be called with the
+// result of each item processed by a ResultWorker. To receive the
+// results on a channel, send them from f.
+func (q *PushQueue) OnResult(f func(Result)) {
+	q.mutex.Lock()
+	q.results.handler = f
+	q.unlock()
+}
+
+// CollectResults tells the queue to keep the result of each item
+// processed by a ResultWorker until DrainResults returns them.
+func (q *PushQueue) CollectResults() {
+	q.mutex.Lock()
+	q.results.collect = true
+	q.unlock()
+}
+
+// DrainResults drains the queue as WaitForDrain does, and returns
+// the results kept since CollectResults was called or the results
+// were last returned, together with any *DrainTimeoutError.
+func (q *PushQueue) DrainResults(timeout time.Duration) ([]Result, error) {
+	err := WaitForDrain(q, timeout)
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.results.take(), err
+}
+
+// ScheduledRetries returns the number of failed items waiting to be
+// retried.
+func (q *PushQueue) ScheduledRetries() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.retries
+}
+
+// MaxDispatchRate limits the queue to handing at most n items to
+// workers in any interval of length per, even when workers are
+// available. MaxDispatchRate panics if n or per is not
+// positive.
+func (q *PushQueue) MaxDispatchRate(n int, per time.Duration) {
+	defer q.guard()
+
+	newRate := func() RateLimiter {
+		return NewRateLimit(n, per)
+	}
+	l := newRate()
+
+	q.mutex.Lock()
+	q.pace.setOwnRate(l, newRate)
+	q.unlock()
+}
+
+// DispatchRateWithBurst limits the queue to handing items to
+// workers at a sustained rate of n per interval, using a token
+// bucket that holds up to burst tokens. Unlike MaxDispatchRate,
+// which caps the count in every interval, this absorbs spikes of
+// up to burst items at full speed and throttles only sustained
+// load. DispatchRateWithBurst panics if n, per or burst is not
+// positive.
+func (q *PushQueue) DispatchRateWithBurst(n int, per time.Duration, burst int) {
+	defer q.guard()
+
+	newRate := func() RateLimiter {
+		return NewRateLimitWithBurst(n, per, burst)
+	}
+	l := newRate()
+
+	q.mutex.Lock()
+	q.pace.setOwnRate(l, newRate)
+	q.unlock()
+}
+
+// IntakeRate limits the rate at which the queue accepts items
+// with a token bucket that is refilled at n tokens per interval
+// and holds at most n tokens. Each Put takes a token; a Put that
+// finds the bucket empty is rejected before it can reach the
+// buffer. Rejected items are counted by ThrottledCount rather
+// than as overloads. IntakeRate panics if n or per is not
+// positive.
+func (q *PushQueue) IntakeRate(n int, per time.Duration) {
+	q.IntakeRateWithBurst(n, per, n)
+}
+
+// IntakeRateWithBurst is like IntakeRate, but the bucket holds
+// up to burst tokens, so that a spike of up to burst items is
+// accepted at full speed and only sustained load above n per
+// interval is throttled. IntakeRateWithBurst panics if n, per or
+// burst is not positive.
+func (q *PushQueue) IntakeRateWithBurst(n int, per time.Duration, burst int) {
+	defer q.guard()
+
+	b := newTokenBucket(n, per, burst)
+
+	q.mutex.Lock()
+	q.intakeRate = b
+	q.unlock()
+}
+
+// ThrottledCount returns the number of items rejected by the
+// intake rate limit. This count is reset by Start and
+// ResetStats.
+func (q *PushQueue) ThrottledCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.throttled.count
+}
+
+// OnThrottled sets an event handler that will be called for every
+// item rejected by the intake rate limit.
+func (q *PushQueue) OnThrottled(f func(interface{})) {
+	q.mutex.Lock()
+	q.throttled.handler = f
+	q.unlock()
+}
+
+// ApplyPressure puts the queue under pressure p, so that it sheds
+// load until ReleasePressure is called. Pending items beyond p.Depth
+// and the p.Evict oldest pending items are shed at once, the oldest
+// of the lowest priority band first, and items put are then handled
+// according to p. Shed items are dropped and reported to the OnShed
+// handler, and their Futures report ErrShed. A pressure already
+// applied is replaced.
+func (q *PushQueue) ApplyPressure(p Pressure) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.pressure = pressure{on: true, p: p}
+	var shed []*Envelope
+	for n := q.pressure.excess(len(q.items), q.depth); n > 0; n-- {
+		i := oldestLowest(q.items)
+		shed = append(shed, q.items[i])
+		q.items = removeIndex(q.items, i)
+	}
+	q.total.dropped += q.shed.add(shed, q.deliverEnvelopes, &q.events)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.draining && q.idle() {
+		q.setDrained()
+	}
+}
+
+// ReleasePressure ends the pressure set with ApplyPressure. Items
+// already shed are not restored.
+func (q *PushQueue) ReleasePressure() {
+	q.mutex.Lock()
+	q.pressure = pressure{}
+	q.unlock()
+}
+
+// ShedCount returns the number of items shed under pressure. This
+// count is reset by Start and ResetStats.
+func (q *PushQueue) ShedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.shed.count
+}
+
+// OnShed sets an event handler that will be called for every item
+// shed under pressure.
+func (q *PushQueue) OnShed(f func(interface{})) {
+	q.mutex.Lock()
+	q.shed.handler = f
+	q.unlock()
+}
+
+// SuppressDuplicates suppresses every item put whose key, as returned
+// by key, is that of an item put within window before it, even if
+// that item has since been processed or dropped. Suppressed items
+// are dropped and reported to the OnSuppressed handler, and their
+// Futures report ErrDuplicate. Keys must be comparable.
+// SuppressDuplicates panics if key is nil or window is not
+// positive.
+func (q *PushQueue) SuppressDuplicates(key func(QueueItem) interface{}, window time.Duration) {
+	defer q.guard()
+
+	d := newDedupe(key, window)
+
+	q.mutex.Lock()
+	q.dedupe = d
+	q.unlock()
+}
+
+// SuppressedCount returns the number of items suppressed as
+// duplicates. This count is reset by Start and ResetStats.
+func (q *PushQueue) SuppressedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.suppressed.count
+}
+
+// OnSuppressed sets an event handler that will be called for every
+// item suppressed as a duplicate.
+func (q *PushQueue) OnSuppressed(f func(interface{})) {
+	q.mutex.Lock()
+	q.suppressed.handler = f
+	q.unlock()
+}
+
+// SmoothDispatchRate spaces the handing of items to workers
+// evenly over time at n per interval, like a leaky bucket, rather
+// than releasing bursts up to the concurrency limit. It is
+// equivalent to DispatchRateWithBurst(n, per, 1).
+func (q *PushQueue) SmoothDispatchRate(n int, per time.Duration) {
+	q.DispatchRateWithBurst(n, per, 1)
+}
+
+// DispatchRateLimiter limits the rate at which the queue hands
+// items to workers with any RateLimiter, such as a *rate.Limiter
+// from golang.org/x/time/rate. Each item handed to a worker takes
+// one permission from the limiter. The same limiter may be given
+// to several components.
+func (q *PushQueue) DispatchRateLimiter(l RateLimiter) {
+	q.mutex.Lock()
+	q.pace.setRate(l)
+	q.unlock()
+}
+
+// SharedDispatchRate limits the rate at which the queue hands
+// items to workers with a RateLimit that may also be given to
+// other components, so that their combined dispatches respect a
+// single quota.
+func (q *PushQueue) SharedDispatchRate(l *RateLimit) {
+	q.DispatchRateLimiter(l)
+}
+
+// AdaptiveDispatchRate limits the rate at which the queue hands
+// items to workers with the given AdaptiveRate, which the workers
+// inform of their outcomes so that the rate follows the health of
+// the downstream.
+func (q *PushQueue) AdaptiveDispatchRate(a *AdaptiveRate) {
+	q.DispatchRateLimiter(a)
+}
+
+// DispatchJitter waits a random delay of up to max before each
+// item is handed to a worker, including the first. This spreads
+// out the load when many components start or drain against the
+// same backend at once. DispatchJitter panics if max is not
+// positive.
+func (q *PushQueue) DispatchJitter(max time.Duration) {
+	defer q.guard()
+
+	j := newJitterLimiter(max)
+
+	q.mutex.Lock()
+	q.pace.jitter = j
+	q.unlock()
+}
+
+// Warmup sets a function that Start calls before any item is
+// handed to a worker, to acquire the workers' resources or to Put
+// items preloaded from storage; Start returns once f has. If ramp
+// is positive, the number of busy workers is then allowed to grow
+// evenly from one to the concurrency over ramp, so that a cold
+// start does not stampede the services the workers call. f may be
+// nil to ramp only. Warmup panics if ramp is negative.
+func (q *PushQueue) Warmup(f func(), ramp time.Duration) {
+	defer q.guard()
+
+	w := newWarmup(f, ramp)
+
+	q.mutex.Lock()
+	q.warmup = w
+	q.unlock()
+}
+
+// ExpiredCount returns the number of items that were skipped
+// because their Envelope deadline had passed by the time they
+// were due to be handed to a worker. Expired items are not
+// counted as overloads. This count is reset by Start and
+// ResetStats.
+func (q *PushQueue) ExpiredCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.expired.count
+}
+
+// OnItemStart sets an event handler that will be called each time
+// an item is handed to a worker, with the time the item waited in
+// the queue. The handler is called on the worker's goroutine
+// immediately before the worker, so together with OnItemDone it
+// brackets the processing of the item.
+func (q *PushQueue) OnItemStart(f func(item interface{}, waited time.Duration)) {
+	q.mutex.Lock()
+	q.hooks.onStart = f
+	q.unlock()
+}
+
+// OnItemDone sets an event handler that will be called each time a
+// worker has finished with an item, with the time the worker took.
+// The handler is called on the worker's goroutine immediately after
+// the worker returns, including when the worker panicked and the
+// panic was reported through the item's Future.
+func (q *PushQueue) OnItemDone(f func(item interface{}, elapsed time.Duration)) {
+	q.mutex.Lock()
+	q.hooks.onDone = f
+	q.unlock()
+}
+
+// OnExpired sets an event handler that will be called for every
+// item skipped because its deadline had passed.
+func (q *PushQueue) OnExpired(f func(interface{})) {
+	q.mutex.Lock()
+	q.expired.handler = f
+	q.unlock()
+}
+
+// DroppedWhileDrainingCount returns the number of items refused
+// because they were put while the queue was draining. Such items
+// are lost at shutdown rather than for lack of capacity, so they
+// are not counted as overloads. This count is reset by Start
+// and ResetStats.
+func (q *PushQueue) DroppedWhileDrainingCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.drainDropped.count
+}
+
+// OnDroppedWhileDraining sets an event handler that will be called
+// for every item refused because it was put while the queue was
+// draining. Such items do not raise the OnOverload and
+// OnFirstOverload events.
+func (q *PushQueue) OnDroppedWhileDraining(f func(interface{})) {
+	q.mutex.Lock()
+	q.drainDropped.handler = f
+	q.unlock()
+}
+
+// OnThreshold sets an event handler that will be called when the
+// count of items in the queue rises to level, a fraction of the
+// queue depth, and again when it falls back below level less
+// hysteresis, so that a count hovering around the level does not
+// raise a stream of events. Unlike the other events, any number of
+// thresholds may be set, each with its own handler, for graduated
+// alerts; each is removed by unsubscribing the returned
+// Subscription. OnThreshold panics unless 0 < level <= 1 and
+// 0 <= hysteresis < level.
+func (q *PushQueue) OnThreshold(level, hysteresis float64, f func(ThresholdEvent)) *Subscription {
+	defer q.guard()
+
+	t := newThreshold(level, hysteresis, f)
+
+	q.mutex.Lock()
+	q.levels = append(q.levels, t)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	q.unlock()
+
+	return newSubscription(&q.mutex, func() {
+		q.levels = q.levels.remove(t)
+	})
+}
+
+// OnAlert sets an alert that calls alert when the count of items in
+// the queue has stayed at or above level, a fraction of the queue
+// depth, for the sustain period, and then calls cleared, if not nil,
+// once the count falls back below level less hysteresis. A count
+// that falls back before the period is over raises nothing, so a
+// count flapping around the level does not raise a stream of
+// alerts. Any number of alerts may be set; each is removed by
+// unsubscribing the returned Subscription. OnAlert panics unless
+// 0 < level <= 1, 0 <= hysteresis < level and sustain is not
+// negative.
+func (q *PushQueue) OnAlert(level, hysteresis float64, sustain time.Duration, alert, cleared func(AlertEvent)) *Subscription {
+	defer q.guard()
+
+	a, t := newAlert(level, hysteresis, sustain, alert, cleared)
+	a.attach(&q.mutex, q.unlock, &q.events)
+
+	q.mutex.Lock()
+	q.levels = append(q.levels, t)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	q.unlock()
+
+	return newSubscription(&q.mutex, func() {
+		q.levels = q.levels.remove(t)
+		a.remove()
+	})
+}
+
+// Subscribe adds the given event handlers to those of the queue,
+// without replacing the handlers set with the On methods or by
+// other subscriptions. The handlers are removed by unsubscribing
+// the returned Subscription.
+func (q *PushQueue) Subscribe(h Handlers) *Subscription {
+	q.mutex.Lock()
+	sub := q.events.subscribe(h)
+	q.hooks.subs = q.events.subs
+	q.unlock()
+
+	return newSubscription(&q.mutex, func() {
+		q.events.unsubscribe(sub)
+		q.hooks.subs = q.events.subs
+	})
+}
+
+// OnOverload sets an event handler that will be called *every
+// time* a client attempts to overload the queue. The handler
+// is passed the value of the Overload register.
+func (q *PushQueue) OnOverload(f func(interface{})) {
+	q.mutex.Lock()
+	q.onOverload = f
+	q.unlock()
+}
+
+// OnOverloadEvent sets an event handler that will be called every
+// time an item is dropped as an overload, like OnOverload, but with
+// an OverloadEvent telling why the item was dropped and the state of
+// the queue at the time.
+func (q *PushQueue) OnOverloadEvent(f func(OverloadEvent)) {
+	q.mutex.Lock()
+	q.onOverloadEvent = f
+	q.unlock()
+}
+
+// OnFirstOverload sets an event handler that will be called the first
+// time a client attempts to overload the queue.
+func (q *PushQueue) OnFirstOverload(f func(interface{})) {
+	q.mutex.Lock()
+	q.onFirstOverload = f
+	q.unlock()
+}
+
+// PutItems adds several items to the queue under a single lock.
+// Items that do not fit within the queue depth are handled
+// according to the overload policy, exactly as if they had been
+// added one at a time with Put.
+func (q *PushQueue) PutItems(items ...interface{}) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.total.put += len(items)
+	now := time.Now()
+	envelopes := make([]*Envelope, 0, len(items))
+	for _, item := range items {
+		e := envelop(item)
+		if q.intakeRate != nil && !q.intakeRate.take(now) {
+			q.total.throttled += q.throttled.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+			continue
+		}
+		if q.dedupe.duplicate(e, q.deliverEnvelopes, now) {
+			q.total.dropped += q.suppressed.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+			continue
+		}
+		if q.pressure.paused() && !q.draining {
+			q.total.dropped += q.shed.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+			continue
+		}
+		if q.tenants != nil && !q.draining && q.tenants.full(e, q.deliverEnvelopes, q.items, envelopes) {
+			q.overloaded([]*Envelope{e}, OverloadTenant)
+			continue
+		}
+		envelopes = append(envelopes, e)
+	}
+
+	depth := q.pressure.capacity(q.depth)
+	remainingCapacity := depth - len(q.items)
+	if q.draining {
+		remainingCapacity = 0
+	}
+	if remainingCapacity < len(envelopes) {
+		var dropItems []*Envelope
+		if q.dropOldestOnOverload && !q.draining {
+			for _, e := range envelopes {
+				q.items = insertByPriority(q.items, e)
+			}
+			for len(q.items) > depth {
+				i := oldestLowest(q.items)
+				dropItems = append(dropItems, q.items[i])
+				q.items = removeIndex(q.items, i)
+			}
+		} else {
+			dropItems = envelopes[remainingCapacity:]
+			for _, e := range envelopes[:remainingCapacity] {
+				q.items = insertByPriority(q.items, e)
+			}
+		}
+		q.overloaded(dropItems, q.overloadReason())
+		go q.get()
+		return
+	}
+
+	for _, e := range envelopes {
+		q.items = insertByPriority(q.items, e)
+	}
+	go q.get()
+}
+
+// Put adds an item to the queue for processing. If the count
+// of items in the queue is at the queue depth, then
+// the Overload flag is set and the item is dropped on the floor.
+// If DropOldestOnOverload is set, the oldest item of the lowest
+// priority band is dropped instead. While the queue is draining,
+// the item is always dropped, and reported to the
+// OnDroppedWhileDraining handler instead.
+func (q *PushQueue) Put(item interface{}) {
+	e := envelop(item)
+
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.total.put++
+	now := time.Now()
+	if q.intakeRate != nil && !q.intakeRate.take(now) {
+		q.total.throttled += q.throttled.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+		return
+	}
+	if q.dedupe.duplicate(e, q.deliverEnvelopes, now) {
+		q.total.dropped += q.suppressed.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+		return
+	}
+
+	if q.add(e) && q.preempt != nil && q.availableWorkers == 0 {
+		q.preempt.preempt(e.Priority)
+	}
+	go q.get()
+}
+
+// add adds e to the pending items, or handles it according to the
+// overload policy if the queue is full or draining, and reports
+// whether e was added. It must be called with the mutex held.
+func (q *PushQueue) add(e *Envelope) bool {
+	if q.pressure.paused() && !q.draining {
+		q.total.dropped += q.shed.add([]*Envelope{e}, q.deliverEnvelopes, &q.events)
+		return false
+	}
+	if q.tenants != nil && !q.draining && q.tenants.full(e, q.deliverEnvelopes, q.items) {
+		q.overloaded([]*Envelope{e}, OverloadTenant)
+		return false
+	}
+	if len(q.items) >= q.pressure.capacity(q.depth) || q.draining {
+		var dropItem *Envelope
+		if q.dropOldestOnOverload && !q.draining {
+			q.items = insertByPriority(q.items, e)
+			i := oldestLowest(q.items)
+			dropItem = q.items[i]
+			q.items = removeIndex(q.items, i)
+		} else {
+			dropItem = e
+		}
+		q.overloaded([]*Envelope{dropItem}, q.overloadReason())
+		return dropItem != e
+	}
+
+	q.items = insertByPriority(q.items, e)
+	return true
+}
+
+// PutWithPriority adds an item to the queue like Put, in the given
+// priority band. Items in higher bands are handed to workers before
+// items in lower bands; within a band, items are processed in the
+// order they were put. Put places bare items in band 0 and an
+// *Envelope in the band given by its Priority. Putting into a
+// band costs time proportional to the number of pending items in
+// lower bands, so a small number of bands is recommended.
+func (q *PushQueue) PutWithPriority(item interface{}, priority int) {
+	e := envelop(item)
+	e.Priority = priority
+	q.Put(e)
+}
+
+// PutFuture adds an item to the queue like Put and returns a
+// Future that is resolved when the item's worker has finished,
+// or when the item is dropped or removed from the queue.
+func (q *PushQueue) PutFuture(item interface{}) *Future {
+	e := envelop(item)
+	e.future = newFuture()
+	q.Put(e)
+	return e.future
+}
+
+// PutAndWait adds an item to the queue and blocks until the
+// item's worker has finished or ctx is done. It returns the
+// same outcome as the item's Future, or ctx.Err() if ctx is done
+// first, in which case the item remains in the queue.
+func (q *PushQueue) PutAndWait(ctx context.Context, item interface{}) error {
+	return q.PutFuture(item).WaitContext(ctx)
+}
+
+func (q *PushQueue) readyToWork() bool {
+	return (q.started && !q.suspended || q.draining) &&
+		q.availableWorkers > 0 &&
+		len(q.items) > 0 &&
+		q.warmup.allows(time.Now(), q.concurrency-q.availableWorkers, q.concurrency)
+}
+
+func (q *PushQueue) get() {
+	q.mutex.Lock()
+	q.levels.check(len(q.items), q.depth, &q.events)
+
+	if !q.readyToWork() {
+		q.unlock()
+		return
+	}
+
+	now := time.Now()
+	var expired []*Envelope
+	var i int
+	var classes []interface{}
+	for len(q.items) > 0 {
+		i, classes = q.nextIndex(now)
+		if i < 0 || !q.items[i].expired(now) {
+			break
+		}
+		expired = append(expired, q.items[i])
+		q.items = removeIndex(q.items, i)
+	}
+	q.total.expired += q.expired.add(expired, q.deliverEnvelopes, &q.events)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if len(q.items) == 0 {
+		if q.draining && q.idle() {
+			q.setDrained()
+		}
+		q.unlock()
+		return
+	}
+	if i < 0 {
+		// every item waits for a busy slot or tenant; a
+		// completing worker will try again
+		q.unlock()
+		return
+	}
+
+	e := q.items[i]
+	cost := q.costs.of(e.payload(q.deliverEnvelopes))
+	if !q.costs.fits(0, cost) {
+		// a completing worker will try again
+		q.unlock()
+		return
+	}
+	if q.pace.delayed(now) || !q.pace.allow() {
+		q.unlock()
+		return
+	}
+	if q.microBatching() {
+		q.getBatch(now, i, cost)
+		return
+	}
+
+	q.availableWorkers--
+	q.total.inFlight++
+	q.costs.inFlight += cost
+	q.items = removeIndex(q.items, i)
+	q.levels.check(len(q.items), q.depth, &q.events)
+	if q.fair != nil {
+		q.fair.commit(classes, q.fair.classify(e.payload(q.deliverEnvelopes)))
+	}
+	slot := -1
+	if q.affinity != nil {
+		slot = q.affinity.slot(e.payload(q.deliverEnvelopes))
+		q.affinity.busy[slot] = true
+		e.Slot = slot
+	}
+	if q.tenants != nil {
+		q.tenants.begin(e, q.deliverEnvelopes)
+	}
+	var r *preemption
+	if q.preempt != nil {
+		r = q.preempt.begin(e)
+	}
+	e.Attempts++
+	item := e.payload(q.deliverEnvelopes)
+	hooks := q.hooks
+	preempt, retry, res, once := q.preempt, q.retry, q.resulter, q.once
+
+	q.unlock()
+
+	q.doWork(e, item, cost, slot, hooks, preempt, r, retry, res, once)
+}
+
+// microBatching reports whether items are to be handed to the
+// worker set with MicroBatch in batches, which only happens while no
+// option that works item by item is set. It must be called with the
+// mutex held.
+func (q *PushQueue) microBatching() bool {
+	return q.micro.batching() && q.fair == nil && q.affinity == nil && q.tenants == nil &&
+		q.preempt == nil && q.retry == nil && q.resulter == nil && q.once == nil
+}
+
+// getBatch hands the item at index i, whose cost is given, to the
+// worker set with MicroBatch, together with as many of the items
+// next in line as fit in the batch, the cost limit and the dispatch
+// rate. It must be called with the mutex held, and releases it.
+func (q *PushQueue) getBatch(now time.Time, i, cost int) {
+	batch := []*Envelope{q.items[i]}
+	q.items = removeIndex(q.items, i)
+	for len(batch) < q.micro.size && len(q.items) > 0 {
+		j, _ := q.nextIndex(now)
+		e := q.items[j]
+		itemCost := q.costs.of(e.payload(q.deliverEnvelopes))
+		if e.expired(now) || !q.costs.fits(cost, itemCost) || !q.pace.allow() {
+			// left for the next get
+			break
+		}
+		cost += itemCost
+		batch = append(batch, e)
+		q.items = removeIndex(q.items, j)
+	}
+
+	q.availableWorkers--
+	q.total.inFlight += len(batch)
+	q.costs.inFlight += cost
+	q.levels.check(len(q.items), q.depth, &q.events)
+	items := make([]interface{}, len(batch))
+	for k, e := range batch {
+		e.Attempts++
+		items[k] = e.payload(q.deliverEnvelopes)
+	}
+	hooks, worker := q.hooks, q.micro.worker
+
+	q.unlock()
+
+	q.doBatch(batch, items, cost, hooks, worker)
+}
+
+func (q *PushQueue) doBatch(batch []*Envelope, items []interface{}, cost int, hooks itemHooks, worker func([]interface{})) {
+	done := make(chan bool)
+	go func() {
+		var started time.Time
+		for k, e := range batch {
+			started = hooks.start(e, items[k])
+		}
+		q.safely(func() {
+			call(func() {
+				worker(items)
+			}, batch...)
+		})
+		for _, item := range items {
+			hooks.done(item, started)
+		}
+		done <- true
+	}()
+	<-done
+
+	q.batchCompleted(len(batch), cost)
+}
+
+// batchCompleted records that the worker set with MicroBatch has
+// returned from a batch of n items.
+func (q *PushQueue) batchCompleted(n, cost int) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.costs.inFlight -= cost
+	q.total.inFlight -= n
+	q.total.processed += n
+
+	if q.availableWorkers < q.concurrency {
+		q.availableWorkers++
+	}
+
+	if q.draining && q.idle() {
+		// final worker has completed
+		q.setDrained()
+		return
+	}
+
+	go q.get()
+}
+
+// firstFree returns the index of the first item whose affinity slot
+// is free and whose tenant may have another worker, or -1 if there
+// is none. It must be called with the mutex held.
+func (q *PushQueue) firstFree() int {
+	for i, e := range q.items {
+		item := e.payload(q.deliverEnvelopes)
+		if q.affinity != nil && !q.affinity.free(item) {
+			continue
+		}
+		if q.tenants != nil && !q.tenants.free(item) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// nextIndex returns the index of the next item to hand to a worker at
+// now, or -1 if every item waits for a busy slot or tenant, and, when
+// fair dispatch is enabled, the classes that have pending items. It
+// must be called with the mutex held and with at least one item in
+// the queue.
+func (q *PushQueue) nextIndex(now time.Time) (int, []interface{}) {
+	if q.affinity != nil || q.tenants.limitsWorkers() {
+		return q.firstFree(), nil
+	}
+	if q.fair != nil {
+		i, classes := q.fair.pick(q.items, q.deliverEnvelopes)
+		if j, ok := q.aging.overdue(q.items, now); ok {
+			i = j
+		}
+		return i, classes
+	}
+	if q.policy != nil {
+		return q.policy.Pick(q.items, now), nil
+	}
+	i := 0
+	if q.aging != nil {
+		i = q.aging.pick(q.items, now)
+	}
+	if q.shortest != nil {
+		if j, ok := q.shortest.pick(q.items, i, q.deliverEnvelopes, now); ok {
+			return j, nil
+		}
+	}
+	if q.deadlineFirst {
+		i = earliestDeadline(q.items, i)
+	}
+	return i, nil
+}
+
+func (q *PushQueue) doWork(e *Envelope, item interface{}, cost, slot int, hooks itemHooks, preempt *preemptor, r *preemption, retry *retrier, res *resulter, once *exactlyOnce) {
+
+	done := make(chan bool)
+	var o outcome
+	go func() {
+		started := hooks.start(e, item)
+		q.safely(func() {
+			// work reports whether the item was processed
+			work := func() bool {
+				switch {
+				case r != nil:
+					o.requeue = preempt.run(r, e, item)
+				case retry != nil:
+					o = retry.run(e, item)
+				case res != nil:
+					o.result = res.run(e, item)
+					return o.result.Err == nil
+				default:
+					panicked := true
+					call(func() {
+						q.worker(item)
+						panicked = false
+					}, e)
+					return !panicked
+				}
+				return !o.requeue && !o.retry
+			}
+			if once == nil {
+				work()
+				return
+			}
+			var err error
+			o.skipped, err = once.run(item, work)
+			switch {
+			case err != nil:
+				// a worker that ran has resolved e already
+				e.resolve(err)
+				q.storeFailed(err)
+			case o.skipped:
+				e.resolve(nil)
+			}
+		})
+		hooks.done(item, started)
+		done <- true
+	}()
+	<-done
+
+	q.workerCompleted(e, cost, slot, o)
+}
+
+// workerCompleted records that the worker of e has returned with
+// outcome o. If e was preempted, it is put back into the queue; if
+// it failed and is to be retried, it is scheduled to be put back.
+func (q *PushQueue) workerCompleted(e *Envelope, cost, slot int, o outcome) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	if slot >= 0 && q.affinity != nil {
+		q.affinity.busy[slot] = false
+	}
+	if q.tenants != nil {
+		q.tenants.end(e)
+	}
+	if q.preempt != nil {
+		q.preempt.end(e)
+	}
+	q.costs.inFlight -= cost
+	q.total.inFlight--
+	switch {
+	case o.requeue:
+		q.putBack(e)
+	case o.retry:
+		q.total.processed++
+		q.retries++
+		time.AfterFunc(o.after, func() {
+			q.retryDue(e)
+		})
+	default:
+		q.total.processed++
+	}
+	if o.skipped {
+		q.skippedProcessed++
+	}
+	if o.result != nil {
+		q.results.deliver(*o.result, &q.events)
+	}
+
+	if q.availableWorkers < q.concurrency {
+		q.availableWorkers++
+	}
+
+	if q.draining && q.idle() {
+		// final worker has completed
+		q.setDrained()
+		return
+	}
+
+	go q.get()
+}
+
+// putBack puts e, which was already accepted, back into the queue,
+// even while draining if there is room. It must be called with the
+// mutex held.
+func (q *PushQueue) putBack(e *Envelope) {
+	if len(q.items) < q.depth {
+		q.items = insertByPriority(q.items, e)
+		return
+	}
+	q.add(e)
+}
+
+// retryDue puts back e, whose retry was scheduled, for another
+// attempt.
+func (q *PushQueue) retryDue(e *Envelope) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.retries--
+	q.total.put++
+	q.putBack(e)
+	if q.draining && q.idle() {
+		q.setDrained()
+		return
+	}
+	go q.get()
+}
+
+// idle reports whether the queue has nothing left to process: no
+// pending items, no items in flight and no scheduled retries. It
+// must be called with the mutex held.
+func (q *PushQueue) idle() bool {
+	return len(q.items) == 0 && q.availableWorkers == q.concurrency && q.retries == 0
+}
+
+// overloaded passes the given items to the Forwarder, if one is
+// set, or else drops them. It must be called with the mutex held,
+// after the items have been removed from the queue.
+func (q *PushQueue) overloaded(dropped []*Envelope, reason OverloadReason) {
+	if q.forwarder != nil {
+		f := q.forwarder
+		for _, e := range dropped {
+			e, item := e, e.payload(q.deliverEnvelopes)
+			q.total.forwarded++
+			q.events.emit(func() {
+				q.forwardDone(e, reason, forward(f, item))
+			})
+		}
+		return
+	}
+	q.drop(dropped, reason)
+}
+
+// forwardDone records the outcome of forwarding e. An item that
+// could not be forwarded is dropped as it would have been without a
+// Forwarder.
+func (q *PushQueue) forwardDone(e *Envelope, reason OverloadReason, err error) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.total.forwarded--
+	if err != nil {
+		q.drop([]*Envelope{e}, reason)
+		return
+	}
+	q.total.dropped++
+	q.forwarded++
+	e.resolve(ErrForwarded)
+}
+
+// drop drops the given items and raises the overload events for
+// them. Items refused because the queue is draining are counted
+// apart from overloads. It must be called with the mutex held.
+func (q *PushQueue) drop(dropped []*Envelope, reason OverloadReason) {
+	if reason == OverloadDraining {
+		n := q.drainDropped.count
+		q.total.dropped += q.drainDropped.add(dropped, q.deliverEnvelopes, &q.events)
+		for i, e := range dropped {
+			q.overloadEvent(e, reason, n+i+1)
+		}
+		return
+	}
+
+	first := q.overload == 0
+	for _, e := range dropped {
+		e.resolve(ErrDropped)
+		q.events.audited(e.payload(q.deliverEnvelopes), reason.dropReason())
+		q.total.dropped++
+		q.overload++
+		if q.onOverload != nil {
+			q.events.item(q.onOverload, e.payload(q.deliverEnvelopes))
+		}
+		q.overloads.add(e.payload(q.deliverEnvelopes))
+		q.overloadEvent(e, reason, q.overload)
+	}
+	if first && len(dropped) > 0 {
+		item := dropped[0].payload(q.deliverEnvelopes)
+		if q.onFirstOverload != nil {
+			q.events.item(q.onFirstOverload, item)
+		}
+		q.events.subscribed(pickFirstOverload, item)
+	}
+}
+
+// MicroBatch tells the queue to hand items to worker in batches of
+// up to size items, rather than one at a time to its own worker,
+// while the count of items in the queue is at or above level, a
+// fraction of the queue depth, until it falls back below level less
+// hysteresis. Under load this amortizes the cost of each call, such
+// as a write to the network, over several items, while at other
+// times items are handed over singly with the least delay. Each
+// batch takes up one worker, and its items' Futures report the
+// outcome of the batch. Items are not batched while FairDispatch,
+// TenantLimits, Affinity, a PreemptiveWorker, RetryWorker,
+// ResultWorker or ExactlyOnce is set, as they work item by item. A
+// nil worker stops batching. MicroBatch panics unless size is
+// greater than 1, 0 < level <= 1 and 0 <= hysteresis < level.
+func (q *PushQueue) MicroBatch(worker func(items []interface{}), size int, level, hysteresis float64) {
+	defer q.guard()
+
+	var m *microBatch
+	if worker != nil {
+		m = newMicroBatch(worker, size, level, hysteresis)
+	}
+
+	q.mutex.Lock()
+	if q.micro != nil {
+		q.levels = q.levels.remove(q.micro.level)
+	}
+	q.micro = m
+	if m != nil {
+		q.levels = append(q.levels, m.level)
+		q.levels.check(len(q.items), q.depth, &q.events)
+	}
+	q.unlock()
+}
+
+// MicroBatching reports whether the queue is handing items to the
+// worker set with MicroBatch in batches.
+func (q *PushQueue) MicroBatching() bool {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.microBatching()
+}
+
+// ForwardOverloads passes every item that the queue would drop as
+// an overload, or refuse while draining, to f instead, such as to
+// forward it to a peer instance. f is called like an event handler,
+// without the mutex held. An item f forwards is counted by
+// ForwardedCount and its Future reports ErrForwarded; an item f
+// returns an error for is dropped and reported as it would have
+// been without f. A nil f stops forwarding.
+func (q *PushQueue) ForwardOverloads(f Forwarder) {
+	q.mutex.Lock()
+	q.forwarder = f
+	q.unlock()
+}
+
+// ExactlyOnce tells the queue to process each item at most once,
+// as told apart by the key that key returns for it, by passing the
+// worker through store. The store records an item's key together
+// with its successful processing, such as in the transaction the
+// worker writes its effects in, so that an item redelivered after a
+// crash, or put twice, is skipped rather than processed again. A
+// skipped item is counted by SkippedProcessedCount, and its Future
+// reports success without a value. An item whose worker fails,
+// panics or is preempted is not recorded, so it is processed again
+// when retried or redelivered. ExactlyOnce should be called before
+// the queue is started, and panics if key or store is nil.
+func (q *PushQueue) ExactlyOnce(key func(QueueItem) interface{}, store ProcessedStore) {
+	defer q.guard()
+
+	x := newExactlyOnce(key, store)
+
+	q.mutex.Lock()
+	q.once = x
+	q.unlock()
+}
+
+// OnStoreError sets an event handler that will be called with each
+// error returned by the ProcessedStore set with ExactlyOnce. The
+// Future of the item, unless its worker has already resolved it,
+// reports the error too. Until a handler is set, such errors are
+// written to the standard logger.
+func (q *PushQueue) OnStoreError(f func(error)) {
+	q.mutex.Lock()
+	q.onStoreError = f
+	q.unlock()
+}
+
+// SkippedProcessedCount returns the number of items skipped by
+// ExactlyOnce as already processed since the queue was created.
+func (q *PushQueue) SkippedProcessedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.skippedProcessed
+}
+
+// storeFailed raises the OnStoreError event for err, returned by
+// the ProcessedStore.
+func (q *PushQueue) storeFailed(err error) {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	q.events.errored(q.onStoreError, pickStoreError, "processed store: ", err)
+}
+
+// ForwardedCount returns the number of items passed on by the
+// Forwarder set with ForwardOverloads since the queue was created.
+func (q *PushQueue) ForwardedCount() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.forwarded
+}
+
+// OnOverloadSummary sets an event handler that will be called at
+// most once per period, with the number of overloads in the period
+// and a sample of the dropped items. Unlike OnOverload, which is
+// called for every dropped item, it stays cheap however fast items
+// are dropped. Items refused while draining are not included. The
+// period also applies to the OverloadSummary handlers of
+// subscriptions, which may set it with a nil f. OnOverloadSummary
+// panics if f is not nil and period is not positive.
+func (q *PushQueue) OnOverloadSummary(period time.Duration, f func(OverloadSummary)) {
+	defer q.guard()
+
+	checkSummaryPeriod(period, f)
+
+	q.mutex.Lock()
+	q.overloads.set(period, f, q.reportOverloads)
+	q.unlock()
+}
+
+// reportOverloads raises the summary of the overloads in the period
+// that has ended.
+func (q *PushQueue) reportOverloads() {
+	q.mutex.Lock()
+	q.overloads.report(&q.events)
+	q.unlock()
+}
+
+// overloadEvent raises the OnOverloadEvent event for a dropped
+// item. It must be called with the mutex held.
+func (q *PushQueue) overloadEvent(e *Envelope, reason OverloadReason, overloads int) {
+	ev := OverloadEvent{
+		Item:      e.payload(q.deliverEnvelopes),
+		Reason:    reason,
+		Overloads: overloads,
+		Count:     len(q.items),
+		Capacity:  q.depth}
+	if reason == OverloadTenant {
+		ev.Tenant = q.tenants.key(ev.Item)
+	}
+	q.events.overload(q.onOverloadEvent, ev)
+}
+
+// overloadReason returns the reason for an overload occurring now.
+// It must be called with the mutex held.
+func (q *PushQueue) overloadReason() OverloadReason {
+	if q.draining {
+		return OverloadDraining
+	}
+	return OverloadFull
+}
+
+// CheckInvariants verifies that the queue's accounting of its items
+// and workers is consistent, and returns an error describing the
+// first inconsistency found.
+func (q *PushQueue) CheckInvariants() error {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.total.check(len(q.items), q.depth, q.availableWorkers, q.concurrency, q.costs.inFlight)
+}
+
+// drained reports whether the component has finished draining, or
+// was never draining, with nothing left to process.
+func (q *PushQueue) drained() bool {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return !q.draining && q.idle()
+}
+
+// busyWorkers returns the number of workers currently processing.
+func (q *PushQueue) busyWorkers() int {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.concurrency - q.availableWorkers
+}
+
+// setDrained ends draining and raises the drained event. It must be
+// called with the mutex held.
+func (q *PushQueue) setDrained() {
+	q.events.drained(q.onDrained, q.onDrainSummary,
+		q.drain.summary(q.total.processed, q.drainDropped.count))
+	q.draining = false
+	q.changeState(StateDraining, CauseDrained)
+}
+
+// State returns the lifecycle state of the queue.
+func (q *PushQueue) State() State {
+	q.mutex.Lock()
+	defer q.unlock()
+
+	return q.state()
+}
+
+func (q *PushQueue) state() State {
+	return stateOf(q.started, q.draining)
+}
+
+// OnStateChange sets an event handler that will be called when the
+// queue changes state, with the cause of the change.
+func (q *PushQueue) OnStateChange(f func(StateChangeEvent)) {
+	q.mutex.Lock()
+	q.onStateChange = f
+	q.unlock()
+}
+
+// changeState raises the state change event for a change from the
+// given state to the current one. It must be called with the mutex
+// held.
+func (q *PushQueue) changeState(from State, cause StateCause) {
+	q.events.stateChange(q.onStateChange, from, q.state(), cause)
+}
+
+// unlock releases the mutex and then delivers the events held for
+// synchronous delivery, if any.
+func (q *PushQueue) unlock() {
+	pending := q.events.take()
+	q.mutex.Unlock()
+	deliver(pending)
 }
@@ -0,0 +1,1598 @@
+package push_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestPutWithPriority(t *testing.T) {
+	var mutex sync.Mutex
+	var got []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		got = append(got, item)
+		mutex.Unlock()
+	})
+
+	q.Put("a0")
+	q.PutWithPriority("b2", 2)
+	q.PutWithPriority("c1", 1)
+	q.Put("d0")
+	q.PutWithPriority("e2", 2)
+
+	want := []interface{}{"b2", "e2", "c1", "a0", "d0"}
+	if items := q.Items(); !reflect.DeepEqual(items, want) {
+		t.Errorf("pending items %v, want %v", items, want)
+	}
+
+	q.Start()
+	drainAndWait(t, q)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+}
+
+func TestMaxDispatchRate(t *testing.T) {
+	q := NewPushQueue(10, 100, func(item interface{}) {})
+	q.MaxDispatchRate(5, 50*time.Millisecond)
+	for i := 0; i < 15; i++ {
+		q.Put(i)
+	}
+	start := time.Now()
+	q.Start()
+	drainAndWait(t, q)
+
+	// 5 items go at once, then 5 more per interval
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("15 items dispatched in %v, want at least 100ms", elapsed)
+	}
+}
+
+// uncomparableLimiter has a func field, so comparing two
+// RateLimiter values holding it panics.
+type uncomparableLimiter struct {
+	RateLimiter
+	tag func()
+}
+
+func TestDispatchRateLimiterUncomparable(t *testing.T) {
+	q := NewPushQueue(1, 100, func(item interface{}) {})
+	q.DispatchRateLimiter(uncomparableLimiter{RateLimiter: NewRateLimit(1, 10*time.Millisecond)})
+	for i := 0; i < 5; i++ {
+		q.Put(i)
+	}
+	q.Start()
+	drainAndWait(t, q)
+}
+
+func TestOnItemStartDone(t *testing.T) {
+	var mutex sync.Mutex
+	var events []string
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		events = append(events, "work")
+		mutex.Unlock()
+	})
+	q.OnItemStart(func(item interface{}, waited time.Duration) {
+		mutex.Lock()
+		events = append(events, "start")
+		mutex.Unlock()
+		if waited < 10*time.Millisecond {
+			t.Errorf("waited %v, want at least 10ms", waited)
+		}
+	})
+	q.OnItemDone(func(item interface{}, elapsed time.Duration) {
+		mutex.Lock()
+		events = append(events, "done")
+		mutex.Unlock()
+	})
+	q.Put(1)
+	time.Sleep(10 * time.Millisecond)
+	q.Start()
+	if err := WaitForDrain(q, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s := strings.Join(events, " "); s != "start work done" {
+		t.Errorf("got %q, want start work done", s)
+	}
+}
+
+func TestOnOverloadEvent(t *testing.T) {
+	events := make(chan OverloadEvent, 2)
+	release := make(chan bool)
+	q := NewPushQueue(1, 1, func(item interface{}) {
+		<-release
+	})
+	q.OnOverloadEvent(func(e OverloadEvent) {
+		events <- e
+	})
+	q.Put(1)
+	q.Put(2)
+	e := <-events
+	if e.Item != 2 || e.Reason != OverloadFull || e.Overloads != 1 || e.Count != 1 || e.Capacity != 1 {
+		t.Errorf("got %+v, want item 2 dropped because full", e)
+	}
+
+	// with item 1 held by the worker, the drain cannot complete
+	q.Start()
+	q.Drain()
+	q.Put(3)
+	e = <-events
+	if e.Item != 3 || e.Reason != OverloadDraining {
+		t.Errorf("got %+v, want item 3 dropped because draining", e)
+	}
+	close(release)
+}
+
+func TestDroppedWhileDraining(t *testing.T) {
+	release := make(chan bool)
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		<-release
+	})
+	overloads := make(chan interface{}, 1)
+	dropped := make(chan interface{}, 1)
+	q.OnOverload(func(item interface{}) { overloads <- item })
+	q.OnDroppedWhileDraining(func(item interface{}) { dropped <- item })
+	q.Start()
+	q.Put(1)
+
+	// with item 1 held by the worker, the drain cannot complete
+	q.Drain()
+	f := q.PutFuture(2)
+	if err := f.Err(); err != ErrDropped {
+		t.Errorf("refused item's Future reports %v, want ErrDropped", err)
+	}
+	if item := <-dropped; item != 2 {
+		t.Errorf("OnDroppedWhileDraining got %v, want 2", item)
+	}
+	if n := q.DroppedWhileDrainingCount(); n != 1 {
+		t.Errorf("dropped while draining %d, want 1", n)
+	}
+	if n := q.OverloadCount(); n != 0 {
+		t.Errorf("overload count %d, want 0", n)
+	}
+	close(release)
+	select {
+	case item := <-overloads:
+		t.Errorf("OnOverload got %v for an item refused while draining", item)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRemoveWhere(t *testing.T) {
+	var mutex sync.Mutex
+	var got []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		got = append(got, item)
+		mutex.Unlock()
+	})
+	for i := 1; i <= 5; i++ {
+		q.Put(i)
+	}
+	f := q.PutFuture(6)
+
+	even := func(item QueueItem) bool { return item.(int)%2 == 0 }
+	if n := q.RemoveWhere(even); n != 3 {
+		t.Errorf("removed %d items, want 3", n)
+	}
+	if err := f.Err(); err != ErrRemoved {
+		t.Errorf("removed item's Future reports %v, want ErrRemoved", err)
+	}
+	want := []interface{}{1, 3, 5}
+	if items := q.Items(); !reflect.DeepEqual(items, want) {
+		t.Errorf("pending items %v, want %v", items, want)
+	}
+
+	q.Start()
+	drainAndWait(t, q)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+}
+
+func TestExpired(t *testing.T) {
+	var mutex sync.Mutex
+	var got []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		got = append(got, item)
+		mutex.Unlock()
+	})
+	expired := make(chan interface{}, 1)
+	q.OnExpired(func(item interface{}) { expired <- item })
+
+	stale := NewEnvelope("stale")
+	stale.Deadline = time.Now().Add(-time.Second)
+	f := q.PutFuture(stale)
+	q.Put("fresh")
+	q.Start()
+	drainAndWait(t, q)
+
+	if err := f.Wait(); err != ErrExpired {
+		t.Errorf("expired item's Future reports %v, want ErrExpired", err)
+	}
+	if item := <-expired; item != "stale" {
+		t.Errorf("OnExpired got %v, want stale", item)
+	}
+	if n := q.ExpiredCount(); n != 1 {
+		t.Errorf("expired count %d, want 1", n)
+	}
+	if n := q.OverloadCount(); n != 0 {
+		t.Errorf("overload count %d, want 0", n)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := []interface{}{"fresh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+}
+
+func TestIntakeRate(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.IntakeRate(2, time.Hour)
+	throttled := make(chan interface{}, 1)
+	q.OnThrottled(func(item interface{}) { throttled <- item })
+
+	q.Put("a")
+	q.Put("b")
+	f := q.PutFuture("c")
+	if err := f.Err(); err != ErrThrottled {
+		t.Errorf("throttled item's Future reports %v, want ErrThrottled", err)
+	}
+	if item := <-throttled; item != "c" {
+		t.Errorf("OnThrottled got %v, want c", item)
+	}
+	if n := q.ThrottledCount(); n != 1 {
+		t.Errorf("throttled count %d, want 1", n)
+	}
+	if n := q.OverloadCount(); n != 0 {
+		t.Errorf("overload count %d, want 0", n)
+	}
+	if n := q.Count(); n != 2 {
+		t.Errorf("count %d, want 2", n)
+	}
+
+	q.Start()
+	if n := q.ThrottledCount(); n != 0 {
+		t.Errorf("throttled count %d after Start, want 0", n)
+	}
+	drainAndWait(t, q)
+}
+
+func TestIntakeRateWithBurst(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.IntakeRateWithBurst(1, 20*time.Millisecond, 3)
+	for i := 0; i < 4; i++ {
+		q.Put(i)
+	}
+	if n := q.ThrottledCount(); n != 1 {
+		t.Errorf("throttled %d of a burst of 4, want 1", n)
+	}
+
+	// the bucket refills at the sustained rate
+	time.Sleep(30 * time.Millisecond)
+	q.Put(4)
+	if n := q.ThrottledCount(); n != 1 {
+		t.Errorf("throttled count %d after refill, want 1", n)
+	}
+}
+
+// dispatchTimes runs n items through q with a concurrency high
+// enough not to matter, and returns how long after Start each item
+// reached a worker, in order.
+func dispatchTimes(t *testing.T, n int, configure func(*PushQueue)) []time.Duration {
+	var mutex sync.Mutex
+	var start time.Time
+	var times []time.Duration
+	q := NewPushQueue(n, n, func(item interface{}) {
+		mutex.Lock()
+		times = append(times, time.Since(start))
+		mutex.Unlock()
+	})
+	configure(q)
+	for i := 0; i < n; i++ {
+		q.Put(i)
+	}
+	mutex.Lock()
+	start = time.Now()
+	mutex.Unlock()
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	return times
+}
+
+func TestDispatchRateWithBurst(t *testing.T) {
+	per := 50 * time.Millisecond
+	times := dispatchTimes(t, 4, func(q *PushQueue) {
+		q.DispatchRateWithBurst(1, per, 3)
+	})
+
+	// the burst goes at once, the rest at the sustained rate
+	if times[2] > per/2 {
+		t.Errorf("burst of 3 took %v, want well under %v", times[2], per)
+	}
+	if times[3] < per*3/4 {
+		t.Errorf("item after the burst went at %v, want about %v", times[3], per)
+	}
+}
+
+func TestDispatchJitter(t *testing.T) {
+	max := 20 * time.Millisecond
+	times := dispatchTimes(t, 5, func(q *PushQueue) {
+		q.DispatchJitter(max)
+	})
+
+	// each item waits a random gap of less than max after the last
+	last := time.Duration(0)
+	for i, at := range times {
+		if gap := at - last; gap > max+15*time.Millisecond {
+			t.Errorf("item %d went %v after the one before, want under %v", i, gap, max)
+		}
+		last = at
+	}
+	// five gaps averaging max/2 add up to far more than this
+	if last < 2*time.Millisecond {
+		t.Errorf("items went within %v, want them spread out", last)
+	}
+}
+
+func TestDispatchJitterPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("DispatchJitter(0) did not panic")
+		}
+	}()
+	NewPushQueue(1, 1, func(item interface{}) {}).DispatchJitter(0)
+}
+
+func TestSmoothDispatchRate(t *testing.T) {
+	per := 20 * time.Millisecond
+	times := dispatchTimes(t, 4, func(q *PushQueue) {
+		q.SmoothDispatchRate(1, per)
+	})
+
+	// no burst: after the first item, each waits its own interval
+	for i := 1; i < len(times); i++ {
+		if gap := times[i] - times[i-1]; gap < per*3/4 {
+			t.Errorf("item %d went %v after the one before, want about %v", i, gap, per)
+		}
+	}
+}
+
+func TestSharedDispatchRate(t *testing.T) {
+	per := 50 * time.Millisecond
+	shared := NewRateLimit(4, per)
+	q := NewPushQueue(10, 10, func(item interface{}) {})
+	s := NewPushStack(10, 10, func(item interface{}) {})
+	q.SharedDispatchRate(shared)
+	s.SharedDispatchRate(shared)
+	for i := 0; i < 6; i++ {
+		q.Put(i)
+		s.Push(i)
+	}
+
+	start := time.Now()
+	q.Start()
+	s.Start()
+	drainAndWait(t, q)
+	drainAndWait(t, s)
+
+	// 12 items at a combined 4 per interval need two more intervals
+	// after the first 4; separate limits would need only one
+	if elapsed := time.Since(start); elapsed < 2*per {
+		t.Errorf("12 items dispatched in %v, want at least %v", elapsed, 2*per)
+	}
+}
+
+func TestStartContext(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	drained := make(chan bool, 1)
+	q.OnDrained(func() { drained <- true })
+	ctx, cancel := context.WithCancel(context.Background())
+	q.StartContext(ctx)
+	q.Put("a")
+
+	cancel()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue not drained when its context was cancelled")
+	}
+	if q.IsStarted() {
+		t.Error("queue still started after its context was cancelled")
+	}
+}
+
+func TestStartContextStopOnCancel(t *testing.T) {
+	release := make(chan bool)
+	q := NewPushQueue(1, 10, func(item interface{}) { <-release })
+	defer close(release)
+	q.StopOnCancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	q.StartContext(ctx)
+	for i := 0; i < 3; i++ {
+		q.Put(i)
+	}
+	// wait for the worker to take the first item
+	for q.Count() > 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.IsStarted() {
+		if time.Now().After(deadline) {
+			t.Fatal("queue not stopped when its context was cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// stopped rather than drained, so the pending items stay
+	if n := q.Count(); n != 2 {
+		t.Errorf("count %d after stop, want 2", n)
+	}
+}
+
+func TestStartReleasesContext(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	q.StartContext(ctx)
+	q.Start()
+
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if !q.IsStarted() {
+		t.Error("queue restarted with Start still bound to the first context")
+	}
+}
+
+func TestOnThreshold(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	events := make(chan ThresholdEvent, 10)
+	q.OnThreshold(0.5, 0.2, func(e ThresholdEvent) { events <- e })
+	next := func() ThresholdEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no threshold event")
+		}
+		return ThresholdEvent{}
+	}
+
+	for i := 0; i < 5; i++ {
+		q.Put(i)
+	}
+	if e := next(); !e.Above || e.Count != 5 || e.Level != 0.5 || e.Capacity != 10 {
+		t.Errorf("got %+v, want rise to 5 of 10", e)
+	}
+
+	// within the hysteresis band no event is raised
+	q.RemoveWhere(func(item QueueItem) bool { return item.(int) < 2 })
+	q.Put(5)
+	q.RemoveWhere(func(item QueueItem) bool { return item.(int) == 5 })
+	q.RemoveWhere(func(item QueueItem) bool { return item.(int) == 2 })
+	if e := next(); e.Above || e.Count != 2 {
+		t.Errorf("got %+v, want fall to 2 of 10", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.SyncEvents()
+	var panics []interface{}
+	var mutex sync.Mutex
+	q.OnHandlerPanic(func(v interface{}) {
+		mutex.Lock()
+		panics = append(panics, v)
+		mutex.Unlock()
+	})
+	q.OnOverload(func(item interface{}) { panic("overload handler") })
+	q.OnItemStart(func(item interface{}, waited time.Duration) { panic("start handler") })
+
+	q.Put(1)
+	q.Put(2) // overload; the panic must not reach Put
+	q.Start()
+	drainAndWait(t, q)
+
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []interface{}{"overload handler", "start handler"}
+	if !reflect.DeepEqual(panics, want) {
+		t.Errorf("got panics %v, want %v", panics, want)
+	}
+}
+
+func TestOnAlert(t *testing.T) {
+	q := NewPushQueue(1, 4, func(item interface{}) {})
+	alerts := make(chan AlertEvent, 10)
+	cleared := make(chan AlertEvent, 10)
+	q.OnAlert(0.5, 0.25, 30*time.Millisecond, func(e AlertEvent) { alerts <- e }, func(e AlertEvent) { cleared <- e })
+
+	// a count that falls back within the period raises nothing
+	q.PutItems(1, 2)
+	q.Empty()
+	select {
+	case e := <-alerts:
+		t.Errorf("unexpected alert %+v", e)
+	case <-time.After(60 * time.Millisecond):
+	}
+
+	q.PutItems(1, 2)
+	select {
+	case e := <-alerts:
+		if e.Level != 0.5 || e.Count != 2 || e.Capacity != 4 {
+			t.Errorf("got alert %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert")
+	}
+	q.Empty()
+	select {
+	case <-cleared:
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert not cleared")
+	}
+}
+
+func TestDrainSummary(t *testing.T) {
+	release := make(chan struct{})
+	q := NewPushQueue(1, 10, func(item interface{}) { <-release })
+	summaries := make(chan DrainSummary, 1)
+	q.OnDrainSummary(func(s DrainSummary) { summaries <- s })
+
+	q.Put(1)
+	q.Put(2)
+	q.Put(3)
+	q.Start()
+	// wait for the worker to take the first item
+	for q.Count() > 2 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Drain()
+	q.Put(4)
+	close(release)
+
+	select {
+	case s := <-summaries:
+		if s.Processed != 3 || s.Dropped != 1 || s.Duration <= 0 {
+			t.Errorf("got summary %+v, want 3 processed and 1 dropped", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no drain summary")
+	}
+}
+
+func TestOnStateChange(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	q.SyncEvents()
+	var got []string
+	var mutex sync.Mutex
+	q.OnStateChange(func(e StateChangeEvent) {
+		mutex.Lock()
+		got = append(got, fmt.Sprintf("%v->%v (%v)", e.From, e.To, e.Cause))
+		mutex.Unlock()
+	})
+
+	q.Start()
+	q.Start()
+	q.Drain()
+	q.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	q.StopOnCancel()
+	q.StartContext(ctx)
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.State() != StateStopped && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{
+		"stopped->started (call)",
+		"started->draining (call)",
+		"draining->stopped (drained)",
+		"stopped->started (call)",
+		"started->stopped (context)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %q, want %q", got, want)
+	}
+}
+
+func TestOnOverloadSummary(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	summaries := make(chan OverloadSummary, 10)
+	q.OnOverloadSummary(50*time.Millisecond, func(s OverloadSummary) { summaries <- s })
+
+	for i := 0; i < 100; i++ {
+		q.Put(i)
+	}
+
+	select {
+	case s := <-summaries:
+		if s.Overloads != 99 || s.Sample != 1 || s.Period != 50*time.Millisecond {
+			t.Errorf("got summary %+v, want 99 overloads with sample 1", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no overload summary")
+	}
+	select {
+	case s := <-summaries:
+		t.Errorf("unexpected summary %+v", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	release := make(chan struct{})
+	q := NewPushQueue(1, 10, func(item interface{}) { <-release })
+	defer close(release)
+	q.Put(1)
+	q.Put(2)
+	q.Put(3)
+	q.Start()
+	// wait for the worker to take the first item
+	for q.Count() > 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := q.InFlight(); n != 1 {
+		t.Errorf("%d items in flight, want 1", n)
+	}
+	if n := q.AvailableWorkers(); n != 0 {
+		t.Errorf("%d workers available, want 0", n)
+	}
+	s := q.Snapshot()
+	if !reflect.DeepEqual(s.Items, []QueueItem{2, 3}) {
+		t.Errorf("got items %v, want [2 3]", s.Items)
+	}
+	if s.InFlight != 1 || s.Capacity != 10 || s.State != StateStarted || s.Taken.IsZero() {
+		t.Errorf("got snapshot %+v, want 1 in flight of 10, started", s)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	for i := 0; i < 5; i++ {
+		q.Put(i)
+	}
+
+	var got []QueueItem
+	q.ForEach(func(item QueueItem) bool {
+		got = append(got, item)
+		return item.(int) < 2
+	})
+	if !reflect.DeepEqual(got, []QueueItem{0, 1, 2}) {
+		t.Errorf("got items %v, want [0 1 2]", got)
+	}
+}
+
+func TestSort(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	for _, i := range []int{3, 1, 2} {
+		q.Put(i)
+	}
+	q.PutWithPriority(0, 1)
+	q.PutWithPriority(5, 1)
+
+	q.Sort(func(a, b QueueItem) bool { return a.(int) > b.(int) })
+	if got, want := q.Items(), []QueueItem{5, 0, 3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got items %v, want %v", got, want)
+	}
+}
+
+func TestAbsorb(t *testing.T) {
+	q := NewPushQueue(1, 3, func(item interface{}) {})
+	other := NewPushQueue(1, 10, func(item interface{}) {})
+	q.Put(1)
+	other.Start()
+	other.Stop()
+	other.Put(2)
+	f := other.PutFuture(3)
+	other.Put(4)
+
+	q.Absorb(other)
+	if got, want := q.Items(), []QueueItem{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got items %v, want %v", got, want)
+	}
+	if n := q.OverloadCount(); n != 1 {
+		t.Errorf("overload count %d, want 1", n)
+	}
+	if n := other.Count(); n != 0 || other.State() != StateStopped {
+		t.Errorf("other has %d items in state %v, want 0, stopped", n, other.State())
+	}
+	for _, c := range []*PushQueue{q, other} {
+		if err := c.CheckInvariants(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	q.Start()
+	if err := f.Wait(); err != nil {
+		t.Errorf("absorbed item's future reported %v", err)
+	}
+}
+
+func TestSplitWhere(t *testing.T) {
+	q := NewPushQueue(1, 10, func(item interface{}) {})
+	other := NewPushQueue(1, 10, func(item interface{}) {})
+	q.Put(1)
+	f := q.PutFuture(2)
+	q.Put(3)
+	q.PutWithPriority(4, 1)
+
+	split := q.SplitWhere(func(item QueueItem) bool { return item.(int)%2 == 0 })
+	if got, want := q.Items(), []QueueItem{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got items %v, want %v", got, want)
+	}
+	for _, item := range split {
+		other.Put(item)
+	}
+	if got, want := other.Items(), []QueueItem{4, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got split items %v, want %v", got, want)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	other.Start()
+	if err := f.Wait(); err != nil {
+		t.Errorf("split item's future reported %v", err)
+	}
+}
+
+func TestCloneConfig(t *testing.T) {
+	var mutex sync.Mutex
+	var processed []interface{}
+	q := NewPushQueue(2, 3, func(item interface{}) {
+		mutex.Lock()
+		processed = append(processed, item)
+		mutex.Unlock()
+	})
+	q.SyncEvents()
+	q.DropOldestOnOverload()
+	var overloads []interface{}
+	q.OnOverload(func(item interface{}) { overloads = append(overloads, item) })
+	q.Put(0)
+
+	c := q.CloneConfig()
+	if c.Count() != 0 || c.Depth() != 3 || c.IsStarted() {
+		t.Fatalf("clone has %d items, depth %d, started %v; want an empty, unstarted queue of depth 3",
+			c.Count(), c.Depth(), c.IsStarted())
+	}
+	for i := 1; i <= 4; i++ {
+		c.Put(i)
+	}
+	if got, want := overloads, []interface{}{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got overloads %v, want %v", got, want)
+	}
+	if n := q.Count(); n != 1 {
+		t.Errorf("original has %d items, want 1", n)
+	}
+
+	c.Start()
+	drainAndWait(t, c)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(processed) != 3 {
+		t.Errorf("clone processed %v, want 3 items", processed)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.SyncEvents()
+	var first []interface{}
+	q.OnFirstOverload(func(item interface{}) { first = append(first, item) })
+	q.Put(1)
+	q.Put(2)
+
+	q.ResetStats()
+	if n := q.OverloadCount(); n != 0 {
+		t.Errorf("overload count %d after reset, want 0", n)
+	}
+	q.Put(3)
+	if n := q.OverloadCount(); n != 1 {
+		t.Errorf("overload count %d, want 1", n)
+	}
+	if got, want := first, []interface{}{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got first overloads %v, want %v", got, want)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStringAndDump(t *testing.T) {
+	q := NewPushQueue(2, 20, func(item interface{}) {})
+	for i := 0; i < 12; i++ {
+		q.Put(i)
+	}
+
+	if got, want := q.String(), "PushQueue(stopped, 12/20 pending, 0 in flight, 2/2 workers free)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	dump := q.Dump()
+	for _, want := range []string{q.String(), "overloads=0", "pending: 0 1 2 3 4 5 6 7 8 9 ... and 2 more"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump %q does not contain %q", dump, want)
+		}
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	var mutex sync.Mutex
+	var order []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		order = append(order, item)
+		mutex.Unlock()
+	})
+	q.PriorityAging(10*time.Millisecond, 5)
+
+	q.PutWithPriority("old low", 0)
+	// aged by at least four bands
+	time.Sleep(45 * time.Millisecond)
+	q.PutWithPriority("new high", 2)
+	q.PutWithPriority("new higher", 3)
+	q.PutWithPriority("ancient", -10)
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []interface{}{"old low", "new higher", "new high", "ancient"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestStepAgingWithFairDispatch(t *testing.T) {
+	curve := StepAging(AgingStep{After: 20 * time.Millisecond, Boost: 1}, AgingStep{After: time.Second, Boost: 5})
+	for waited, want := range map[time.Duration]int{0: 0, 25 * time.Millisecond: 1, 2 * time.Second: 5} {
+		if got := curve.Boost(waited); got != want {
+			t.Errorf("boost after %v is %d, want %d", waited, got, want)
+		}
+	}
+
+	var mutex sync.Mutex
+	var order []interface{}
+	q := NewPushQueue(1, 100, func(item interface{}) {
+		mutex.Lock()
+		order = append(order, item)
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	})
+	q.FairDispatch(func(item QueueItem) interface{} {
+		return item.(string)[:1]
+	}, map[interface{}]int{"a": 1000, "b": 1})
+	q.PriorityAgingCurve(curve)
+	q.Start()
+	for i := 0; i < 50; i++ {
+		if i == 5 {
+			q.Put("b")
+		}
+		q.Put("a")
+	}
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, item := range order {
+		if item == "b" {
+			if i > 15 {
+				t.Errorf("b dispatched %dth, want it dispatched once aged", i)
+			}
+			return
+		}
+	}
+	t.Error("b was not dispatched")
+}
+
+func TestDeadlineFirst(t *testing.T) {
+	var mutex sync.Mutex
+	var order []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		order = append(order, item.(*Envelope).Item)
+		mutex.Unlock()
+	})
+	q.DeliverEnvelopes()
+	q.DeadlineFirst()
+
+	now := time.Now()
+	q.Put("none")
+	q.Put(&Envelope{Item: "late", Deadline: now.Add(time.Hour)})
+	q.Put(&Envelope{Item: "soon", Deadline: now.Add(time.Minute)})
+	q.Put(&Envelope{Item: "urgent", Priority: 1, Deadline: now.Add(2 * time.Hour)})
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []interface{}{"urgent", "soon", "late", "none"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestShortestJobFirst(t *testing.T) {
+	var mutex sync.Mutex
+	var order []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		order = append(order, item)
+		mutex.Unlock()
+	})
+	q.ShortestJobFirst(func(item QueueItem) int { return len(item.(string)) }, 3, time.Hour)
+
+	for _, item := range []string{"large", "tiny", "medium", "xs"} {
+		q.Put(item)
+	}
+	q.Start()
+	drainAndWait(t, q)
+
+	// once fewer than 3 items are pending, they go in order
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []interface{}{"xs", "tiny", "large", "medium"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestShortestJobFirstMaxWait(t *testing.T) {
+	var mutex sync.Mutex
+	var order []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		order = append(order, item)
+		mutex.Unlock()
+	})
+	q.ShortestJobFirst(func(item QueueItem) int { return len(item.(string)) }, 1, 20*time.Millisecond)
+
+	q.Put("large")
+	time.Sleep(30 * time.Millisecond)
+	q.Put("xs")
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []interface{}{"large", "xs"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	type job struct {
+		key string
+		seq int
+	}
+	var mutex sync.Mutex
+	slots := make(map[string]map[int]bool)
+	last := make(map[string]int)
+	active := make(map[int]bool)
+	q := NewPushQueue(4, 100, func(item interface{}) {
+		e := item.(*Envelope)
+		j := e.Item.(job)
+		mutex.Lock()
+		if active[e.Slot] {
+			t.Errorf("slot %d handed a second item", e.Slot)
+		}
+		active[e.Slot] = true
+		if slots[j.key] == nil {
+			slots[j.key] = make(map[int]bool)
+		}
+		slots[j.key][e.Slot] = true
+		if j.seq != last[j.key]+1 {
+			t.Errorf("key %s: got item %d after %d", j.key, j.seq, last[j.key])
+		}
+		last[j.key] = j.seq
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		active[e.Slot] = false
+		mutex.Unlock()
+	})
+	q.DeliverEnvelopes()
+	q.Affinity(func(item QueueItem) interface{} { return item.(*Envelope).Item.(job).key })
+
+	for seq := 1; seq <= 10; seq++ {
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			q.Put(job{key, seq})
+		}
+	}
+	q.Start()
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for key, s := range slots {
+		if len(s) != 1 {
+			t.Errorf("key %s handed to slots %v, want one", key, s)
+		}
+	}
+}
+
+func TestPreemptiveWorker(t *testing.T) {
+	var mutex sync.Mutex
+	var events []string
+	record := func(s string) {
+		mutex.Lock()
+		events = append(events, s)
+		mutex.Unlock()
+	}
+	started := make(chan struct{}, 1)
+	q := NewPushQueue(1, 10, nil)
+	q.DeliverEnvelopes()
+	q.PreemptiveWorker(func(ctx context.Context, item interface{}) error {
+		e := item.(*Envelope)
+		if e.Item == "background" && e.Attempts == 1 {
+			started <- struct{}{}
+			<-ctx.Done()
+			record("background preempted")
+			return ctx.Err()
+		}
+		record(e.Item.(string))
+		return nil
+	})
+	q.Start()
+
+	f := q.PutFuture("background")
+	<-started
+	q.PutWithPriority("urgent", 1)
+	if err := f.Wait(); err != nil {
+		t.Errorf("preempted item's future reported %v", err)
+	}
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{"background preempted", "urgent", "background"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %q, want %q", events, want)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreemptiveWorkerDropped(t *testing.T) {
+	started := make(chan struct{}, 1)
+	preempted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	q := NewPushQueue(1, 1, nil)
+	q.DeliverEnvelopes()
+	q.PreemptiveWorker(func(ctx context.Context, item interface{}) error {
+		if item.(*Envelope).Item != "background" {
+			return nil
+		}
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			preempted <- struct{}{}
+			return ctx.Err()
+		case <-release:
+			return nil
+		}
+	})
+	q.Start()
+
+	q.Put("background")
+	<-started
+	q.Put("filler")
+	// the queue is full, so the urgent item is dropped and must not
+	// preempt the background item in its stead
+	q.PutWithPriority("urgent", 1)
+	if n := q.OverloadCount(); n != 1 {
+		t.Errorf("overload count %d, want 1", n)
+	}
+	select {
+	case <-preempted:
+		t.Error("dropped item preempted the in-flight item")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	drainAndWait(t, q)
+}
+
+func TestRetryWorker(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	waiting := make(chan int, 1)
+	q := NewPushQueue(1, 1, nil)
+	q.RetryWorker(func(item interface{}) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	}, func(attempts int) time.Duration {
+		return 20 * time.Millisecond
+	}, 3)
+	q.Start()
+
+	f := q.PutFuture("item")
+	go func() {
+		for q.ScheduledRetries() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		waiting <- q.Count()
+	}()
+	if n := <-waiting; n != 0 {
+		t.Errorf("scheduled retry took %d buffer slots", n)
+	}
+	if err := f.Wait(); err != nil {
+		t.Errorf("future reported %v after final attempt succeeded", err)
+	}
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+	if n := q.ScheduledRetries(); n != 0 {
+		t.Errorf("got %d scheduled retries after drain, want 0", n)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAlignedBatchWindow(t *testing.T) {
+	const every = 50 * time.Millisecond
+	batches := make(chan []interface{}, 10)
+	q := NewPushBatchQueue(1, 10, 10, func(items []interface{}) {
+		batches <- items
+	})
+	q.AlignedBatchWindow(every)
+	q.Start()
+
+	put := time.Now()
+	q.Put(1)
+	q.Put(2)
+	q.Put(3)
+	batch := <-batches
+	if dispatched := time.Now(); dispatched.Before(put.Truncate(every).Add(every)) {
+		t.Errorf("batch dispatched at %v, before its window closed", dispatched.Sub(put))
+	}
+	if !reflect.DeepEqual(batch, []interface{}{1, 2, 3}) {
+		t.Errorf("got batch %v, want the window's items together", batch)
+	}
+	drainAndWait(t, q)
+}
+
+func TestSchedule(t *testing.T) {
+	soon := time.Now().Add(time.Hour)
+	later := soon.Add(time.Hour)
+	policies := []struct {
+		name   string
+		policy SchedulingPolicy
+		want   []interface{}
+	}{
+		{"FIFO", FIFO, []interface{}{"a", "b", "c", "d"}},
+		{"LIFO", LIFO, []interface{}{"d", "c", "b", "a"}},
+		{"PriorityOrder", PriorityOrder, []interface{}{"c", "a", "b", "d"}},
+		{"EarliestDeadlineFirst", EarliestDeadlineFirst, []interface{}{"b", "d", "c", "a"}},
+		{"custom", SchedulingPolicyFunc(func(items []*Envelope, now time.Time) int {
+			return len(items) - 1
+		}), []interface{}{"d", "b", "a", "c"}},
+	}
+	for _, p := range policies {
+		var got []interface{}
+		q := NewPushQueue(1, 10, func(item interface{}) {
+			got = append(got, item)
+		})
+		q.Schedule(p.policy)
+		q.Put("a")
+		q.Put(&Envelope{Item: "b", Deadline: soon})
+		q.Put(&Envelope{Item: "c", Priority: 1})
+		q.Put(&Envelope{Item: "d", Deadline: later})
+		q.Start()
+		drainAndWait(t, q)
+		if !reflect.DeepEqual(got, p.want) {
+			t.Errorf("%s: got order %v, want %v", p.name, got, p.want)
+		}
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	errs := make(chan error, 10)
+	q := NewPushQueue(1, 10, nil)
+	q.SafeMode()
+	q.OnInternalError(func(err error) { errs <- err })
+	next := func() error {
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("no internal error reported")
+			return nil
+		}
+	}
+
+	q.Start()
+	if _, ok := next().(*InternalError); !ok || q.IsStarted() {
+		t.Error("Start with no worker was not refused")
+	}
+	q.IntakeRate(0, time.Second)
+	if _, ok := next().(*InternalError); !ok {
+		t.Error("invalid intake rate not reported")
+	}
+	q.OnThreshold(2, 0, func(ThresholdEvent) {}).Unsubscribe()
+	if _, ok := next().(*InternalError); !ok {
+		t.Error("invalid threshold not reported")
+	}
+	if q.Contains("key") {
+		t.Error("found a key with no key function")
+	}
+	next()
+
+	done := make(chan bool)
+	p := NewPushQueue(1, 10, func(item interface{}) {
+		if item == "bad" {
+			panic("bad item")
+		}
+		done <- true
+	})
+	p.SafeMode()
+	p.OnInternalError(func(err error) { errs <- err })
+	p.Start()
+	p.Put("bad")
+	if _, ok := next().(*PanicError); !ok {
+		t.Error("worker panic not reported")
+	}
+	p.Put("good")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue stopped after a worker panic")
+	}
+	if err := p.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	q := NewPushQueue(2, 10, func(item interface{}) {
+		started <- item.(string)
+		<-release
+	})
+	q.TenantLimits(func(item QueueItem) interface{} {
+		return item.(string)[:1]
+	}, 2, 1)
+	overloads := make(chan OverloadEvent, 10)
+	q.OnOverloadEvent(func(e OverloadEvent) { overloads <- e })
+	q.Start()
+
+	q.Put("a1")
+	<-started
+	// a1 is running, so a2 and a3 wait and a4 is over the limit
+	q.PutItems("a2", "a3", "a4")
+	select {
+	case e := <-overloads:
+		if e.Item != "a4" || e.Reason != OverloadTenant || e.Tenant != "a" {
+			t.Errorf("got overload %+v, want a4 of tenant a", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no tenant overload")
+	}
+
+	q.Put("b1")
+	select {
+	case item := <-started:
+		if item != "b1" {
+			t.Errorf("dispatched %v while tenant a was at its worker limit", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b1 not dispatched")
+	}
+	close(release)
+	drainAndWait(t, q)
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuditSink(t *testing.T) {
+	records := make(chan AuditRecord, 10)
+	release := make(chan struct{})
+	q := NewPushQueue(1, 2, func(item interface{}) { <-release })
+	q.AuditSink(func(r AuditRecord) { records <- r })
+
+	q.Put(1)
+	q.Put(&Envelope{Item: 2, Deadline: time.Now().Add(-time.Second)})
+	q.Put(3)
+	q.Start()
+	// item 1 keeps the worker busy, so the queue is still draining
+	q.Drain()
+	q.Put(4)
+	close(release)
+
+	want := map[interface{}]DropReason{2: DropExpired, 3: DropOverload, 4: DropDraining}
+	for range want {
+		select {
+		case r := <-records:
+			if reason, ok := want[r.Item]; !ok || r.Reason != reason || r.At.IsZero() {
+				t.Errorf("got record %+v", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing audit record")
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var mutex sync.Mutex
+	busy, peak := 0, 0
+	release := make(chan struct{})
+	q := NewPushQueue(3, 10, func(item interface{}) {
+		mutex.Lock()
+		busy++
+		if busy > peak {
+			peak = busy
+		}
+		mutex.Unlock()
+		<-release
+		mutex.Lock()
+		busy--
+		mutex.Unlock()
+	})
+	q.Warmup(func() {
+		for i := 0; i < 6; i++ {
+			q.Put(i)
+		}
+	}, 200*time.Millisecond)
+	q.Start()
+
+	peakAfter := func(d time.Duration) int {
+		time.Sleep(d)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return peak
+	}
+	if p := peakAfter(50 * time.Millisecond); p != 1 {
+		t.Errorf("%d workers busy early in the ramp, want 1", p)
+	}
+	if p := peakAfter(250 * time.Millisecond); p != 3 {
+		t.Errorf("%d workers busy after the ramp, want 3", p)
+	}
+	close(release)
+	drainAndWait(t, q)
+}
+
+func TestResultWorker(t *testing.T) {
+	q := NewPushQueue(2, 10, nil)
+	q.ResultWorker(func(item interface{}) (interface{}, error) {
+		n := item.(int)
+		if n < 0 {
+			return nil, errors.New("negative")
+		}
+		return n * n, nil
+	})
+	handled := make(chan Result, 10)
+	q.OnResult(func(r Result) { handled <- r })
+	q.CollectResults()
+
+	f := q.PutFuture(3)
+	q.Put(-1)
+	q.Start()
+	if err := f.Wait(); err != nil || f.Value() != 9 {
+		t.Errorf("got future value %v and error %v, want 9 and nil", f.Value(), err)
+	}
+
+	results, err := q.DrainResults(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		switch r.Item {
+		case 3:
+			if r.Value != 9 || r.Err != nil {
+				t.Errorf("got result %+v", r)
+			}
+		case -1:
+			if r.Err == nil {
+				t.Errorf("got result %+v, want an error", r)
+			}
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing OnResult event")
+		}
+	}
+	if results, _ := q.DrainResults(time.Second); len(results) != 0 {
+		t.Errorf("got %d results again, want 0", len(results))
+	}
+}
+
+func TestSuppressDuplicates(t *testing.T) {
+	var mutex sync.Mutex
+	var processed []string
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		mutex.Lock()
+		processed = append(processed, item.(string))
+		mutex.Unlock()
+	})
+	q.SuppressDuplicates(func(item QueueItem) interface{} {
+		return item.(string)[:1]
+	}, 100*time.Millisecond)
+	suppressed := make(chan interface{}, 10)
+	q.OnSuppressed(func(item interface{}) { suppressed <- item })
+	q.Start()
+
+	if err := q.PutFuture("a1").Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// suppressed even though a1 has been processed
+	if err := q.PutFuture("a2").Wait(); err != ErrDuplicate {
+		t.Errorf("got %v for duplicate, want ErrDuplicate", err)
+	}
+	q.PutItems("b1", "b2")
+	time.Sleep(150 * time.Millisecond)
+	q.Put("a3")
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(processed, []string{"a1", "b1", "a3"}) {
+		t.Errorf("processed %v, want [a1 b1 a3]", processed)
+	}
+	if n := q.SuppressedCount(); n != 2 {
+		t.Errorf("suppressed count %d, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-suppressed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing OnSuppressed event")
+		}
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCoalesceByKey(t *testing.T) {
+	type delta struct {
+		key string
+		n   int
+	}
+	batches := make(chan []interface{}, 10)
+	q := NewPushBatchQueue(1, 10, 10, func(items []interface{}) {
+		batches <- items
+	})
+	q.CoalesceByKey(func(item QueueItem) interface{} {
+		return item.(delta).key
+	}, func(pending, item interface{}) interface{} {
+		return delta{pending.(delta).key, pending.(delta).n + item.(delta).n}
+	})
+
+	first := q.PutFuture(delta{"a", 1})
+	q.Put(delta{"b", 2})
+	merged := q.PutFuture(delta{"a", 3})
+	q.Put(delta{"a", 5})
+	q.Start()
+
+	select {
+	case batch := <-batches:
+		want := []interface{}{delta{"a", 9}, delta{"b", 2}}
+		if !reflect.DeepEqual(batch, want) {
+			t.Errorf("got batch %v, want %v", batch, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch")
+	}
+	if err := merged.Wait(); err != nil {
+		t.Error(err)
+	}
+	if err := first.Wait(); err != nil {
+		t.Error(err)
+	}
+	drainAndWait(t, q)
+	if n := q.CoalescedCount(); n != 2 {
+		t.Errorf("coalesced count %d, want 2", n)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestForwardOverloads(t *testing.T) {
+	release := make(chan struct{})
+	q := NewPushQueue(1, 1, func(item interface{}) { <-release })
+	forwarded := make(chan interface{}, 10)
+	q.ForwardOverloads(ForwarderFunc(func(item interface{}) error {
+		if item == "refused" {
+			return errors.New("peer full")
+		}
+		forwarded <- item
+		return nil
+	}))
+	overloads := make(chan interface{}, 10)
+	q.OnOverload(func(item interface{}) { overloads <- item })
+
+	q.Start()
+	q.Put("working")
+	for q.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Put("pending")
+	f := q.PutFuture("spilled")
+	q.Put("refused")
+
+	if err := f.Wait(); err != ErrForwarded {
+		t.Errorf("got %v for forwarded item, want ErrForwarded", err)
+	}
+	select {
+	case item := <-forwarded:
+		if item != "spilled" {
+			t.Errorf("forwarded %v, want spilled", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("item not forwarded")
+	}
+	select {
+	case item := <-overloads:
+		if item != "refused" {
+			t.Errorf("overload %v, want refused", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("item failing to forward not reported as overload")
+	}
+
+	close(release)
+	drainAndWait(t, q)
+	if n := q.ForwardedCount(); n != 1 {
+		t.Errorf("forwarded count %d, want 1", n)
+	}
+	if n := q.OverloadCount(); n != 1 {
+		t.Errorf("overload count %d, want 1", n)
+	}
+	if err := q.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
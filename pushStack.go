@@ -1,7 +1,9 @@
 package push
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
 // PushStack holds the processing and state information
@@ -11,13 +13,42 @@ type PushStack struct {
 	concurrency      int
 	availableWorkers int
 	height           int
-	items            []interface{}
+	items            []*Envelope
+	deliverEnvelopes bool
+	keyFunc          func(QueueItem) interface{}
 	started          bool
+	suspended        bool
+	run              int
+	stopOnCancel     bool
 	draining         bool
+	drainOldestFirst bool
+	overwriteOldest  bool
+	higherPriority   func(a, b interface{}) bool
 	overload         int
+	intakeRate       *tokenBucket
+	throttled        skipCount
+	shed             skipCount
+	suppressed       skipCount
+	dedupe           *dedupe
+	pressure         pressure
+	expired          skipCount
+	drainDropped     skipCount
+	pace             pacer
+	warmup           warmup
+	costs            costLimit
+	levels           thresholds
+	total            totals
+	hooks            itemHooks
+	events           eventQueue
+	safe             safety
 	onOverload       func(interface{})
 	onFirstOverload  func(interface{})
+	onOverloadEvent  func(OverloadEvent)
+	overloads        overloadSummary
 	onDrained        func()
+	onDrainSummary   func(DrainSummary)
+	onStateChange    func(StateChangeEvent)
+	drain            drainStats
 	mutex            sync.Mutex
 }
 
@@ -31,8 +62,19 @@ type PushStackPut interface {
 	IsStarted() bool
 }
 
-// compile-time check that interface is satisfied
+// PushStackPutEvents extends PushStackPut with the event
+// registration methods, so that clients holding only the
+// interface can still attach handlers to the stack's events.
+type PushStackPutEvents interface {
+	PushStackPut
+	OnOverload(func(interface{}))
+	OnFirstOverload(func(interface{}))
+	OnDrained(func())
+}
+
+// compile-time check that interfaces are satisfied
 var _ PushStackPut = (*PushStack)(nil)
+var _ PushStackPutEvents = (*PushStack)(nil)
 
 // NewPushStack creates a new PushStack with the given concurrency,
 // height and worker. The worker is the function that will be called
@@ -51,54 +93,289 @@ func NewPushStack(concurrency int, height int, worker func(interface{})) *PushSt
 		concurrency:      concurrency,
 		availableWorkers: concurrency,
 		height:           height,
-		items:            make([]interface{}, 0, height),
-		worker:           worker}
+		items:            make([]*Envelope, 0, height),
+		worker:           worker,
+		throttled:        skipCount{err: ErrThrottled, reason: DropThrottled, pick: pickThrottled},
+		shed:             skipCount{err: ErrShed, reason: DropShed, pick: pickShed},
+		suppressed:       skipCount{err: ErrDuplicate, reason: DropDuplicate, pick: pickSuppressed},
+		expired:          skipCount{err: ErrExpired, reason: DropExpired, pick: pickExpired},
+		drainDropped:     skipCount{err: ErrDropped, reason: DropDraining, pick: pickDroppedWhileDraining}}
+	s.pace = newPacer(&s.mutex, s.pop)
 
 	return s
 }
 
+// CloneConfig returns a new, unstarted stack with the same
+// concurrency, height, worker, policies and event handlers as the
+// stack, and an empty buffer. Dispatch and intake rates set on the
+// stack are given afresh to the clone, while a limiter given to the
+// stack, such as with SharedDispatchRate, is shared with it.
+// Handlers added with Subscribe, OnThreshold or OnAlert are not
+// copied, as their Subscriptions belong to the stack.
+func (s *PushStack) CloneConfig() *PushStack {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	c := &PushStack{
+		concurrency:      s.concurrency,
+		availableWorkers: s.concurrency,
+		height:           s.height,
+		items:            make([]*Envelope, 0, s.height),
+		worker:           s.worker,
+		deliverEnvelopes: s.deliverEnvelopes,
+		keyFunc:          s.keyFunc,
+		stopOnCancel:     s.stopOnCancel,
+		throttled:        s.throttled.clone(),
+		shed:             s.shed.clone(),
+		suppressed:       s.suppressed.clone(),
+		dedupe:           s.dedupe.clone(),
+		expired:          s.expired.clone(),
+		drainDropped:     s.drainDropped.clone(),
+		costs:            s.costs.clone(),
+		hooks:            s.hooks.clone(),
+		events:           eventQueue{sync: s.events.sync, onPanic: s.events.onPanic, audit: s.events.audit},
+		safe:             s.safe,
+		drainOldestFirst: s.drainOldestFirst,
+		overwriteOldest:  s.overwriteOldest,
+		higherPriority:   s.higherPriority,
+		onOverload:       s.onOverload,
+		onFirstOverload:  s.onFirstOverload,
+		onOverloadEvent:  s.onOverloadEvent,
+		onDrained:        s.onDrained,
+		onDrainSummary:   s.onDrainSummary,
+		onStateChange:    s.onStateChange}
+	if s.intakeRate != nil {
+		c.intakeRate = s.intakeRate.clone()
+	}
+	c.pace = s.pace.clone(&c.mutex, c.pop)
+	c.warmup = newWarmup(s.warmup.run, s.warmup.ramp)
+	c.overloads.set(s.overloads.period, s.overloads.handler, c.reportOverloads)
+
+	return c
+}
+
 // Start begins stack processing. Start panics if no worker
 // has been set.
 func (s *PushStack) Start() {
+	s.start()
+}
+
+// start begins processing and returns the number of the new run.
+func (s *PushStack) start() int {
+	defer s.guard()
+
 	if s.worker == nil {
 		panic("no worker set")
 	}
+
+	s.mutex.Lock()
+	prepare := s.warmup.run
+	s.unlock()
+	if prepare != nil {
+		prepare()
+	}
+
+	s.mutex.Lock()
+	from := s.state()
 	s.started = true
 	s.draining = false
-	s.overload = 0
+	s.changeState(from, CauseCall)
+	s.resetStats()
+	s.run++
+	run := s.run
+	s.warmup.begin(time.Now(), s.concurrency, s.pop)
+	s.unlock()
+
 	go s.pop()
+	return run
+}
+
+// ResetStats resets the counts of overloads, expired, throttled,
+// shed, suppressed and dropped-while-draining items, as Start does,
+// without affecting processing. After a reset the next overload
+// raises the OnFirstOverload event again.
+func (s *PushStack) ResetStats() {
+	s.mutex.Lock()
+	s.resetStats()
+	s.unlock()
+}
+
+// resetStats resets the counts. It must be called with the mutex
+// held.
+func (s *PushStack) resetStats() {
+	s.overload = 0
+	s.expired.count = 0
+	s.throttled.count = 0
+	s.shed.count = 0
+	s.suppressed.count = 0
+	s.drainDropped.count = 0
+}
+
+// StartContext begins stack processing like Start, and ties the
+// stack's lifetime to ctx: when ctx is done, the stack is drained,
+// or stopped if StopOnCancel has been set. Calling Start, Stop or
+// StartContext again releases the stack from ctx.
+func (s *PushStack) StartContext(ctx context.Context) {
+	run := s.start()
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		current := s.run == run && s.started
+		stop := s.stopOnCancel
+		s.unlock()
+		if !current {
+			return
+		}
+		if stop {
+			s.stop(CauseContext)
+		} else {
+			s.startDrain(CauseContext)
+		}
+	}()
+}
+
+// StopOnCancel tells a stack started with StartContext to Stop,
+// rather than Drain, when its context is done.
+func (s *PushStack) StopOnCancel() {
+	s.mutex.Lock()
+	s.stopOnCancel = true
+	s.unlock()
 }
 
 // IsStarted indicates whether the stack is started. This method
 // returns true when the stack is available to clients to Put
 // items. IsStarted returns false when the stack is draining.
 func (s *PushStack) IsStarted() bool {
+	s.mutex.Lock()
+	defer s.unlock()
+
 	return s.started
 }
 
+// SuspendIntake stops the stack from handing items to its workers,
+// while it goes on accepting Puts and keeping them, until
+// ResumeIntake is called. Unlike Stop, it leaves the stack started,
+// and unlike Start, ResumeIntake leaves the counts as they are. A
+// drain proceeds even while intake is suspended.
+func (s *PushStack) SuspendIntake() {
+	s.mutex.Lock()
+	s.suspended = true
+	s.unlock()
+}
+
+// ResumeIntake resumes handing items to workers after
+// SuspendIntake.
+func (s *PushStack) ResumeIntake() {
+	s.mutex.Lock()
+	s.suspended = false
+	n := s.availableWorkers
+	s.unlock()
+
+	for i := 0; i < n; i++ {
+		go s.pop()
+	}
+}
+
 // Stop ends processing of stack items. This also ends
 // draining of items if Drain has been called.
 func (s *PushStack) Stop() {
+	s.stop(CauseCall)
+}
+
+func (s *PushStack) stop(cause StateCause) {
+	s.mutex.Lock()
+	s.halt(cause)
+	s.unlock()
+}
+
+// halt ends processing. It must be called with the mutex held.
+func (s *PushStack) halt(cause StateCause) {
+	from := s.state()
+	s.run++
 	s.started = false
 	s.draining = false
+	s.changeState(from, cause)
+}
+
+// Absorb moves the items pending in other into the stack, as though
+// they had been Pushed in the order they were pending in other, and
+// stops other. Items that do not fit are handled according to the
+// stack's overload policy. Items already being processed by other's
+// workers are left to finish there. Absorb panics if other is the
+// stack itself.
+func (s *PushStack) Absorb(other *PushStack) {
+	defer s.guard()
+
+	if other == s {
+		panic("cannot absorb a stack into itself")
+	}
+
+	other.mutex.Lock()
+	items := other.items
+	other.items = make([]*Envelope, 0, other.height)
+	other.total.removed += len(items)
+	other.halt(CauseCall)
+	other.levels.check(0, other.height, &other.events)
+	other.unlock()
+
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.total.put += len(items)
+	for _, e := range items {
+		s.add(e)
+	}
+	go s.pop()
 }
 
 // Drain processes remaining items in the stack and prevents
 // new items from being put onto the stack.
 func (s *PushStack) Drain() {
+	s.startDrain(CauseCall)
+}
+
+func (s *PushStack) startDrain(cause StateCause) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	from := s.state()
+	if !s.draining {
+		s.drain.begin(s.total.processed, s.drainDropped.count)
+	}
 	s.draining = true
 	s.started = false
-	if s.Count() == 0 && s.availableWorkers == s.concurrency {
+	s.changeState(from, cause)
+	if len(s.items) == 0 && s.availableWorkers == s.concurrency {
 		// already drained
 		s.setDrained()
 	}
 	go s.pop()
 }
 
+// DrainOldestFirst tells the stack to process the items remaining
+// at the time of a Drain in the order they were pushed (oldest first)
+// rather than the normal LIFO order.
+func (s *PushStack) DrainOldestFirst() {
+	s.mutex.Lock()
+	s.drainOldestFirst = true
+	s.unlock()
+}
+
 // OnDrained sets an event handler that will be called when
 // the draining is complete.
 func (s *PushStack) OnDrained(f func()) {
+	s.mutex.Lock()
 	s.onDrained = f
+	s.unlock()
+}
+
+// OnDrainSummary sets an event handler that will be called when the
+// draining is complete, like the OnDrained handler, with a summary
+// of the drain.
+func (s *PushStack) OnDrainSummary(f func(DrainSummary)) {
+	s.mutex.Lock()
+	s.onDrainSummary = f
+	s.unlock()
 }
 
 // Empty removes all items currently in the stack. This method
@@ -106,44 +383,790 @@ func (s *PushStack) OnDrained(f func()) {
 // stack.
 func (s *PushStack) Empty() {
 	s.mutex.Lock()
-	s.items = make([]interface{}, 0, s.Height())
-	s.mutex.Unlock()
+	for _, e := range s.items {
+		e.resolve(ErrRemoved)
+	}
+	s.total.removed += len(s.items)
+	s.items = make([]*Envelope, 0, s.height)
+	s.levels.check(len(s.items), s.height, &s.events)
+	if s.draining && s.availableWorkers == s.concurrency {
+		s.setDrained()
+	}
+	s.unlock()
+}
+
+// Items returns a snapshot of the items currently in the stack,
+// oldest first. The returned slice is a copy taken under lock; it
+// is safe to read and modify, and does not change as the stack
+// is processed.
+func (s *PushStack) Items() []QueueItem {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.pending()
+}
+
+// Snapshot returns a copy of the items currently in the stack,
+// oldest first, together with the stack's state, all taken at the
+// same moment under lock.
+func (s *PushStack) Snapshot() Snapshot {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return Snapshot{
+		Items:    s.pending(),
+		InFlight: s.total.inFlight,
+		Capacity: s.height,
+		State:    s.state(),
+		Taken:    time.Now()}
+}
+
+// ForEach calls f for each item currently in the stack, oldest
+// first, until f returns false. Unlike Items, it does not copy the
+// stack; instead f is called with the mutex held, so it must be
+// quick and must not call back into the stack.
+func (s *PushStack) ForEach(f func(QueueItem) bool) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	for _, e := range s.items {
+		if !f(e.payload(s.deliverEnvelopes)) {
+			return
+		}
+	}
+}
+
+// Sort reorders the items currently in the stack as though they
+// had been put in the order given by less, which reports whether
+// item a goes before item b. The sort is stable, and less is
+// called with the mutex held, so it must not call back into the
+// stack.
+func (s *PushStack) Sort(less func(a, b QueueItem) bool) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	sortItems(s.items, less, s.deliverEnvelopes)
+}
+
+// String returns a one-line description of the stack's state, for
+// logs.
+func (s *PushStack) String() string {
+	return s.describe().String()
+}
+
+// Dump returns a multi-line description of the stack's settings,
+// state and counts, with a sample of the pending items, for logs and
+// crash reports.
+func (s *PushStack) Dump() string {
+	return s.describe().dump()
+}
+
+func (s *PushStack) describe() *description {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	sample, more := sampleItems(s.items, s.deliverEnvelopes)
+	return &description{
+		kind:        "PushStack",
+		state:       s.state(),
+		count:       len(s.items),
+		capacity:    s.height,
+		inFlight:    s.total.inFlight,
+		available:   s.availableWorkers,
+		concurrency: s.concurrency,
+		settings: []interface{}{
+			"deliverEnvelopes", s.deliverEnvelopes,
+			"drainOldestFirst", s.drainOldestFirst,
+			"overwriteOldest", s.overwriteOldest,
+			"popByPriority", s.higherPriority != nil,
+			"syncEvents", s.events.sync},
+		counts: []interface{}{
+			"overloads", s.overload,
+			"throttled", s.throttled.count,
+			"shed", s.shed.count,
+			"suppressed", s.suppressed.count,
+			"expired", s.expired.count,
+			"droppedWhileDraining", s.drainDropped.count,
+			"processed", s.total.processed,
+			"removed", s.total.removed},
+		sample: sample,
+		more:   more}
+}
+
+// pending returns a copy of the pending items. It must be called
+// with the mutex held.
+func (s *PushStack) pending() []QueueItem {
+	items := make([]QueueItem, len(s.items))
+	for i, e := range s.items {
+		items[i] = e.payload(s.deliverEnvelopes)
+	}
+	return items
+}
+
+// RemoveWhere atomically removes the pending items for which pred
+// returns true and returns the number of items removed. Removed
+// items are not processed; their Futures report ErrRemoved.
+func (s *PushStack) RemoveWhere(pred func(QueueItem) bool) int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	var removed []*Envelope
+	s.items, removed = removeWhere(s.items, s.deliverEnvelopes, pred)
+	for _, e := range removed {
+		e.resolve(ErrRemoved)
+	}
+	s.total.removed += len(removed)
+	s.levels.check(len(s.items), s.height, &s.events)
+	if s.draining && len(s.items) == 0 && s.availableWorkers == s.concurrency {
+		s.setDrained()
+	}
+	return len(removed)
+}
+
+// SplitWhere atomically removes the pending items for which pred
+// returns true, like RemoveWhere, and returns them, oldest first,
+// so that they can be redirected to another component. Each item is
+// returned in its *Envelope, so that Pushting it into another
+// component carries its priority, deadline and Future along; the
+// item's Future is not resolved by the removal.
+func (s *PushStack) SplitWhere(pred func(QueueItem) bool) []QueueItem {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	var removed []*Envelope
+	s.items, removed = removeWhere(s.items, s.deliverEnvelopes, pred)
+	s.total.removed += len(removed)
+	s.levels.check(len(s.items), s.height, &s.events)
+	if s.draining && len(s.items) == 0 && s.availableWorkers == s.concurrency {
+		s.setDrained()
+	}
+
+	items := make([]QueueItem, len(removed))
+	for i, e := range removed {
+		items[i] = e
+	}
+	return items
+}
+
+// KeyFunc sets the function used by Contains and Get to derive
+// a key from an item. Keys must be comparable.
+func (s *PushStack) KeyFunc(f func(QueueItem) interface{}) {
+	s.mutex.Lock()
+	s.keyFunc = f
+	s.unlock()
+}
+
+// Contains reports whether an item with the given key is pending
+// in the stack. Items already handed to a worker are not pending.
+// Contains panics if no key function has been set.
+func (s *PushStack) Contains(key interface{}) bool {
+	_, ok := s.Get(key)
+	return ok
+}
+
+// Get returns the first pending item with the given key, and
+// whether one was found. Get panics if no key function has been
+// set.
+func (s *PushStack) Get(key interface{}) (QueueItem, bool) {
+	defer s.guard()
+
+	s.mutex.Lock()
+	defer s.unlock()
+
+	e := findKey(s.items, s.deliverEnvelopes, s.keyFunc, key)
+	if e == nil {
+		return nil, false
+	}
+	return e.payload(s.deliverEnvelopes), true
 }
 
 // IsFull indicates whether the stack can accept new items.
 func (s *PushStack) IsFull() bool {
-	return s.Count() >= s.Height()
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return len(s.items) >= s.height
 }
 
 // Count returns the current number of items in the stack.
 func (s *PushStack) Count() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
 	return len(s.items)
 }
 
+// InFlight returns the number of items currently being processed by
+// workers. Together with Count it tells whether any work
+// is still happening.
+func (s *PushStack) InFlight() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.total.inFlight
+}
+
+// AvailableWorkers returns the number of workers currently free to
+// take an item, out of the stack's concurrency.
+func (s *PushStack) AvailableWorkers() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.availableWorkers
+}
+
 // Height returns the maximum capacity of the stack.
 func (s *PushStack) Height() int {
 	return s.height
 }
 
-// Overload returns the number of times that clients attempted
-// to Put items exceeding stack height or while the stack was
-// draining. The exceeding items were dropped on the floor. This
-// count is reset when Start is called.
-func (s *PushStack) Overload() int {
+// OverloadCount returns the number of times that clients attempted
+// to Put items exceeding stack height. The exceeding items were
+// dropped on the floor. Items refused while the stack is draining
+// are counted by DroppedWhileDrainingCount instead. This count is
+// reset by Start and ResetStats.
+func (s *PushStack) OverloadCount() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
 	return s.overload
 }
 
+// Overload returns the same count as OverloadCount.
+//
+// Deprecated: Use OverloadCount, named as on the queues.
+func (s *PushStack) Overload() int {
+	return s.OverloadCount()
+}
+
+// DeliverEnvelopes tells the stack to hand each item to the worker,
+// and to the event handlers, wrapped in its *Envelope rather than
+// as the bare item. The PopByPriority function is likewise given
+// envelopes.
+func (s *PushStack) DeliverEnvelopes() {
+	s.mutex.Lock()
+	s.deliverEnvelopes = true
+	s.unlock()
+}
+
+// SyncEvents tells the stack to call its event handlers in the order
+// the events occur, on the goroutine that caused them, rather than
+// each on its own goroutine. The handlers are still called without
+// the stack's mutex held, so they may call back into the stack, but a
+// slow handler holds up the call that raised its event, such as a
+// Put or the completion of a worker. To have only some handlers
+// called in order, Subscribe them with Handlers.Sync instead.
+func (s *PushStack) SyncEvents() {
+	s.mutex.Lock()
+	s.events.sync = true
+	s.unlock()
+}
+
+// AuditSink sets a sink that will be called with a record of every
+// item the stack drops without processing it, whatever the reason,
+// for audit logging and later replay. Like the event handlers, the
+// sink is never called with the mutex held. AuditTo makes a sink
+// that Puts the records into another component.
+func (s *PushStack) AuditSink(f func(AuditRecord)) {
+	s.mutex.Lock()
+	s.events.audit = f
+	s.unlock()
+}
+
+// OnHandlerPanic sets a function to be called with the value of any
+// panic raised by one of the stack's event handlers. The panic is
+// recovered and the stack keeps running. Until a function is set,
+// such panics are written to the standard logger.
+func (s *PushStack) OnHandlerPanic(f func(interface{})) {
+	s.mutex.Lock()
+	s.events.onPanic = f
+	s.hooks.onPanic = f
+	s.unlock()
+}
+
+// SafeMode tells the stack to recover panics rather than let them
+// crash the program, for long-running daemons that cannot tolerate
+// them. In safe mode a method that would panic, such as Start with
+// no worker set or a setter given an invalid argument, instead
+// reports an *InternalError to the OnInternalError handler and
+// returns without effect, returning zero values if it has results.
+// A panic in a worker is reported as a *PanicError, and the stack
+// keeps running. Constructors still panic on invalid arguments.
+func (s *PushStack) SafeMode() {
+	s.mutex.Lock()
+	s.safe.on = true
+	s.unlock()
+}
+
+// OnInternalError sets an event handler that will be called with
+// each error recovered in safe mode. Until a handler is set, such
+// errors are written to the standard logger.
+func (s *PushStack) OnInternalError(f func(error)) {
+	s.mutex.Lock()
+	s.safe.handler = f
+	s.unlock()
+}
+
+// guard recovers a panic in a method of the stack in safe mode and
+// reports it, and otherwise lets it continue. It must be deferred
+// by methods that may panic, which must not hold the mutex at the
+// point of the panic.
+func (s *PushStack) guard() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	s.mutex.Lock()
+	safe := s.safe.on
+	if safe {
+		s.safe.report(&InternalError{Value: v}, &s.events)
+	}
+	s.unlock()
+	if !safe {
+		panic(v)
+	}
+}
+
+// safely runs work, which calls a worker, recovering and reporting a
+// panic in it in safe mode.
+func (s *PushStack) safely(work func()) {
+	s.mutex.Lock()
+	safe := s.safe.on
+	s.unlock()
+	if !safe {
+		work()
+		return
+	}
+	if err := recovered(work); err != nil {
+		s.mutex.Lock()
+		s.safe.report(err, &s.events)
+		s.unlock()
+	}
+}
+
+// OverwriteOldestWhenFull puts the stack into sliding-overwrite
+// mode. When the stack is full, Push silently discards the bottom
+// (oldest) item to make room for the new one. This is not treated
+// as an overload: the Overload count is not incremented and the
+// overload event handlers are not called. This suits "keep the
+// newest N" uses such as recent-state caches.
+func (s *PushStack) OverwriteOldestWhenFull() {
+	s.mutex.Lock()
+	s.overwriteOldest = true
+	s.unlock()
+}
+
+// PopByPriority tells the stack to pop the item with the highest
+// priority first. The higher function reports whether item a has a
+// higher priority than item b. Items of equal priority are popped
+// in the normal LIFO order (or oldest first while draining, if
+// DrainOldestFirst is set).
+func (s *PushStack) PopByPriority(higher func(a, b interface{}) bool) {
+	s.mutex.Lock()
+	s.higherPriority = higher
+	s.unlock()
+}
+
+// CostLimit enforces concurrency by item cost in addition to the
+// worker count. The cost function returns the cost of an item, and
+// new work is started only while the total cost of the items being
+// processed stays within maxCost. An item whose cost alone
+// exceeds maxCost is started only when nothing else is in flight.
+// CostLimit panics if maxCost is less than 1.
+func (s *PushStack) CostLimit(maxCost int, cost func(QueueItem) int) {
+	defer s.guard()
+
+	checkMaxCost(maxCost)
+
+	s.mutex.Lock()
+	s.costs.set(maxCost, cost)
+	s.unlock()
+}
+
+// MaxDispatchRate limits the stack to handing at most n items to
+// workers in any interval of length per, even when workers are
+// available. MaxDispatchRate panics if n or per is not
+// positive.
+func (s *PushStack) MaxDispatchRate(n int, per time.Duration) {
+	defer s.guard()
+
+	newRate := func() RateLimiter {
+		return NewRateLimit(n, per)
+	}
+	l := newRate()
+
+	s.mutex.Lock()
+	s.pace.setOwnRate(l, newRate)
+	s.unlock()
+}
+
+// DispatchRateWithBurst limits the stack to handing items to
+// workers at a sustained rate of n per interval, using a token
+// bucket that holds up to burst tokens. Unlike MaxDispatchRate,
+// which caps the count in every interval, this absorbs spikes of
+// up to burst items at full speed and throttles only sustained
+// load. DispatchRateWithBurst panics if n, per or burst is not
+// positive.
+func (s *PushStack) DispatchRateWithBurst(n int, per time.Duration, burst int) {
+	defer s.guard()
+
+	newRate := func() RateLimiter {
+		return NewRateLimitWithBurst(n, per, burst)
+	}
+	l := newRate()
+
+	s.mutex.Lock()
+	s.pace.setOwnRate(l, newRate)
+	s.unlock()
+}
+
+// IntakeRate limits the rate at which the stack accepts items
+// with a token bucket that is refilled at n tokens per interval
+// and holds at most n tokens. Each Push takes a token; a Push that
+// finds the bucket empty is rejected before it can reach the
+// buffer. Rejected items are counted by ThrottledCount rather
+// than as overloads. IntakeRate panics if n or per is not
+// positive.
+func (s *PushStack) IntakeRate(n int, per time.Duration) {
+	s.IntakeRateWithBurst(n, per, n)
+}
+
+// IntakeRateWithBurst is like IntakeRate, but the bucket holds
+// up to burst tokens, so that a spike of up to burst items is
+// accepted at full speed and only sustained load above n per
+// interval is throttled. IntakeRateWithBurst panics if n, per or
+// burst is not positive.
+func (s *PushStack) IntakeRateWithBurst(n int, per time.Duration, burst int) {
+	defer s.guard()
+
+	b := newTokenBucket(n, per, burst)
+
+	s.mutex.Lock()
+	s.intakeRate = b
+	s.unlock()
+}
+
+// ThrottledCount returns the number of items rejected by the
+// intake rate limit. This count is reset by Start and
+// ResetStats.
+func (s *PushStack) ThrottledCount() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.throttled.count
+}
+
+// OnThrottled sets an event handler that will be called for every
+// item rejected by the intake rate limit.
+func (s *PushStack) OnThrottled(f func(interface{})) {
+	s.mutex.Lock()
+	s.throttled.handler = f
+	s.unlock()
+}
+
+// ApplyPressure puts the stack under pressure p, so that it sheds
+// load until ReleasePressure is called. Pending items beyond p.Depth
+// and the p.Evict oldest pending items are shed at once, oldest
+// first, and items put are then handled according to p. Shed items
+// are dropped and reported to the OnShed handler, and their Futures
+// report ErrShed. A pressure already applied is replaced.
+func (s *PushStack) ApplyPressure(p Pressure) {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	s.pressure = pressure{on: true, p: p}
+	n := s.pressure.excess(len(s.items), s.height)
+	var shed []*Envelope
+	s.items, shed = shedFirst(s.items, n)
+	s.total.dropped += s.shed.add(shed, s.deliverEnvelopes, &s.events)
+	s.levels.check(len(s.items), s.height, &s.events)
+	if s.draining && len(s.items) == 0 && s.availableWorkers == s.concurrency {
+		s.setDrained()
+	}
+}
+
+// ReleasePressure ends the pressure set with ApplyPressure. Items
+// already shed are not restored.
+func (s *PushStack) ReleasePressure() {
+	s.mutex.Lock()
+	s.pressure = pressure{}
+	s.unlock()
+}
+
+// ShedCount returns the number of items shed under pressure. This
+// count is reset by Start and ResetStats.
+func (s *PushStack) ShedCount() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.shed.count
+}
+
+// OnShed sets an event handler that will be called for every item
+// shed under pressure.
+func (s *PushStack) OnShed(f func(interface{})) {
+	s.mutex.Lock()
+	s.shed.handler = f
+	s.unlock()
+}
+
+// SuppressDuplicates suppresses every item pushed whose key, as returned
+// by key, is that of an item pushed within window before it, even if
+// that item has since been processed or dropped. Suppressed items
+// are dropped and reported to the OnSuppressed handler, and their
+// Futures report ErrDuplicate. Keys must be comparable.
+// SuppressDuplicates panics if key is nil or window is not
+// positive.
+func (s *PushStack) SuppressDuplicates(key func(QueueItem) interface{}, window time.Duration) {
+	defer s.guard()
+
+	d := newDedupe(key, window)
+
+	s.mutex.Lock()
+	s.dedupe = d
+	s.unlock()
+}
+
+// SuppressedCount returns the number of items suppressed as
+// duplicates. This count is reset by Start and ResetStats.
+func (s *PushStack) SuppressedCount() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.suppressed.count
+}
+
+// OnSuppressed sets an event handler that will be called for every
+// item suppressed as a duplicate.
+func (s *PushStack) OnSuppressed(f func(interface{})) {
+	s.mutex.Lock()
+	s.suppressed.handler = f
+	s.unlock()
+}
+
+// SmoothDispatchRate spaces the handing of items to workers
+// evenly over time at n per interval, like a leaky bucket, rather
+// than releasing bursts up to the concurrency limit. It is
+// equivalent to DispatchRateWithBurst(n, per, 1).
+func (s *PushStack) SmoothDispatchRate(n int, per time.Duration) {
+	s.DispatchRateWithBurst(n, per, 1)
+}
+
+// DispatchRateLimiter limits the rate at which the stack hands
+// items to workers with any RateLimiter, such as a *rate.Limiter
+// from golang.org/x/time/rate. Each item handed to a worker takes
+// one permission from the limiter. The same limiter may be given
+// to several components.
+func (s *PushStack) DispatchRateLimiter(l RateLimiter) {
+	s.mutex.Lock()
+	s.pace.setRate(l)
+	s.unlock()
+}
+
+// SharedDispatchRate limits the rate at which the stack hands
+// items to workers with a RateLimit that may also be given to
+// other components, so that their combined dispatches respect a
+// single quota.
+func (s *PushStack) SharedDispatchRate(l *RateLimit) {
+	s.DispatchRateLimiter(l)
+}
+
+// AdaptiveDispatchRate limits the rate at which the stack hands
+// items to workers with the given AdaptiveRate, which the workers
+// inform of their outcomes so that the rate follows the health of
+// the downstream.
+func (s *PushStack) AdaptiveDispatchRate(a *AdaptiveRate) {
+	s.DispatchRateLimiter(a)
+}
+
+// DispatchJitter waits a random delay of up to max before each
+// item is handed to a worker, including the first. This spreads
+// out the load when many components start or drain against the
+// same backend at once. DispatchJitter panics if max is not
+// positive.
+func (s *PushStack) DispatchJitter(max time.Duration) {
+	defer s.guard()
+
+	j := newJitterLimiter(max)
+
+	s.mutex.Lock()
+	s.pace.jitter = j
+	s.unlock()
+}
+
+// Warmup sets a function that Start calls before any item is
+// handed to a worker, to acquire the workers' resources or to Put
+// items preloaded from storage; Start returns once f has. If ramp
+// is positive, the number of busy workers is then allowed to grow
+// evenly from one to the concurrency over ramp, so that a cold
+// start does not stampede the services the workers call. f may be
+// nil to ramp only. Warmup panics if ramp is negative.
+func (s *PushStack) Warmup(f func(), ramp time.Duration) {
+	defer s.guard()
+
+	w := newWarmup(f, ramp)
+
+	s.mutex.Lock()
+	s.warmup = w
+	s.unlock()
+}
+
+// ExpiredCount returns the number of items that were skipped
+// because their Envelope deadline had passed by the time they
+// were due to be handed to a worker. Expired items are not
+// counted as overloads. This count is reset by Start and
+// ResetStats.
+func (s *PushStack) ExpiredCount() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.expired.count
+}
+
+// OnItemStart sets an event handler that will be called each time
+// an item is handed to a worker, with the time the item waited in
+// the stack. The handler is called on the worker's goroutine
+// immediately before the worker, so together with OnItemDone it
+// brackets the processing of the item.
+func (s *PushStack) OnItemStart(f func(item interface{}, waited time.Duration)) {
+	s.mutex.Lock()
+	s.hooks.onStart = f
+	s.unlock()
+}
+
+// OnItemDone sets an event handler that will be called each time a
+// worker has finished with an item, with the time the worker took.
+// The handler is called on the worker's goroutine immediately after
+// the worker returns, including when the worker panicked and the
+// panic was reported through the item's Future.
+func (s *PushStack) OnItemDone(f func(item interface{}, elapsed time.Duration)) {
+	s.mutex.Lock()
+	s.hooks.onDone = f
+	s.unlock()
+}
+
+// OnExpired sets an event handler that will be called for every
+// item skipped because its deadline had passed.
+func (s *PushStack) OnExpired(f func(interface{})) {
+	s.mutex.Lock()
+	s.expired.handler = f
+	s.unlock()
+}
+
+// DroppedWhileDrainingCount returns the number of items refused
+// because they were put while the stack was draining. Such items
+// are lost at shutdown rather than for lack of capacity, so they
+// are not counted as overloads. This count is reset by Start
+// and ResetStats.
+func (s *PushStack) DroppedWhileDrainingCount() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.drainDropped.count
+}
+
+// OnDroppedWhileDraining sets an event handler that will be called
+// for every item refused because it was put while the stack was
+// draining. Such items do not raise the OnOverload and
+// OnFirstOverload events.
+func (s *PushStack) OnDroppedWhileDraining(f func(interface{})) {
+	s.mutex.Lock()
+	s.drainDropped.handler = f
+	s.unlock()
+}
+
+// OnThreshold sets an event handler that will be called when the
+// count of items in the stack rises to level, a fraction of the
+// stack height, and again when it falls back below level less
+// hysteresis, so that a count hovering around the level does not
+// raise a stream of events. Unlike the other events, any number of
+// thresholds may be set, each with its own handler, for graduated
+// alerts; each is removed by unsubscribing the returned
+// Subscription. OnThreshold panics unless 0 < level <= 1 and
+// 0 <= hysteresis < level.
+func (s *PushStack) OnThreshold(level, hysteresis float64, f func(ThresholdEvent)) *Subscription {
+	defer s.guard()
+
+	t := newThreshold(level, hysteresis, f)
+
+	s.mutex.Lock()
+	s.levels = append(s.levels, t)
+	s.levels.check(len(s.items), s.height, &s.events)
+	s.unlock()
+
+	return newSubscription(&s.mutex, func() {
+		s.levels = s.levels.remove(t)
+	})
+}
+
+// OnAlert sets an alert that calls alert when the count of items in
+// the stack has stayed at or above level, a fraction of the stack
+// height, for the sustain period, and then calls cleared, if not nil,
+// once the count falls back below level less hysteresis. A count
+// that falls back before the period is over raises nothing, so a
+// count flapping around the level does not raise a stream of
+// alerts. Any number of alerts may be set; each is removed by
+// unsubscribing the returned Subscription. OnAlert panics unless
+// 0 < level <= 1, 0 <= hysteresis < level and sustain is not
+// negative.
+func (s *PushStack) OnAlert(level, hysteresis float64, sustain time.Duration, alert, cleared func(AlertEvent)) *Subscription {
+	defer s.guard()
+
+	a, t := newAlert(level, hysteresis, sustain, alert, cleared)
+	a.attach(&s.mutex, s.unlock, &s.events)
+
+	s.mutex.Lock()
+	s.levels = append(s.levels, t)
+	s.levels.check(len(s.items), s.height, &s.events)
+	s.unlock()
+
+	return newSubscription(&s.mutex, func() {
+		s.levels = s.levels.remove(t)
+		a.remove()
+	})
+}
+
+// Subscribe adds the given event handlers to those of the stack,
+// without replacing the handlers set with the On methods or by
+// other subscriptions. The handlers are removed by unsubscribing
+// the returned Subscription.
+func (s *PushStack) Subscribe(h Handlers) *Subscription {
+	s.mutex.Lock()
+	sub := s.events.subscribe(h)
+	s.hooks.subs = s.events.subs
+	s.unlock()
+
+	return newSubscription(&s.mutex, func() {
+		s.events.unsubscribe(sub)
+		s.hooks.subs = s.events.subs
+	})
+}
+
 // OnOverload sets an event handler that will be called *every
 // time* a client attempts to overload the stack. The handler
 // is passed the value of the Overload register.
 func (s *PushStack) OnOverload(f func(interface{})) {
+	s.mutex.Lock()
 	s.onOverload = f
+	s.unlock()
+}
+
+// OnOverloadEvent sets an event handler that will be called every
+// time an item is dropped as an overload, like OnOverload, but with
+// an OverloadEvent telling why the item was dropped and the state of
+// the stack at the time.
+func (s *PushStack) OnOverloadEvent(f func(OverloadEvent)) {
+	s.mutex.Lock()
+	s.onOverloadEvent = f
+	s.unlock()
 }
 
 // OnFirstOverload sets an event handler that will be called the first
 // time a client attempts to overload the stack.
 func (s *PushStack) OnFirstOverload(f func(interface{})) {
+	s.mutex.Lock()
 	s.onFirstOverload = f
+	s.unlock()
 }
 
 // Push adds an item to the stack for processing. If the count
@@ -151,77 +1174,212 @@ func (s *PushStack) OnFirstOverload(f func(interface{})) {
 // the Overload flag is set and the first item added is dropped
 // on the floor. The dropped item is sent to the OnOverload
 // and OnFirstOverload (if this is the first time) event
-// handlers.
+// handlers. In sliding-overwrite mode (see OverwriteOldestWhenFull)
+// the oldest item is dropped silently instead. While the stack is
+// draining, the new item is dropped and reported to the
+// OnDroppedWhileDraining handler instead.
 func (s *PushStack) Push(item interface{}) {
+	e := envelop(item)
+
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.unlock()
 
-	if s.Count() >= s.Height() || s.draining {
-		firstItem := s.items[:1]
-		s.items = append(s.items[1:], item)
-		go s.pop()
+	s.total.put++
+	now := time.Now()
+	if s.intakeRate != nil && !s.intakeRate.take(now) {
+		s.total.throttled += s.throttled.add([]*Envelope{e}, s.deliverEnvelopes, &s.events)
+		return
+	}
+	if s.dedupe.duplicate(e, s.deliverEnvelopes, now) {
+		s.total.dropped += s.suppressed.add([]*Envelope{e}, s.deliverEnvelopes, &s.events)
+		return
+	}
 
-		s.overload++
-		if s.onOverload != nil {
-			s.onOverload(firstItem)
-		}
-		if s.overload == 1 && s.onFirstOverload != nil {
-			s.onFirstOverload(firstItem)
+	s.add(e)
+	go s.pop()
+}
+
+// add adds e to the pending items, making room for it if the stack
+// is full, or refuses it if the stack is draining. It must be called
+// with the mutex held.
+func (s *PushStack) add(e *Envelope) {
+	if s.pressure.paused() && !s.draining {
+		s.total.dropped += s.shed.add([]*Envelope{e}, s.deliverEnvelopes, &s.events)
+		return
+	}
+	height := s.pressure.capacity(s.height)
+	if s.overwriteOldest && !s.draining && len(s.items) >= height {
+		s.items[0].resolve(ErrDropped)
+		s.events.audited(s.items[0].payload(s.deliverEnvelopes), DropOverload)
+		s.total.dropped++
+		s.items = append(s.items[1:], e)
+		return
+	}
+
+	if len(s.items) >= height || s.draining {
+		// while draining the new item is refused; otherwise the
+		// first item added makes room for it
+		dropItem := e
+		if !s.draining {
+			dropItem = s.items[0]
+			s.items = append(s.items[1:], e)
 		}
+		s.overloaded([]*Envelope{dropItem}, s.overloadReason())
 		return
 	}
 
-	s.items = append(s.items, item)
-	go s.pop()
+	s.items = append(s.items, e)
+}
+
+// PushFuture adds an item to the stack like Push and returns a
+// Future that is resolved when the item's worker has finished,
+// or when the item is dropped or removed from the stack.
+func (s *PushStack) PushFuture(item interface{}) *Future {
+	e := envelop(item)
+	e.future = newFuture()
+	s.Push(e)
+	return e.future
+}
+
+// PushAndWait adds an item to the stack and blocks until the
+// item's worker has finished or ctx is done. It returns the
+// same outcome as the item's Future, or ctx.Err() if ctx is done
+// first, in which case the item remains in the stack.
+func (s *PushStack) PushAndWait(ctx context.Context, item interface{}) error {
+	return s.PushFuture(item).WaitContext(ctx)
 }
 
 func (s *PushStack) readyToWork() bool {
-	return (s.started || s.draining) &&
+	return (s.started && !s.suspended || s.draining) &&
 		s.availableWorkers > 0 &&
-		len(s.items) > 0
+		len(s.items) > 0 &&
+		s.warmup.allows(time.Now(), s.concurrency-s.availableWorkers, s.concurrency)
 }
 
 func (s *PushStack) pop() {
+	s.mutex.Lock()
+	s.levels.check(len(s.items), s.height, &s.events)
+
 	if !s.readyToWork() {
+		s.unlock()
 		return
 	}
 
-	s.mutex.Lock()
-
-	if !s.readyToWork() {
-		s.mutex.Unlock()
+	now := time.Now()
+	var e *Envelope
+	var expired []*Envelope
+	cost := 0
+	for len(s.items) > 0 {
+		i := s.nextIndex()
+		if s.items[i].expired(now) {
+			expired = append(expired, s.removeAt(i))
+			continue
+		}
+		cost = s.costs.of(s.items[i].payload(s.deliverEnvelopes))
+		if !s.costs.fits(0, cost) {
+			break
+		}
+		if s.pace.delayed(now) || !s.pace.allow() {
+			break
+		}
+		e = s.removeAt(i)
+		break
+	}
+	s.levels.check(len(s.items), s.height, &s.events)
+	s.total.expired += s.expired.add(expired, s.deliverEnvelopes, &s.events)
+	if e == nil {
+		if len(s.items) == 0 && s.draining && s.availableWorkers == s.concurrency {
+			s.setDrained()
+		}
+		// otherwise a completing worker will try again
+		s.unlock()
 		return
 	}
 
 	s.availableWorkers--
-	lastIndex := len(s.items) - 1
-	item := s.items[lastIndex:][0]
-	s.items = s.items[:lastIndex]
+	s.total.inFlight++
+	s.costs.inFlight += cost
+	e.Attempts++
+	item := e.payload(s.deliverEnvelopes)
+	hooks := s.hooks
 
-	s.mutex.Unlock()
+	s.unlock()
 
-	s.doWork(item)
-	go s.worker(item)
+	s.doWork(e, item, cost, hooks)
+}
 
-	if !s.draining {
-		go s.pop()
+// nextIndex returns the index of the next item to pop. It must
+// be called with the mutex held and with at least one item on
+// the stack.
+func (s *PushStack) nextIndex() int {
+	oldestFirst := s.draining && s.drainOldestFirst
+
+	next := len(s.items) - 1
+	if oldestFirst {
+		next = 0
+	}
+	if s.higherPriority == nil {
+		return next
 	}
+
+	// scan away from the default position so that ties keep
+	// the default order
+	if oldestFirst {
+		for i := 1; i < len(s.items); i++ {
+			if s.higher(s.items[i], s.items[next]) {
+				next = i
+			}
+		}
+	} else {
+		for i := next - 1; i >= 0; i-- {
+			if s.higher(s.items[i], s.items[next]) {
+				next = i
+			}
+		}
+	}
+	return next
+}
+
+// removeAt removes and returns the item at index i. It must be
+// called with the mutex held.
+func (s *PushStack) removeAt(i int) *Envelope {
+	e := s.items[i]
+	if i == 0 {
+		s.items = s.items[1:]
+	} else {
+		s.items = append(s.items[:i], s.items[i+1:]...)
+	}
+	return e
+}
+
+func (s *PushStack) higher(a, b *Envelope) bool {
+	return s.higherPriority(a.payload(s.deliverEnvelopes), b.payload(s.deliverEnvelopes))
 }
 
-func (s *PushStack) doWork(item interface{}) {
+func (s *PushStack) doWork(e *Envelope, item interface{}, cost int, hooks itemHooks) {
 	done := make(chan bool)
 	go func() {
-		s.worker(item)
+		started := hooks.start(e, item)
+		s.safely(func() {
+			call(func() {
+				s.worker(item)
+			}, e)
+		})
+		hooks.done(item, started)
 		done <- true
 	}()
 	<-done
 
-	s.workerCompleted()
+	s.workerCompleted(cost)
 }
 
-func (s *PushStack) workerCompleted() {
+func (s *PushStack) workerCompleted(cost int) {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	defer s.unlock()
+
+	s.costs.inFlight -= cost
+	s.total.inFlight--
+	s.total.processed++
 
 	if s.availableWorkers < s.concurrency {
 		s.availableWorkers++
@@ -236,9 +1394,154 @@ func (s *PushStack) workerCompleted() {
 	go s.pop()
 }
 
-func (s *PushStack) setDrained() {
-	if s.onDrained != nil {
-		go s.onDrained()
+// overloaded drops the given items and raises the overload events
+// for them. Items refused because the stack is draining are counted
+// apart from overloads. It must be called with the mutex held,
+// after the items have been removed from the stack.
+func (s *PushStack) overloaded(dropped []*Envelope, reason OverloadReason) {
+	if reason == OverloadDraining {
+		n := s.drainDropped.count
+		s.total.dropped += s.drainDropped.add(dropped, s.deliverEnvelopes, &s.events)
+		for i, e := range dropped {
+			s.overloadEvent(e, reason, n+i+1)
+		}
+		return
 	}
+
+	first := s.overload == 0
+	for _, e := range dropped {
+		e.resolve(ErrDropped)
+		s.events.audited(e.payload(s.deliverEnvelopes), reason.dropReason())
+		s.total.dropped++
+		s.overload++
+		if s.onOverload != nil {
+			s.events.item(s.onOverload, e.payload(s.deliverEnvelopes))
+		}
+		s.overloads.add(e.payload(s.deliverEnvelopes))
+		s.overloadEvent(e, reason, s.overload)
+	}
+	if first && len(dropped) > 0 {
+		item := dropped[0].payload(s.deliverEnvelopes)
+		if s.onFirstOverload != nil {
+			s.events.item(s.onFirstOverload, item)
+		}
+		s.events.subscribed(pickFirstOverload, item)
+	}
+}
+
+// OnOverloadSummary sets an event handler that will be called at
+// most once per period, with the number of overloads in the period
+// and a sample of the dropped items. Unlike OnOverload, which is
+// called for every dropped item, it stays cheap however fast items
+// are dropped. Items refused while draining are not included. The
+// period also applies to the OverloadSummary handlers of
+// subscriptions, which may set it with a nil f. OnOverloadSummary
+// panics if f is not nil and period is not positive.
+func (s *PushStack) OnOverloadSummary(period time.Duration, f func(OverloadSummary)) {
+	defer s.guard()
+
+	checkSummaryPeriod(period, f)
+
+	s.mutex.Lock()
+	s.overloads.set(period, f, s.reportOverloads)
+	s.unlock()
+}
+
+// reportOverloads raises the summary of the overloads in the period
+// that has ended.
+func (s *PushStack) reportOverloads() {
+	s.mutex.Lock()
+	s.overloads.report(&s.events)
+	s.unlock()
+}
+
+// overloadEvent raises the OnOverloadEvent event for a dropped
+// item. It must be called with the mutex held.
+func (s *PushStack) overloadEvent(e *Envelope, reason OverloadReason, overloads int) {
+	s.events.overload(s.onOverloadEvent, OverloadEvent{
+		Item:      e.payload(s.deliverEnvelopes),
+		Reason:    reason,
+		Overloads: overloads,
+		Count:     len(s.items),
+		Capacity:  s.height})
+}
+
+// overloadReason returns the reason for an overload occurring now.
+// It must be called with the mutex held.
+func (s *PushStack) overloadReason() OverloadReason {
+	if s.draining {
+		return OverloadDraining
+	}
+	return OverloadFull
+}
+
+// CheckInvariants verifies that the stack's accounting of its items
+// and workers is consistent, and returns an error describing the
+// first inconsistency found.
+func (s *PushStack) CheckInvariants() error {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.total.check(len(s.items), s.height, s.availableWorkers, s.concurrency, s.costs.inFlight)
+}
+
+// drained reports whether the component has finished draining, or
+// was never draining, with nothing left to process.
+func (s *PushStack) drained() bool {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return !s.draining && len(s.items) == 0 && s.availableWorkers == s.concurrency
+}
+
+// busyWorkers returns the number of workers currently processing.
+func (s *PushStack) busyWorkers() int {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.concurrency - s.availableWorkers
+}
+
+// setDrained ends draining and raises the drained event. It must be
+// called with the mutex held.
+func (s *PushStack) setDrained() {
+	s.events.drained(s.onDrained, s.onDrainSummary,
+		s.drain.summary(s.total.processed, s.drainDropped.count))
 	s.draining = false
+	s.changeState(StateDraining, CauseDrained)
+}
+
+// State returns the lifecycle state of the stack.
+func (s *PushStack) State() State {
+	s.mutex.Lock()
+	defer s.unlock()
+
+	return s.state()
+}
+
+func (s *PushStack) state() State {
+	return stateOf(s.started, s.draining)
+}
+
+// OnStateChange sets an event handler that will be called when the
+// stack changes state, with the cause of the change.
+func (s *PushStack) OnStateChange(f func(StateChangeEvent)) {
+	s.mutex.Lock()
+	s.onStateChange = f
+	s.unlock()
+}
+
+// changeState raises the state change event for a change from the
+// given state to the current one. It must be called with the mutex
+// held.
+func (s *PushStack) changeState(from State, cause StateCause) {
+	s.events.stateChange(s.onStateChange, from, s.state(), cause)
+}
+
+// unlock releases the mutex and then delivers the events held for
+// synchronous delivery, if any.
+func (s *PushStack) unlock() {
+	pending := s.events.take()
+	s.mutex.Unlock()
+	deliver(pending)
 }
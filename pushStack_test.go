@@ -0,0 +1,218 @@
+package push_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+// orderedStack returns a stack with a single worker that records
+// the order in which items are processed.
+func orderedStack(height int) (*PushStack, func() []interface{}) {
+	var mutex sync.Mutex
+	var got []interface{}
+	s := NewPushStack(1, height, func(item interface{}) {
+		mutex.Lock()
+		got = append(got, item)
+		mutex.Unlock()
+	})
+	return s, func() []interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]interface{}(nil), got...)
+	}
+}
+
+func TestDrainOldestFirst(t *testing.T) {
+	s, got := orderedStack(10)
+	s.DrainOldestFirst()
+	for _, item := range []string{"a", "b", "c"} {
+		s.Push(item)
+	}
+	drainAndWait(t, s)
+
+	if want := []interface{}{"a", "b", "c"}; !reflect.DeepEqual(got(), want) {
+		t.Errorf("drained %v, want %v", got(), want)
+	}
+}
+
+func TestDrainNewestFirst(t *testing.T) {
+	s, got := orderedStack(10)
+	for _, item := range []string{"a", "b", "c"} {
+		s.Push(item)
+	}
+	drainAndWait(t, s)
+
+	if want := []interface{}{"c", "b", "a"}; !reflect.DeepEqual(got(), want) {
+		t.Errorf("drained %v, want %v", got(), want)
+	}
+}
+
+func TestOverwriteOldestWhenFull(t *testing.T) {
+	s, got := orderedStack(2)
+	s.OverwriteOldestWhenFull()
+	var mutex sync.Mutex
+	events := 0
+	s.OnOverload(func(interface{}) {
+		mutex.Lock()
+		events++
+		mutex.Unlock()
+	})
+	s.OnFirstOverload(func(interface{}) {
+		mutex.Lock()
+		events++
+		mutex.Unlock()
+	})
+	s.OnOverloadEvent(func(OverloadEvent) {
+		mutex.Lock()
+		events++
+		mutex.Unlock()
+	})
+
+	for _, item := range []string{"a", "b", "c", "d"} {
+		s.Push(item)
+	}
+	if want := []interface{}{"c", "d"}; !reflect.DeepEqual(s.Items(), want) {
+		t.Errorf("pending items %v, want %v", s.Items(), want)
+	}
+	drainAndWait(t, s)
+	// overload events would be raised on their own goroutines
+	time.Sleep(20 * time.Millisecond)
+
+	if n := s.OverloadCount(); n != 0 {
+		t.Errorf("overload count %d, want 0", n)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if events != 0 {
+		t.Errorf("got %d overload events, want none", events)
+	}
+	if want := []interface{}{"d", "c"}; !reflect.DeepEqual(got(), want) {
+		t.Errorf("processed %v, want %v", got(), want)
+	}
+}
+
+// byPriority orders items named by a letter and a priority digit,
+// such as "a2", by the digit.
+func byPriority(a, b interface{}) bool {
+	return a.(string)[1] > b.(string)[1]
+}
+
+func TestPopByPriority(t *testing.T) {
+	s, got := orderedStack(10)
+	s.PopByPriority(byPriority)
+	for _, item := range []string{"a1", "b2", "c1", "d2", "e0"} {
+		s.Push(item)
+	}
+	drainAndWait(t, s)
+
+	// ties are popped newest first
+	want := []interface{}{"d2", "b2", "c1", "a1", "e0"}
+	if !reflect.DeepEqual(got(), want) {
+		t.Errorf("popped %v, want %v", got(), want)
+	}
+}
+
+func TestPopByPriorityDrainOldestFirst(t *testing.T) {
+	s, got := orderedStack(10)
+	s.PopByPriority(byPriority)
+	s.DrainOldestFirst()
+	for _, item := range []string{"a1", "b2", "c1", "d2", "e0"} {
+		s.Push(item)
+	}
+	drainAndWait(t, s)
+
+	// priority still comes first; ties are drained oldest first
+	want := []interface{}{"b2", "d2", "a1", "c1", "e0"}
+	if !reflect.DeepEqual(got(), want) {
+		t.Errorf("drained %v, want %v", got(), want)
+	}
+}
+
+func TestContainsGet(t *testing.T) {
+	type job struct {
+		id   string
+		data int
+	}
+	s := NewPushStack(1, 10, func(item interface{}) {})
+	s.KeyFunc(func(item QueueItem) interface{} { return item.(job).id })
+	s.Push(job{"a", 1})
+	s.Push(job{"b", 2})
+
+	if !s.Contains("a") || s.Contains("c") {
+		t.Errorf("Contains(a) = %v, Contains(c) = %v, want true and false", s.Contains("a"), s.Contains("c"))
+	}
+	if item, ok := s.Get("b"); !ok || item.(job).data != 2 {
+		t.Errorf("Get(b) = %v, %v, want {b 2}, true", item, ok)
+	}
+
+	drainAndWait(t, s)
+	if s.Contains("a") {
+		t.Error("processed item still contained")
+	}
+}
+
+func TestPushStackPutEvents(t *testing.T) {
+	s := NewPushStack(1, 1, func(item interface{}) {})
+	overloads := make(chan interface{}, 2)
+	firsts := make(chan interface{}, 2)
+	drained := make(chan struct{}, 1)
+
+	// a client holding only the interface can attach every handler
+	var c PushStackPutEvents = s
+	c.OnOverload(func(item interface{}) { overloads <- item })
+	c.OnFirstOverload(func(item interface{}) { firsts <- item })
+	c.OnDrained(func() { drained <- struct{}{} })
+
+	c.Push(1)
+	c.Push(2)
+	c.Push(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-overloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d overload events, want 2", i)
+		}
+	}
+	select {
+	case <-firsts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no first overload event")
+	}
+	select {
+	case item := <-firsts:
+		t.Errorf("second first overload event for %v", item)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.Start()
+	s.Drain()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no drained event")
+	}
+}
+
+func TestStackSnapshot(t *testing.T) {
+	s := NewPushStack(1, 5, func(item interface{}) {})
+	for i := 1; i <= 3; i++ {
+		s.Push(i)
+	}
+
+	snap := s.Snapshot()
+	if !reflect.DeepEqual(snap.Items, []QueueItem{1, 2, 3}) {
+		t.Errorf("got items %v, want [1 2 3]", snap.Items)
+	}
+	if snap.InFlight != 0 || snap.Capacity != 5 || snap.State != StateStopped || snap.Taken.IsZero() {
+		t.Errorf("got snapshot %+v, want 0 in flight of 5, stopped", snap)
+	}
+	// the snapshot is a copy
+	snap.Items[0] = 99
+	if got := s.Items(); !reflect.DeepEqual(got, []QueueItem{1, 2, 3}) {
+		t.Errorf("stack items changed to %v through the snapshot", got)
+	}
+}
@@ -0,0 +1,158 @@
+package pushtest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+)
+
+// ErrChaos is the value a chaos worker panics with when it injects a
+// failure and no Fail function is set.
+var ErrChaos = errors.New("pushtest: injected failure")
+
+// Chaos injects faults into a push component under test, so that
+// handlers for slow workers, failures and overloads can be exercised.
+// Set the fields before wrapping anything with the Chaos. The
+// faults are drawn from a seeded random source, so a failing run can
+// be reproduced with the same seed.
+type Chaos struct {
+	// MaxDelay is the longest delay added before a worker call. Each
+	// call is delayed by a random duration up to MaxDelay.
+	MaxDelay time.Duration
+
+	// FailureRate is the probability, from 0 to 1, that a worker
+	// call fails instead of calling the worker.
+	FailureRate float64
+
+	// Fail is called with the item in place of the worker when a
+	// failure is injected. If it is nil, the worker panics with
+	// ErrChaos, which a component reports through the item's Future
+	// as a *push.PanicError.
+	Fail func(item interface{})
+
+	// OverloadRate is the probability, from 0 to 1, that an item Put
+	// through a ChaosQueue is dropped as an overload instead.
+	OverloadRate float64
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewChaos creates a Chaos that injects no faults until its fields
+// are set, drawing from a random source with the given seed.
+func NewChaos(seed int64) *Chaos {
+	return &Chaos{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (c *Chaos) float64() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.rand.Float64()
+}
+
+// Worker wraps worker with injected delays and failures.
+func (c *Chaos) Worker(worker func(interface{})) func(interface{}) {
+	return func(item interface{}) {
+		if c.MaxDelay > 0 {
+			time.Sleep(time.Duration(c.float64() * float64(c.MaxDelay)))
+		}
+		if c.FailureRate > 0 && c.float64() < c.FailureRate {
+			if c.Fail == nil {
+				panic(ErrChaos)
+			}
+			c.Fail(item)
+			return
+		}
+		worker(item)
+	}
+}
+
+// ChaosQueue wraps a component and drops some of the items Put into
+// it as forced overloads, raising the overload events registered
+// through the ChaosQueue as the component would. Register handlers
+// on the ChaosQueue rather than on the component, so that they see
+// both real and forced overloads.
+type ChaosQueue struct {
+	q               push.PushQueuePutEvents
+	chaos           *Chaos
+	mutex           sync.Mutex
+	overloaded      bool
+	onOverload      func(interface{})
+	onFirstOverload func(interface{})
+}
+
+// compile-time check that interface is satisfied
+var _ push.PushQueuePutEvents = (*ChaosQueue)(nil)
+
+// Queue wraps q with forced overloads.
+func (c *Chaos) Queue(q push.PushQueuePutEvents) *ChaosQueue {
+	cq := &ChaosQueue{q: q, chaos: c}
+	q.OnOverload(cq.overload)
+	return cq
+}
+
+// Put drops item as an overload with the Chaos's OverloadRate, and
+// otherwise Puts it into the component.
+func (cq *ChaosQueue) Put(item interface{}) {
+	if cq.chaos.OverloadRate > 0 && cq.chaos.float64() < cq.chaos.OverloadRate {
+		go cq.overload(item)
+		return
+	}
+	cq.q.Put(item)
+}
+
+func (cq *ChaosQueue) overload(item interface{}) {
+	cq.mutex.Lock()
+	first := !cq.overloaded
+	cq.overloaded = true
+	onOverload, onFirstOverload := cq.onOverload, cq.onFirstOverload
+	cq.mutex.Unlock()
+
+	if first && onFirstOverload != nil {
+		onFirstOverload(item)
+	}
+	if onOverload != nil {
+		onOverload(item)
+	}
+}
+
+// Depth returns the depth of the component.
+func (cq *ChaosQueue) Depth() int {
+	return cq.q.Depth()
+}
+
+// Count returns the count of the component.
+func (cq *ChaosQueue) Count() int {
+	return cq.q.Count()
+}
+
+// IsStarted indicates whether the component is started.
+func (cq *ChaosQueue) IsStarted() bool {
+	return cq.q.IsStarted()
+}
+
+// OnOverload sets the handler for every real or forced overload.
+func (cq *ChaosQueue) OnOverload(f func(interface{})) {
+	cq.mutex.Lock()
+	defer cq.mutex.Unlock()
+
+	cq.onOverload = f
+}
+
+// OnFirstOverload sets the handler for the first real or forced
+// overload.
+func (cq *ChaosQueue) OnFirstOverload(f func(interface{})) {
+	cq.mutex.Lock()
+	defer cq.mutex.Unlock()
+
+	cq.onFirstOverload = f
+}
+
+// OnDrained sets the component's drained handler.
+func (cq *ChaosQueue) OnDrained(f func()) {
+	cq.q.OnDrained(f)
+}
@@ -0,0 +1,65 @@
+package pushtest_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/blocktop/go-push-components/pushtest"
+)
+
+func TestChaos(t *testing.T) {
+	c := pushtest.NewChaos(1)
+	c.MaxDelay = time.Millisecond
+	c.FailureRate = 0.5
+	c.OverloadRate = 0.5
+
+	var mutex sync.Mutex
+	worked, failed, overloads := 0, 0, 0
+	c.Fail = func(interface{}) {
+		mutex.Lock()
+		failed++
+		mutex.Unlock()
+	}
+	q := push.NewPushQueue(4, 1000, c.Worker(func(interface{}) {
+		mutex.Lock()
+		worked++
+		mutex.Unlock()
+	}))
+	drained := make(chan bool, 1)
+	q.OnDrained(func() {
+		drained <- true
+	})
+	cq := c.Queue(q)
+	cq.OnOverload(func(interface{}) {
+		mutex.Lock()
+		overloads++
+		mutex.Unlock()
+	})
+
+	for i := 0; i < 200; i++ {
+		cq.Put(i)
+	}
+	q.Start()
+	q.Drain()
+	<-drained
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		total := worked + failed + overloads
+		w, f, o := worked, failed, overloads
+		mutex.Unlock()
+		if total == 200 {
+			if w == 0 || f == 0 || o == 0 {
+				t.Errorf("got %d worked, %d failed, %d overloaded; want some of each", w, f, o)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d worked, %d failed, %d overloaded; want 200 in total", w, f, o)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
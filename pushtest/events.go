@@ -0,0 +1,200 @@
+package pushtest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event identifies a component event.
+type Event int
+
+// The events recorded by an EventRecorder.
+const (
+	EventOverload Event = iota
+	EventFirstOverload
+	EventDrained
+	EventThrottled
+	EventExpired
+	EventItemStart
+	EventItemDone
+	EventDroppedWhileDraining
+)
+
+var eventNames = []string{"Overload", "FirstOverload", "Drained", "Throttled", "Expired", "ItemStart", "ItemDone", "DroppedWhileDraining"}
+
+func (e Event) String() string {
+	if e < 0 || int(e) >= len(eventNames) {
+		return fmt.Sprintf("Event(%d)", int(e))
+	}
+	return eventNames[e]
+}
+
+// Record is an event captured by an EventRecorder. Duration is the
+// time the item waited for EventItemStart, and the time its worker
+// took for EventItemDone.
+type Record struct {
+	Event    Event
+	Item     interface{}
+	Duration time.Duration
+	At       time.Time
+}
+
+// EventRecorder captures the events of push components in the order
+// they are delivered, so that tests can assert on them without
+// collecting them by hand. It is safe for concurrent use.
+type EventRecorder struct {
+	mutex   sync.Mutex
+	changed *sync.Cond
+	records []Record
+}
+
+// NewEventRecorder creates an empty EventRecorder.
+func NewEventRecorder() *EventRecorder {
+	r := &EventRecorder{}
+	r.changed = sync.NewCond(&r.mutex)
+	return r
+}
+
+// Attach registers the recorder as the handler of every event that c
+// raises, replacing any handlers already registered. c is normally a
+// PushQueue, PushBatchQueue, PushStack, FakeQueue or FakeStack;
+// events that c does not support are not recorded.
+func (r *EventRecorder) Attach(c interface{}) {
+	if h, ok := c.(interface{ OnOverload(func(interface{})) }); ok {
+		h.OnOverload(r.handler(EventOverload))
+	}
+	if h, ok := c.(interface{ OnFirstOverload(func(interface{})) }); ok {
+		h.OnFirstOverload(r.handler(EventFirstOverload))
+	}
+	if h, ok := c.(interface{ OnDrained(func()) }); ok {
+		h.OnDrained(func() {
+			r.record(EventDrained, nil, 0)
+		})
+	}
+	if h, ok := c.(interface{ OnThrottled(func(interface{})) }); ok {
+		h.OnThrottled(r.handler(EventThrottled))
+	}
+	if h, ok := c.(interface{ OnExpired(func(interface{})) }); ok {
+		h.OnExpired(r.handler(EventExpired))
+	}
+	if h, ok := c.(interface{ OnDroppedWhileDraining(func(interface{})) }); ok {
+		h.OnDroppedWhileDraining(r.handler(EventDroppedWhileDraining))
+	}
+	if h, ok := c.(interface {
+		OnItemStart(func(interface{}, time.Duration))
+	}); ok {
+		h.OnItemStart(r.timedHandler(EventItemStart))
+	}
+	if h, ok := c.(interface {
+		OnItemDone(func(interface{}, time.Duration))
+	}); ok {
+		h.OnItemDone(r.timedHandler(EventItemDone))
+	}
+}
+
+func (r *EventRecorder) handler(e Event) func(interface{}) {
+	return func(item interface{}) {
+		r.record(e, item, 0)
+	}
+}
+
+func (r *EventRecorder) timedHandler(e Event) func(interface{}, time.Duration) {
+	return func(item interface{}, d time.Duration) {
+		r.record(e, item, d)
+	}
+}
+
+func (r *EventRecorder) record(e Event, item interface{}, d time.Duration) {
+	r.mutex.Lock()
+	r.records = append(r.records, Record{Event: e, Item: item, Duration: d, At: time.Now()})
+	r.mutex.Unlock()
+	r.changed.Broadcast()
+}
+
+// Records returns every event recorded so far, in order.
+func (r *EventRecorder) Records() []Record {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Record(nil), r.records...)
+}
+
+// Count returns the number of times e has been recorded.
+func (r *EventRecorder) Count(e Event) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.count(e)
+}
+
+func (r *EventRecorder) count(e Event) int {
+	n := 0
+	for _, rec := range r.records {
+		if rec.Event == e {
+			n++
+		}
+	}
+	return n
+}
+
+// Items returns the items of the recorded occurrences of e, in order.
+func (r *EventRecorder) Items(e Event) []interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var items []interface{}
+	for _, rec := range r.records {
+		if rec.Event == e {
+			items = append(items, rec.Item)
+		}
+	}
+	return items
+}
+
+// Sequence returns the recorded events, in order.
+func (r *EventRecorder) Sequence() []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	seq := make([]Event, len(r.records))
+	for i, rec := range r.records {
+		seq[i] = rec.Event
+	}
+	return seq
+}
+
+// WaitFor blocks until e has been recorded at least n times or
+// timeout has elapsed, and reports whether it was. Components raise
+// most events on their own goroutines, so tests should wait for the
+// events they expect rather than sleeping.
+func (r *EventRecorder) WaitFor(e Event, n int, timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		// take the lock so that the wakeup cannot slip in between
+		// the deadline check and Wait
+		r.mutex.Lock()
+		r.mutex.Unlock()
+		r.changed.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for r.count(e) < n {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		r.changed.Wait()
+	}
+	return true
+}
+
+// Reset discards the recorded events.
+func (r *EventRecorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.records = nil
+}
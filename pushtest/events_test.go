@@ -0,0 +1,41 @@
+package pushtest_test
+
+import (
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/blocktop/go-push-components/pushtest"
+)
+
+func TestEventRecorder(t *testing.T) {
+	r := pushtest.NewEventRecorder()
+	q := push.NewPushQueue(1, 2, func(interface{}) {})
+	r.Attach(q)
+
+	q.Put(1)
+	q.Put(2)
+	q.Put(3)
+	q.Put(4)
+	if !r.WaitFor(pushtest.EventOverload, 2, 5*time.Second) {
+		t.Fatalf("got %d overloads, want 2", r.Count(pushtest.EventOverload))
+	}
+	if !r.WaitFor(pushtest.EventFirstOverload, 1, 5*time.Second) {
+		t.Fatal("no first overload recorded")
+	}
+
+	q.Start()
+	q.Drain()
+	if !r.WaitFor(pushtest.EventDrained, 1, 5*time.Second) {
+		t.Fatal("no drain recorded")
+	}
+	if n := r.Count(pushtest.EventItemDone); n != 2 {
+		t.Errorf("got %d items done, want 2", n)
+	}
+	if n := len(r.Records()); n != 8 {
+		t.Errorf("got %d records, want 8", n)
+	}
+	if seq := r.Sequence(); seq[len(seq)-1] != pushtest.EventDrained {
+		t.Errorf("got %v, want Drained last", seq)
+	}
+}
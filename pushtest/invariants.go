@@ -0,0 +1,76 @@
+package pushtest
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+)
+
+// Subject is a component driven by CheckProperties.
+type Subject interface {
+	push.Lifecycle
+	push.InvariantChecker
+	Stop()
+	Empty()
+}
+
+// CheckProperties drives c through a random sequence of steps
+// operations, each of which puts an item with put or calls Start,
+// Stop, Drain or Empty, and fails t if c.CheckInvariants reports an
+// inconsistency after any of them. The sequence is determined by
+// seed, and the failure message includes the operations performed,
+// so that a failure can be reproduced. Workers keep running between
+// operations, so c should be given a worker that takes a little
+// time, such as one wrapped by a Chaos.
+func CheckProperties(t testing.TB, c Subject, put func(interface{}), seed int64, steps int) {
+	t.Helper()
+
+	type op struct {
+		name   string
+		weight int
+		do     func(i int)
+	}
+	ops := []op{
+		{"Put", 10, func(i int) { put(i) }},
+		{"Start", 2, func(int) { c.Start() }},
+		{"Stop", 1, func(int) { c.Stop() }},
+		{"Drain", 1, func(int) { c.Drain() }},
+		{"Empty", 1, func(int) { c.Empty() }},
+		{"Sleep", 2, func(int) { time.Sleep(100 * time.Microsecond) }},
+	}
+	total := 0
+	for _, o := range ops {
+		total += o.weight
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	var history []string
+	for i := 0; i < steps; i++ {
+		n := r.Intn(total)
+		var o op
+		for _, o = range ops {
+			if n < o.weight {
+				break
+			}
+			n -= o.weight
+		}
+		o.do(i)
+		history = append(history, o.name)
+
+		if err := c.CheckInvariants(); err != nil {
+			t.Fatalf("seed %d, after %s: %v", seed, strings.Join(history, " "), err)
+		}
+	}
+
+	// let the remaining items settle and check the final state
+	c.Start()
+	if err := push.WaitForDrain(c, 5*time.Second); err != nil {
+		t.Fatalf("seed %d: %v", seed, err)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Fatalf("seed %d, after drain: %v", seed, err)
+	}
+}
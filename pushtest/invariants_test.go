@@ -0,0 +1,30 @@
+package pushtest_test
+
+import (
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/blocktop/go-push-components/pushtest"
+)
+
+func TestCheckProperties(t *testing.T) {
+	c := pushtest.NewChaos(1)
+	c.MaxDelay = 200 * time.Microsecond
+	worker := c.Worker(func(interface{}) {})
+
+	for seed := int64(0); seed < 5; seed++ {
+		q := push.NewPushQueue(3, 10, worker)
+		pushtest.CheckProperties(t, q, q.Put, seed, 500)
+
+		bq := push.NewPushBatchQueue(3, 10, 4, func(batch []interface{}) {
+			for _, item := range batch {
+				worker(item)
+			}
+		})
+		pushtest.CheckProperties(t, bq, bq.Put, seed, 500)
+
+		s := push.NewPushStack(3, 10, worker)
+		pushtest.CheckProperties(t, s, s.Push, seed, 500)
+	}
+}
@@ -0,0 +1,381 @@
+// Package pushtest provides utilities for testing code that uses the
+// push components.
+package pushtest
+
+import (
+	"sync"
+	"testing"
+
+	push "github.com/blocktop/go-push-components"
+)
+
+// fake is the state and behaviour shared by FakeQueue and FakeStack.
+// Items are buffered up to the capacity, but never processed on their
+// own: the test decides when items are processed by calling Process.
+// Event handlers are called synchronously, so that tests need not
+// wait for them.
+type fake struct {
+	mutex           sync.Mutex
+	capacity        int
+	lifo            bool
+	worker          func(interface{})
+	started         bool
+	draining        bool
+	puts            []interface{}
+	pending         []interface{}
+	processed       int
+	dropped         int
+	drainDropped    int
+	onOverload      func(interface{})
+	onFirstOverload func(interface{})
+	onOverloadEvent func(push.OverloadEvent)
+	onDrainDropped  func(interface{})
+	onDrained       func()
+}
+
+// put records item and buffers it. If the fake is draining, item is
+// refused and reported as dropped while draining. If the buffer is
+// full, the item given by drop, which is passed the buffer and item,
+// is dropped as an overload and the buffer is replaced by the one
+// drop returns.
+func (f *fake) put(item interface{}, drop func(pending []interface{}, item interface{}) ([]interface{}, interface{})) {
+	f.mutex.Lock()
+	f.puts = append(f.puts, item)
+	if f.draining {
+		f.mutex.Unlock()
+		f.overload(item, push.OverloadDraining)
+		return
+	}
+	if len(f.pending) < f.capacity {
+		f.pending = append(f.pending, item)
+		f.mutex.Unlock()
+		return
+	}
+	var dropped interface{}
+	f.pending, dropped = drop(f.pending, item)
+	f.mutex.Unlock()
+
+	f.overload(dropped, push.OverloadFull)
+}
+
+// Count returns the number of buffered items.
+func (f *fake) Count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.pending)
+}
+
+// IsStarted indicates whether the fake has been started and not
+// drained since.
+func (f *fake) IsStarted() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.started
+}
+
+// Start marks the fake as started and no longer draining. It does
+// not process items.
+func (f *fake) Start() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.started = true
+	f.draining = false
+}
+
+// Drain marks the fake as draining and no longer started. From then
+// on new items are refused as dropped while draining, as by the
+// real components. The drained event is raised by the Process call
+// that empties the buffer, or immediately if the buffer is already
+// empty.
+func (f *fake) Drain() {
+	f.mutex.Lock()
+	f.draining = true
+	f.started = false
+	empty := len(f.pending) == 0
+	f.mutex.Unlock()
+
+	if empty {
+		f.Drained()
+	}
+}
+
+// OnOverload sets the handler for every overload.
+func (f *fake) OnOverload(h func(interface{})) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.onOverload = h
+}
+
+// OnFirstOverload sets the handler for the first overload.
+func (f *fake) OnFirstOverload(h func(interface{})) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.onFirstOverload = h
+}
+
+// OnOverloadEvent sets the handler for every overload, which is
+// given the reason for the overload along with the dropped item.
+func (f *fake) OnOverloadEvent(h func(push.OverloadEvent)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.onOverloadEvent = h
+}
+
+// OnDroppedWhileDraining sets the handler for items refused while
+// draining.
+func (f *fake) OnDroppedWhileDraining(h func(interface{})) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.onDrainDropped = h
+}
+
+// OnDrained sets the handler for the drained event.
+func (f *fake) OnDrained(h func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.onDrained = h
+}
+
+// Process processes up to n buffered items, in the order the real
+// component would hand them to workers, handing them to the worker
+// if there is one. It returns the number of items processed.
+func (f *fake) Process(n int) int {
+	f.mutex.Lock()
+	if n > len(f.pending) {
+		n = len(f.pending)
+	}
+	var items []interface{}
+	if f.lifo {
+		rest := len(f.pending) - n
+		for i := len(f.pending) - 1; i >= rest; i-- {
+			items = append(items, f.pending[i])
+		}
+		f.pending = f.pending[:rest:rest]
+	} else {
+		items = f.pending[:n:n]
+		f.pending = f.pending[n:]
+	}
+	f.processed += n
+	drained := n > 0 && f.draining && len(f.pending) == 0
+	worker := f.worker
+	f.mutex.Unlock()
+
+	if worker != nil {
+		for _, item := range items {
+			worker(item)
+		}
+	}
+	if drained {
+		f.Drained()
+	}
+	return n
+}
+
+// ProcessAll processes every buffered item.
+func (f *fake) ProcessAll() int {
+	return f.Process(f.Count())
+}
+
+// Overload counts item as dropped and raises the overload events as
+// if the buffer were full.
+func (f *fake) Overload(item interface{}) {
+	f.overload(item, push.OverloadFull)
+}
+
+func (f *fake) overload(item interface{}, reason push.OverloadReason) {
+	f.mutex.Lock()
+	f.dropped++
+	overloads := f.dropped - f.drainDropped
+	if reason == push.OverloadDraining {
+		f.drainDropped++
+		overloads = f.drainDropped
+	}
+	first := reason == push.OverloadFull && overloads == 1
+	onOverload, onFirstOverload := f.onOverload, f.onFirstOverload
+	onOverloadEvent, onDrainDropped := f.onOverloadEvent, f.onDrainDropped
+	event := push.OverloadEvent{
+		Item:      item,
+		Reason:    reason,
+		Overloads: overloads,
+		Count:     len(f.pending),
+		Capacity:  f.capacity}
+	f.mutex.Unlock()
+
+	if reason == push.OverloadDraining {
+		if onDrainDropped != nil {
+			onDrainDropped(item)
+		}
+		if onOverloadEvent != nil {
+			onOverloadEvent(event)
+		}
+		return
+	}
+	if first && onFirstOverload != nil {
+		onFirstOverload(item)
+	}
+	if onOverload != nil {
+		onOverload(item)
+	}
+	if onOverloadEvent != nil {
+		onOverloadEvent(event)
+	}
+}
+
+// Drained raises the drained event.
+func (f *fake) Drained() {
+	f.mutex.Lock()
+	onDrained := f.onDrained
+	f.mutex.Unlock()
+
+	if onDrained != nil {
+		onDrained()
+	}
+}
+
+func (f *fake) attempts() []interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]interface{}(nil), f.puts...)
+}
+
+// Pending returns the buffered items, oldest first.
+func (f *fake) Pending() []interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]interface{}(nil), f.pending...)
+}
+
+// ProcessedCount returns the number of items processed.
+func (f *fake) ProcessedCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.processed
+}
+
+// DroppedCount returns the number of items dropped, including
+// those refused while draining.
+func (f *fake) DroppedCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.dropped
+}
+
+// DroppedWhileDrainingCount returns the number of items refused
+// while draining.
+func (f *fake) DroppedWhileDrainingCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.drainDropped
+}
+
+// AssertCounts fails t unless exactly processed items have been
+// processed and dropped items dropped.
+func (f *fake) AssertCounts(t testing.TB, processed, dropped int) {
+	t.Helper()
+	if p := f.ProcessedCount(); p != processed {
+		t.Errorf("processed %d items, want %d", p, processed)
+	}
+	if d := f.DroppedCount(); d != dropped {
+		t.Errorf("dropped %d items, want %d", d, dropped)
+	}
+}
+
+// FakeQueue is a fake push component for testing clients that hold a
+// push.PushQueuePut or push.PushQueuePutEvents. It records every Put,
+// buffers items up to its depth and drops the rest as an overload,
+// but never processes anything on its own: the test decides when
+// items are processed, oldest first, by calling Process. Event
+// handlers are called synchronously, so that tests need not wait for
+// them.
+type FakeQueue struct {
+	fake
+}
+
+// compile-time check that interfaces are satisfied
+var _ push.PushQueuePutEvents = (*FakeQueue)(nil)
+var _ push.Lifecycle = (*FakeQueue)(nil)
+
+// NewFakeQueue creates a FakeQueue with the given depth. If worker
+// is not nil, Process hands it each processed item.
+func NewFakeQueue(depth int, worker func(interface{})) *FakeQueue {
+	if depth < 1 {
+		panic("depth must be greater than 0")
+	}
+	return &FakeQueue{fake{capacity: depth, worker: worker}}
+}
+
+// Put records item and buffers it, or drops it and raises the
+// overload events if the buffer is full or the fake is draining.
+func (f *FakeQueue) Put(item interface{}) {
+	f.put(item, func(pending []interface{}, item interface{}) ([]interface{}, interface{}) {
+		return pending, item
+	})
+}
+
+// Depth returns the depth the fake was created with.
+func (f *FakeQueue) Depth() int {
+	return f.capacity
+}
+
+// Puts returns every item Put into the fake, in order, including
+// those that were dropped.
+func (f *FakeQueue) Puts() []interface{} {
+	return f.attempts()
+}
+
+// FakeStack is a fake push component for testing clients that hold a
+// push.PushStackPut or push.PushStackPutEvents. Like the real stack,
+// it makes room for a new item when full by dropping the oldest one.
+// The test decides when items are processed, newest first, by
+// calling Process. Event handlers are called synchronously, so that
+// tests need not wait for them.
+type FakeStack struct {
+	fake
+}
+
+// compile-time check that interfaces are satisfied
+var _ push.PushStackPutEvents = (*FakeStack)(nil)
+var _ push.Lifecycle = (*FakeStack)(nil)
+
+// NewFakeStack creates a FakeStack with the given height. If worker
+// is not nil, Process hands it each processed item.
+func NewFakeStack(height int, worker func(interface{})) *FakeStack {
+	if height < 1 {
+		panic("height must be greater than 0")
+	}
+	return &FakeStack{fake{capacity: height, lifo: true, worker: worker}}
+}
+
+// Push records item and buffers it. If the buffer is full, the
+// oldest item is dropped to make room and the overload events are
+// raised for it. While the fake is draining, item itself is
+// dropped.
+func (f *FakeStack) Push(item interface{}) {
+	f.put(item, func(pending []interface{}, item interface{}) ([]interface{}, interface{}) {
+		return append(pending[1:], item), pending[0]
+	})
+}
+
+// Height returns the height the fake was created with.
+func (f *FakeStack) Height() int {
+	return f.capacity
+}
+
+// Pushes returns every item Pushed onto the fake, in order, including
+// those that were dropped.
+func (f *FakeStack) Pushes() []interface{} {
+	return f.attempts()
+}
@@ -0,0 +1,91 @@
+package pushtest_test
+
+import (
+	"testing"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/blocktop/go-push-components/pushtest"
+)
+
+func TestFakeQueue(t *testing.T) {
+	var worked []interface{}
+	f := pushtest.NewFakeQueue(2, func(item interface{}) {
+		worked = append(worked, item)
+	})
+	overloads, firsts, drains := 0, 0, 0
+	f.OnOverload(func(interface{}) { overloads++ })
+	f.OnFirstOverload(func(interface{}) { firsts++ })
+	f.OnDrained(func() { drains++ })
+
+	f.Put("a")
+	f.Put("b")
+	f.Put("c")
+	f.Put("d")
+	if len(f.Puts()) != 4 || f.Count() != 2 {
+		t.Errorf("got %d puts and %d pending, want 4 and 2", len(f.Puts()), f.Count())
+	}
+	if overloads != 2 || firsts != 1 {
+		t.Errorf("got %d overloads and %d first overloads, want 2 and 1", overloads, firsts)
+	}
+
+	f.Drain()
+	if f.Process(1) != 1 || drains != 0 {
+		t.Errorf("drained with an item pending")
+	}
+	f.ProcessAll()
+	if drains != 1 {
+		t.Errorf("got %d drains, want 1", drains)
+	}
+	if len(worked) != 2 || worked[0] != "a" || worked[1] != "b" {
+		t.Errorf("worker got %v, want [a b]", worked)
+	}
+	f.AssertCounts(t, 2, 2)
+}
+
+func TestFakeQueueRefusesWhileDraining(t *testing.T) {
+	f := pushtest.NewFakeQueue(2, nil)
+	var events []push.OverloadEvent
+	f.OnOverloadEvent(func(e push.OverloadEvent) { events = append(events, e) })
+	f.Start()
+	f.Put("a")
+	f.Drain()
+	if f.IsStarted() {
+		t.Error("fake still started while draining")
+	}
+
+	f.Put("b")
+	if f.Count() != 1 {
+		t.Errorf("got %d pending, want 1", f.Count())
+	}
+	if len(events) != 1 || events[0].Item != "b" || events[0].Reason != push.OverloadDraining {
+		t.Errorf("got events %v, want b refused while draining", events)
+	}
+	if f.DroppedWhileDrainingCount() != 1 {
+		t.Errorf("got %d dropped while draining, want 1", f.DroppedWhileDrainingCount())
+	}
+}
+
+func TestFakeStack(t *testing.T) {
+	var worked []interface{}
+	f := pushtest.NewFakeStack(2, func(item interface{}) {
+		worked = append(worked, item)
+	})
+	var overloads []interface{}
+	f.OnOverload(func(item interface{}) { overloads = append(overloads, item) })
+
+	f.Push("a")
+	f.Push("b")
+	f.Push("c")
+	if len(f.Pushes()) != 3 || f.Count() != 2 {
+		t.Errorf("got %d pushes and %d pending, want 3 and 2", len(f.Pushes()), f.Count())
+	}
+	if len(overloads) != 1 || overloads[0] != "a" {
+		t.Errorf("got overloads %v, want the oldest item a", overloads)
+	}
+
+	f.ProcessAll()
+	if len(worked) != 2 || worked[0] != "c" || worked[1] != "b" {
+		t.Errorf("worker got %v, want [c b]", worked)
+	}
+	f.AssertCounts(t, 2, 1)
+}
@@ -0,0 +1,148 @@
+package pushtest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+)
+
+// Durations generates a sequence of durations, such as the gaps
+// between item arrivals or the time a worker spends on each item.
+// The Durations returned by this package are safe for concurrent
+// use.
+type Durations func() time.Duration
+
+// lockedRand is a seeded random source that may be shared by
+// goroutines.
+type lockedRand struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rand: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) expFloat64() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.rand.ExpFloat64()
+}
+
+func (r *lockedRand) int63n(n int64) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.rand.Int63n(n)
+}
+
+func interval(rate float64) time.Duration {
+	if rate <= 0 {
+		panic("rate must be positive")
+	}
+	return time.Duration(float64(time.Second) / rate)
+}
+
+// Steady produces arrivals evenly spaced at rate items per second.
+func Steady(rate float64) Durations {
+	gap := interval(rate)
+	return func() time.Duration {
+		return gap
+	}
+}
+
+// Poisson produces arrivals at an average of rate items per second,
+// with exponentially distributed gaps, as from many independent
+// clients.
+func Poisson(rate float64, seed int64) Durations {
+	mean := float64(interval(rate))
+	r := newLockedRand(seed)
+	return func() time.Duration {
+		return time.Duration(r.expFloat64() * mean)
+	}
+}
+
+// Bursty produces bursts of size items arriving at rate items per
+// second, separated by pauses of the given length.
+func Bursty(size int, rate float64, pause time.Duration) Durations {
+	if size < 1 {
+		panic("size must be greater than 0")
+	}
+	gap := interval(rate)
+	var mutex sync.Mutex
+	n := 0
+	return func() time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		n++
+		if n%size == 0 {
+			return pause
+		}
+		return gap
+	}
+}
+
+// FixedCost produces the same duration every time.
+func FixedCost(d time.Duration) Durations {
+	return func() time.Duration {
+		return d
+	}
+}
+
+// UniformCost produces durations spread evenly between min and max.
+func UniformCost(min, max time.Duration, seed int64) Durations {
+	if max < min {
+		panic("max must not be less than min")
+	}
+	r := newLockedRand(seed)
+	return func() time.Duration {
+		return min + time.Duration(r.int63n(int64(max-min)+1))
+	}
+}
+
+// ExponentialCost produces exponentially distributed durations with
+// the given mean, so that most items are cheap and a few are very
+// expensive.
+func ExponentialCost(mean time.Duration, seed int64) Durations {
+	r := newLockedRand(seed)
+	return func() time.Duration {
+		return time.Duration(r.expFloat64() * float64(mean))
+	}
+}
+
+// SyntheticWorker returns a worker that spends a duration drawn from
+// cost on each item, for benchmarking a component's configuration
+// before the real worker exists.
+func SyntheticWorker(cost Durations) func(interface{}) {
+	return func(interface{}) {
+		time.Sleep(cost())
+	}
+}
+
+// Generate Puts n items into q, spaced by durations drawn from
+// arrivals, and returns how long it took. The item for the ith
+// arrival is item(i), or i itself if item is nil. Arrivals are
+// scheduled against the start time, so that sleep overshoot does
+// not accumulate.
+func Generate(q push.PushQueuePut, arrivals Durations, n int, item func(i int) interface{}) time.Duration {
+	start := time.Now()
+	due := start
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			due = due.Add(arrivals())
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if item != nil {
+			q.Put(item(i))
+		} else {
+			q.Put(i)
+		}
+	}
+	return time.Since(start)
+}
@@ -0,0 +1,42 @@
+package pushtest_test
+
+import (
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/blocktop/go-push-components/pushtest"
+)
+
+func TestGenerate(t *testing.T) {
+	f := pushtest.NewFakeQueue(100, nil)
+	d := pushtest.Generate(f, pushtest.Bursty(5, 10000, 10*time.Millisecond), 10, nil)
+	if d < 10*time.Millisecond || d > time.Second {
+		t.Errorf("took %v, want about 10ms for one pause", d)
+	}
+	if len(f.Puts()) != 10 || f.Puts()[9] != 9 {
+		t.Errorf("got %v, want 0 through 9", f.Puts())
+	}
+}
+
+func TestPoissonMean(t *testing.T) {
+	p := pushtest.Poisson(1000, 1)
+	var sum time.Duration
+	for i := 0; i < 10000; i++ {
+		sum += p()
+	}
+	if mean := sum / 10000; mean < 900*time.Microsecond || mean > 1100*time.Microsecond {
+		t.Errorf("mean gap %v, want about 1ms", mean)
+	}
+}
+
+func BenchmarkSyntheticWorkload(b *testing.B) {
+	q := push.NewPushQueue(4, 100, pushtest.SyntheticWorker(pushtest.ExponentialCost(50*time.Microsecond, 1)))
+	q.Start()
+	b.ResetTimer()
+	pushtest.Generate(q, pushtest.Poisson(50000, 1), b.N, nil)
+	if err := push.WaitForDrain(q, time.Minute); err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("%d of %d items overloaded", q.OverloadCount(), b.N)
+}
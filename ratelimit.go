@@ -0,0 +1,222 @@
+package push
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RateLimiter is the interface used by push components to throttle
+// dispatch. Allow reports whether an event may happen now, and
+// consumes the permission if so. Wait blocks until an event may
+// happen, consuming the permission, or until ctx is done.
+//
+// The interface is satisfied by *rate.Limiter from
+// golang.org/x/time/rate, as well as by RateLimit and
+// AdaptiveRate, so any of these may be given to a component's
+// DispatchRateLimiter.
+type RateLimiter interface {
+	Allow() bool
+	Wait(ctx context.Context) error
+}
+
+// limiter paces events.
+type limiter interface {
+	// reserve records an event at now if one is allowed and
+	// returns 0. Otherwise it records nothing and returns how
+	// long until an event will be allowed.
+	reserve(now time.Time) time.Duration
+}
+
+// windowLimiter allows at most n events in any window of
+// length per.
+type windowLimiter struct {
+	mutex sync.Mutex
+	per   time.Duration
+	times []time.Time // ring of the last n event times
+	next  int
+}
+
+func newWindowLimiter(n int, per time.Duration) *windowLimiter {
+	if n < 1 {
+		panic("rate must be greater than 0")
+	}
+	if per <= 0 {
+		panic("rate interval must be greater than 0")
+	}
+	return &windowLimiter{per: per, times: make([]time.Time, n)}
+}
+
+func (l *windowLimiter) reserve(now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	oldest := l.times[l.next]
+	if !oldest.IsZero() {
+		if wait := oldest.Add(l.per).Sub(now); wait > 0 {
+			return wait
+		}
+	}
+	l.times[l.next] = now
+	l.next = (l.next + 1) % len(l.times)
+	return 0
+}
+
+// tokenBucket is a token bucket that holds at most burst tokens
+// and is refilled at n tokens per interval. It starts full.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens per nanosecond
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(n int, per time.Duration, burst int) *tokenBucket {
+	if n < 1 {
+		panic("rate must be greater than 0")
+	}
+	if per <= 0 {
+		panic("rate interval must be greater than 0")
+	}
+	if burst < 1 {
+		panic("burst must be greater than 0")
+	}
+	return &tokenBucket{
+		rate:   float64(n) / float64(per),
+		burst:  float64(burst),
+		tokens: float64(burst)}
+}
+
+// clone returns a full token bucket with the same rate and burst.
+func (b *tokenBucket) clone() *tokenBucket {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return &tokenBucket{rate: b.rate, burst: b.burst, tokens: b.burst}
+}
+
+// setRate changes the refill rate to n tokens per interval.
+func (b *tokenBucket) setRate(n float64, per time.Duration) {
+	b.mutex.Lock()
+	b.rate = n / float64(per)
+	b.mutex.Unlock()
+}
+
+// take removes a token from the bucket if one is available and
+// reports whether it did.
+func (b *tokenBucket) take(now time.Time) bool {
+	return b.reserve(now) == 0
+}
+
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += float64(now.Sub(b.last)) * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return time.Duration((1-b.tokens)/b.rate) + 1
+	}
+	b.tokens--
+	return 0
+}
+
+// jitterLimiter spaces events by a random gap of up to max.
+type jitterLimiter struct {
+	mutex sync.Mutex
+	max   time.Duration
+	next  time.Time
+	rand  *rand.Rand
+}
+
+func newJitterLimiter(max time.Duration) *jitterLimiter {
+	if max <= 0 {
+		panic("jitter must be greater than 0")
+	}
+	return &jitterLimiter{
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (l *jitterLimiter) reserve(now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.next.IsZero() {
+		// jitter the very first event as well
+		l.next = now.Add(l.gap())
+	}
+	if now.Before(l.next) {
+		return l.next.Sub(now)
+	}
+	l.next = now.Add(l.gap())
+	return 0
+}
+
+func (l *jitterLimiter) gap() time.Duration {
+	return time.Duration(l.rand.Int63n(int64(l.max)))
+}
+
+// RateLimit is a dispatch rate limit that can be shared. Giving
+// the same RateLimit to several components with
+// SharedDispatchRate makes their combined dispatches respect a
+// single quota, where separate per-component limits would add up.
+type RateLimit struct {
+	limiter limiter
+}
+
+// NewRateLimit creates a RateLimit that allows at most n items in
+// any interval of length per, like MaxDispatchRate. NewRateLimit
+// panics if n or per is not positive.
+func NewRateLimit(n int, per time.Duration) *RateLimit {
+	return &RateLimit{limiter: newWindowLimiter(n, per)}
+}
+
+// NewRateLimitWithBurst creates a RateLimit that allows a sustained
+// n items per interval with bursts of up to burst items, like
+// DispatchRateWithBurst. NewRateLimitWithBurst panics if n, per or
+// burst is not positive.
+func NewRateLimitWithBurst(n int, per time.Duration, burst int) *RateLimit {
+	return &RateLimit{limiter: newTokenBucket(n, per, burst)}
+}
+
+// compile-time check that interface is satisfied
+var _ RateLimiter = (*RateLimit)(nil)
+
+// Allow reports whether an item may be dispatched now.
+func (r *RateLimit) Allow() bool {
+	return r.limiter.reserve(time.Now()) == 0
+}
+
+// Wait blocks until an item may be dispatched or ctx is done.
+func (r *RateLimit) Wait(ctx context.Context) error {
+	return waitLimiter(ctx, r.limiter)
+}
+
+// waitLimiter blocks until l allows an event, recording it, or
+// until ctx is done.
+func waitLimiter(ctx context.Context, l limiter) error {
+	for {
+		wait := l.reserve(time.Now())
+		if wait == 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package push
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Recorder captures the stream of Put attempts made on a component,
+// so that it can later be reproduced with Replay. It wraps a
+// component and is used in its place: every item Put into the
+// Recorder is written to the Recorder's writer as a line of JSON,
+// together with the time since the Recorder was created, and then
+// Put into the component. Items must therefore be encodable with
+// encoding/json.
+//
+// The Recorder records the load offered to the component, not what
+// the component accepted: items that the component drops, throttles
+// or refuses while draining are recorded all the same, so that
+// replaying the recording reproduces those overloads too.
+//
+// A recording of large or repetitive items can be compressed in
+// either of two ways. Giving NewRecorder a Codec, such as GzipCodec,
+// compresses each item on its own, so that every line of the
+// recording still stands alone and can be stored or shipped as it
+// is written; the same Codec must then be given to Replay. Giving
+// NewRecorder a compressing writer instead, such as a gzip.Writer,
+// which must be closed once recording is done, and giving Replay the
+// matching reader, compresses the whole stream, which lets the
+// compression share what items have in common.
+type Recorder struct {
+	q       PushQueuePut
+	enc     *json.Encoder
+	codec   Codec
+	created time.Time
+	version int
+	mutex   sync.Mutex
+	err     error
+}
+
+// recordedItem is the JSON form of a recorded item. An item
+// compressed by a Codec is held in Packed in place of Item.
+type recordedItem struct {
+	At      time.Duration   `json:"at"`
+	Version int             `json:"v,omitempty"`
+	Item    json.RawMessage `json:"item,omitempty"`
+	Packed  []byte          `json:"packed,omitempty"`
+}
+
+// ErrNoCodec is returned when replaying a recording whose items were
+// compressed by a Codec without giving a Codec to decompress them.
+var ErrNoCodec = errors.New("push: recorded item is compressed but no codec was given")
+
+// compile-time check that interface is satisfied
+var _ PushQueuePut = (*Recorder)(nil)
+
+// NewRecorder creates a Recorder that writes to w the items Put
+// into q, each compressed by codec unless it is nil.
+func NewRecorder(w io.Writer, q PushQueuePut, codec Codec) *Recorder {
+	return NewVersionedRecorder(w, q, 0, codec)
+}
+
+// NewVersionedRecorder creates a Recorder like NewRecorder that
+// labels each item it records with the given version of the item's
+// encoding, so that a recording made by an old binary can still be
+// decoded, or migrated, by a newer one with ReplayVersioned. Items
+// recorded by NewRecorder have version 0.
+func NewVersionedRecorder(w io.Writer, q PushQueuePut, version int, codec Codec) *Recorder {
+	return &Recorder{q: q, enc: json.NewEncoder(w), codec: codec, created: time.Now(), version: version}
+}
+
+// Put records the attempt to Put item and Puts it into the
+// component, whether or not the component accepts it. An item that
+// cannot be recorded is still Put; the error is reported by Err.
+func (r *Recorder) Put(item interface{}) {
+	r.mutex.Lock()
+	if r.err == nil {
+		r.err = r.record(time.Since(r.created), item)
+	}
+	r.mutex.Unlock()
+
+	r.q.Put(item)
+}
+
+// record writes item, Put at, to the recording. It must be called
+// with the mutex held.
+func (r *Recorder) record(at time.Duration, item interface{}) error {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	rec := recordedItem{At: at, Version: r.version, Item: raw}
+	if r.codec != nil {
+		if rec.Packed, err = r.codec.Compress(raw); err != nil {
+			return err
+		}
+		rec.Item = nil
+	}
+	return r.enc.Encode(rec)
+}
+
+// Err returns the first error encountered while recording. Once an
+// error occurs, the Recorder stops recording but keeps passing items
+// to the component.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+// Depth returns the depth of the component.
+func (r *Recorder) Depth() int {
+	return r.q.Depth()
+}
+
+// Count returns the count of the component.
+func (r *Recorder) Count() int {
+	return r.q.Count()
+}
+
+// IsStarted indicates whether the component is started.
+func (r *Recorder) IsStarted() bool {
+	return r.q.IsStarted()
+}
+
+// Replay reads items recorded by a Recorder from rd and Puts them
+// into q with the same pacing as when they were recorded, divided by
+// speed: a speed of 2 replays twice as fast, and a speed of 0 Puts
+// the items as fast as possible. Unlike the source adapters, Replay
+// does not wait for room in q, so that overloads are reproduced too.
+//
+// Each item is decompressed by codec, which must be the Codec the
+// recording was made with, if any, and then decoded by decode, or
+// into the interface{} produced by json.Unmarshal if decode is nil.
+// Replay returns nil at the end of rd, or the first error.
+func Replay(rd io.Reader, q PushQueuePut, speed float64, decode func(json.RawMessage) (interface{}, error), codec Codec) error {
+	return replay(rd, speed, codec, decoder(decode), func(i int, item interface{}) error {
+		q.Put(item)
+		return nil
+	})
+}
+
+// decoder returns a decoder of recorded items of any version that
+// calls decode, or json.Unmarshal if decode is nil.
+func decoder(decode func(json.RawMessage) (interface{}, error)) func(int, json.RawMessage) (interface{}, error) {
+	return func(version int, raw json.RawMessage) (item interface{}, err error) {
+		if decode != nil {
+			return decode(raw)
+		}
+		err = json.Unmarshal(raw, &item)
+		return item, err
+	}
+}
+
+// ReplayFrom resumes a recording read from rd at the position of c,
+// the index of the first item not yet processed, Putting the items
+// into q as fast as q has room for them rather than at their recorded
+// pace. Each item whose Future reports success is marked done in c,
+// so that c's position follows the items processed, and a later
+// ReplayFrom with the same Cursor carries on from there, or from
+// wherever c has been moved to with SeekTo. Items are decompressed
+// and decoded as by Replay. ReplayFrom returns nil at the end of rd,
+// ctx.Err() if ctx is done while waiting for room, or the first
+// error.
+func ReplayFrom(ctx context.Context, rd io.Reader, q PushQueuePutFuture, c *Cursor, decode func(json.RawMessage) (interface{}, error), codec Codec) error {
+	from := c.Position()
+	return replay(rd, 0, codec, decoder(decode), func(i int, item interface{}) error {
+		if int64(i) < from {
+			return nil
+		}
+		if err := waitForRoom(ctx, q); err != nil {
+			return err
+		}
+		f := q.PutFuture(item)
+		go func() {
+			if f.Wait() == nil {
+				c.Done(int64(i))
+			}
+		}()
+		return nil
+	})
+}
+
+// ReplayVersioned replays a recording like Replay, decoding each
+// item with the decoder for the version it was recorded with, so
+// that items recorded by older binaries can be decoded, or
+// transformed into the current form, by migration functions kept
+// alongside the current decoder. Items are decompressed by codec as
+// by Replay. It returns an error for an item of a version with no
+// decoder.
+func ReplayVersioned(rd io.Reader, q PushQueuePut, speed float64, decoders map[int]func(json.RawMessage) (interface{}, error), codec Codec) error {
+	return replay(rd, speed, codec, func(version int, raw json.RawMessage) (interface{}, error) {
+		decode, ok := decoders[version]
+		if !ok {
+			return nil, fmt.Errorf("push: no decoder for recorded item version %d", version)
+		}
+		return decode(raw)
+	}, func(i int, item interface{}) error {
+		q.Put(item)
+		return nil
+	})
+}
+
+// replay reads the items recorded in rd, decompresses them with
+// codec if they were compressed, decodes them and passes each to put
+// with its index, with the recorded pacing divided by speed, until
+// rd is exhausted or put returns an error.
+func replay(rd io.Reader, speed float64, codec Codec, decode func(version int, raw json.RawMessage) (interface{}, error), put func(i int, item interface{}) error) error {
+	if speed < 0 {
+		panic("speed must not be negative")
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(rd))
+	start := time.Now()
+	for i := 0; ; i++ {
+		var rec recordedItem
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		raw := rec.Item
+		if rec.Packed != nil {
+			if codec == nil {
+				return ErrNoCodec
+			}
+			unpacked, err := codec.Decompress(rec.Packed)
+			if err != nil {
+				return err
+			}
+			raw = unpacked
+		}
+		item, err := decode(rec.Version, raw)
+		if err != nil {
+			return err
+		}
+
+		if speed > 0 {
+			due := time.Duration(float64(rec.At) / speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if err := put(i, item); err != nil {
+			return err
+		}
+	}
+}
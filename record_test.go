@@ -0,0 +1,227 @@
+package push_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+	"github.com/blocktop/go-push-components/pushtest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf, pushtest.NewFakeQueue(10, nil), nil)
+	r.Put("a")
+	time.Sleep(20 * time.Millisecond)
+	r.Put(map[string]interface{}{"n": 1.0})
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := pushtest.NewFakeQueue(10, nil)
+	start := time.Now()
+	if err := Replay(&buf, f, 2, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond || d > time.Second {
+		t.Errorf("replay at double speed took %v, want about 10ms", d)
+	}
+
+	puts := f.Puts()
+	if len(puts) != 2 || puts[0] != "a" || puts[1].(map[string]interface{})["n"] != 1.0 {
+		t.Errorf("replayed %v, want [a map[n:1]]", puts)
+	}
+}
+
+func TestRecordReplayCompressed(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	r := NewRecorder(zw, pushtest.NewFakeQueue(100, nil), nil)
+	blob := map[string]interface{}{"payload": string(bytes.Repeat([]byte("x"), 1000))}
+	for i := 0; i < 10; i++ {
+		r.Put(blob)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 1000 {
+		t.Errorf("compressed recording is %d bytes, want less than one item", buf.Len())
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := pushtest.NewFakeQueue(100, nil)
+	if err := Replay(zr, f, 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if puts := f.Puts(); len(puts) != 10 || !reflect.DeepEqual(puts[9], blob) {
+		t.Errorf("replayed %d items, want 10 equal to the blob", len(puts))
+	}
+}
+
+func TestRecordReplayCodec(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf, pushtest.NewFakeQueue(100, nil), GzipCodec{Level: gzip.BestSpeed})
+	blob := map[string]interface{}{"payload": string(bytes.Repeat([]byte("x"), 1000))}
+	for i := 0; i < 10; i++ {
+		r.Put(blob)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// each line stands alone, compressed
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 10 || len(lines[0]) > 500 || bytes.Contains(lines[0], []byte("xxx")) {
+		t.Errorf("got %d lines, the first %d bytes long, want 10 compressed lines", len(lines), len(lines[0]))
+	}
+	data := buf.Bytes()
+
+	f := pushtest.NewFakeQueue(100, nil)
+	if err := Replay(bytes.NewReader(data), f, 0, nil, GzipCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	if puts := f.Puts(); len(puts) != 10 || !reflect.DeepEqual(puts[9], blob) {
+		t.Errorf("replayed %d items, want 10 equal to the blob", len(puts))
+	}
+	if err := Replay(bytes.NewReader(data), pushtest.NewFakeQueue(100, nil), 0, nil, nil); err != ErrNoCodec {
+		t.Errorf("replay without a codec: got %v, want ErrNoCodec", err)
+	}
+}
+
+func TestRecorderRecordsDroppedItems(t *testing.T) {
+	var buf bytes.Buffer
+	q := pushtest.NewFakeQueue(1, nil)
+	r := NewRecorder(&buf, q, nil)
+	r.Put("a")
+	r.Put("b")
+	if q.DroppedCount() != 1 {
+		t.Fatalf("dropped %d items, want 1", q.DroppedCount())
+	}
+
+	f := pushtest.NewFakeQueue(10, nil)
+	if err := Replay(&buf, f, 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if puts := f.Puts(); len(puts) != 2 {
+		t.Errorf("replayed %v, want both attempts [a b]", puts)
+	}
+}
+
+func TestReplayVersioned(t *testing.T) {
+	var buf bytes.Buffer
+	q := pushtest.NewFakeQueue(10, nil)
+	NewRecorder(&buf, q, nil).Put("old")
+	NewVersionedRecorder(&buf, q, 2, nil).Put(map[string]string{"name": "new"})
+
+	decoders := map[int]func(json.RawMessage) (interface{}, error){
+		// version 0 recorded bare names
+		0: func(raw json.RawMessage) (interface{}, error) {
+			var name string
+			err := json.Unmarshal(raw, &name)
+			return map[string]string{"name": name}, err
+		},
+		2: func(raw json.RawMessage) (interface{}, error) {
+			var item map[string]string
+			err := json.Unmarshal(raw, &item)
+			return item, err
+		},
+	}
+	f := pushtest.NewFakeQueue(10, nil)
+	if err := ReplayVersioned(bytes.NewReader(buf.Bytes()), f, 0, decoders, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{map[string]string{"name": "old"}, map[string]string{"name": "new"}}
+	if puts := f.Puts(); !reflect.DeepEqual(puts, want) {
+		t.Errorf("replayed %v, want %v", puts, want)
+	}
+
+	delete(decoders, 0)
+	if err := ReplayVersioned(bytes.NewReader(buf.Bytes()), f, 0, decoders, nil); err == nil {
+		t.Error("replayed an item of a version with no decoder")
+	}
+}
+
+func TestReplayFromCursor(t *testing.T) {
+	var rec bytes.Buffer
+	r := NewRecorder(&rec, pushtest.NewFakeQueue(10, nil), nil)
+	for _, item := range []string{"a", "b", "c", "d", "e"} {
+		r.Put(item)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var got []interface{}
+	failing := true
+	q := NewPushQueue(2, 10, nil)
+	q.ResultWorker(func(item interface{}) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		got = append(got, item)
+		if item == "d" && failing {
+			return nil, errors.New("failed")
+		}
+		return item, nil
+	})
+	q.Start()
+	defer q.Stop()
+
+	c := NewCursor(2)
+	advanced := make(chan int64, 10)
+	c.OnAdvance(func(pos int64) { advanced <- pos })
+	waitFor := func(want int64) {
+		for {
+			select {
+			case pos := <-advanced:
+				if pos == want {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("cursor at %d, want %d", c.Position(), want)
+			}
+		}
+	}
+
+	data := rec.Bytes()
+	if err := ReplayFrom(context.Background(), bytes.NewReader(data), q, c, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(3)
+	time.Sleep(20 * time.Millisecond)
+	if pos := c.Position(); pos != 3 {
+		t.Errorf("cursor advanced past the failed item to %d", pos)
+	}
+
+	mutex.Lock()
+	failing = false
+	got = nil
+	mutex.Unlock()
+	if err := ReplayFrom(context.Background(), bytes.NewReader(data), q, c, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(5)
+	mutex.Lock()
+	if len(got) == 0 || len(got) > 2 || (got[0] != "d" && got[0] != "e") {
+		t.Errorf("resumed with %v, want d and e", got)
+	}
+	mutex.Unlock()
+
+	c.SeekTo(0)
+	if err := ReplayFrom(context.Background(), bytes.NewReader(data), q, c, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(5)
+}
@@ -0,0 +1,127 @@
+package push
+
+// Result is what a worker set with ResultWorker returned for an
+// item.
+type Result struct {
+	// Item is the item the worker was handed.
+	Item interface{}
+
+	// Value is the value the worker returned.
+	Value interface{}
+
+	// Err is the error the worker returned, or a *PanicError if it
+	// panicked while the item had a Future.
+	Err error
+}
+
+// resulter runs items with a worker that returns a result.
+type resulter struct {
+	worker func(item interface{}) (interface{}, error)
+}
+
+func newResulter(worker func(item interface{}) (interface{}, error)) *resulter {
+	if worker == nil {
+		panic("no worker set")
+	}
+	return &resulter{worker: worker}
+}
+
+// run calls the worker for e and returns its result, with which e's
+// future is resolved.
+func (r *resulter) run(e *Envelope, item interface{}) *Result {
+	res := &Result{Item: item}
+	work := func() {
+		res.Value, res.Err = r.worker(item)
+	}
+	if e.future == nil {
+		work()
+		return res
+	}
+	if perr := recovered(work); perr != nil {
+		res.Err = perr
+	}
+	e.future.resolveValue(res.Value, res.Err)
+	return res
+}
+
+// batchResulter runs batches with a worker that returns a result
+// for each item.
+type batchResulter struct {
+	worker func(items []interface{}) []Result
+}
+
+func newBatchResulter(worker func(items []interface{}) []Result) *batchResulter {
+	if worker == nil {
+		panic("no worker set")
+	}
+	return &batchResulter{worker: worker}
+}
+
+// run calls the worker for batch and returns a result for each of
+// its items, with which the items' futures are resolved. Items the
+// worker returned no result for are given ErrNoResult.
+func (r *batchResulter) run(batch []*Envelope, items []interface{}) []Result {
+	var out []Result
+	work := func() {
+		out = r.worker(items)
+	}
+	var perr error
+	if watched(batch) {
+		perr = recovered(work)
+	} else {
+		work()
+	}
+
+	results := make([]Result, len(items))
+	for i, item := range items {
+		res := Result{Item: item, Err: ErrNoResult}
+		switch {
+		case perr != nil:
+			res.Err = perr
+		case i < len(out):
+			res.Value, res.Err = out[i].Value, out[i].Err
+		}
+		if batch[i].future != nil {
+			batch[i].future.resolveValue(res.Value, res.Err)
+		}
+		results[i] = res
+	}
+	return results
+}
+
+// results delivers the results of a component's worker to its
+// OnResult handler and, if collecting, keeps them for DrainResults.
+type results struct {
+	handler   func(Result)
+	collect   bool
+	collected []Result
+}
+
+// deliver hands r to the handler and keeps it if collecting. It
+// must be called with the component's mutex held.
+func (c *results) deliver(r Result, events *eventQueue) {
+	if c.collect {
+		c.collected = append(c.collected, r)
+	}
+	if c.handler != nil {
+		f := c.handler
+		events.emit(func() {
+			f(r)
+		})
+	}
+	events.toSubscribers(func(h Handlers) func() {
+		if f := h.Result; f != nil {
+			return func() {
+				f(r)
+			}
+		}
+		return nil
+	})
+}
+
+// take returns the results kept so far and forgets them.
+func (c *results) take() []Result {
+	r := c.collected
+	c.collected = nil
+	return r
+}
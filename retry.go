@@ -0,0 +1,66 @@
+package push
+
+import (
+	"time"
+)
+
+// retrier runs items with a worker that returns an error, and
+// schedules a failed item to be tried again after a backoff.
+type retrier struct {
+	worker      func(item interface{}) error
+	backoff     func(attempts int) time.Duration
+	maxAttempts int
+}
+
+func newRetrier(worker func(item interface{}) error, backoff func(attempts int) time.Duration, maxAttempts int) *retrier {
+	if worker == nil {
+		panic("no worker set")
+	}
+	if backoff == nil {
+		panic("no backoff set")
+	}
+	if maxAttempts < 1 {
+		panic("max attempts must be greater than 0")
+	}
+	return &retrier{worker: worker, backoff: backoff, maxAttempts: maxAttempts}
+}
+
+// run calls the worker for e and returns its outcome. If the worker
+// fails and e has attempts left, e is to be retried after the
+// backoff. Otherwise e's future is resolved with the worker's error,
+// or a *PanicError if it panicked.
+func (r *retrier) run(e *Envelope, item interface{}) outcome {
+	var err error
+	work := func() {
+		err = r.worker(item)
+	}
+	if e.future == nil {
+		work()
+	} else if perr := recovered(work); perr != nil {
+		err = perr
+	}
+	if err != nil && e.Attempts < r.maxAttempts {
+		return outcome{retry: true, after: r.backoff(e.Attempts)}
+	}
+	e.resolve(err)
+	return outcome{}
+}
+
+// outcome is what becomes of an item once its worker has returned.
+type outcome struct {
+	// requeue is set if the item was preempted and is to be put
+	// back at once.
+	requeue bool
+
+	// retry is set if the item failed and is to be put back after
+	// the given delay.
+	retry bool
+	after time.Duration
+
+	// result is set if the item was processed by a result worker.
+	result *Result
+
+	// skipped is set if the item had already been processed, and
+	// its worker was not called.
+	skipped bool
+}
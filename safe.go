@@ -0,0 +1,33 @@
+package push
+
+import (
+	"fmt"
+)
+
+// InternalError is reported to the OnInternalError handler of a
+// component in safe mode in place of a panic raised by one of the
+// component's methods, such as Start with no worker set or a setter
+// given an invalid argument.
+type InternalError struct {
+	// Value is the value the method panicked with.
+	Value interface{}
+}
+
+func (e *InternalError) Error() string {
+	return fmt.Sprintf("push: internal error: %v", e.Value)
+}
+
+// safety is the safe mode of a component. In safe mode, panics in
+// the component's methods and workers are recovered and reported
+// rather than left to crash the program.
+type safety struct {
+	on      bool
+	handler func(error)
+}
+
+// report raises the OnInternalError event for err, or writes it to
+// the standard logger if neither a handler nor a subscriber handles
+// it. It must be called with the component's mutex held.
+func (s *safety) report(err error, events *eventQueue) {
+	events.errored(s.handler, pickInternalError, "", err)
+}
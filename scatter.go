@@ -0,0 +1,39 @@
+package push
+
+import (
+	"context"
+)
+
+// ScatterGather Puts each of the requests into q with PutFuture and
+// waits for all of them to be done, or for ctx to be done. It
+// returns a Result for each request, in order, holding the value
+// and error reported by the request's Future. q's worker is
+// normally set with ResultWorker, so that there are values to
+// gather. If ctx is done first, the requests still pending are given
+// ctx.Err() as their error, which ScatterGather also returns; they
+// are left in q, to be processed or dropped as usual.
+func ScatterGather(ctx context.Context, q PushQueuePutFuture, requests []interface{}) ([]Result, error) {
+	futures := make([]*Future, len(requests))
+	for i, request := range requests {
+		futures[i] = q.PutFuture(request)
+	}
+
+	results := make([]Result, len(requests))
+	var ctxErr error
+	for i, f := range futures {
+		if ctxErr == nil {
+			select {
+			case <-f.Done():
+			case <-ctx.Done():
+				ctxErr = ctx.Err()
+			}
+		}
+		results[i] = Result{Item: requests[i], Err: ctxErr}
+		select {
+		case <-f.Done():
+			results[i].Value, results[i].Err = f.Value(), f.Err()
+		default:
+		}
+	}
+	return results, ctxErr
+}
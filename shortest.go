@@ -0,0 +1,48 @@
+package push
+
+import (
+	"time"
+)
+
+// shortestFirst dispatches the cheapest pending item first while a
+// component is deep, unless an item has waited too long.
+type shortestFirst struct {
+	estimate func(QueueItem) int
+	depth    int
+	maxWait  time.Duration
+}
+
+func newShortestFirst(estimate func(QueueItem) int, depth int, maxWait time.Duration) *shortestFirst {
+	if estimate == nil {
+		panic("no cost estimator set")
+	}
+	if depth < 1 {
+		panic("depth must be greater than 0")
+	}
+	if maxWait <= 0 {
+		panic("max wait must be greater than 0")
+	}
+	return &shortestFirst{estimate: estimate, depth: depth, maxWait: maxWait}
+}
+
+// pick returns the index of the item with the lowest estimated cost
+// in the priority band of items[i], preferring the earlier of
+// equals, among items ordered by insertByPriority, and reports
+// whether it applied. It does not apply while there are fewer than
+// depth items. If items[i], the oldest of its band, has waited at
+// least maxWait at now, it is picked regardless of cost.
+func (f *shortestFirst) pick(items []*Envelope, i int, whole bool, now time.Time) (int, bool) {
+	if len(items) < f.depth {
+		return i, false
+	}
+	if now.Sub(items[i].Enqueued) >= f.maxWait {
+		return i, true
+	}
+	best, bestCost := i, f.estimate(items[i].payload(whole))
+	for j := i + 1; j < len(items) && items[j].Priority == items[i].Priority; j++ {
+		if c := f.estimate(items[j].payload(whole)); c < bestCost {
+			best, bestCost = j, c
+		}
+	}
+	return best, true
+}
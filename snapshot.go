@@ -0,0 +1,24 @@
+package push
+
+import (
+	"time"
+)
+
+// Snapshot is a consistent view of a push component, taken at one
+// moment under lock, for debugging and display.
+type Snapshot struct {
+	// Items holds a copy of the pending items, oldest first.
+	Items []QueueItem
+
+	// InFlight is the number of items being processed by workers.
+	InFlight int
+
+	// Capacity is the depth or height of the component.
+	Capacity int
+
+	// State is the lifecycle state of the component.
+	State State
+
+	// Taken is the time the snapshot was taken.
+	Taken time.Time
+}
@@ -0,0 +1,73 @@
+package push
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ServeRecords accepts connections on l, such as a listener on a
+// Unix domain socket, and reads length-prefixed records from each,
+// as written by WriteRecord, so that other processes on the same
+// host can put items into q. Each record is Put as decode returns
+// it, or as a []byte if decode is nil. As with ReadRecords, reading
+// pauses while q is full, which holds the writers back. A connection
+// is closed when its peer closes it, or sends a record longer than
+// maxSize or that decode fails on.
+//
+// ServeRecords returns nil once ctx is done, having closed l and
+// every connection, or the first error accepting a connection.
+func ServeRecords(ctx context.Context, l net.Listener, q PushQueuePut, maxSize int, decode func([]byte) (interface{}, error)) error {
+	var mutex sync.Mutex
+	conns := make(map[net.Conn]bool)
+	closed := false
+	var wg sync.WaitGroup
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		l.Close()
+		mutex.Lock()
+		closed = true
+		for conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+	}()
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		mutex.Lock()
+		if closed {
+			mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		conns[conn] = true
+		mutex.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readRecords(ctx, conn, q, maxSize, decode)
+			conn.Close()
+			mutex.Lock()
+			delete(conns, conn)
+			mutex.Unlock()
+		}()
+	}
+}
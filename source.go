@@ -0,0 +1,120 @@
+package push
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ReadLines reads lines from r and Puts each one into q as a string
+// without its line ending. While q is full, reading pauses until q
+// has room again, so that a fast source is held back rather than
+// overloading q. ReadLines returns nil when r is exhausted, the
+// first read error, or ctx.Err() if ctx is done while waiting for
+// room. A read already in progress is not interrupted by ctx.
+func ReadLines(ctx context.Context, r io.Reader, q PushQueuePut) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if err := waitForRoom(ctx, q); err != nil {
+				return err
+			}
+			q.Put(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadRecords reads length-prefixed records from r and Puts each one
+// into q as a []byte. Each record is a 4-byte big-endian length
+// followed by that many bytes. A record longer than maxSize is an
+// error. Like ReadLines, reading pauses while q is full, until ctx
+// is done. ReadRecords returns nil when r is exhausted at a record
+// boundary, or the first error.
+func ReadRecords(ctx context.Context, r io.Reader, q PushQueuePut, maxSize int) error {
+	return readRecords(ctx, r, q, maxSize, nil)
+}
+
+// readRecords reads records like ReadRecords, and Puts each one as
+// decode returns it, or as a []byte if decode is nil.
+func readRecords(ctx context.Context, r io.Reader, q PushQueuePut, maxSize int, decode func([]byte) (interface{}, error)) error {
+	br := bufio.NewReader(r)
+	var prefix [4]byte
+	for {
+		if _, err := io.ReadFull(br, prefix[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := binary.BigEndian.Uint32(prefix[:])
+		if uint64(size) > uint64(maxSize) {
+			return fmt.Errorf("push: record of %d bytes exceeds maximum of %d", size, maxSize)
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(br, record); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		var item interface{} = record
+		if decode != nil {
+			var err error
+			if item, err = decode(record); err != nil {
+				return err
+			}
+		}
+		if err := waitForRoom(ctx, q); err != nil {
+			return err
+		}
+		q.Put(item)
+	}
+}
+
+// WriteRecord writes record to w as a length-prefixed record, in
+// the form read by ReadRecords and ServeRecords.
+func WriteRecord(w io.Writer, record []byte) error {
+	buf := make([]byte, 4+len(record))
+	binary.BigEndian.PutUint32(buf, uint32(len(record)))
+	copy(buf[4:], record)
+	_, err := w.Write(buf)
+	return err
+}
+
+// waitForRoom blocks while q is full, until ctx is done, in which
+// case it returns ctx.Err().
+func waitForRoom(ctx context.Context, q PushQueuePut) error {
+	return waitBelow(ctx, q, q.Depth())
+}
+
+// waitBelow blocks while q holds n items or more, until ctx is
+// done, in which case it returns ctx.Err(). The components raise no
+// event when room becomes available, so this backs off between
+// checks, up to a short maximum delay.
+func waitBelow(ctx context.Context, q PushQueuePut, n int) error {
+	delay := time.Millisecond
+	for q.Count() >= n {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if delay < 50*time.Millisecond {
+			delay *= 2
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package push_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestReadLinesBackpressure(t *testing.T) {
+	var mutex sync.Mutex
+	var got []string
+	q := NewPushQueue(1, 2, func(item interface{}) {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		got = append(got, item.(string))
+		mutex.Unlock()
+	})
+	q.Start()
+
+	input := "a\nb\r\nc\nd\ne\nf\ng\nh"
+	if err := ReadLines(context.Background(), strings.NewReader(input), q); err != nil {
+		t.Fatal(err)
+	}
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s := strings.Join(got, ""); s != "abcdefgh" {
+		t.Errorf("got %q, want abcdefgh", s)
+	}
+	if q.OverloadCount() != 0 {
+		t.Errorf("queue overloaded %d times", q.OverloadCount())
+	}
+}
+
+func TestReadRecordsCancelWhileFull(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.Put([]byte("filler"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	input := "\x00\x00\x00\x01a"
+	if err := ReadRecords(ctx, strings.NewReader(input), q, 10); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestServeRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "queue.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan interface{}, 10)
+	q := NewPushQueue(1, 10, func(item interface{}) { got <- item })
+	q.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeRecords(ctx, l, q, 16, func(record []byte) (interface{}, error) {
+			return strings.ToUpper(string(record)), nil
+		})
+	}()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, record := range []string{"a", "b"} {
+		if err := WriteRecord(conn, []byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"A", "B"} {
+		select {
+		case item := <-got:
+			if item != want {
+				t.Errorf("got %v, want %s", item, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("record not put")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeRecords did not return")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var got []interface{}
+	q := NewPushQueue(1, 10, func(item interface{}) {
+		if item == "blocking" {
+			<-release
+		}
+		mutex.Lock()
+		got = append(got, item)
+		mutex.Unlock()
+	})
+	q.Start()
+	q.Put("blocking")
+	for q.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	items := []interface{}{1, 2, 3, 4, 5, 6, 7, 8}
+	var last BackfillProgress
+	done := make(chan error, 1)
+	go func() {
+		done <- Backfill(context.Background(), q, items, NewRateLimit(1000, time.Second), func(p BackfillProgress) {
+			last = p
+		})
+	}()
+	// the backfill leaves half of the queue free
+	for q.Count() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := q.Count(); n != 5 {
+		t.Errorf("backfill filled the queue to %d, want 5", n)
+	}
+	q.Put("live")
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if last.Put != 8 || last.Total != 8 {
+		t.Errorf("got final progress %+v", last)
+	}
+	drainAndWait(t, q)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []interface{}{"blocking", "live", 1, 2, 3, 4, 5, 6, 7, 8}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v, want %v", got, want)
+	}
+}
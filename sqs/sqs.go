@@ -0,0 +1,132 @@
+// Package sqs is a reference adapter between Amazon SQS, by way of
+// github.com/aws/aws-sdk-go, and the push components. It implements
+// push.Poller, so that a component can be fed from a queue with
+//
+//	push.Consume(ctx, push.PollSource(sqs.NewPoller(client, url), 10), q)
+//
+// Each message is deleted from the SQS queue only after its worker
+// has finished. A message that is not processed is made visible
+// again immediately, rather than after its visibility timeout.
+package sqs
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	push "github.com/blocktop/go-push-components"
+)
+
+// maxMessages is the most messages SQS returns from one receive.
+const maxMessages = 10
+
+// API is the subset of the SQS client used by Poller. It is
+// satisfied by *sqs.SQS.
+type API interface {
+	ReceiveMessageWithContext(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(aws.Context, *sqs.DeleteMessageInput, ...request.Option) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibilityWithContext(aws.Context, *sqs.ChangeMessageVisibilityInput, ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// Poller is a push.Poller that long-polls an SQS queue. The values
+// of the messages it returns are *sqs.Message.
+type Poller struct {
+	client   API
+	queueURL string
+	wait     int64
+	onError  func(error)
+}
+
+// compile-time check that interfaces are satisfied
+var _ push.Poller = (*Poller)(nil)
+var _ API = (*sqs.SQS)(nil)
+
+// NewPoller creates a Poller for the queue at queueURL. It long-polls
+// for up to 20 seconds, the most that SQS allows.
+func NewPoller(client API, queueURL string) *Poller {
+	if client == nil {
+		panic("client is required")
+	}
+	if queueURL == "" {
+		panic("queueURL is required")
+	}
+	return &Poller{client: client, queueURL: queueURL, wait: 20}
+}
+
+// WaitSeconds sets how long each poll waits for messages to arrive.
+func (p *Poller) WaitSeconds(n int64) {
+	if n < 0 || n > 20 {
+		panic("WaitSeconds must be between 0 and 20")
+	}
+	p.wait = n
+}
+
+// OnError sets a function to be called when deleting a message, or
+// making it visible again, fails. It must be set before polling.
+func (p *Poller) OnError(f func(error)) {
+	p.onError = f
+}
+
+// Poll receives up to max messages, at most 10, from the queue.
+func (p *Poller) Poll(ctx context.Context, max int) ([]push.Message, error) {
+	if max > maxMessages {
+		max = maxMessages
+	}
+	out, err := p.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(p.queueURL),
+		MaxNumberOfMessages:   aws.Int64(int64(max)),
+		WaitTimeSeconds:       aws.Int64(p.wait),
+		AttributeNames:        aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+		MessageAttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameAll}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]push.Message, len(out.Messages))
+	for i, m := range out.Messages {
+		msgs[i] = &message{poller: p, msg: m}
+	}
+	return msgs, nil
+}
+
+func (p *Poller) report(err error) {
+	if err != nil && p.onError != nil {
+		p.onError(err)
+	}
+}
+
+type message struct {
+	poller *Poller
+	msg    *sqs.Message
+}
+
+func (m *message) Value() interface{} {
+	return m.msg
+}
+
+func (m *message) Ack() {
+	_, err := m.poller.client.DeleteMessageWithContext(aws.BackgroundContext(), &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(m.poller.queueURL),
+		ReceiptHandle: m.msg.ReceiptHandle,
+	})
+	m.poller.report(err)
+}
+
+func (m *message) Nack() {
+	_, err := m.poller.client.ChangeMessageVisibilityWithContext(aws.BackgroundContext(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(m.poller.queueURL),
+		ReceiptHandle:     m.msg.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	})
+	m.poller.report(err)
+}
+
+// Worker adapts a handler of SQS messages to the worker function of
+// a push component fed by a Poller.
+func Worker(handler func(*sqs.Message)) func(interface{}) {
+	return func(item interface{}) {
+		handler(item.(*sqs.Message))
+	}
+}
@@ -0,0 +1,75 @@
+package sqs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	push "github.com/blocktop/go-push-components"
+)
+
+// fakeAPI returns each batch of messages sent to it from a receive,
+// and records deletes as acks and making messages visible again as
+// nacks.
+type fakeAPI struct {
+	msgs chan []*sqs.Message
+	acks chan<- string
+}
+
+func (c *fakeAPI) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	select {
+	case msgs := <-c.msgs:
+		return &sqs.ReceiveMessageOutput{Messages: msgs}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeAPI) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	c.acks <- "ack:" + *in.ReceiptHandle
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (c *fakeAPI) ChangeMessageVisibilityWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	if *in.VisibilityTimeout != 0 {
+		c.acks <- "delayed:" + *in.ReceiptHandle
+	} else {
+		c.acks <- "nack:" + *in.ReceiptHandle
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func TestPollerAcksAfterWorker(t *testing.T) {
+	acks := make(chan string, 2)
+	client := &fakeAPI{msgs: make(chan []*sqs.Message, 1), acks: acks}
+	client.msgs <- []*sqs.Message{
+		{ReceiptHandle: aws.String("good")},
+		{ReceiptHandle: aws.String("bad")},
+	}
+
+	q := push.NewPushQueue(1, 2, Worker(func(m *sqs.Message) {
+		if *m.ReceiptHandle == "bad" {
+			panic("bad message")
+		}
+	}))
+	q.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go push.Consume(ctx, push.PollSource(NewPoller(client, "queue"), 10), q)
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case a := <-acks:
+			got[a] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v, want ack:good and nack:bad", got)
+		}
+	}
+	if !got["ack:good"] || !got["nack:bad"] {
+		t.Errorf("got %v, want ack:good and nack:bad", got)
+	}
+}
@@ -0,0 +1,106 @@
+package push
+
+import (
+	"time"
+)
+
+// State is the lifecycle state of a push component.
+type State int
+
+const (
+	// StateStopped is the state of a component that has not been
+	// started, has been stopped, or has finished draining.
+	StateStopped State = iota
+
+	// StateStarted is the state of a component that is processing
+	// items and accepting new ones.
+	StateStarted
+
+	// StateDraining is the state of a component that is processing
+	// its remaining items and refusing new ones.
+	StateDraining
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateStarted:
+		return "started"
+	case StateDraining:
+		return "draining"
+	}
+	return "unknown"
+}
+
+// stateOf returns the state of a component with the given flags.
+func stateOf(started, draining bool) State {
+	switch {
+	case draining:
+		return StateDraining
+	case started:
+		return StateStarted
+	}
+	return StateStopped
+}
+
+// StateCause is what triggered a state change.
+type StateCause int
+
+const (
+	// CauseCall is a call to Start, StartContext, Stop or Drain.
+	CauseCall StateCause = iota
+
+	// CauseDrained is the completion of a drain.
+	CauseDrained
+
+	// CauseContext is the end of the context given to
+	// StartContext.
+	CauseContext
+)
+
+func (c StateCause) String() string {
+	switch c {
+	case CauseCall:
+		return "call"
+	case CauseDrained:
+		return "drained"
+	case CauseContext:
+		return "context"
+	}
+	return "unknown"
+}
+
+// StateChangeEvent is passed to the OnStateChange handler when a
+// push component changes state.
+type StateChangeEvent struct {
+	From, To State
+
+	// At is the time of the change.
+	At time.Time
+
+	// Cause is what triggered the change.
+	Cause StateCause
+}
+
+// stateChange raises the state change event for f, if not nil and
+// the state has changed.
+func (q *eventQueue) stateChange(f func(StateChangeEvent), from, to State, cause StateCause) {
+	if from == to {
+		return
+	}
+	event := StateChangeEvent{From: from, To: to, At: time.Now(), Cause: cause}
+	if f != nil {
+		q.emit(func() {
+			f(event)
+		})
+	}
+	q.toSubscribers(func(h Handlers) func() {
+		if g := h.StateChange; g != nil {
+			return func() {
+				g(event)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,118 @@
+package push_test
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+type stressed interface {
+	drainer
+	InvariantChecker
+	Start()
+	Stop()
+	Empty()
+	Count() int
+	IsFull() bool
+	IsStarted() bool
+	Items() []QueueItem
+}
+
+// stress calls put and the lifecycle methods of c from several
+// goroutines at once, then starts and drains c and checks that every
+// item put has reached an outcome. Run with -race to check that the
+// component's state is properly guarded.
+func stress(t *testing.T, c stressed, put func(interface{}) *Future) {
+	duration := 200 * time.Millisecond
+	if testing.Short() {
+		duration = 50 * time.Millisecond
+	}
+
+	var mutex sync.Mutex
+	var futures []*Future
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f := put(i)
+				mutex.Lock()
+				futures = append(futures, f)
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	ops := []func(){
+		c.Start, c.Stop, c.Drain, c.Empty,
+		func() { c.Count() },
+		func() { c.IsFull() },
+		func() { c.IsStarted() },
+		func() { c.Items() },
+	}
+	for o := 0; o < 2; o++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ops[r.Intn(len(ops))]()
+				time.Sleep(time.Duration(r.Intn(100)) * time.Microsecond)
+			}
+		}(int64(o))
+	}
+
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+
+	c.Start()
+	drainAndWait(t, c)
+	for _, f := range futures {
+		waitFuture(t, f)
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func stressWorker(item interface{}) {
+	if item.(int)%10 == 0 {
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+func TestPushQueueStress(t *testing.T) {
+	q := NewPushQueue(4, 50, stressWorker)
+	stress(t, q, q.PutFuture)
+}
+
+func TestPushBatchQueueStress(t *testing.T) {
+	q := NewPushBatchQueue(4, 50, 5, func(batch []interface{}) {
+		for _, item := range batch {
+			stressWorker(item)
+		}
+	})
+	stress(t, q, q.PutFuture)
+}
+
+func TestPushStackStress(t *testing.T) {
+	s := NewPushStack(4, 50, stressWorker)
+	stress(t, s, s.PushFuture)
+}
@@ -0,0 +1,270 @@
+package push
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Handlers are the event handlers of a subscription made with
+// Subscribe, one for each of the events that the On methods set a
+// handler for. Any of them may be nil.
+type Handlers struct {
+	// Overload is called for every item dropped as an overload or
+	// refused while draining, as with OnOverloadEvent.
+	Overload func(OverloadEvent)
+
+	// FirstOverload is called for the first item dropped as an
+	// overload since the component was started or its stats were
+	// reset.
+	FirstOverload func(interface{})
+
+	// OverloadSummary is called with the overloads of each period
+	// set with OnOverloadSummary, and not at all if no period is
+	// set.
+	OverloadSummary func(OverloadSummary)
+
+	// DroppedWhileDraining is called for every item refused while
+	// the component is draining.
+	DroppedWhileDraining func(interface{})
+
+	// Drained is called with a summary of the drain when a drain
+	// is complete.
+	Drained func(DrainSummary)
+
+	// Throttled is called for every item rejected by the intake
+	// rate limit.
+	Throttled func(interface{})
+
+	// Expired is called for every item skipped because its
+	// deadline had passed.
+	Expired func(interface{})
+
+	// Shed is called for every item shed under pressure.
+	Shed func(interface{})
+
+	// Suppressed is called for every item suppressed as a
+	// duplicate.
+	Suppressed func(interface{})
+
+	// StateChange is called whenever the component changes state.
+	StateChange func(StateChangeEvent)
+
+	// Result is called with the result of each item processed by
+	// a worker set with ResultWorker.
+	Result func(Result)
+
+	// ItemStart and ItemDone are called on the worker's goroutine
+	// around each worker call, as with OnItemStart and OnItemDone.
+	ItemStart func(item interface{}, waited time.Duration)
+	ItemDone  func(item interface{}, elapsed time.Duration)
+
+	// HandlerPanic is called with the value of any panic raised by
+	// an event handler of the component.
+	HandlerPanic func(interface{})
+
+	// InternalError is called with each error recovered in safe
+	// mode.
+	InternalError func(error)
+
+	// StoreError is called with each error returned by the
+	// ProcessedStore set with ExactlyOnce.
+	StoreError func(error)
+
+	// Sync has these handlers called in the order the events
+	// occur, on the goroutine that caused them, as SyncEvents has
+	// all of a component's handlers called, while the component's
+	// other handlers are called as before.
+	Sync bool
+}
+
+// Subscription is a registration of event handlers that can be
+// removed again, so that short-lived observers do not stay attached
+// for the lifetime of the component.
+type Subscription struct {
+	once   sync.Once
+	remove func()
+}
+
+func newSubscription(mutex *sync.Mutex, remove func()) *Subscription {
+	return &Subscription{remove: func() {
+		mutex.Lock()
+		remove()
+		mutex.Unlock()
+	}}
+}
+
+// Unsubscribe removes the subscription's handlers. Events already
+// raised may still be delivered to them. Unsubscribe may be called
+// more than once, and on the nil Subscription returned by a
+// component in safe mode in place of a panic.
+func (s *Subscription) Unsubscribe() {
+	if s == nil {
+		return
+	}
+	s.once.Do(s.remove)
+}
+
+// subscriber holds the handlers of one subscription.
+type subscriber struct {
+	h Handlers
+}
+
+// subscribe adds a subscriber with handlers h and returns it. It
+// must be called with the component's mutex held.
+func (q *eventQueue) subscribe(h Handlers) *subscriber {
+	s := &subscriber{h: h}
+	q.subs = append(q.subs, s)
+	return s
+}
+
+// unsubscribe removes s. It must be called with the component's
+// mutex held.
+func (q *eventQueue) unsubscribe(s *subscriber) {
+	for i, sub := range q.subs {
+		if sub == s {
+			q.subs = append(q.subs[:i:i], q.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// overload raises an overload event for f, if not nil, and for the
+// subscribers.
+func (q *eventQueue) overload(f func(OverloadEvent), e OverloadEvent) {
+	if f != nil {
+		q.emit(func() {
+			f(e)
+		})
+	}
+	for _, s := range q.subs {
+		if h := s.h.Overload; h != nil {
+			q.send(s.h.Sync, func() {
+				h(e)
+			})
+		}
+	}
+}
+
+// drained raises the drained event for f and g, if not nil, and for
+// the subscribers, passing summary to those that take it.
+func (q *eventQueue) drained(f func(), g func(DrainSummary), summary DrainSummary) {
+	if f != nil {
+		q.emit(f)
+	}
+	if g != nil {
+		q.emit(func() {
+			g(summary)
+		})
+	}
+	for _, s := range q.subs {
+		if h := s.h.Drained; h != nil {
+			q.send(s.h.Sync, func() {
+				h(summary)
+			})
+		}
+	}
+}
+
+// toSubscribers raises an event for each subscriber for which raise
+// returns a function delivering it, and returns how many it raised.
+func (q *eventQueue) toSubscribers(raise func(h Handlers) func()) int {
+	n := 0
+	for _, s := range q.subs {
+		if f := raise(s.h); f != nil {
+			q.send(s.h.Sync, f)
+			n++
+		}
+	}
+	return n
+}
+
+// errored raises an error event for f, if not nil, and for the
+// subscribers whose handler for the event is picked by pick. If
+// there is no handler at all, err is written to the standard logger
+// with prefix.
+func (q *eventQueue) errored(f func(error), pick func(Handlers) func(error), prefix string, err error) {
+	if f != nil {
+		q.emit(func() {
+			f(err)
+		})
+	}
+	n := q.toSubscribers(func(h Handlers) func() {
+		if g := pick(h); g != nil {
+			return func() {
+				g(err)
+			}
+		}
+		return nil
+	})
+	if f == nil && n == 0 {
+		log.Printf("push: %s%v", prefix, err)
+	}
+}
+
+// panicked returns the function that a panic in an event handler
+// is reported to: onPanic and the HandlerPanic handlers of subs, or
+// nil if there are none.
+func panicked(onPanic func(interface{}), subs []*subscriber) func(interface{}) {
+	var fs []func(interface{})
+	for _, s := range subs {
+		if s.h.HandlerPanic != nil {
+			fs = append(fs, s.h.HandlerPanic)
+		}
+	}
+	if len(fs) == 0 {
+		return onPanic
+	}
+	return func(v interface{}) {
+		if onPanic != nil {
+			onPanic(v)
+		}
+		for _, f := range fs {
+			f(v)
+		}
+	}
+}
+
+// subscribed raises an item event for the subscribers whose handler
+// for the event is picked by pick.
+func (q *eventQueue) subscribed(pick func(Handlers) func(interface{}), item interface{}) {
+	for _, s := range q.subs {
+		if h := pick(s.h); h != nil {
+			q.send(s.h.Sync, func() {
+				h(item)
+			})
+		}
+	}
+}
+
+func pickThrottled(h Handlers) func(interface{}) {
+	return h.Throttled
+}
+
+func pickExpired(h Handlers) func(interface{}) {
+	return h.Expired
+}
+
+func pickShed(h Handlers) func(interface{}) {
+	return h.Shed
+}
+
+func pickSuppressed(h Handlers) func(interface{}) {
+	return h.Suppressed
+}
+
+func pickFirstOverload(h Handlers) func(interface{}) {
+	return h.FirstOverload
+}
+
+func pickDroppedWhileDraining(h Handlers) func(interface{}) {
+	return h.DroppedWhileDraining
+}
+
+func pickInternalError(h Handlers) func(error) {
+	return h.InternalError
+}
+
+func pickStoreError(h Handlers) func(error) {
+	return h.StoreError
+}
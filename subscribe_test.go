@@ -0,0 +1,153 @@
+package push_test
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/blocktop/go-push-components"
+)
+
+func TestSubscribeSyncMixed(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	var overloads []interface{}
+	q.Subscribe(Handlers{
+		Overload: func(e OverloadEvent) { overloads = append(overloads, e.Item) },
+		Sync:     true,
+	})
+	release := make(chan struct{})
+	drained := make(chan struct{})
+	q.OnDrained(func() {
+		<-release
+		close(drained)
+	})
+
+	q.Put(1)
+	q.Put(2)
+	q.Put(3)
+	// the sync subscription is called in order before Put returns
+	if len(overloads) != 2 || overloads[0] != 2 || overloads[1] != 3 {
+		t.Errorf("got overloads %v, want [2 3]", overloads)
+	}
+
+	// while OnDrained stays asynchronous, so a blocked handler does
+	// not hold up Drain
+	q.Empty()
+	returned := make(chan struct{})
+	go func() {
+		q.Drain()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain held up by the OnDrained handler")
+	}
+	close(release)
+	<-drained
+}
+
+func TestSubscribeUnsubscribeAll(t *testing.T) {
+	processed := make(chan interface{}, 10)
+	q := NewPushQueue(1, 1, func(item interface{}) { processed <- item })
+	q.SafeMode()
+	var mutex sync.Mutex
+	var events []string
+	record := func(event string) {
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}
+	sub := q.Subscribe(Handlers{
+		FirstOverload: func(item interface{}) { record("first overload") },
+		StateChange:   func(e StateChangeEvent) { record("state " + e.To.String()) },
+		ItemStart:     func(item interface{}, waited time.Duration) { record("item start") },
+		ItemDone:      func(item interface{}, elapsed time.Duration) { record("item done") },
+		InternalError: func(err error) { record("internal error") },
+		Sync:          true,
+	})
+
+	q.Put(1)
+	q.Put(2)
+	q.CostLimit(0, func(QueueItem) int { return 1 })
+	q.Start()
+	<-processed
+	q.Stop()
+	// ItemDone is called after the worker returns
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		n := len(events)
+		mutex.Unlock()
+		if n == 6 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sub.Unsubscribe()
+	q.Start()
+	q.Put(3)
+	<-processed
+	q.Put(4)
+	q.CostLimit(0, func(QueueItem) int { return 1 })
+	q.Stop()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	sort.Strings(events)
+	want := []string{"first overload", "internal error", "item done", "item start", "state started", "state stopped"}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("got events %v, want %v", events, want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	q := NewPushQueue(1, 1, func(item interface{}) {})
+	q.SyncEvents()
+	var got []interface{}
+	q.OnOverload(func(item interface{}) {})
+	sub := q.Subscribe(Handlers{
+		Overload: func(e OverloadEvent) { got = append(got, e.Item) },
+		Drained:  func(DrainSummary) { got = append(got, "drained") },
+	})
+
+	q.Put(1)
+	q.Put(2)
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	q.Put(3)
+
+	if want := []interface{}{2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
+
+func TestThresholdUnsubscribe(t *testing.T) {
+	q := NewPushQueue(1, 2, func(item interface{}) {})
+	events := make(chan ThresholdEvent, 10)
+	sub := q.OnThreshold(0.5, 0, func(e ThresholdEvent) { events <- e })
+
+	q.Put(1)
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no threshold event")
+	}
+	sub.Unsubscribe()
+	q.Empty()
+	q.Put(2)
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
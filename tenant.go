@@ -0,0 +1,84 @@
+package push
+
+// tenants limits the items pending and the workers busy for each
+// tenant of a component, so that one tenant cannot take over a
+// component shared with others. Tenants are told apart by the key
+// that key returns for their items.
+type tenants struct {
+	key        func(QueueItem) interface{}
+	maxPending int
+	maxWorkers int
+	running    map[interface{}]int
+	keys       map[*Envelope]interface{}
+}
+
+func newTenants(key func(QueueItem) interface{}, maxPending, maxWorkers int) *tenants {
+	if key == nil {
+		panic("no key function set")
+	}
+	if maxPending < 0 || maxWorkers < 0 {
+		panic("tenant limits must not be negative")
+	}
+	return &tenants{
+		key:        key,
+		maxPending: maxPending,
+		maxWorkers: maxWorkers,
+		running:    make(map[interface{}]int),
+		keys:       make(map[*Envelope]interface{})}
+}
+
+// clone returns tenants with the same key function and limits and
+// no workers busy.
+func (t *tenants) clone() *tenants {
+	if t == nil {
+		return nil
+	}
+	return newTenants(t.key, t.maxPending, t.maxWorkers)
+}
+
+// full reports whether the tenant of e already has the most items
+// pending that it may, among the given lists of pending items.
+func (t *tenants) full(e *Envelope, whole bool, lists ...[]*Envelope) bool {
+	if t.maxPending == 0 {
+		return false
+	}
+	k := t.key(e.payload(whole))
+	n := 0
+	for _, items := range lists {
+		for _, other := range items {
+			if t.key(other.payload(whole)) == k {
+				n++
+			}
+		}
+	}
+	return n >= t.maxPending
+}
+
+// limitsWorkers reports whether the tenants' workers are limited.
+func (t *tenants) limitsWorkers() bool {
+	return t != nil && t.maxWorkers > 0
+}
+
+// free reports whether the tenant of item may have another worker.
+func (t *tenants) free(item QueueItem) bool {
+	return t.maxWorkers == 0 || t.running[t.key(item)] < t.maxWorkers
+}
+
+// begin records that e has been handed to a worker.
+func (t *tenants) begin(e *Envelope, whole bool) {
+	k := t.key(e.payload(whole))
+	t.running[k]++
+	t.keys[e] = k
+}
+
+// end records that the worker of e has returned.
+func (t *tenants) end(e *Envelope) {
+	k, ok := t.keys[e]
+	if !ok {
+		return
+	}
+	delete(t.keys, e)
+	if t.running[k]--; t.running[k] == 0 {
+		delete(t.running, k)
+	}
+}
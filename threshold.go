@@ -0,0 +1,81 @@
+package push
+
+// ThresholdEvent describes the count of items in a component
+// crossing a threshold set with OnThreshold.
+type ThresholdEvent struct {
+	// Level is the threshold, as a fraction of capacity.
+	Level float64
+
+	// Above is true when the count has risen to Level, and false
+	// when it has fallen back below Level less the hysteresis.
+	Above bool
+
+	// Count is the number of items pending at the crossing.
+	Count int
+
+	// Capacity is the depth of a queue or height of a stack.
+	Capacity int
+}
+
+// threshold is a fill level that raises an event when crossed. If
+// crossed is set, it is called with the mutex held instead of the
+// event being raised.
+type threshold struct {
+	level      float64
+	hysteresis float64
+	above      bool
+	handler    func(ThresholdEvent)
+	crossed    func(ThresholdEvent)
+}
+
+func newThreshold(level, hysteresis float64, f func(ThresholdEvent)) *threshold {
+	if level <= 0 || level > 1 {
+		panic("threshold level must be greater than 0 and at most 1")
+	}
+	if hysteresis < 0 || hysteresis >= level {
+		panic("threshold hysteresis must not be negative and must be less than the level")
+	}
+	return &threshold{level: level, hysteresis: hysteresis, handler: f}
+}
+
+// thresholds are the fill levels set on a component.
+type thresholds []*threshold
+
+// check raises the events of the thresholds that count has crossed
+// since the last check. It must be called with the component's
+// mutex held whenever the count may have changed.
+func (t thresholds) check(count, capacity int, events *eventQueue) {
+	fill := float64(count) / float64(capacity)
+	for _, th := range t {
+		switch {
+		case !th.above && fill >= th.level:
+			th.above = true
+		case th.above && fill < th.level-th.hysteresis:
+			th.above = false
+		default:
+			continue
+		}
+		handler, e := th.handler, ThresholdEvent{
+			Level:    th.level,
+			Above:    th.above,
+			Count:    count,
+			Capacity: capacity}
+		if th.crossed != nil {
+			th.crossed(e)
+			continue
+		}
+		events.emit(func() {
+			handler(e)
+		})
+	}
+}
+
+// remove returns the thresholds without th.
+func (t thresholds) remove(th *threshold) thresholds {
+	for i, other := range t {
+		if other == th {
+			return append(t[:i:i], t[i+1:]...)
+		}
+	}
+	return t
+}
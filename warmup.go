@@ -0,0 +1,49 @@
+package push
+
+import (
+	"time"
+)
+
+// warmup prepares a component on Start. Its function runs before
+// any item is dispatched, and over the ramp period after Start the
+// number of workers allowed to be busy grows evenly from one up to
+// the component's concurrency.
+type warmup struct {
+	run   func()
+	ramp  time.Duration
+	start time.Time
+}
+
+func newWarmup(f func(), ramp time.Duration) warmup {
+	if ramp < 0 {
+		panic("ramp must not be negative")
+	}
+	return warmup{run: f, ramp: ramp}
+}
+
+// begin starts the ramp at now, calling dispatch each time another
+// worker is allowed, so that waiting items are picked up.
+func (w *warmup) begin(now time.Time, concurrency int, dispatch func()) {
+	w.start = now
+	if w.ramp == 0 {
+		return
+	}
+	for i := 1; i < concurrency; i++ {
+		time.AfterFunc(w.step(i, concurrency), dispatch)
+	}
+}
+
+// step returns the time after the start at which the ramp allows
+// busy workers beyond the first.
+func (w *warmup) step(busy, concurrency int) time.Duration {
+	return time.Duration(int64(w.ramp) * int64(busy) / int64(concurrency-1))
+}
+
+// allows reports whether the ramp allows another worker to be busy
+// at now, with busy workers already busy.
+func (w *warmup) allows(now time.Time, busy, concurrency int) bool {
+	if w.ramp == 0 || busy == 0 || busy >= concurrency {
+		return true
+	}
+	return now.Sub(w.start) >= w.step(busy, concurrency)
+}
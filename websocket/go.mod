@@ -0,0 +1,8 @@
+// This module is an example adapter, to be copied rather than
+// depended on. It does not pin its client library and builds against
+// the local checkout of the core package.
+module github.com/blocktop/go-push-components/websocket
+
+require github.com/blocktop/go-push-components v0.0.0
+
+replace github.com/blocktop/go-push-components => ../
@@ -0,0 +1,286 @@
+// Package websocket is a reference adapter between WebSocket
+// connections, by way of github.com/gorilla/websocket, and the push
+// components.
+//
+// A Source reads the messages of a connection so that it can feed a
+// PushQueue with push.Consume. While the queue is full, Consume stops
+// reading, so the connection's flow control holds the peer back
+// rather than messages piling up in memory. When the connection is
+// lost, the Source dials again, backing off between attempts.
+//
+// WebSocket has no acknowledgements. A message whose item is dropped
+// or whose worker panics is counted by Nacked and, if CloseOnNack is
+// set, the connection is closed with the given status, such as
+// websocket.CloseTryAgainLater, to tell the peer to slow down; the
+// Source then dials again.
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/gorilla/websocket"
+)
+
+// ErrClosed is returned by Source.Receive once the Source is closed.
+var ErrClosed = errors.New("websocket: source closed")
+
+// Source is a push.Source that reads messages from a WebSocket
+// connection. The values it delivers are the messages' data as
+// []byte.
+type Source struct {
+	dial        func(ctx context.Context) (connection, error)
+	mutex       sync.Mutex
+	conn        connection
+	closed      bool
+	backoff     func(attempts int) time.Duration
+	onReconnect func(error)
+	closeCode   int
+	closeText   string
+	nacked      int
+}
+
+// connection is the part of *websocket.Conn used by Source.
+type connection interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	SetReadDeadline(t time.Time) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	Close() error
+}
+
+// compile-time check that interfaces are satisfied
+var _ push.Source = (*Source)(nil)
+var _ connection = (*websocket.Conn)(nil)
+
+// NewSource creates a Source reading from the connections made by
+// dial, which is called for the first connection and again whenever
+// the connection is lost, such as with a websocket.Dialer:
+//
+//	src := websocket.NewSource(func(ctx context.Context) (*gws.Conn, error) {
+//	    conn, _, err := gws.DefaultDialer.DialContext(ctx, url, nil)
+//	    return conn, err
+//	})
+func NewSource(dial func(ctx context.Context) (*websocket.Conn, error)) *Source {
+	if dial == nil {
+		panic("dial is required")
+	}
+	return newSource(func(ctx context.Context) (connection, error) {
+		c, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+func newSource(dial func(ctx context.Context) (connection, error)) *Source {
+	return &Source{dial: dial, backoff: defaultBackoff}
+}
+
+// defaultBackoff doubles the wait before each attempt to dial
+// again, from 100ms up to 30s.
+func defaultBackoff(attempts int) time.Duration {
+	d := 100 * time.Millisecond
+	for i := 1; i < attempts && d < 30*time.Second; i++ {
+		d *= 2
+	}
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+// Backoff sets the function that returns how long to wait before
+// dialing again after the given number of failed attempts.
+func (s *Source) Backoff(f func(attempts int) time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.backoff = f
+}
+
+// OnReconnect sets a function to be called with the error that lost
+// the connection, or that failed an attempt to dial, before the
+// Source dials again.
+func (s *Source) OnReconnect(f func(error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.onReconnect = f
+}
+
+// CloseOnNack tells the Source to close the connection with the
+// given status code and text whenever a message is negatively
+// acknowledged, such as with websocket.CloseTryAgainLater, so that
+// the peer learns that its messages are being lost.
+func (s *Source) CloseOnNack(code int, text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closeCode = code
+	s.closeText = text
+}
+
+// Nacked returns the number of messages negatively acknowledged,
+// which were received but never processed.
+func (s *Source) Nacked() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.nacked
+}
+
+// Receive reads the next message, dialing first if there is no
+// connection.
+func (s *Source) Receive(ctx context.Context) (push.Message, error) {
+	for {
+		conn, err := s.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := read(ctx, conn)
+		if err == nil {
+			return &message{source: s, conn: conn, data: data}, nil
+		}
+		s.lost(conn)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		s.reconnecting(err)
+	}
+}
+
+// connect returns the connection, dialing until it succeeds, ctx is
+// done or the Source is closed.
+func (s *Source) connect(ctx context.Context) (connection, error) {
+	for attempts := 0; ; attempts++ {
+		s.mutex.Lock()
+		conn, closed, backoff := s.conn, s.closed, s.backoff
+		s.mutex.Unlock()
+		if closed {
+			return nil, ErrClosed
+		}
+		if conn != nil {
+			return conn, nil
+		}
+
+		if attempts > 0 {
+			t := time.NewTimer(backoff(attempts))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		conn, err := s.dial(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			s.reconnecting(err)
+			continue
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil, ErrClosed
+		}
+		s.conn = conn
+		s.mutex.Unlock()
+		return conn, nil
+	}
+}
+
+// read reads the next data message from conn. If ctx is done first,
+// the read is interrupted, which leaves conn unusable.
+func read(ctx context.Context, conn connection) ([]byte, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	_, data, err := conn.ReadMessage()
+	return data, err
+}
+
+// lost closes conn, which can no longer be read, so that the next
+// Receive dials again.
+func (s *Source) lost(conn connection) {
+	s.mutex.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.mutex.Unlock()
+
+	conn.Close()
+}
+
+func (s *Source) reconnecting(err error) {
+	s.mutex.Lock()
+	f := s.onReconnect
+	s.mutex.Unlock()
+
+	if f != nil {
+		f(err)
+	}
+}
+
+func (s *Source) nack(conn connection) {
+	s.mutex.Lock()
+	s.nacked++
+	code, text := s.closeCode, s.closeText
+	s.mutex.Unlock()
+
+	if code == 0 {
+		return
+	}
+	// the read in progress fails, and Receive dials again
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text),
+		time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// Close closes the connection. Receive returns ErrClosed from then
+// on.
+func (s *Source) Close() error {
+	s.mutex.Lock()
+	conn := s.conn
+	s.conn = nil
+	s.closed = true
+	s.mutex.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+type message struct {
+	source *Source
+	conn   connection
+	data   []byte
+}
+
+func (m *message) Value() interface{} {
+	return m.data
+}
+
+// Ack does nothing, as WebSocket has no acknowledgements.
+func (m *message) Ack() {}
+
+// Nack counts the message as lost, and closes its connection if
+// CloseOnNack is set.
+func (m *message) Nack() {
+	m.source.nack(m.conn)
+}
@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	push "github.com/blocktop/go-push-components"
+	"github.com/gorilla/websocket"
+)
+
+// fakeConn reads its messages, then blocks until it is closed or
+// its read deadline is set.
+type fakeConn struct {
+	msgs   chan []byte
+	mutex  sync.Mutex
+	closed chan struct{}
+	codes  []int
+}
+
+func newFakeConn(msgs ...string) *fakeConn {
+	c := &fakeConn{msgs: make(chan []byte, len(msgs)), closed: make(chan struct{})}
+	for _, m := range msgs {
+		c.msgs <- []byte(m)
+	}
+	return c
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.msgs:
+		return websocket.TextMessage, m, nil
+	case <-c.closed:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (c *fakeConn) SetReadDeadline(t time.Time) error {
+	return c.Close()
+}
+
+func (c *fakeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.codes = append(c.codes, messageType)
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func TestSourceNacksUnprocessed(t *testing.T) {
+	conn := newFakeConn("good", "bad")
+	dials := make(chan struct{}, 2)
+	src := newSource(func(ctx context.Context) (connection, error) {
+		dials <- struct{}{}
+		if len(dials) > 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return conn, nil
+	})
+	src.CloseOnNack(websocket.CloseTryAgainLater, "slow down")
+
+	processed := make(chan string, 2)
+	q := push.NewPushQueue(1, 2, func(item interface{}) {
+		msg := string(item.([]byte))
+		if msg == "bad" {
+			panic("bad message")
+		}
+		processed <- msg
+	})
+	q.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go push.Consume(ctx, src, q)
+
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after nack")
+	}
+	if got := <-processed; got != "good" {
+		t.Errorf("processed %q, want good", got)
+	}
+	if n := src.Nacked(); n != 1 {
+		t.Errorf("got %d nacked, want 1", n)
+	}
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if len(conn.codes) != 1 || conn.codes[0] != websocket.CloseMessage {
+		t.Errorf("got control messages %v, want one close", conn.codes)
+	}
+}
@@ -0,0 +1,25 @@
+package push
+
+import (
+	"time"
+)
+
+// batchWindow holds items back until the end of the wall-clock
+// window in which they were accepted. Windows are multiples of every
+// counted from the zero time, so that components in different
+// processes close their windows at the same instants.
+type batchWindow struct {
+	every time.Duration
+}
+
+func newBatchWindow(every time.Duration) *batchWindow {
+	if every <= 0 {
+		panic("batch window must be greater than 0")
+	}
+	return &batchWindow{every: every}
+}
+
+// closes returns the time at which the window holding e closes.
+func (w *batchWindow) closes(e *Envelope) time.Time {
+	return e.Enqueued.Truncate(w.every).Add(w.every)
+}